@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Opening hours
+// ------------------------------------------------------------
+
+// openingHours is a daily [Open, Close) window on the listed weekdays,
+// in minutes since local midnight. Close may be 24*60.
+type openingHours struct {
+	Open  int
+	Close int
+	Days  [7]bool // indexed by time.Weekday
+}
+
+// parseOpeningHours reads "08:00-20:00" and "MO-FR" / "MO,WE,FR" style values.
+func parseOpeningHours(hours, days string) (openingHours, error) {
+	var oh openingHours
+	o, c, ok := strings.Cut(strings.TrimSpace(hours), "-")
+	if !ok {
+		return oh, fmt.Errorf("opening hours must look like 08:00-20:00, got %q", hours)
+	}
+	var err error
+	if oh.Open, err = parseClock(o); err != nil {
+		return oh, err
+	}
+	if oh.Close, err = parseClock(c); err != nil {
+		return oh, err
+	}
+	if oh.Close <= oh.Open {
+		return oh, fmt.Errorf("opening hours: close must be after open in %q", hours)
+	}
+
+	days = strings.ToUpper(strings.TrimSpace(days))
+	for _, part := range strings.Split(days, ",") {
+		part = strings.TrimSpace(part)
+		if from, to, isRange := strings.Cut(part, "-"); isRange {
+			f, ok1 := weekdayCodes[from]
+			t, ok2 := weekdayCodes[to]
+			if !ok1 || !ok2 {
+				return oh, fmt.Errorf("opening days: invalid range %q", part)
+			}
+			// Monday-based walk so that MO-SU and FR-MO both work
+			for d := f; ; d = (d + 1) % 7 {
+				oh.Days[d] = true
+				if d == t {
+					break
+				}
+			}
+			continue
+		}
+		d, ok := weekdayCodes[part]
+		if !ok {
+			return oh, fmt.Errorf("opening days: invalid day %q", part)
+		}
+		oh.Days[d] = true
+	}
+	return oh, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return 0, fmt.Errorf("invalid clock time %q (want HH:MM)", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// windows returns the open intervals intersecting [from,to), with days
+// evaluated in loc.
+func (oh openingHours) windows(from, to time.Time, loc *time.Location) []span {
+	var out []span
+	f := from.In(loc)
+	day := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !oh.Days[day.Weekday()] {
+			continue
+		}
+		ws, we := oh.window(day)
+		if ws.Before(from) {
+			ws = from
+		}
+		if we.After(to) {
+			we = to
+		}
+		if we.After(ws) {
+			out = append(out, span{StartSec: ws.Unix(), EndSec: we.Unix()})
+		}
+	}
+	return out
+}
+
+// window returns the opening and closing time on day's date in day's
+// location. The clock times are placed with time.Date: adding minutes to
+// midnight would be an hour off on DST transition days.
+func (oh openingHours) window(day time.Time) (time.Time, time.Time) {
+	y, m, d := day.Date()
+	loc := day.Location()
+	return time.Date(y, m, d, oh.Open/60, oh.Open%60, 0, 0, loc), time.Date(y, m, d, oh.Close/60, oh.Close%60, 0, 0, loc)
+}
+
+func (oh openingHours) String() string {
+	var days []string
+	for d := time.Monday; ; d = (d + 1) % 7 {
+		if oh.Days[d] {
+			days = append(days, weekdayCode(d))
+		}
+		if d == time.Sunday {
+			break
+		}
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d %s", oh.Open/60, oh.Open%60, oh.Close/60, oh.Close%60, strings.Join(days, ","))
+}
+
+// ------------------------------------------------------------
+// Interval helpers (spans sorted by start)
+// ------------------------------------------------------------
+
+// subtractBusy removes busy intervals from the free windows.
+func subtractBusy(free, busy []span) []span {
+	var out []span
+	for _, w := range free {
+		cur := w.StartSec
+		for _, b := range busy {
+			if b.EndSec <= cur || b.StartSec >= w.EndSec {
+				continue
+			}
+			if b.StartSec > cur {
+				out = append(out, span{StartSec: cur, EndSec: b.StartSec})
+			}
+			if b.EndSec > cur {
+				cur = b.EndSec
+			}
+		}
+		if cur < w.EndSec {
+			out = append(out, span{StartSec: cur, EndSec: w.EndSec})
+		}
+	}
+	return out
+}
+
+func intersectSpans(a, b []span) []span {
+	var out []span
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		s := max(a[i].StartSec, b[j].StartSec)
+		e := min(a[i].EndSec, b[j].EndSec)
+		if e > s {
+			out = append(out, span{StartSec: s, EndSec: e})
+		}
+		if a[i].EndSec < b[j].EndSec {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+func longerThan(spans []span, minSec int64) []span {
+	out := []span{}
+	for _, s := range spans {
+		if s.EndSec-s.StartSec >= minSec {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// ------------------------------------------------------------
+// GET /availability
+// ------------------------------------------------------------
+
+const maxAvailabilityWindow = 62 * 24 * time.Hour
+
+type Slot struct {
+	StartsAt string `json:"starts_at"`
+	EndsAt   string `json:"ends_at"`
+}
+
+type RoomAvailability struct {
+	Room Room   `json:"room"`
+	Free []Slot `json:"free"`
+}
+
+// toSlot renders a span in loc (the room's zone unless ?tz= is given).
+func toSlot(s span, loc *time.Location) Slot {
+	return Slot{StartsAt: formatIn(s.StartSec, loc), EndsAt: formatIn(s.EndSec, loc)}
+}
+
+// parseDurationParam accepts Go durations ("90m", "1h30m") or plain minutes ("90").
+func parseDurationParam(v string) (time.Duration, error) {
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("duration must be a positive number of minutes or a Go duration like 1h30m")
+	}
+	return d, nil
+}
+
+// availability lists free slots per room within [from,to).
+//
+//	GET /availability?from=&to=&min_capacity=&duration=&room_id=a,b&equipment=projector
+//	GET /availability?...&mode=first  -> earliest slot of `duration` when all
+//	                                     requested rooms (or any single room,
+//	                                     when room_id is omitted) are free
+func (a *App) availability(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tz, err := tzParam(r)
+	if err != nil {
+		writeClientError(w, err.(*clientError))
+		return
+	}
+	from, err := parseTimeIn(q.Get("from"), tz)
+	if err != nil {
+		badRequest(w, timeFieldErr("from", err))
+		return
+	}
+	to, err := parseTimeIn(q.Get("to"), tz)
+	if err != nil {
+		badRequest(w, timeFieldErr("to", err))
+		return
+	}
+	if !to.After(from) {
+		badRequest(w, "to must be after from")
+		return
+	}
+	if to.Sub(from) > maxAvailabilityWindow {
+		badRequest(w, "window too large (max 62 days)")
+		return
+	}
+	minCap := 0
+	if v := q.Get("min_capacity"); v != "" {
+		if minCap, err = strconv.Atoi(v); err != nil || minCap < 0 {
+			badRequest(w, "min_capacity must be a non-negative integer")
+			return
+		}
+	}
+	var duration time.Duration
+	if v := q.Get("duration"); v != "" {
+		if duration, err = parseDurationParam(v); err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+	}
+	roomIDs := splitList(q["room_id"])
+	mode := strings.ToLower(q.Get("mode"))
+	if mode != "" && mode != "first" {
+		badRequest(w, `mode must be empty or "first"`)
+		return
+	}
+	if mode == "first" && duration == 0 {
+		badRequest(w, "duration is required with mode=first")
+		return
+	}
+
+	equipment := normalizeEquipment(splitList(q["equipment"]))
+	rooms, err := a.roomsForAvailability(r, minCap, roomIDs, equipment)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if len(roomIDs) > 0 && len(rooms) != len(uniqueStrings(roomIDs)) {
+		writeError(w, http.StatusNotFound, "some room_id not found, below min_capacity or missing equipment")
+		return
+	}
+
+	free, err := a.freeSpans(r, rooms, from, to)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	if mode == "first" {
+		a.writeFirstSlot(w, rooms, free, len(roomIDs) > 0, int64(duration/time.Second), tz)
+		return
+	}
+
+	out := make([]RoomAvailability, 0, len(rooms))
+	for _, rm := range rooms {
+		loc := rm.location()
+		if tz != nil {
+			loc = tz
+		}
+		slots := []Slot{}
+		for _, s := range longerThan(free[rm.ID], int64(duration/time.Second)) {
+			slots = append(slots, toSlot(s, loc))
+		}
+		out = append(out, RoomAvailability{Room: rm, Free: slots})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":          from.Format(time.RFC3339),
+		"to":            to.Format(time.RFC3339),
+		"opening_hours": a.hours.String(),
+		"rooms":         out,
+	})
+}
+
+func (a *App) writeFirstSlot(w http.ResponseWriter, rooms []Room, free map[string][]span, allRooms bool, durSec int64, tz *time.Location) {
+	notFoundMsg := "no slot found in the requested window"
+	if allRooms {
+		loc := rooms[0].location()
+		if tz != nil {
+			loc = tz
+		}
+		common := free[rooms[0].ID]
+		ids := make([]string, len(rooms))
+		for i, rm := range rooms {
+			ids[i] = rm.ID
+			common = intersectSpans(common, free[rm.ID])
+		}
+		for _, s := range common {
+			if s.EndSec-s.StartSec >= durSec {
+				writeJSON(w, http.StatusOK, map[string]any{
+					"room_ids": ids,
+					"slot":     toSlot(span{StartSec: s.StartSec, EndSec: s.StartSec + durSec}, loc),
+				})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, notFoundMsg)
+		return
+	}
+
+	// any single room: earliest start wins, ties go to the smallest room
+	var best *span
+	var bestRoom Room
+	for _, rm := range rooms {
+		for _, s := range free[rm.ID] {
+			if s.EndSec-s.StartSec < durSec {
+				continue
+			}
+			if best == nil || s.StartSec < best.StartSec || (s.StartSec == best.StartSec && rm.Capacity < bestRoom.Capacity) {
+				c := span{StartSec: s.StartSec, EndSec: s.StartSec + durSec}
+				best, bestRoom = &c, rm
+			}
+			break
+		}
+	}
+	if best == nil {
+		writeError(w, http.StatusNotFound, notFoundMsg)
+		return
+	}
+	loc := bestRoom.location()
+	if tz != nil {
+		loc = tz
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"room_ids": []string{bestRoom.ID},
+		"room":     bestRoom,
+		"slot":     toSlot(*best, loc),
+	})
+}
+
+func (a *App) roomsForAvailability(r *http.Request, minCap int, ids, equipment []string) ([]Room, error) {
+	where := []string{"capacity >= ?"}
+	args := []any{minCap}
+	if len(ids) > 0 {
+		where = append(where, "id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+")")
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	if frag, fargs := equipmentFilter(equipment); frag != "" {
+		where = append(where, frag)
+		args = append(args, fargs...)
+	}
+	rows, err := a.db.QueryContext(r.Context(), `SELECT id, room_no, capacity, created_at, time_zone FROM rooms WHERE `+strings.Join(where, " AND ")+` ORDER BY room_no`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Room{}
+	for rows.Next() {
+		var rm Room
+		if err := rows.Scan(&rm.ID, &rm.RoomNo, &rm.Capacity, &rm.CreatedAt, &rm.TimeZone); err != nil {
+			return nil, err
+		}
+		list = append(list, rm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return list, loadRoomExtras(r.Context(), a.db, list)
+}
+
+// freeSpans returns, per room id, the opening-hour windows in [from,to)
+// minus active bookings. Opening hours are evaluated in each room's zone;
+// rooms with business hours use them instead of the default opening hours,
+// and their buffer is kept free around bookings.
+func (a *App) freeSpans(r *http.Request, rooms []Room, from, to time.Time) (map[string][]span, error) {
+	busy := map[string][]span{}
+	rows, err := a.db.QueryContext(r.Context(), `SELECT room_id, starts_at, ends_at FROM bookings
+		WHERE status IN ('PENDING','CONFIRMED') AND starts_at < ? AND ends_at > ?
+		ORDER BY room_id, starts_at`, to.Unix(), from.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID string
+		var s span
+		if err := rows.Scan(&roomID, &s.StartSec, &s.EndSec); err != nil {
+			return nil, err
+		}
+		busy[roomID] = append(busy[roomID], s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string][]span, len(rooms))
+	for _, rm := range rooms {
+		hours := a.hours
+		var buffer int64
+		if rm.Policy != nil {
+			if oh, ok, _ := rm.Policy.hours(); ok {
+				hours = oh
+			}
+			buffer = rm.Policy.bufferSec()
+		}
+		b := busy[rm.ID]
+		for i := range b {
+			b[i].StartSec -= buffer
+			b[i].EndSec += buffer
+		}
+		sort.Slice(b, func(i, j int) bool { return b[i].StartSec < b[j].StartSec })
+		out[rm.ID] = subtractBusy(hours.windows(from, to, rm.location()), b)
+	}
+	return out, nil
+}
+
+func uniqueStrings(in []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 2027-03-28 is the spring-forward Sunday in Europe/Berlin: the day is 23
+// hours long, so the opening hours must still be 08:00-18:00 local time.
+func TestOpeningHoursOnDSTDay(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	oh, err := parseOpeningHours("08:00-18:00", "MO-SU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, date := range []int{27, 28, 31} { // before, on and after the change
+		from := time.Date(2027, 3, date, 0, 0, 0, 0, loc)
+		spans := oh.windows(from, from.AddDate(0, 0, 1), loc)
+		if len(spans) != 1 {
+			t.Fatalf("2027-03-%d: got %d windows", date, len(spans))
+		}
+		ws, we := time.Unix(spans[0].StartSec, 0).In(loc), time.Unix(spans[0].EndSec, 0).In(loc)
+		if ws.Format("15:04") != "08:00" || we.Format("15:04") != "18:00" {
+			t.Errorf("2027-03-%d: window %s - %s", date, ws.Format(time.RFC3339), we.Format(time.RFC3339))
+		}
+
+		start := time.Date(2027, 3, date, 8, 0, 0, 0, loc)
+		if !oh.contains(start, start.Add(10*time.Hour), loc) {
+			t.Errorf("2027-03-%d: 08:00-18:00 not within business hours", date)
+		}
+		if oh.contains(start.Add(-time.Hour), start, loc) {
+			t.Errorf("2027-03-%d: 07:00-08:00 within business hours", date)
+		}
+	}
+}
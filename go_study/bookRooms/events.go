@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ------------------------------------------------------------
+// Booking change events (SSE / WebSocket)
+// ------------------------------------------------------------
+//
+// Every committed create / update / cancel of a single booking is appended
+// to booking_events and pushed to connected clients. The row id doubles as
+// the SSE event id, so a client that reconnects with Last-Event-ID (or
+// ?last_event_id= for WebSocket) first receives what it missed.
+
+const (
+	eventRetention = 7 * 24 * time.Hour // older events are pruned by the lifecycle job
+	eventHeartbeat = 25 * time.Second   // keeps proxies from closing idle streams
+	eventBuffer    = 64                 // per-client backlog before it is dropped
+)
+
+type BookingEvent struct {
+	ID        int64   `json:"id"`
+	Type      string  `json:"type"` // booking.created, booking.updated, booking.cancelled
+	BookingID string  `json:"booking_id"`
+	RoomID    string  `json:"room_id"`
+	Booking   Booking `json:"booking"` // state after the change (last state for a delete)
+	CreatedAt string  `json:"created_at"`
+}
+
+// eventHub fans events out to subscribers. A subscriber that falls behind is
+// dropped (its channel closed) and is expected to reconnect and resume.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan BookingEvent]string // channel -> room filter ("" = all rooms)
+
+	// emitMu is held from insert to publish so subscribers see ids in
+	// increasing order; streams rely on that to skip what they replayed.
+	emitMu sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[chan BookingEvent]string{}}
+}
+
+func (h *eventHub) subscribe(roomID string) (chan BookingEvent, func()) {
+	ch := make(chan BookingEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = roomID
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(ev BookingEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, room := range h.subs {
+		if room != "" && room != ev.RoomID {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// bookingEventType names the change from the booking's new state.
+func bookingEventType(created bool, b Booking) string {
+	switch {
+	case created:
+		return "booking.created"
+	case b.Status == "CANCELLED":
+		return "booking.cancelled"
+	}
+	return "booking.updated"
+}
+
+// emit records an event for a change that has already been committed and
+// pushes it to subscribers. A failure here must not fail the request.
+func (a *App) emit(ctx context.Context, typ string, b Booking) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+	now := time.Now().UTC()
+	a.events.emitMu.Lock()
+	defer a.events.emitMu.Unlock()
+	res, err := a.db.ExecContext(context.WithoutCancel(ctx), `INSERT INTO booking_events(type, booking_id, room_id, payload, created_at) VALUES(?,?,?,?,?)`,
+		typ, b.ID, b.RoomID, string(payload), now.Unix())
+	if err != nil {
+		log.Printf("events: record %s %s: %v", typ, b.ID, err)
+		return
+	}
+	id, _ := res.LastInsertId()
+	a.events.publish(BookingEvent{ID: id, Type: typ, BookingID: b.ID, RoomID: b.RoomID, Booking: b, CreatedAt: now.Format(time.RFC3339)})
+}
+
+// emitBookings reloads bookings changed by a committed transaction and emits
+// one event each; created picks booking.created over updated / cancelled.
+func (a *App) emitBookings(ctx context.Context, created bool, ids []string) {
+	for _, id := range ids {
+		b, err := a.sqliteStore.GetBooking(context.WithoutCancel(ctx), id)
+		if err != nil {
+			log.Printf("events: load %s: %v", id, err)
+			continue
+		}
+		a.emit(ctx, bookingEventType(created, b), b)
+	}
+}
+
+// emitDeleted emits booking.cancelled for rows read before they were deleted.
+func (a *App) emitDeleted(ctx context.Context, rows []bookingRow) {
+	for _, br := range rows {
+		a.emit(ctx, "booking.cancelled", toBookingDTO(br))
+	}
+}
+
+// eventsSince returns recorded events after id, oldest first.
+func (a *App) eventsSince(ctx context.Context, afterID int64, roomID string) ([]BookingEvent, error) {
+	query := `SELECT id, type, booking_id, room_id, payload, created_at FROM booking_events WHERE id > ?`
+	args := []any{afterID}
+	if roomID != "" {
+		query += ` AND room_id = ?`
+		args = append(args, roomID)
+	}
+	rows, err := a.db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BookingEvent
+	for rows.Next() {
+		var ev BookingEvent
+		var payload string
+		var at int64
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.BookingID, &ev.RoomID, &payload, &at); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(payload), &ev.Booking); err != nil {
+			return nil, err
+		}
+		ev.CreatedAt = time.Unix(at, 0).UTC().Format(time.RFC3339)
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// lastEventID reads the resume point: the Last-Event-ID header (sent by
+// EventSource on reconnect) or ?last_event_id=.
+func lastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("last event id must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// eventStream subscribes and replays missed events. Subscribing first means
+// nothing committed in between is lost; live events already replayed are
+// skipped by id.
+func (a *App) eventStream(r *http.Request) (replay []BookingEvent, live chan BookingEvent, stop func(), err error) {
+	after, err := lastEventID(r)
+	if err != nil {
+		return nil, nil, nil, clientErr(err.Error(), http.StatusBadRequest)
+	}
+	roomID := r.URL.Query().Get("room_id")
+	live, stop = a.events.subscribe(roomID)
+	if r.Header.Get("Last-Event-ID") == "" && r.URL.Query().Get("last_event_id") == "" {
+		return nil, live, stop, nil
+	}
+	replay, err = a.eventsSince(r.Context(), after, roomID)
+	if err != nil {
+		stop()
+		return nil, nil, nil, err
+	}
+	return replay, live, stop, nil
+}
+
+// GET /events?room_id= (Server-Sent Events)
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	replay, live, stop, err := a.eventStream(r)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	var sent int64
+	write := func(ev BookingEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		sent = ev.ID
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		return err
+	}
+	for _, ev := range replay {
+		if write(ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	beat := time.NewTicker(eventHeartbeat)
+	defer beat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-live:
+			if !ok {
+				return // dropped for being slow; EventSource reconnects with Last-Event-ID
+			}
+			if ev.ID <= sent {
+				continue
+			}
+			if write(ev) != nil {
+				return
+			}
+		case <-beat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		allow := getenv("CORS_ALLOW_ORIGIN", "*")
+		origin := r.Header.Get("Origin")
+		return allow == "*" || origin == "" || origin == allow
+	},
+}
+
+// GET /events/ws?room_id=&last_event_id= (WebSocket). Each text message is
+// one BookingEvent as JSON; client messages are ignored.
+func (a *App) streamEventsWS(w http.ResponseWriter, r *http.Request) {
+	replay, live, stop, err := a.eventStream(r)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	defer stop()
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied
+	}
+	defer conn.Close()
+
+	// reader: answers control frames and notices when the client goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * eventHeartbeat))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var sent int64
+	write := func(ev BookingEvent) error {
+		sent = ev.ID
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(ev)
+	}
+	for _, ev := range replay {
+		if write(ev) != nil {
+			return
+		}
+	}
+
+	beat := time.NewTicker(eventHeartbeat)
+	defer beat.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case ev, ok := <-live:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow, resume with last_event_id"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if ev.ID <= sent {
+				continue
+			}
+			if write(ev) != nil {
+				return
+			}
+		case <-beat.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestApp returns an App on a fresh SQLite database in t.TempDir.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	db, err := sql.Open("sqlite", sqliteDSN(filepath.Join(t.TempDir(), "app.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	hours, err := parseOpeningHours("00:00-24:00", "MO-SU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newApp(db, 30*time.Minute, hours)
+}
+
+func TestEmitPublishesInIDOrder(t *testing.T) {
+	app := newTestApp(t)
+	live, stop := app.events.subscribe("")
+	defer stop()
+
+	const n = 40
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.emit(context.Background(), "booking.updated", Booking{ID: "b", RoomID: "r"})
+		}()
+	}
+	wg.Wait()
+
+	var last int64
+	for i := 0; i < n; i++ {
+		ev := <-live
+		if ev.ID <= last {
+			t.Fatalf("event %d published after %d", ev.ID, last)
+		}
+		last = ev.ID
+	}
+}
+
+func TestLifecycleEmitsExpiryAndPromotion(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := app.db.Exec(`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r1', '101', 2, ?)`, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"g1", "g2"} {
+		if _, err := app.db.Exec(`INSERT INTO guests(id, name, created_at) VALUES(?, ?, ?)`, g, g, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, end := slot(9, 10)
+	held, err := app.store.CreateBooking(ctx, newBooking{RoomID: "r1", GuestID: "g1", Start: start, End: end, Status: "PENDING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec(`INSERT INTO waitlist(id, room_id, guest_id, starts_at, ends_at, status, created_at) VALUES('w1', 'r1', 'g2', ?, ?, 'WAITING', ?)`,
+		start.Unix(), end.Unix(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	live, stop := app.events.subscribe("r1")
+	defer stop()
+	if err := app.lifecycleTick(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := <-live
+	if expired.Type != "booking.cancelled" || expired.BookingID != held.ID || expired.Booking.StatusReason != "EXPIRED" {
+		t.Fatalf("first event: %+v", expired)
+	}
+	promoted := <-live
+	if promoted.Type != "booking.created" || promoted.Booking.GuestID != "g2" || promoted.Booking.Status != "PENDING" {
+		t.Fatalf("second event: %+v", promoted)
+	}
+}
+
+func TestSeriesChangesEmitPerOccurrence(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := app.db.Exec(`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r1', '101', 2, ?)`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec(`INSERT INTO guests(id, name, created_at) VALUES('g1', 'g1', ?)`, now); err != nil {
+		t.Fatal(err)
+	}
+	live, stop := app.events.subscribe("")
+	defer stop()
+
+	rule, err := parseRRule("FREQ=DAILY;COUNT=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := slot(9, 10)
+	s, err := app.insertSeries(ctx, newBooking{RoomID: "r1", GuestID: "g1", Start: start, End: end, Status: "CONFIRMED"}, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ev := <-live; ev.Type != "booking.created" || ev.BookingID != s.Occurrences[i].ID {
+			t.Fatalf("create event %d: %+v", i, ev)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	app.deleteFollowing(w, httptest.NewRequest(http.MethodDelete, "/bookings/x?scope=following", nil), s.Occurrences[1].ID)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete following: %d %s", w.Code, w.Body)
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		ev := <-live
+		if ev.Type != "booking.cancelled" {
+			t.Fatalf("delete event %d: %+v", i, ev)
+		}
+		got[ev.BookingID] = true
+	}
+	if !got[s.Occurrences[1].ID] || !got[s.Occurrences[2].ID] {
+		t.Fatalf("cancelled %v", got)
+	}
+}
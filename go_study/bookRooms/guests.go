@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ------------------------------------------------------------
+// Guests
+// ------------------------------------------------------------
+
+type Guest struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const guestColumns = `id, name, email, phone, created_at`
+
+func scanGuest(sc rowScanner) (Guest, error) {
+	var g Guest
+	var email, phone sql.NullString
+	err := sc.Scan(&g.ID, &g.Name, &email, &phone, &g.CreatedAt)
+	g.Email = email.String
+	g.Phone = phone.String
+	return g, err
+}
+
+type guestReq struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+	Phone *string `json:"phone"`
+}
+
+// normalize trims the fields and validates the email.
+func (req *guestReq) normalize() error {
+	for _, f := range []*string{req.Name, req.Email, req.Phone} {
+		if f != nil {
+			*f = strings.TrimSpace(*f)
+		}
+	}
+	if req.Name != nil && *req.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+	if req.Email != nil && *req.Email != "" {
+		addr, err := mail.ParseAddress(*req.Email)
+		if err != nil {
+			return errors.New("email is not a valid address")
+		}
+		*req.Email = strings.ToLower(addr.Address)
+	}
+	return nil
+}
+
+func (a *App) createGuest(w http.ResponseWriter, r *http.Request) {
+	var req guestReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "invalid JSON body")
+		return
+	}
+	if req.Name == nil {
+		badRequest(w, "name is required")
+		return
+	}
+	if err := req.normalize(); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	g := Guest{ID: uuid.New().String(), Name: *req.Name, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	if req.Email != nil {
+		g.Email = *req.Email
+	}
+	if req.Phone != nil {
+		g.Phone = *req.Phone
+	}
+	_, err := a.db.ExecContext(r.Context(), `INSERT INTO guests(id, name, email, phone, created_at) VALUES(?,?,?,?,?)`,
+		g.ID, g.Name, nullIfEmpty(g.Email), nullIfEmpty(g.Phone), g.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			conflict(w, "email already exists")
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, g)
+}
+
+// GET /guests?q= matches name or email.
+func (a *App) listGuests(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + guestColumns + ` FROM guests`
+	var args []any
+	if s := strings.TrimSpace(r.URL.Query().Get("q")); s != "" {
+		query += ` WHERE name LIKE ? OR email LIKE ?`
+		like := "%" + s + "%"
+		args = append(args, like, like)
+	}
+	query += ` ORDER BY name, id`
+	rows, err := a.db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	list := []Guest{}
+	for rows.Next() {
+		g, err := scanGuest(rows)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		list = append(list, g)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *App) getGuest(w http.ResponseWriter, r *http.Request) {
+	g, err := scanGuest(a.db.QueryRowContext(r.Context(), `SELECT `+guestColumns+` FROM guests WHERE id = ?`, chi.URLParam(r, "id")))
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+func (a *App) updateGuest(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var req guestReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "invalid JSON body")
+		return
+	}
+	if err := req.normalize(); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	sets := []string{}
+	args := []any{}
+	if req.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, *req.Name)
+	}
+	if req.Email != nil {
+		sets = append(sets, "email = ?")
+		args = append(args, nullIfEmpty(*req.Email))
+	}
+	if req.Phone != nil {
+		sets = append(sets, "phone = ?")
+		args = append(args, nullIfEmpty(*req.Phone))
+	}
+	if len(sets) == 0 {
+		badRequest(w, "no fields to update")
+		return
+	}
+	args = append(args, id)
+	res, err := a.db.ExecContext(r.Context(), "UPDATE guests SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		if isUniqueViolation(err) {
+			conflict(w, "email already exists")
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		notFound(w)
+		return
+	}
+	a.getGuest(w, r)
+}
+
+// DELETE /guests/{id} is refused while the guest still has bookings, so
+// that booking history keeps pointing at a real guest.
+func (a *App) deleteGuest(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx := r.Context()
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		var n int
+		if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM bookings WHERE guest_id = ?`, id).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return clientErr("guest has bookings", http.StatusConflict)
+		}
+		res, err := conn.ExecContext(ctx, `DELETE FROM guests WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// GET /guests/{id}/bookings
+func (a *App) listGuestBookings(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.db.QueryContext(r.Context(), `SELECT `+bookingColumns+` FROM bookings WHERE guest_id = ? ORDER BY starts_at`, chi.URLParam(r, "id"))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	list := []Booking{}
+	for rows.Next() {
+		br, err := scanBookingRow(rows)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		list = append(list, toBookingDTO(br))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// guestExistsConn is the guest counterpart of the "room exists" check done
+// before every insert.
+func guestExistsConn(ctx context.Context, q dbtx, guestID string) error {
+	var x string
+	err := q.QueryRowContext(ctx, `SELECT id FROM guests WHERE id = ?`, guestID).Scan(&x)
+	if errors.Is(err, sql.ErrNoRows) {
+		return clientErr("guest not found", http.StatusBadRequest)
+	}
+	return err
+}
+
+// guestForEmail returns the guest with this email, creating one when there
+// is none yet. Used by calendar import to map ORGANIZER to a guest.
+func guestForEmail(ctx context.Context, q dbtx, email, name string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	var id string
+	err := q.QueryRowContext(ctx, `SELECT id FROM guests WHERE email = ?`, email).Scan(&id)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return id, err
+	}
+	if name == "" {
+		name = email
+	}
+	id = uuid.New().String()
+	_, err = q.ExecContext(ctx, `INSERT INTO guests(id, name, email, created_at) VALUES(?,?,?,?)`,
+		id, name, email, time.Now().UTC().Format(time.RFC3339))
+	return id, err
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// iCalendar (RFC 5545) feeds and import
+// ------------------------------------------------------------
+
+const (
+	icsProdID      = "-//bookingapi//Room Bookings//EN"
+	icsUIDDomain   = "bookingapi"
+	icsUTCLayout   = "20060102T150405Z"
+	icsLocalLayout = "20060102T150405"
+	icsDateLayout  = "20060102"
+	maxICSBytes    = 2 << 20
+)
+
+// icsWriter writes content lines with CRLF endings and 75-octet folding.
+type icsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	s := name + ":" + value
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if _, iw.err = iw.w.WriteString(s[:cut] + "\r\n "); iw.err != nil {
+			return
+		}
+		s = s[cut:]
+		limit = 74 // the leading space of a continuation line counts too
+	}
+	_, iw.err = iw.w.WriteString(s + "\r\n")
+}
+
+func icsEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+func icsUnescape(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	return r.Replace(s)
+}
+
+// icsEvent is a booking as rendered in a feed.
+type icsEvent struct {
+	Booking
+	RoomNo string
+}
+
+func icsStatus(status string) string {
+	if status == "CONFIRMED" {
+		return "CONFIRMED"
+	}
+	return "TENTATIVE"
+}
+
+func writeCalendar(w http.ResponseWriter, name string, events []icsEvent) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+	w.WriteHeader(http.StatusOK)
+
+	iw := &icsWriter{w: bufio.NewWriter(w)}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", icsProdID)
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.line("X-WR-CALNAME", icsEscape(name))
+	for _, ev := range events {
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", ev.ID+"@"+icsUIDDomain)
+		iw.line("DTSTAMP", icsTime(ev.CreatedAt))
+		iw.line("DTSTART", icsTime(ev.StartsAt))
+		iw.line("DTEND", icsTime(ev.EndsAt))
+		iw.line("SUMMARY", icsEscape(fmt.Sprintf("Room %s - %s", ev.RoomNo, ev.GuestID)))
+		iw.line("LOCATION", icsEscape(ev.RoomNo))
+		iw.line("STATUS", icsStatus(ev.Status))
+		if ev.SeriesID != "" {
+			iw.line("RELATED-TO", ev.SeriesID+"@"+icsUIDDomain)
+		}
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	if iw.err == nil {
+		iw.err = iw.w.Flush()
+	}
+	if iw.err != nil {
+		// headers are already sent; nothing more we can tell the client
+		log.Printf("write calendar: %v", iw.err)
+	}
+}
+
+func icsTime(rfc string) string {
+	t, err := parseRFC3339(rfc)
+	if err != nil {
+		return rfc
+	}
+	return t.UTC().Format(icsUTCLayout)
+}
+
+// GET /rooms/{id}/calendar.ics
+func (a *App) roomCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "id")
+	var roomNo string
+	err := a.db.QueryRowContext(r.Context(), `SELECT room_no FROM rooms WHERE id = ?`, roomID).Scan(&roomNo)
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	events, err := a.calendarEvents(r.Context(), "b.room_id = ?", roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeCalendar(w, "Room "+roomNo, events)
+}
+
+// GET /guests/{id}/calendar.ics
+func (a *App) guestCalendar(w http.ResponseWriter, r *http.Request) {
+	guestID := chi.URLParam(r, "id")
+	var name string
+	err := a.db.QueryRowContext(r.Context(), `SELECT name FROM guests WHERE id = ?`, guestID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	events, err := a.calendarEvents(r.Context(), "b.guest_id = ?", guestID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeCalendar(w, "Bookings of "+name, events)
+}
+
+func (a *App) calendarEvents(ctx context.Context, where string, args ...any) ([]icsEvent, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT `+prefixColumns("b", bookingColumns)+`, r.room_no
+		FROM bookings b JOIN rooms r ON r.id = b.room_id
+		WHERE b.status IN ('PENDING','CONFIRMED') AND `+where+` ORDER BY b.starts_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []icsEvent
+	for rows.Next() {
+		var roomNo string
+		br, err := scanBookingRow(rows, &roomNo)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, icsEvent{Booking: toBookingDTO(br), RoomNo: roomNo})
+	}
+	return out, rows.Err()
+}
+
+// ------------------------------------------------------------
+// Parsing
+// ------------------------------------------------------------
+
+// icsProp is one unfolded content line: NAME;PARAM=V:VALUE
+type icsProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// vevent holds the VEVENT properties needed to create a booking.
+type vevent struct {
+	UID       string
+	Start     time.Time
+	End       time.Time
+	Status    string
+	RRule     string
+	Organizer string // email from ORGANIZER
+	// CN parameter of ORGANIZER, used as the name of a new guest
+	OrganizerName string
+}
+
+// unfoldICS joins folded lines (CRLF followed by a space or tab).
+func unfoldICS(r io.Reader) ([]string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxICSBytes)
+	var lines []string
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, sc.Err()
+}
+
+func parseICSProp(line string) (icsProp, error) {
+	// the value starts at the first ':' outside a quoted parameter value
+	inQuote := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ':' && !inQuote {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProp{}, fmt.Errorf("malformed line %q", line)
+	}
+	head := strings.Split(line[:colon], ";")
+	p := icsProp{Name: strings.ToUpper(head[0]), Params: map[string]string{}, Value: line[colon+1:]}
+	for _, kv := range head[1:] {
+		k, v, _ := strings.Cut(kv, "=")
+		p.Params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return p, nil
+}
+
+// parseICSTime handles UTC, TZID-qualified, floating (taken as defLoc) and DATE values.
+func parseICSTime(p icsProp, defLoc *time.Location) (t time.Time, allDay bool, err error) {
+	v := strings.TrimSpace(p.Value)
+	if p.Params["VALUE"] == "DATE" || len(v) == len(icsDateLayout) {
+		t, err = time.ParseInLocation(icsDateLayout, v, defLoc)
+		return t, true, err
+	}
+	if strings.HasSuffix(v, "Z") {
+		t, err = time.Parse(icsUTCLayout, v)
+		return t, false, err
+	}
+	loc := defLoc
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+	}
+	t, err = time.ParseInLocation(icsLocalLayout, v, loc)
+	return t, false, err
+}
+
+var icsDurationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICSDuration parses RFC 5545 durations such as PT1H30M or P1D.
+func parseICSDuration(s string) (time.Duration, error) {
+	m := icsDurationRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid DURATION %q", s)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, u := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * u
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseVEvents extracts all VEVENTs; floating times are read in defLoc.
+func parseVEvents(r io.Reader, defLoc *time.Location) ([]vevent, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("not an iCalendar file (missing BEGIN:VCALENDAR)")
+	}
+	var (
+		out      []vevent
+		cur      *vevent
+		depth    int // nesting inside VEVENT (e.g. VALARM)
+		duration string
+		allDay   bool
+	)
+	for _, l := range lines {
+		p, err := parseICSProp(l)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VEVENT"):
+			cur, depth, duration, allDay = &vevent{}, 0, "", false
+		case cur == nil:
+			// outside VEVENT: VCALENDAR / VTIMEZONE properties are ignored
+		case p.Name == "BEGIN":
+			depth++
+		case p.Name == "END" && depth > 0:
+			depth--
+		case depth > 0:
+		case p.Name == "END" && strings.EqualFold(p.Value, "VEVENT"):
+			if cur.Start.IsZero() {
+				return nil, fmt.Errorf("VEVENT %q has no DTSTART", cur.UID)
+			}
+			if cur.End.IsZero() {
+				switch {
+				case duration != "":
+					d, err := parseICSDuration(duration)
+					if err != nil {
+						return nil, err
+					}
+					cur.End = cur.Start.Add(d)
+				case allDay:
+					cur.End = cur.Start.AddDate(0, 0, 1)
+				}
+			}
+			out = append(out, *cur)
+			cur = nil
+		case p.Name == "UID":
+			cur.UID = p.Value
+		case p.Name == "DTSTART":
+			if cur.Start, allDay, err = parseICSTime(p, defLoc); err != nil {
+				return nil, fmt.Errorf("DTSTART: %w", err)
+			}
+		case p.Name == "DTEND":
+			if cur.End, _, err = parseICSTime(p, defLoc); err != nil {
+				return nil, fmt.Errorf("DTEND: %w", err)
+			}
+		case p.Name == "DURATION":
+			duration = p.Value
+		case p.Name == "STATUS":
+			cur.Status = strings.ToUpper(p.Value)
+		case p.Name == "RRULE":
+			cur.RRule = p.Value
+		case p.Name == "ORGANIZER":
+			v := p.Value
+			if len(v) > 7 && strings.EqualFold(v[:7], "mailto:") {
+				v = v[7:]
+			}
+			cur.Organizer = icsUnescape(v)
+			cur.OrganizerName = p.Params["CN"]
+		}
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("unterminated VEVENT %q", cur.UID)
+	}
+	return out, nil
+}
+
+// ------------------------------------------------------------
+// POST /rooms/{id}/import
+// ------------------------------------------------------------
+
+type importError struct {
+	UID       string `json:"uid"`
+	StartsAt  string `json:"starts_at,omitempty"`
+	Error     string `json:"error"`
+	Code      int    `json:"code"`
+	Conflicts any    `json:"conflicts,omitempty"`
+}
+
+// importCalendar creates one booking per VEVENT (a series for events with an
+// RRULE) through the same overlap-checked path as POST /bookings. Each event
+// is handled in its own transaction; failures are reported per event.
+//
+// The .ics may be sent as multipart field "file" or as the raw body.
+// guest_id (query) overrides the event ORGANIZER; status (query) is used for
+// events without STATUS (default PENDING).
+func (a *App) importCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "id")
+	var x string
+	if err := a.db.QueryRowContext(r.Context(), `SELECT id FROM rooms WHERE id = ?`, roomID).Scan(&x); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notFound(w)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxICSBytes)
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			badRequest(w, `multipart upload must contain a "file" field`)
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+
+	q := r.URL.Query()
+	defStatus := "PENDING"
+	if v := q.Get("status"); v != "" {
+		defStatus = strings.ToUpper(strings.TrimSpace(v))
+		if defStatus != "PENDING" && defStatus != "CONFIRMED" {
+			badRequest(w, "status must be PENDING or CONFIRMED")
+			return
+		}
+	}
+
+	// floating times (no Z, no TZID) are read in ?tz= or the room's zone
+	defLoc, err := a.requestLocation(r, roomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	events, err := parseVEvents(src, defLoc)
+	if err != nil {
+		badRequest(w, "invalid iCalendar: "+err.Error())
+		return
+	}
+
+	created := []Booking{}
+	series := []*Series{}
+	skipped := []map[string]string{}
+	failed := []importError{}
+	for _, ev := range events {
+		status := defStatus
+		switch ev.Status {
+		case "CANCELLED":
+			skipped = append(skipped, map[string]string{"uid": ev.UID, "reason": "event is cancelled"})
+			continue
+		case "TENTATIVE":
+			status = "PENDING"
+		case "CONFIRMED":
+			status = "CONFIRMED"
+		}
+		guestID := q.Get("guest_id")
+		fail := func(msg string, code int, details map[string]any) {
+			ie := importError{UID: ev.UID, StartsAt: ev.Start.Format(time.RFC3339), Error: msg, Code: code}
+			if c, ok := details["conflicts"]; ok {
+				ie.Conflicts = c
+			}
+			failed = append(failed, ie)
+		}
+		if guestID == "" && ev.Organizer != "" {
+			// ORGANIZER is matched to a guest by email, creating the guest if needed
+			id, err := guestForEmail(r.Context(), a.db, ev.Organizer, ev.OrganizerName)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			guestID = id
+		}
+		if guestID == "" {
+			fail("no guest_id given and event has no ORGANIZER", http.StatusBadRequest, nil)
+			continue
+		}
+		if !ev.End.After(ev.Start) {
+			fail("event must end after it starts", http.StatusBadRequest, nil)
+			continue
+		}
+
+		nb := newBooking{RoomID: roomID, GuestID: guestID, Start: ev.Start, End: ev.End, Status: status}
+		if ev.RRule != "" {
+			rule, err := parseRRule(ev.RRule)
+			if err != nil {
+				fail(err.Error(), http.StatusBadRequest, nil)
+				continue
+			}
+			s, err := a.insertSeries(r.Context(), nb, rule)
+			if err != nil {
+				if ce, ok := err.(*clientError); ok {
+					fail(ce.msg, ce.code, ce.details)
+					continue
+				}
+				serverError(w, err)
+				return
+			}
+			series = append(series, s)
+			continue
+		}
+		b, err := a.store.CreateBooking(r.Context(), nb)
+		if err != nil {
+			if ce, ok := err.(*clientError); ok {
+				fail(ce.msg, ce.code, ce.details)
+				continue
+			}
+			serverError(w, err)
+			return
+		}
+		a.emit(r.Context(), "booking.created", b)
+		created = append(created, b)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"events":  len(events),
+		"created": created,
+		"series":  series,
+		"skipped": skipped,
+		"errors":  failed,
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestICSLineFolding(t *testing.T) {
+	for _, value := range []string{
+		strings.Repeat("a", 300),
+		strings.Repeat("会议室", 60), // 3-octet runes must not be split
+	} {
+		var sb strings.Builder
+		iw := &icsWriter{w: bufio.NewWriter(&sb)}
+		iw.line("SUMMARY", value)
+		if err := iw.w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		out := sb.String()
+		for _, l := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+			if len(l) > 75 {
+				t.Errorf("line of %d octets: %q", len(l), l)
+			}
+		}
+		lines, err := unfoldICS(strings.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 || lines[0] != "SUMMARY:"+value {
+			t.Errorf("unfolded to %q", lines)
+		}
+	}
+}
+
+func TestGuestCalendarUnknownGuest(t *testing.T) {
+	app := newTestApp(t)
+	r := chi.NewRouter()
+	r.Get("/guests/{id}/calendar.ics", app.guestCalendar)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/guests/nobody/calendar.ics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown guest: %d", w.Code)
+	}
+
+	if _, err := app.db.Exec(`INSERT INTO guests(id, name, created_at) VALUES('g1', 'Ann', '2030-01-01T00:00:00Z')`); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/guests/g1/calendar.ics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "X-WR-CALNAME:Bookings of Ann") {
+		t.Fatalf("known guest: %d %s", w.Code, w.Body)
+	}
+}
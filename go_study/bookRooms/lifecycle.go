@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ------------------------------------------------------------
+// Booking lifecycle: PENDING holds, check-in, DONE, waitlist
+// ------------------------------------------------------------
+//
+// A PENDING booking holds its slot for PENDING_HOLD (default 30m). If it is
+// not confirmed in time the scheduler cancels it with status_reason EXPIRED.
+// A CONFIRMED booking can be checked in from checkInEarly before its start
+// until its end. Once the end has passed it becomes DONE; without a check-in
+// it gets status_reason NO_SHOW. Whenever a slot is
+// freed (cancel, delete, expiry, move) the room's waitlist is checked in FIFO
+// order and the first request that now fits becomes a PENDING booking.
+
+// holdUpdateSQL keeps hold_expires_at in step with the status on UPDATE.
+// Args: new status, fresh hold deadline. An existing hold is kept.
+const holdUpdateSQL = `hold_expires_at = CASE WHEN ? = 'PENDING' THEN COALESCE(hold_expires_at, ?) ELSE NULL END`
+
+// checkInEarly is how long before its start a booking can be checked in.
+const checkInEarly = 15 * time.Minute
+
+// holdFor returns the hold deadline (unix seconds) for a new booking, or nil
+// when the status does not hold a slot.
+func (s *sqliteStore) holdFor(status string) any {
+	if status != "PENDING" {
+		return nil
+	}
+	return time.Now().Add(s.hold).Unix()
+}
+
+// prefixColumns qualifies a comma separated column list with a table alias.
+func prefixColumns(alias, cols string) string {
+	parts := strings.Split(cols, ",")
+	for i, c := range parts {
+		parts[i] = alias + "." + strings.TrimSpace(c)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// backfillHolds gives PENDING bookings created before holds existed a fresh
+// deadline instead of expiring them all on the first tick.
+func (a *App) backfillHolds(ctx context.Context) error {
+	_, err := a.db.ExecContext(ctx, `UPDATE bookings SET hold_expires_at = ? WHERE status = 'PENDING' AND hold_expires_at IS NULL`,
+		time.Now().Add(a.hold).Unix())
+	return err
+}
+
+func (a *App) runLifecycle(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := a.lifecycleTick(ctx, time.Now()); err != nil {
+			log.Printf("lifecycle: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// lifecycleTick runs one pass of the scheduler in a single transaction.
+func (a *App) lifecycleTick(ctx context.Context, now time.Time) error {
+	var expired, done []bookingRow
+	var promoted []string
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		var err error
+		expired, err = queryBookingRows(ctx, conn, `UPDATE bookings SET status = 'CANCELLED', status_reason = 'EXPIRED', hold_expires_at = NULL
+			WHERE status = 'PENDING' AND hold_expires_at <= ? RETURNING `+bookingColumns, now.Unix())
+		if err != nil {
+			return err
+		}
+
+		done, err = queryBookingRows(ctx, conn, `UPDATE bookings SET status = 'DONE',
+				status_reason = CASE WHEN checked_in_at IS NULL THEN 'NO_SHOW' END
+			WHERE status = 'CONFIRMED' AND ends_at <= ? RETURNING `+bookingColumns, now.Unix())
+		if err != nil {
+			return err
+		}
+
+		// the event log only has to cover reconnecting clients
+		if _, err := conn.ExecContext(ctx, `DELETE FROM booking_events WHERE created_at < ?`, now.Add(-eventRetention).Unix()); err != nil {
+			return err
+		}
+
+		// waitlist requests whose start has passed can no longer be served
+		if _, err := conn.ExecContext(ctx, `UPDATE waitlist SET status = 'EXPIRED' WHERE status = 'WAITING' AND starts_at <= ?`, now.Unix()); err != nil {
+			return err
+		}
+
+		rooms := make([]string, len(expired))
+		for i, br := range expired {
+			rooms[i] = br.RoomID
+		}
+		for _, roomID := range uniqueStrings(rooms) {
+			ids, err := a.promoteWaitlistConn(ctx, conn, roomID, now)
+			if err != nil {
+				return err
+			}
+			promoted = append(promoted, ids...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(expired)+len(done)+len(promoted) > 0 {
+		log.Printf("lifecycle: expired=%d done=%d promoted=%d", len(expired), len(done), len(promoted))
+	}
+	for _, br := range expired {
+		a.emit(ctx, "booking.cancelled", toBookingDTO(br))
+	}
+	for _, br := range done {
+		a.emit(ctx, "booking.updated", toBookingDTO(br))
+	}
+	a.notifyPromoted(ctx, promoted)
+	return nil
+}
+
+// queryBookingRows runs a SELECT or a ... RETURNING bookingColumns statement.
+func queryBookingRows(ctx context.Context, q dbtx, query string, args ...any) ([]bookingRow, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []bookingRow
+	for rows.Next() {
+		br, err := scanBookingRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, br)
+	}
+	return out, rows.Err()
+}
+
+func queryStrings(ctx context.Context, q dbtx, query string, args ...any) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// POST /bookings/{id}/confirm
+func (a *App) confirmBooking(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx := r.Context()
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		cur, err := scanBookingRow(conn.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if cur.Status != "PENDING" {
+			msg := "only PENDING bookings can be confirmed (status is " + cur.Status + ")"
+			if cur.Reason == "EXPIRED" {
+				msg = "booking hold expired"
+			}
+			return clientErr(msg, http.StatusConflict)
+		}
+		if cur.HoldSec > 0 && cur.HoldSec <= time.Now().Unix() {
+			// the scheduler has not run yet; the hold is gone all the same
+			return clientErr("booking hold expired", http.StatusConflict)
+		}
+		_, err = conn.ExecContext(ctx, `UPDATE bookings SET status = 'CONFIRMED', hold_expires_at = NULL WHERE id = ?`, id)
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	b, err := a.store.GetBooking(ctx, id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	a.emit(ctx, "booking.updated", b)
+	writeJSON(w, http.StatusOK, b)
+}
+
+// POST /bookings/{id}/check-in
+func (a *App) checkInBooking(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx := r.Context()
+	now := time.Now()
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		cur, err := scanBookingRow(conn.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if cur.Status != "CONFIRMED" {
+			return clientErr("only CONFIRMED bookings can be checked in (status is "+cur.Status+")", http.StatusConflict)
+		}
+		if cur.CheckIn > 0 {
+			return clientErr("booking is already checked in", http.StatusConflict)
+		}
+		if now.Add(checkInEarly).Unix() < cur.StartSec {
+			return clientErr(fmt.Sprintf("check-in opens %d minutes before the start", int(checkInEarly.Minutes())), http.StatusConflict)
+		}
+		if now.Unix() >= cur.EndSec {
+			// the scheduler has not marked it DONE yet
+			return clientErr("booking has already ended", http.StatusConflict)
+		}
+		_, err = conn.ExecContext(ctx, `UPDATE bookings SET checked_in_at = ? WHERE id = ?`, now.Unix(), id)
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	b, err := a.store.GetBooking(ctx, id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	a.emit(ctx, "booking.updated", b)
+	writeJSON(w, http.StatusOK, b)
+}
+
+// ------------------------------------------------------------
+// Waitlist
+// ------------------------------------------------------------
+
+type WaitlistEntry struct {
+	ID         string `json:"id"`
+	RoomID     string `json:"room_id"`
+	GuestID    string `json:"guest_id"`
+	StartsAt   string `json:"starts_at"`
+	EndsAt     string `json:"ends_at"`
+	Status     string `json:"status"` // WAITING, PROMOTED, CANCELLED, EXPIRED
+	BookingID  string `json:"booking_id,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	PromotedAt string `json:"promoted_at,omitempty"`
+}
+
+const waitlistColumns = `id, room_id, guest_id, starts_at, ends_at, status, booking_id, created_at, promoted_at, start_offset, end_offset`
+
+func scanWaitlist(sc rowScanner) (WaitlistEntry, error) {
+	var e WaitlistEntry
+	var start, end int64
+	var startOff, endOff int
+	var bookingID, promoted sql.NullString
+	err := sc.Scan(&e.ID, &e.RoomID, &e.GuestID, &start, &end, &e.Status, &bookingID, &e.CreatedAt, &promoted, &startOff, &endOff)
+	e.StartsAt = formatAt(start, startOff)
+	e.EndsAt = formatAt(end, endOff)
+	e.BookingID = bookingID.String
+	e.PromotedAt = promoted.String
+	return e, err
+}
+
+type joinWaitlistReq struct {
+	GuestID  string `json:"guest_id"`
+	StartsAt string `json:"starts_at"`
+	EndsAt   string `json:"ends_at"`
+}
+
+// POST /rooms/{id}/waitlist
+// If the slot happens to be free already the entry is promoted right away.
+func (a *App) joinWaitlist(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "id")
+	var req joinWaitlistReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "invalid JSON body")
+		return
+	}
+	if req.GuestID == "" || req.StartsAt == "" || req.EndsAt == "" {
+		badRequest(w, "guest_id, starts_at, ends_at are required")
+		return
+	}
+	loc, err := a.requestLocation(r, roomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	startT, err := parseTimeIn(req.StartsAt, loc)
+	if err != nil {
+		badRequest(w, timeFieldErr("starts_at", err))
+		return
+	}
+	endT, err := parseTimeIn(req.EndsAt, loc)
+	if err != nil {
+		badRequest(w, timeFieldErr("ends_at", err))
+		return
+	}
+	if !endT.After(startT) {
+		badRequest(w, "ends_at must be after starts_at")
+		return
+	}
+	now := time.Now()
+	if !startT.After(now) {
+		badRequest(w, "starts_at must be in the future")
+		return
+	}
+
+	id := uuid.New().String()
+	ctx := r.Context()
+	var promoted []string
+	err = withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		var x string
+		if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, roomID).Scan(&x); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return clientErr("room not found", http.StatusNotFound)
+			}
+			return err
+		}
+		if err := guestExistsConn(ctx, conn, req.GuestID); err != nil {
+			return err
+		}
+		// a request the room could never accept would wait forever
+		if err := checkRoomPolicyConn(ctx, conn, roomID, startT, endT); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, `INSERT INTO waitlist(id, room_id, guest_id, starts_at, ends_at, status, created_at, start_offset, end_offset) VALUES(?,?,?,?,?,'WAITING',?,?,?)`,
+			id, roomID, req.GuestID, startT.Unix(), endT.Unix(), now.UTC().Format(time.RFC3339), offsetOf(startT), offsetOf(endT)); err != nil {
+			return err
+		}
+		var err error
+		promoted, err = a.promoteWaitlistConn(ctx, conn, roomID, now)
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	a.notifyPromoted(ctx, promoted)
+	e, err := scanWaitlist(a.db.QueryRowContext(ctx, `SELECT `+waitlistColumns+` FROM waitlist WHERE id = ?`, id))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, e)
+}
+
+// GET /rooms/{id}/waitlist?status=WAITING
+func (a *App) listWaitlist(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "id")
+	q := `SELECT ` + waitlistColumns + ` FROM waitlist WHERE room_id = ?`
+	args := []any{roomID}
+	if st := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("status"))); st != "" {
+		q += ` AND status = ?`
+		args = append(args, st)
+	}
+	q += ` ORDER BY created_at, id`
+	rows, err := a.db.QueryContext(r.Context(), q, args...)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer rows.Close()
+	out := []WaitlistEntry{}
+	for rows.Next() {
+		e, err := scanWaitlist(rows)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// DELETE /waitlist/{id} withdraws a request that is still waiting.
+func (a *App) leaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var status string
+	err := a.db.QueryRowContext(r.Context(), `SELECT status FROM waitlist WHERE id = ?`, id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if status != "WAITING" {
+		conflict(w, "waitlist entry is "+status)
+		return
+	}
+	if _, err := a.db.ExecContext(r.Context(), `UPDATE waitlist SET status = 'CANCELLED' WHERE id = ? AND status = 'WAITING'`, id); err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// promoteWaitlistConn turns waiting requests for roomID into PENDING bookings,
+// oldest first, as long as they no longer overlap an active booking. Must run
+// inside the transaction that freed the slot. Returns the new booking ids.
+func (s *sqliteStore) promoteWaitlistConn(ctx context.Context, conn *sql.Conn, roomID string, now time.Time) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT `+waitlistColumns+` FROM waitlist
+		WHERE room_id = ? AND status = 'WAITING' AND starts_at > ? ORDER BY created_at, id`, roomID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	var waiting []WaitlistEntry
+	for rows.Next() {
+		e, err := scanWaitlist(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		waiting = append(waiting, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var promoted []string
+	stamp := now.UTC().Format(time.RFC3339)
+	for _, e := range waiting {
+		start, _ := time.Parse(time.RFC3339, e.StartsAt) // keeps the requested offset
+		end, _ := time.Parse(time.RFC3339, e.EndsAt)
+		ids, err := conflictingBookingsConn(ctx, conn, roomID, start.Unix(), end.Unix(), overlapExclude{})
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			continue
+		}
+		bookingID := uuid.New().String()
+		if _, err := conn.ExecContext(ctx, `INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, created_at, hold_expires_at, start_offset, end_offset) VALUES(?,?,?,?,?,'PENDING',?,?,?,?)`,
+			bookingID, roomID, e.GuestID, start.Unix(), end.Unix(), stamp, now.Add(s.hold).Unix(), offsetOf(start), offsetOf(end)); err != nil {
+			return nil, err
+		}
+		if _, err := conn.ExecContext(ctx, `UPDATE waitlist SET status = 'PROMOTED', booking_id = ?, promoted_at = ? WHERE id = ?`,
+			bookingID, stamp, e.ID); err != nil {
+			return nil, err
+		}
+		promoted = append(promoted, bookingID)
+	}
+	return promoted, nil
+}
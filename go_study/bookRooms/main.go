@@ -27,20 +27,28 @@ import (
 // ------------------------------------------------------------
 
 type Room struct {
-	ID        string `json:"id"`
-	RoomNo    string `json:"room_no"`
-	Capacity  int    `json:"capacity"`
-	CreatedAt string `json:"created_at"`
+	ID        string      `json:"id"`
+	RoomNo    string      `json:"room_no"`
+	Capacity  int         `json:"capacity"`
+	CreatedAt string      `json:"created_at"`
+	TimeZone  string      `json:"time_zone"` // IANA name, e.g. Europe/Berlin
+	Equipment []string    `json:"equipment"` // e.g. projector, whiteboard
+	Policy    *RoomPolicy `json:"policy,omitempty"`
 }
 
 type Booking struct {
 	ID        string `json:"id"`
 	RoomID    string `json:"room_id"`
 	GuestID   string `json:"guest_id"`
-	StartsAt  string `json:"starts_at"` // RFC3339
+	StartsAt  string `json:"starts_at"` // RFC3339, in the offset it was booked with
 	EndsAt    string `json:"ends_at"`   // RFC3339
 	Status    string `json:"status"`
 	CreatedAt string `json:"created_at"`
+	SeriesID  string `json:"series_id,omitempty"` // set for occurrences of a recurring series
+	// lifecycle: PENDING bookings are held until HoldExpiresAt, then expire
+	HoldExpiresAt string `json:"hold_expires_at,omitempty"`
+	StatusReason  string `json:"status_reason,omitempty"` // EXPIRED (hold ran out) or NO_SHOW (ended without check-in)
+	CheckedInAt   string `json:"checked_in_at,omitempty"`
 }
 
 // internal representation for time storage (unix seconds)
@@ -52,6 +60,33 @@ type bookingRow struct {
 	EndSec   int64
 	Status   string
 	Created  string
+	SeriesID string
+	HoldSec  int64 // 0 when not held
+	Reason   string
+	CheckIn  int64 // 0 when not checked in
+	StartOff int   // UTC offset (seconds) starts_at was given in
+	EndOff   int
+}
+
+// bookingColumns is the column list matching scanBookingRow.
+const bookingColumns = `id, room_id, guest_id, starts_at, ends_at, status, created_at, series_id, hold_expires_at, status_reason, start_offset, end_offset, checked_in_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanBookingRow scans bookingColumns followed by any extra selected columns.
+func scanBookingRow(sc rowScanner, extra ...any) (bookingRow, error) {
+	var br bookingRow
+	var seriesID, reason sql.NullString
+	var hold, checkIn sql.NullInt64
+	dest := append([]any{&br.ID, &br.RoomID, &br.GuestID, &br.StartSec, &br.EndSec, &br.Status, &br.Created, &seriesID, &hold, &reason, &br.StartOff, &br.EndOff, &checkIn}, extra...)
+	err := sc.Scan(dest...)
+	br.SeriesID = seriesID.String
+	br.HoldSec = hold.Int64
+	br.Reason = reason.String
+	br.CheckIn = checkIn.Int64
+	return br, err
 }
 
 // Allowed statuses
@@ -66,8 +101,20 @@ var allowedStatus = map[string]bool{
 // App bootstrap
 // ------------------------------------------------------------
 
+// App serves the HTTP API. Single-booking CRUD goes through store; series,
+// waitlist, guests and rooms still work directly on the embedded SQLite store.
 type App struct {
-	db *sql.DB
+	*sqliteStore
+	hours  openingHours // default opening hours used by availability search
+	store  BookingStore
+	events *eventHub // live booking change notifications
+}
+
+func newApp(db *sql.DB, hold time.Duration, hours openingHours) *App {
+	a := &App{sqliteStore: newSQLiteStore(db, hold), hours: hours, events: newEventHub()}
+	a.store = a.sqliteStore
+	a.onPromote = func(ctx context.Context, ids []string) { a.emitBookings(ctx, true, ids) }
+	return a
 }
 
 // 将路径或 URL 规范化为可打开的目标（本地文件 -> file://）
@@ -93,12 +140,19 @@ func openBrowser(target string) error {
     }
 }
 
+// sqliteDSN turns a database path into a DSN for modernc.org/sqlite, which
+// applies _pragma options to every pooled connection and ignores the
+// mattn-style _foreign_keys / _busy_timeout.
+func sqliteDSN(path string) string {
+	return fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)", path)
+}
+
 func main() {
 	port := getenv("PORT", "8080")
 	dsn := getenv("DB_PATH", "app.db")
 
 	// modernc.org/sqlite driver name is "sqlite"
-	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", dsn))
+	db, err := sql.Open("sqlite", sqliteDSN(dsn))
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
@@ -115,7 +169,26 @@ func main() {
 		log.Fatalf("migrate: %v", err)
 	}
 
-	app := &App{db: db}
+	hours, err := parseOpeningHours(getenv("OPEN_HOURS", "08:00-20:00"), getenv("OPEN_DAYS", "MO-SU"))
+	if err != nil {
+		log.Fatalf("opening hours: %v", err)
+	}
+
+	hold, err := time.ParseDuration(getenv("PENDING_HOLD", "30m"))
+	if err != nil || hold <= 0 {
+		log.Fatalf("PENDING_HOLD must be a positive duration like 30m")
+	}
+	tick, err := time.ParseDuration(getenv("LIFECYCLE_INTERVAL", "1m"))
+	if err != nil || tick <= 0 {
+		log.Fatalf("LIFECYCLE_INTERVAL must be a positive duration like 1m")
+	}
+
+	app := newApp(db, hold, hours)
+	if err := app.backfillHolds(context.Background()); err != nil {
+		log.Fatalf("backfill holds: %v", err)
+	}
+	// Background lifecycle: expire PENDING holds, mark past bookings DONE, promote waitlist
+	go app.runLifecycle(context.Background(), tick)
 
 	r := chi.NewRouter()
 	r.Use(middleware.RealIP)
@@ -126,6 +199,16 @@ func main() {
 
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, map[string]any{"ok": true}) })
 
+	// Booking change notifications: SSE and WebSocket, resumable by event id
+	r.Get("/events", app.streamEvents)
+	r.Get("/events/ws", app.streamEventsWS)
+
+	// Free/busy search across rooms
+	r.Get("/availability", app.availability)
+
+	// Utilization / occupancy reports
+	r.Get("/reports/utilization", app.utilizationReport)
+
 	// Rooms
 	r.Route("/rooms", func(r chi.Router) {
 		r.Post("/", app.createRoom)
@@ -136,6 +219,39 @@ func main() {
 			r.Delete("/", app.deleteRoom)
 			// nested: list bookings for a room
 			r.Get("/bookings", app.listRoomBookings)
+			// iCalendar feed / import
+			r.Get("/calendar.ics", app.roomCalendar)
+			r.Post("/import", app.importCalendar)
+			// waitlist: promoted automatically when a conflicting booking goes away
+			r.Post("/waitlist", app.joinWaitlist)
+			r.Get("/waitlist", app.listWaitlist)
+			// booking rules: duration, lead time, buffer, business hours
+			r.Get("/policy", app.getRoomPolicy)
+			r.Put("/policy", app.putRoomPolicy)
+		})
+	})
+
+	r.Delete("/waitlist/{id}", app.leaveWaitlist)
+
+	// Guests
+	r.Route("/guests", func(r chi.Router) {
+		r.Post("/", app.createGuest)
+		r.Get("/", app.listGuests)
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", app.getGuest)
+			r.Patch("/", app.updateGuest)
+			r.Delete("/", app.deleteGuest)
+			r.Get("/bookings", app.listGuestBookings)
+			r.Get("/calendar.ics", app.guestCalendar)
+		})
+	})
+
+	// Recurring booking series
+	r.Route("/series", func(r chi.Router) {
+		r.Post("/", app.createSeries)
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", app.getSeries)
+			r.Delete("/", app.deleteSeries)
 		})
 	})
 
@@ -147,6 +263,8 @@ func main() {
 			r.Get("/", app.getBooking)
 			r.Patch("/", app.updateBooking)
 			r.Delete("/", app.deleteBooking)
+			r.Post("/confirm", app.confirmBooking)
+			r.Post("/check-in", app.checkInBooking)
 		})
 	})
 
@@ -209,12 +327,139 @@ func migrate(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_bookings_status ON bookings(status);`,
 		// Partial index for active bookings to speed up overlap checks
 		`CREATE INDEX IF NOT EXISTS idx_bookings_active_range ON bookings(room_id, starts_at, ends_at) WHERE status IN ('PENDING','CONFIRMED');`,
+		// Recurring series: the rule is kept for reference, occurrences are materialized as bookings
+		`CREATE TABLE IF NOT EXISTS booking_series (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			guest_id TEXT NOT NULL,
+			rrule TEXT NOT NULL,
+			starts_at INTEGER NOT NULL,
+			duration_sec INTEGER NOT NULL CHECK (duration_sec > 0),
+			created_at TEXT NOT NULL,
+			FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
 	}
 	for _, s := range stmts {
 		if _, err := db.Exec(s); err != nil {
 			return fmt.Errorf("migrate exec: %w", err)
 		}
 	}
+
+	// Columns added after the initial schema
+	if err := ensureColumn(db, "bookings", "series_id", "TEXT REFERENCES booking_series(id) ON DELETE CASCADE"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "bookings", "hold_expires_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "bookings", "status_reason", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "bookings", "checked_in_at", "INTEGER"); err != nil {
+		return err
+	}
+	post := []string{
+		`CREATE INDEX IF NOT EXISTS idx_bookings_series ON bookings(series_id, starts_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_bookings_hold ON bookings(hold_expires_at) WHERE status = 'PENDING';`,
+		// Waitlist: requests for a slot that was taken, promoted FIFO when it frees up
+		`CREATE TABLE IF NOT EXISTS waitlist (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			guest_id TEXT NOT NULL,
+			starts_at INTEGER NOT NULL,
+			ends_at INTEGER NOT NULL,
+			status TEXT NOT NULL CHECK (status IN ('WAITING','PROMOTED','CANCELLED','EXPIRED')),
+			booking_id TEXT,
+			created_at TEXT NOT NULL,
+			promoted_at TEXT,
+			FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+			CHECK (ends_at > starts_at)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_waitlist_room ON waitlist(room_id, status, created_at);`,
+		`CREATE TABLE IF NOT EXISTS guests (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			email TEXT UNIQUE,
+			phone TEXT,
+			created_at TEXT NOT NULL
+		);`,
+		// guest_id used to be free-form: give every id already in use a guest row
+		`INSERT OR IGNORE INTO guests(id, name, created_at)
+			SELECT guest_id, guest_id, strftime('%Y-%m-%dT%H:%M:%SZ','now') FROM bookings
+			UNION SELECT guest_id, guest_id, strftime('%Y-%m-%dT%H:%M:%SZ','now') FROM waitlist;`,
+		`CREATE INDEX IF NOT EXISTS idx_bookings_guest ON bookings(guest_id, starts_at);`,
+		`CREATE TABLE IF NOT EXISTS room_equipment (
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (room_id, name),
+			FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_room_equipment_name ON room_equipment(name);`,
+		`CREATE TABLE IF NOT EXISTS room_policies (
+			room_id TEXT PRIMARY KEY,
+			min_duration_min INTEGER,
+			max_duration_min INTEGER,
+			lead_time_min INTEGER,
+			max_advance_days INTEGER,
+			buffer_min INTEGER,
+			business_hours TEXT,
+			business_days TEXT,
+			FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+		);`,
+		// change log behind /events; ids are the SSE event ids
+		`CREATE TABLE IF NOT EXISTS booking_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			booking_id TEXT NOT NULL,
+			room_id TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_booking_events_room ON booking_events(room_id, id);`,
+	}
+	for _, s := range post {
+		if _, err := db.Exec(s); err != nil {
+			return fmt.Errorf("migrate exec: %w", err)
+		}
+	}
+	// time zones: rooms get an IANA zone, bookings keep the offset they were given in
+	if err := ensureColumn(db, "rooms", "time_zone", "TEXT NOT NULL DEFAULT 'UTC'"); err != nil {
+		return err
+	}
+	for _, table := range []string{"bookings", "waitlist"} {
+		if err := ensureColumn(db, table, "start_offset", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if err := ensureColumn(db, table, "end_offset", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column to an existing table unless it is already there
+// (SQLite has no ADD COLUMN IF NOT EXISTS).
+func ensureColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return fmt.Errorf("migrate table_info %s: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl)); err != nil {
+		return fmt.Errorf("migrate add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -223,8 +468,11 @@ func migrate(db *sql.DB) error {
 // ------------------------------------------------------------
 
 type createRoomReq struct {
-	RoomNo   string `json:"room_no"`
-	Capacity int    `json:"capacity"`
+	RoomNo    string      `json:"room_no"`
+	Capacity  int         `json:"capacity"`
+	TimeZone  string      `json:"time_zone"` // default UTC
+	Equipment []string    `json:"equipment"`
+	Policy    *RoomPolicy `json:"policy"`
 }
 
 func (a *App) createRoom(w http.ResponseWriter, r *http.Request) {
@@ -237,24 +485,75 @@ func (a *App) createRoom(w http.ResponseWriter, r *http.Request) {
 		badRequest(w, "room_no and positive capacity are required")
 		return
 	}
+	if req.Policy != nil {
+		if err := req.Policy.validate(); err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+	}
+	if req.TimeZone == "" {
+		req.TimeZone = "UTC"
+	}
+	if _, err := loadZone(req.TimeZone); err != nil {
+		badRequest(w, "time_zone: "+err.Error())
+		return
+	}
 
 	id := uuid.New().String()
 	now := time.Now().UTC().Format(time.RFC3339)
+	equipment := normalizeEquipment(req.Equipment)
 
-	_, err := a.db.Exec(`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES(?,?,?,?)`, id, req.RoomNo, req.Capacity, now)
+	ctx := r.Context()
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, `INSERT INTO rooms(id, room_no, capacity, created_at, time_zone) VALUES(?,?,?,?,?)`, id, req.RoomNo, req.Capacity, now, req.TimeZone); err != nil {
+			if isUniqueViolation(err) {
+				return clientErr("room_no already exists", http.StatusConflict)
+			}
+			return err
+		}
+		if err := setRoomEquipment(ctx, conn, id, equipment); err != nil {
+			return err
+		}
+		if req.Policy != nil {
+			return saveRoomPolicy(ctx, conn, id, *req.Policy)
+		}
+		return nil
+	})
 	if err != nil {
-		if isUniqueViolation(err) {
-			conflict(w, "room_no already exists")
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
 			return
 		}
 		serverError(w, err)
 		return
 	}
-	writeJSON(w, http.StatusCreated, Room{ID: id, RoomNo: req.RoomNo, Capacity: req.Capacity, CreatedAt: now})
+	rm := Room{ID: id, RoomNo: req.RoomNo, Capacity: req.Capacity, CreatedAt: now, TimeZone: req.TimeZone, Equipment: equipment}
+	if req.Policy != nil && !req.Policy.empty() {
+		rm.Policy = req.Policy
+	}
+	writeJSON(w, http.StatusCreated, rm)
 }
 
+// GET /rooms?equipment=projector,whiteboard&min_capacity=8
+// equipment lists tags the room must all have.
 func (a *App) listRooms(w http.ResponseWriter, r *http.Request) {
-	rows, err := a.db.Query(`SELECT id, room_no, capacity, created_at FROM rooms ORDER BY created_at DESC`)
+	q := r.URL.Query()
+	where := []string{"1=1"}
+	args := []any{}
+	if v := q.Get("min_capacity"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			badRequest(w, "min_capacity must be a non-negative integer")
+			return
+		}
+		where = append(where, "capacity >= ?")
+		args = append(args, n)
+	}
+	if frag, fargs := equipmentFilter(normalizeEquipment(splitList(q["equipment"]))); frag != "" {
+		where = append(where, frag)
+		args = append(args, fargs...)
+	}
+	rows, err := a.db.Query(`SELECT id, room_no, capacity, created_at, time_zone FROM rooms WHERE `+strings.Join(where, " AND ")+` ORDER BY created_at DESC`, args...)
 	if err != nil {
 		serverError(w, err)
 		return
@@ -264,19 +563,24 @@ func (a *App) listRooms(w http.ResponseWriter, r *http.Request) {
 	list := []Room{} // 关键：用空切片而不是 nil
 	for rows.Next() {
 		var rm Room
-		if err := rows.Scan(&rm.ID, &rm.RoomNo, &rm.Capacity, &rm.CreatedAt); err != nil {
+		if err := rows.Scan(&rm.ID, &rm.RoomNo, &rm.Capacity, &rm.CreatedAt, &rm.TimeZone); err != nil {
 			serverError(w, err)
 			return
 		}
 		list = append(list, rm)
 	}
+	rows.Close()
+	if err := loadRoomExtras(r.Context(), a.db, list); err != nil {
+		serverError(w, err)
+		return
+	}
 	writeJSON(w, http.StatusOK, list)
 }
 
 func (a *App) getRoom(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	var rm Room
-	err := a.db.QueryRow(`SELECT id, room_no, capacity, created_at FROM rooms WHERE id = ?`, id).Scan(&rm.ID, &rm.RoomNo, &rm.Capacity, &rm.CreatedAt)
+	err := a.db.QueryRow(`SELECT id, room_no, capacity, created_at, time_zone FROM rooms WHERE id = ?`, id).Scan(&rm.ID, &rm.RoomNo, &rm.Capacity, &rm.CreatedAt, &rm.TimeZone)
 	if errors.Is(err, sql.ErrNoRows) {
 		notFound(w)
 		return
@@ -285,12 +589,20 @@ func (a *App) getRoom(w http.ResponseWriter, r *http.Request) {
 		serverError(w, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, rm)
+	list := []Room{rm}
+	if err := loadRoomExtras(r.Context(), a.db, list); err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list[0])
 }
 
 type updateRoomReq struct {
-	RoomNo   *string `json:"room_no"`
-	Capacity *int    `json:"capacity"`
+	RoomNo    *string     `json:"room_no"`
+	Capacity  *int        `json:"capacity"`
+	TimeZone  *string     `json:"time_zone"` // existing bookings keep their instants
+	Equipment *[]string   `json:"equipment"` // replaces the whole list
+	Policy    *RoomPolicy `json:"policy"`    // replaces the whole policy
 }
 
 func (a *App) updateRoom(w http.ResponseWriter, r *http.Request) {
@@ -320,26 +632,66 @@ func (a *App) updateRoom(w http.ResponseWriter, r *http.Request) {
 		sets = append(sets, "capacity = ?")
 		args = append(args, *req.Capacity)
 	}
-	if len(sets) == 0 {
+	if req.TimeZone != nil {
+		if _, err := loadZone(*req.TimeZone); err != nil {
+			badRequest(w, "time_zone: "+err.Error())
+			return
+		}
+		sets = append(sets, "time_zone = ?")
+		args = append(args, strings.TrimSpace(*req.TimeZone))
+	}
+	if req.Policy != nil {
+		if err := req.Policy.validate(); err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+	}
+	if len(sets) == 0 && req.Equipment == nil && req.Policy == nil {
 		badRequest(w, "no fields to update")
 		return
 	}
 	args = append(args, id)
 
-	res, err := a.db.Exec("UPDATE rooms SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	ctx := r.Context()
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		if len(sets) > 0 {
+			res, err := conn.ExecContext(ctx, "UPDATE rooms SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+			if err != nil {
+				if isUniqueViolation(err) {
+					return clientErr("room_no already exists", http.StatusConflict)
+				}
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return clientErr("not found", http.StatusNotFound)
+			}
+		} else {
+			var x string
+			if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, id).Scan(&x); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return clientErr("not found", http.StatusNotFound)
+				}
+				return err
+			}
+		}
+		if req.Equipment != nil {
+			if err := setRoomEquipment(ctx, conn, id, normalizeEquipment(*req.Equipment)); err != nil {
+				return err
+			}
+		}
+		if req.Policy != nil {
+			return saveRoomPolicy(ctx, conn, id, *req.Policy)
+		}
+		return nil
+	})
 	if err != nil {
-		if isUniqueViolation(err) {
-			conflict(w, "room_no already exists")
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
 			return
 		}
 		serverError(w, err)
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		notFound(w)
-		return
-	}
 	a.getRoom(w, r)
 }
 
@@ -363,22 +715,31 @@ func (a *App) listRoomBookings(w http.ResponseWriter, r *http.Request) {
 	fromStr := q.Get("from")
 	toStr := q.Get("to")
 
+	loc, err := a.requestLocation(r, roomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
 	where := []string{"room_id = ?"}
 	args := []any{roomID}
 	if fromStr != "" {
-		if fromT, err := parseRFC3339(fromStr); err == nil {
+		if fromT, err := parseTimeIn(fromStr, loc); err == nil {
 			where = append(where, "ends_at > ?")
 			args = append(args, fromT.Unix())
 		}
 	}
 	if toStr != "" {
-		if toT, err := parseRFC3339(toStr); err == nil {
+		if toT, err := parseTimeIn(toStr, loc); err == nil {
 			where = append(where, "starts_at < ?")
 			args = append(args, toT.Unix())
 		}
 	}
 
-	rows, err := a.db.Query(`SELECT id, room_id, guest_id, starts_at, ends_at, status, created_at
+	rows, err := a.db.Query(`SELECT `+bookingColumns+`
 		FROM bookings WHERE `+strings.Join(where, " AND ")+` ORDER BY starts_at`, args...)
 	if err != nil {
 		serverError(w, err)
@@ -389,8 +750,8 @@ func (a *App) listRoomBookings(w http.ResponseWriter, r *http.Request) {
 	// var list []Booking
 	list := []Booking{} // 关键
 	for rows.Next() {
-		var br bookingRow
-		if err := rows.Scan(&br.ID, &br.RoomID, &br.GuestID, &br.StartSec, &br.EndSec, &br.Status, &br.Created); err != nil {
+		br, err := scanBookingRow(rows)
+		if err != nil {
 			serverError(w, err)
 			return
 		}
@@ -421,14 +782,23 @@ func (a *App) createBooking(w http.ResponseWriter, r *http.Request) {
 		badRequest(w, "room_id, guest_id, starts_at, ends_at are required")
 		return
 	}
-	startT, err := parseRFC3339(req.StartsAt)
+	loc, err := a.requestLocation(r, req.RoomID)
 	if err != nil {
-		badRequest(w, "starts_at must be RFC3339")
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
 		return
 	}
-	endT, err := parseRFC3339(req.EndsAt)
+	startT, err := parseTimeIn(req.StartsAt, loc)
 	if err != nil {
-		badRequest(w, "ends_at must be RFC3339")
+		badRequest(w, timeFieldErr("starts_at", err))
+		return
+	}
+	endT, err := parseTimeIn(req.EndsAt, loc)
+	if err != nil {
+		badRequest(w, timeFieldErr("ends_at", err))
 		return
 	}
 	if !endT.After(startT) {
@@ -444,43 +814,27 @@ func (a *App) createBooking(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	id := uuid.New().String()
-	now := time.Now().UTC().Format(time.RFC3339)
-
-	ctx := r.Context()
-	err = withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
-		// Ensure room exists
-		var x string
-		if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, req.RoomID).Scan(&x); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				return clientErr("room not found", http.StatusBadRequest)
-			}
-			return err
-		}
-		// Overlap check for active statuses
-		if status == "PENDING" || status == "CONFIRMED" {
-			ok, err := hasOverlapConn(ctx, conn, req.RoomID, startT.Unix(), endT.Unix(), "")
-			if err != nil {
-				return err
-			}
-			if ok {
-				return clientErr("booking time overlaps existing booking", http.StatusConflict)
-			}
-		}
-		_, err := conn.ExecContext(ctx, `INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, created_at) VALUES(?,?,?,?,?,?,?)`,
-			id, req.RoomID, req.GuestID, startT.Unix(), endT.Unix(), status, now)
-		return err
-	})
+	b, err := a.store.CreateBooking(r.Context(), newBooking{RoomID: req.RoomID, GuestID: req.GuestID, Start: startT, End: endT, Status: status})
 	if err != nil {
 		if ce, ok := err.(*clientError); ok {
-			writeError(w, ce.code, ce.Error())
+			writeClientError(w, ce)
 			return
 		}
 		serverError(w, err)
 		return
 	}
 
-	writeJSON(w, http.StatusCreated, Booking{ID: id, RoomID: req.RoomID, GuestID: req.GuestID, StartsAt: startT.UTC().Format(time.RFC3339), EndsAt: endT.UTC().Format(time.RFC3339), Status: status, CreatedAt: now})
+	a.emit(r.Context(), "booking.created", b)
+	writeJSON(w, http.StatusCreated, b)
+}
+
+// newBooking is a validated booking request.
+type newBooking struct {
+	RoomID  string
+	GuestID string
+	Start   time.Time
+	End     time.Time
+	Status  string
 }
 
 type listBookingsFilters struct {
@@ -507,69 +861,45 @@ func (a *App) listBookings(w http.ResponseWriter, r *http.Request) {
 			filters.Offset = n
 		}
 	}
+	loc, err := a.requestLocation(r, filters.RoomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
 	if v := q.Get("from"); v != "" {
-		if t, err := parseRFC3339(v); err == nil {
+		if t, err := parseTimeIn(v, loc); err == nil {
 			filters.From = &t
 		}
 	}
 	if v := q.Get("to"); v != "" {
-		if t, err := parseRFC3339(v); err == nil {
+		if t, err := parseTimeIn(v, loc); err == nil {
 			filters.To = &t
 		}
 	}
 
-	where := []string{"1=1"}
-	args := []any{}
-	if filters.RoomID != "" {
-		where = append(where, "room_id = ?")
-		args = append(args, filters.RoomID)
-	}
-	if filters.Status != "" {
-		where = append(where, "status = ?")
-		args = append(args, filters.Status)
-	}
-	if filters.From != nil {
-		where = append(where, "ends_at > ?")
-		args = append(args, filters.From.Unix())
-	}
-	if filters.To != nil {
-		where = append(where, "starts_at < ?")
-		args = append(args, filters.To.Unix())
-	}
-
-	rows, err := a.db.Query(`SELECT id, room_id, guest_id, starts_at, ends_at, status, created_at FROM bookings WHERE `+strings.Join(where, " AND ")+` ORDER BY starts_at LIMIT ? OFFSET ?`, append(args, filters.Limit, filters.Offset)...)
+	list, err := a.store.ListBookings(r.Context(), filters)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	defer rows.Close()
-
-	// var list []Booking
-	list := []Booking{} // 关键
-	for rows.Next() {
-		var br bookingRow
-		if err := rows.Scan(&br.ID, &br.RoomID, &br.GuestID, &br.StartSec, &br.EndSec, &br.Status, &br.Created); err != nil {
-			serverError(w, err)
-			return
-		}
-		list = append(list, toBookingDTO(br))
-	}
 	writeJSON(w, http.StatusOK, list)
 }
 
 func (a *App) getBooking(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	var br bookingRow
-	err := a.db.QueryRow(`SELECT id, room_id, guest_id, starts_at, ends_at, status, created_at FROM bookings WHERE id = ?`, id).Scan(&br.ID, &br.RoomID, &br.GuestID, &br.StartSec, &br.EndSec, &br.Status, &br.Created)
-	if errors.Is(err, sql.ErrNoRows) {
-		notFound(w)
-		return
-	}
+	b, err := a.store.GetBooking(r.Context(), chi.URLParam(r, "id"))
 	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
 		serverError(w, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, toBookingDTO(br))
+	writeJSON(w, http.StatusOK, b)
 }
 
 type updateBookingReq struct {
@@ -582,15 +912,15 @@ type updateBookingReq struct {
 
 func (a *App) updateBooking(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
+	ctx := r.Context()
 
-	// fetch current row first
-	var cur bookingRow
-	err := a.db.QueryRow(`SELECT id, room_id, guest_id, starts_at, ends_at, status, created_at FROM bookings WHERE id = ?`, id).Scan(&cur.ID, &cur.RoomID, &cur.GuestID, &cur.StartSec, &cur.EndSec, &cur.Status, &cur.Created)
-	if errors.Is(err, sql.ErrNoRows) {
-		notFound(w)
-		return
-	}
+	// fetch current booking first: its room decides how local times are read
+	cur, err := a.store.GetBooking(ctx, id)
 	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
 		serverError(w, err)
 		return
 	}
@@ -601,94 +931,104 @@ func (a *App) updateBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	patch := bookingPatch{RoomID: req.RoomID, GuestID: req.GuestID}
 	newRoomID := cur.RoomID
 	if req.RoomID != nil {
 		newRoomID = *req.RoomID
 	}
-	newGuestID := cur.GuestID
-	if req.GuestID != nil {
-		newGuestID = *req.GuestID
+	loc, err := a.requestLocation(r, newRoomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
 	}
-	newStart := cur.StartSec
 	if req.StartsAt != nil {
-		st, err := parseRFC3339(*req.StartsAt)
+		st, err := parseTimeIn(*req.StartsAt, loc)
 		if err != nil {
-			badRequest(w, "starts_at must be RFC3339")
+			badRequest(w, timeFieldErr("starts_at", err))
 			return
 		}
-		newStart = st.Unix()
+		patch.Start = &st
 	}
-	newEnd := cur.EndSec
 	if req.EndsAt != nil {
-		et, err := parseRFC3339(*req.EndsAt)
+		et, err := parseTimeIn(*req.EndsAt, loc)
 		if err != nil {
-			badRequest(w, "ends_at must be RFC3339")
+			badRequest(w, timeFieldErr("ends_at", err))
 			return
 		}
-		newEnd = et.Unix()
+		patch.End = &et
 	}
-	if newEnd <= newStart {
-		badRequest(w, "ends_at must be after starts_at")
-		return
-	}
-	newStatus := cur.Status
 	if req.Status != nil {
-		newStatus = strings.ToUpper(strings.TrimSpace(*req.Status))
-		if !allowedStatus[newStatus] {
+		st := strings.ToUpper(strings.TrimSpace(*req.Status))
+		if !allowedStatus[st] {
 			badRequest(w, "invalid status")
 			return
 		}
+		patch.Status = &st
 	}
 
-	ctx := r.Context()
-	err = withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
-		// Ensure room exists if changed
-		if newRoomID != cur.RoomID {
-			var x string
-			if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, newRoomID).Scan(&x); err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					return clientErr("room not found", http.StatusBadRequest)
-				}
-				return err
-			}
+	scope, err := parseEditScope(r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if scope == scopeFollowing && cur.SeriesID != "" {
+		// series edits are SQLite-only: they also rewrite booking_series
+		row, err := scanBookingRow(a.db.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+		if err != nil {
+			serverError(w, err)
+			return
 		}
-		// Overlap check when status is active
-		if newStatus == "PENDING" || newStatus == "CONFIRMED" {
-			ok, err := hasOverlapConn(ctx, conn, newRoomID, newStart, newEnd, id)
-			if err != nil {
-				return err
-			}
-			if ok {
-				return clientErr("booking time overlaps existing booking", http.StatusConflict)
-			}
+		next, err := row.apply(patch)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
 		}
-		_, err := conn.ExecContext(ctx, `UPDATE bookings SET room_id=?, guest_id=?, starts_at=?, ends_at=?, status=? WHERE id=?`,
-			newRoomID, newGuestID, newStart, newEnd, newStatus, id)
-		return err
-	})
+		a.updateFollowing(w, r, row, bookingChange{RoomID: next.RoomID, GuestID: next.GuestID, StartSec: next.StartSec, EndSec: next.EndSec, Status: next.Status})
+		return
+	}
+
+	b, err := a.store.UpdateBooking(ctx, id, patch)
 	if err != nil {
 		if ce, ok := err.(*clientError); ok {
-			writeError(w, ce.code, ce.Error())
+			writeClientError(w, ce)
 			return
 		}
 		serverError(w, err)
 		return
 	}
-
-	a.getBooking(w, r)
+	a.emit(ctx, bookingEventType(false, b), b)
+	writeJSON(w, http.StatusOK, b)
 }
 
 func (a *App) deleteBooking(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	res, err := a.db.Exec(`DELETE FROM bookings WHERE id = ?`, id)
+	scope, err := parseEditScope(r)
 	if err != nil {
-		serverError(w, err)
+		badRequest(w, err.Error())
 		return
 	}
-	if n, _ := res.RowsAffected(); n == 0 {
-		notFound(w)
+	if scope == scopeFollowing {
+		a.deleteFollowing(w, r, id)
+		return
+	}
+	// the event carries the booking as it was before the delete
+	b, err := a.store.GetBooking(r.Context(), id)
+	if err == nil {
+		err = a.store.DeleteBooking(r.Context(), id)
+	}
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
 		return
 	}
+	a.emit(r.Context(), "booking.cancelled", b)
 	writeJSON(w, http.StatusNoContent, nil)
 }
 
@@ -698,26 +1038,53 @@ func (a *App) deleteBooking(w http.ResponseWriter, r *http.Request) {
 
 // returns true if overlap exists for [start,end) interval in given room.
 func hasOverlapConn(ctx context.Context, conn *sql.Conn, roomID string, startSec, endSec int64, excludeID string) (bool, error) {
-	q := `SELECT 1 FROM bookings 
+	ids, err := conflictingBookingsConn(ctx, conn, roomID, startSec, endSec, overlapExclude{BookingID: excludeID})
+	if err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// overlapExclude lists bookings that must not count as conflicts, e.g. the
+// booking being edited or the series occurrences being moved together.
+type overlapExclude struct {
+	BookingID  string
+	SeriesID   string // ignore occurrences of this series ...
+	SeriesFrom int64  // ... starting at or after this instant
+}
+
+// returns the ids of active bookings overlapping [start,end) in given room.
+// The room's buffer (room_policies.buffer_min) is kept free on both sides.
+func conflictingBookingsConn(ctx context.Context, conn *sql.Conn, roomID string, startSec, endSec int64, ex overlapExclude) ([]string, error) {
+	q := `SELECT id FROM bookings 
 		WHERE room_id = ?
 			AND status IN ('PENDING','CONFIRMED')
-			AND starts_at < ?
-			AND ends_at > ?`
-	args := []any{roomID, endSec, startSec}
-	if excludeID != "" {
+			AND starts_at < ? + IFNULL((SELECT buffer_min * 60 FROM room_policies WHERE room_id = ?), 0)
+			AND ends_at > ? - IFNULL((SELECT buffer_min * 60 FROM room_policies WHERE room_id = ?), 0)`
+	args := []any{roomID, endSec, roomID, startSec, roomID}
+	if ex.BookingID != "" {
 		q += " AND id <> ?"
-		args = append(args, excludeID)
+		args = append(args, ex.BookingID)
 	}
-	q += " LIMIT 1"
-	var one int
-	err := conn.QueryRowContext(ctx, q, args...).Scan(&one)
-	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
+	if ex.SeriesID != "" {
+		q += " AND NOT (IFNULL(series_id, '') = ? AND starts_at >= ?)"
+		args = append(args, ex.SeriesID, ex.SeriesFrom)
 	}
+	q += " ORDER BY starts_at"
+	rows, err := conn.QueryContext(ctx, q, args...)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return true, nil
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 // Wrap a function in a BEGIN IMMEDIATE transaction using a single connection.
@@ -770,15 +1137,24 @@ func parseRFC3339(s string) (time.Time, error) {
 }
 
 func toBookingDTO(br bookingRow) Booking {
-	return Booking{
+	b := Booking{
 		ID:        br.ID,
 		RoomID:    br.RoomID,
 		GuestID:   br.GuestID,
-		StartsAt:  time.Unix(br.StartSec, 0).UTC().Format(time.RFC3339),
-		EndsAt:    time.Unix(br.EndSec, 0).UTC().Format(time.RFC3339),
+		StartsAt:  formatAt(br.StartSec, br.StartOff),
+		EndsAt:    formatAt(br.EndSec, br.EndOff),
 		Status:    br.Status,
 		CreatedAt: br.Created,
+		SeriesID:  br.SeriesID,
+		StatusReason: br.Reason,
+	}
+	if br.HoldSec > 0 && br.Status == "PENDING" {
+		b.HoldExpiresAt = time.Unix(br.HoldSec, 0).UTC().Format(time.RFC3339)
 	}
+	if br.CheckIn > 0 {
+		b.CheckedInAt = time.Unix(br.CheckIn, 0).UTC().Format(time.RFC3339)
+	}
+	return b
 }
 
 func writeJSON(w http.ResponseWriter, code int, v any) {
@@ -846,9 +1222,18 @@ func corsMiddleware() func(http.Handler) http.Handler {
 }
 
 type clientError struct {
-	msg  string
-	code int
+	msg     string
+	code    int
+	details map[string]any // extra fields merged into the JSON error body
 }
 
 func (e *clientError) Error() string       { return e.msg }
 func clientErr(msg string, code int) error { return &clientError{msg: msg, code: code} }
+
+func writeClientError(w http.ResponseWriter, ce *clientError) {
+	body := map[string]any{"error": ce.msg, "code": ce.code}
+	for k, v := range ce.details {
+		body[k] = v
+	}
+	writeJSON(w, ce.code, body)
+}
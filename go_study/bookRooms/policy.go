@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// Room equipment and booking policies
+// ------------------------------------------------------------
+
+// dbtx is satisfied by *sql.DB and *sql.Conn, so helpers can run inside or
+// outside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// RoomPolicy limits what can be booked in a room. Unset fields impose no limit.
+type RoomPolicy struct {
+	MinDurationMin *int   `json:"min_duration_minutes,omitempty"`
+	MaxDurationMin *int   `json:"max_duration_minutes,omitempty"`
+	LeadTimeMin    *int   `json:"lead_time_minutes,omitempty"` // earliest start = now + lead time
+	MaxAdvanceDays *int   `json:"max_advance_days,omitempty"`  // latest start = now + N days
+	BufferMin      *int   `json:"buffer_minutes,omitempty"`    // gap required between bookings
+	BusinessHours  string `json:"business_hours,omitempty"`    // "08:00-18:00"
+	BusinessDays   string `json:"business_days,omitempty"`     // "MO-FR", defaults to MO-SU
+}
+
+func (p RoomPolicy) empty() bool {
+	return p.MinDurationMin == nil && p.MaxDurationMin == nil && p.LeadTimeMin == nil &&
+		p.MaxAdvanceDays == nil && p.BufferMin == nil && p.BusinessHours == ""
+}
+
+func (p RoomPolicy) validate() error {
+	for name, v := range map[string]*int{
+		"min_duration_minutes": p.MinDurationMin,
+		"max_duration_minutes": p.MaxDurationMin,
+		"lead_time_minutes":    p.LeadTimeMin,
+		"max_advance_days":     p.MaxAdvanceDays,
+		"buffer_minutes":       p.BufferMin,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%s must be >= 0", name)
+		}
+	}
+	if p.MinDurationMin != nil && p.MaxDurationMin != nil && *p.MinDurationMin > *p.MaxDurationMin {
+		return fmt.Errorf("min_duration_minutes must not exceed max_duration_minutes")
+	}
+	if p.BusinessDays != "" && p.BusinessHours == "" {
+		return fmt.Errorf("business_days requires business_hours")
+	}
+	_, _, err := p.hours()
+	return err
+}
+
+// hours returns the room's business hours; ok is false when none are set.
+func (p RoomPolicy) hours() (oh openingHours, ok bool, err error) {
+	if p.BusinessHours == "" {
+		return oh, false, nil
+	}
+	days := p.BusinessDays
+	if days == "" {
+		days = "MO-SU"
+	}
+	oh, err = parseOpeningHours(p.BusinessHours, days)
+	return oh, err == nil, err
+}
+
+func (p RoomPolicy) bufferSec() int64 {
+	if p.BufferMin == nil {
+		return 0
+	}
+	return int64(*p.BufferMin) * 60
+}
+
+// policyViolation is a 422 naming the rule that was broken and its limit.
+func policyViolation(rule string, limit any, msg string) error {
+	return &clientError{msg: msg, code: http.StatusUnprocessableEntity, details: map[string]any{"policy": rule, "limit": limit}}
+}
+
+// check validates a booking [start,end) made at now. Business hours are
+// evaluated in loc.
+func (p RoomPolicy) check(start, end, now time.Time, loc *time.Location) error {
+	minutes := int(end.Sub(start) / time.Minute)
+	if p.MinDurationMin != nil && minutes < *p.MinDurationMin {
+		return policyViolation("min_duration", *p.MinDurationMin,
+			fmt.Sprintf("booking is %d minutes, this room requires at least %d", minutes, *p.MinDurationMin))
+	}
+	if p.MaxDurationMin != nil && minutes > *p.MaxDurationMin {
+		return policyViolation("max_duration", *p.MaxDurationMin,
+			fmt.Sprintf("booking is %d minutes, this room allows at most %d", minutes, *p.MaxDurationMin))
+	}
+	if p.LeadTimeMin != nil && start.Before(now.Add(time.Duration(*p.LeadTimeMin)*time.Minute)) {
+		return policyViolation("lead_time", *p.LeadTimeMin,
+			fmt.Sprintf("this room must be booked at least %d minutes in advance", *p.LeadTimeMin))
+	}
+	if p.MaxAdvanceDays != nil && start.After(now.AddDate(0, 0, *p.MaxAdvanceDays)) {
+		return policyViolation("max_advance", *p.MaxAdvanceDays,
+			fmt.Sprintf("this room can be booked at most %d days in advance", *p.MaxAdvanceDays))
+	}
+	oh, ok, err := p.hours()
+	if err != nil {
+		return err
+	}
+	if ok && !oh.contains(start, end, loc) {
+		return policyViolation("business_hours", oh.String(),
+			fmt.Sprintf("booking must fall within business hours %s", oh.String()))
+	}
+	return nil
+}
+
+// contains reports whether [start,end) lies inside a single opening window.
+func (oh openingHours) contains(start, end time.Time, loc *time.Location) bool {
+	s := start.In(loc)
+	day := time.Date(s.Year(), s.Month(), s.Day(), 0, 0, 0, 0, loc)
+	if !oh.Days[day.Weekday()] {
+		return false
+	}
+	ws, we := oh.window(day)
+	return !start.Before(ws) && !end.After(we)
+}
+
+// roomPolicy loads the policy of a room; a room without one gets the zero policy.
+func roomPolicy(ctx context.Context, q dbtx, roomID string) (RoomPolicy, error) {
+	var p RoomPolicy
+	var minD, maxD, lead, adv, buf sql.NullInt64
+	var hours, days sql.NullString
+	err := q.QueryRowContext(ctx, `SELECT min_duration_min, max_duration_min, lead_time_min, max_advance_days, buffer_min, business_hours, business_days
+		FROM room_policies WHERE room_id = ?`, roomID).Scan(&minD, &maxD, &lead, &adv, &buf, &hours, &days)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	p.MinDurationMin = nullIntPtr(minD)
+	p.MaxDurationMin = nullIntPtr(maxD)
+	p.LeadTimeMin = nullIntPtr(lead)
+	p.MaxAdvanceDays = nullIntPtr(adv)
+	p.BufferMin = nullIntPtr(buf)
+	p.BusinessHours = hours.String
+	p.BusinessDays = days.String
+	return p, nil
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
+
+// checkRoomPolicyConn loads the room policy and checks one booking against it
+// in the room's zone.
+func checkRoomPolicyConn(ctx context.Context, q dbtx, roomID string, start, end time.Time) error {
+	p, err := roomPolicy(ctx, q, roomID)
+	if err != nil {
+		return err
+	}
+	loc, err := roomLocation(ctx, q, roomID)
+	if err != nil {
+		return err
+	}
+	return p.check(start, end, time.Now(), loc)
+}
+
+func saveRoomPolicy(ctx context.Context, q dbtx, roomID string, p RoomPolicy) error {
+	if p.empty() {
+		_, err := q.ExecContext(ctx, `DELETE FROM room_policies WHERE room_id = ?`, roomID)
+		return err
+	}
+	_, err := q.ExecContext(ctx, `INSERT INTO room_policies(room_id, min_duration_min, max_duration_min, lead_time_min, max_advance_days, buffer_min, business_hours, business_days)
+		VALUES(?,?,?,?,?,?,?,?)
+		ON CONFLICT(room_id) DO UPDATE SET min_duration_min=excluded.min_duration_min, max_duration_min=excluded.max_duration_min,
+			lead_time_min=excluded.lead_time_min, max_advance_days=excluded.max_advance_days, buffer_min=excluded.buffer_min,
+			business_hours=excluded.business_hours, business_days=excluded.business_days`,
+		roomID, p.MinDurationMin, p.MaxDurationMin, p.LeadTimeMin, p.MaxAdvanceDays, p.BufferMin,
+		nullIfEmpty(p.BusinessHours), nullIfEmpty(p.BusinessDays))
+	return err
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// GET /rooms/{id}/policy
+func (a *App) getRoomPolicy(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !a.roomExists(r.Context(), id) {
+		notFound(w)
+		return
+	}
+	p, err := roomPolicy(r.Context(), a.db, id)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// PUT /rooms/{id}/policy replaces the whole policy; {} removes it.
+func (a *App) putRoomPolicy(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var p RoomPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		badRequest(w, "invalid JSON body")
+		return
+	}
+	if err := p.validate(); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if !a.roomExists(r.Context(), id) {
+		notFound(w)
+		return
+	}
+	if err := saveRoomPolicy(r.Context(), a.db, id, p); err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a *App) roomExists(ctx context.Context, id string) bool {
+	var x string
+	return a.db.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, id).Scan(&x) == nil
+}
+
+// normalizeEquipment lower-cases, trims and de-duplicates equipment tags.
+func normalizeEquipment(in []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, e := range in {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" && !seen[e] {
+			seen[e] = true
+			out = append(out, e)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func setRoomEquipment(ctx context.Context, q dbtx, roomID string, equipment []string) error {
+	if _, err := q.ExecContext(ctx, `DELETE FROM room_equipment WHERE room_id = ?`, roomID); err != nil {
+		return err
+	}
+	for _, e := range equipment {
+		if _, err := q.ExecContext(ctx, `INSERT INTO room_equipment(room_id, name) VALUES(?,?)`, roomID, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRoomExtras fills in equipment and policy for a batch of rooms.
+func loadRoomExtras(ctx context.Context, q dbtx, rooms []Room) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+	idx := make(map[string]int, len(rooms))
+	args := make([]any, len(rooms))
+	for i := range rooms {
+		idx[rooms[i].ID] = i
+		args[i] = rooms[i].ID
+		rooms[i].Equipment = []string{}
+	}
+	in := strings.TrimSuffix(strings.Repeat("?,", len(rooms)), ",")
+
+	rows, err := q.QueryContext(ctx, `SELECT room_id, name FROM room_equipment WHERE room_id IN (`+in+`) ORDER BY name`, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var roomID, name string
+		if err := rows.Scan(&roomID, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		rm := &rooms[idx[roomID]]
+		rm.Equipment = append(rm.Equipment, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ids, err := queryStrings(ctx, q, `SELECT room_id FROM room_policies WHERE room_id IN (`+in+`)`, args...)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		p, err := roomPolicy(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		rooms[idx[id]].Policy = &p
+	}
+	return nil
+}
+
+// equipmentFilter returns a WHERE fragment requiring every listed tag.
+func equipmentFilter(tags []string) (string, []any) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	args := make([]any, 0, len(tags)+1)
+	for _, t := range tags {
+		args = append(args, t)
+	}
+	args = append(args, len(tags))
+	return `id IN (SELECT room_id FROM room_equipment WHERE name IN (` +
+		strings.TrimSuffix(strings.Repeat("?,", len(tags)), ",") +
+		`) GROUP BY room_id HAVING COUNT(*) = ?)`, args
+}
+
+// splitList reads repeated and comma separated query values.
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// Reports: GET /reports/utilization
+// ------------------------------------------------------------
+//
+// Booked time counts CONFIRMED and DONE bookings. Utilization is booked time
+// inside opening hours divided by opening hours (room business hours, else
+// OPEN_HOURS / OPEN_DAYS), both evaluated in the room's zone. The heatmap
+// covers all booked time by the room's local weekday and hour. Rates use the
+// bookings starting in the window: a PENDING booking whose hold expired
+// (status_reason EXPIRED) counts as an expired hold, any other CANCELLED
+// booking as a cancellation. A DONE booking has ended; the no-show rate is
+// the share of those that were never checked in (status_reason NO_SHOW).
+// Guest rates only cover the rooms in the report.
+
+const maxReportWindow = 366 * 24 * time.Hour
+
+// heatmapDays is the row order of heatmaps: Monday first.
+var heatmapDays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+type UtilizationPeriod struct {
+	Start          string  `json:"start"`
+	End            string  `json:"end"`
+	BookedHours    float64 `json:"booked_hours"`
+	AvailableHours float64 `json:"available_hours"`
+	Utilization    float64 `json:"utilization"` // 0..1, 0 when nothing was open
+}
+
+type HeatmapRow struct {
+	Weekday string      `json:"weekday"` // MO..SU
+	Hours   [24]float64 `json:"hours"`   // booked hours starting in each local hour
+}
+
+type BookingRates struct {
+	Bookings         int     `json:"bookings"`
+	Cancelled        int     `json:"cancelled"`
+	ExpiredHolds     int     `json:"expired_holds"`
+	Ended            int     `json:"ended"`    // DONE
+	NoShows          int     `json:"no_shows"` // DONE without check-in
+	CancellationRate float64 `json:"cancellation_rate"`
+	ExpiredHoldRate  float64 `json:"expired_hold_rate"`
+	NoShowRate       float64 `json:"no_show_rate"` // of ended bookings
+}
+
+type RoomUtilization struct {
+	RoomID         string              `json:"room_id"`
+	RoomNo         string              `json:"room_no"`
+	TimeZone       string              `json:"time_zone"`
+	BookedHours    float64             `json:"booked_hours"`
+	AvailableHours float64             `json:"available_hours"`
+	Utilization    float64             `json:"utilization"`
+	Periods        []UtilizationPeriod `json:"periods"`
+	Heatmap        []HeatmapRow        `json:"heatmap"`
+	Rates          BookingRates        `json:"rates"`
+}
+
+type GuestRates struct {
+	GuestID string `json:"guest_id"`
+	Name    string `json:"name"`
+	BookingRates
+}
+
+type UtilizationReport struct {
+	From           string            `json:"from"`
+	To             string            `json:"to"`
+	Granularity    string            `json:"granularity"`
+	BookedHours    float64           `json:"booked_hours"`
+	AvailableHours float64           `json:"available_hours"`
+	Utilization    float64           `json:"utilization"`
+	Heatmap        []HeatmapRow      `json:"heatmap"` // all rooms together
+	Rooms          []RoomUtilization `json:"rooms"`
+	Guests         []GuestRates      `json:"guests"`
+}
+
+// GET /reports/utilization?from=&to=&granularity=day|week&tz=&room_id=a,b
+// &format=json|csv&table=rooms|periods|heatmap|guests
+func (a *App) utilizationReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tz, err := tzParam(r)
+	if err != nil {
+		writeClientError(w, err.(*clientError))
+		return
+	}
+	from, err := parseTimeIn(q.Get("from"), tz)
+	if err != nil {
+		badRequest(w, timeFieldErr("from", err))
+		return
+	}
+	to, err := parseTimeIn(q.Get("to"), tz)
+	if err != nil {
+		badRequest(w, timeFieldErr("to", err))
+		return
+	}
+	if !to.After(from) {
+		badRequest(w, "to must be after from")
+		return
+	}
+	if to.Sub(from) > maxReportWindow {
+		badRequest(w, "window too large (max 366 days)")
+		return
+	}
+	granularity := strings.ToLower(q.Get("granularity"))
+	if granularity == "" {
+		granularity = "day"
+	}
+	if granularity != "day" && granularity != "week" {
+		badRequest(w, `granularity must be "day" or "week"`)
+		return
+	}
+	format := strings.ToLower(q.Get("format"))
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format != "" && format != "json" && format != "csv" {
+		badRequest(w, `format must be "json" or "csv"`)
+		return
+	}
+	table := strings.ToLower(q.Get("table"))
+	if table == "" {
+		table = "rooms"
+	}
+	if format == "csv" && !map[string]bool{"rooms": true, "periods": true, "heatmap": true, "guests": true}[table] {
+		badRequest(w, "table must be one of rooms, periods, heatmap, guests")
+		return
+	}
+	// periods are cut in ?tz=, else UTC
+	loc := tz
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	roomIDs := splitList(q["room_id"])
+	rooms, err := a.roomsForAvailability(r, 0, roomIDs, nil)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if len(roomIDs) > 0 && len(rooms) != len(uniqueStrings(roomIDs)) {
+		writeError(w, http.StatusNotFound, "some room_id not found")
+		return
+	}
+
+	rep, err := a.buildUtilization(r, rooms, from, to, granularity, loc)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if format == "csv" {
+		writeUtilizationCSV(w, rep, table)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func (a *App) buildUtilization(r *http.Request, rooms []Room, from, to time.Time, granularity string, loc *time.Location) (UtilizationReport, error) {
+	ctx := r.Context()
+	rep := UtilizationReport{
+		From:        formatIn(from.Unix(), loc),
+		To:          formatIn(to.Unix(), loc),
+		Granularity: granularity,
+		Heatmap:     newHeatmap(),
+		Rooms:       []RoomUtilization{},
+		Guests:      []GuestRates{},
+	}
+
+	// booked time per room
+	booked := map[string][]span{}
+	rows, err := a.db.QueryContext(ctx, `SELECT room_id, starts_at, ends_at FROM bookings
+		WHERE status IN ('CONFIRMED','DONE') AND starts_at < ? AND ends_at > ?
+		ORDER BY room_id, starts_at`, to.Unix(), from.Unix())
+	if err != nil {
+		return rep, err
+	}
+	for rows.Next() {
+		var roomID string
+		var s span
+		if err := rows.Scan(&roomID, &s.StartSec, &s.EndSec); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		booked[roomID] = append(booked[roomID], span{StartSec: max(s.StartSec, from.Unix()), EndSec: min(s.EndSec, to.Unix())})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+
+	// outcomes of bookings starting in the window, per room and guest
+	roomRates := map[string]*BookingRates{}
+	guestRates := map[string]*GuestRates{}
+	outcomeSQL := `SELECT b.room_id, b.guest_id, IFNULL(g.name, ''), b.status, IFNULL(b.status_reason, ''), COUNT(*)
+		FROM bookings b LEFT JOIN guests g ON g.id = b.guest_id
+		WHERE b.starts_at >= ? AND b.starts_at < ?`
+	args := []any{from.Unix(), to.Unix()}
+	if len(rooms) > 0 {
+		// only the rooms in the report, so ?room_id= narrows the guest rates too
+		outcomeSQL += ` AND b.room_id IN (` + strings.TrimSuffix(strings.Repeat("?,", len(rooms)), ",") + `)`
+		for _, rm := range rooms {
+			args = append(args, rm.ID)
+		}
+	}
+	rows, err = a.db.QueryContext(ctx, outcomeSQL+` GROUP BY b.room_id, b.guest_id, b.status, b.status_reason`, args...)
+	if err != nil {
+		return rep, err
+	}
+	for rows.Next() {
+		var roomID, guestID, name, status, reason string
+		var n int
+		if err := rows.Scan(&roomID, &guestID, &name, &status, &reason, &n); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		if roomRates[roomID] == nil {
+			roomRates[roomID] = &BookingRates{}
+		}
+		if guestRates[guestID] == nil {
+			guestRates[guestID] = &GuestRates{GuestID: guestID, Name: name}
+		}
+		roomRates[roomID].add(status, reason, n)
+		guestRates[guestID].add(status, reason, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+
+	periods := reportPeriods(from, to, granularity, loc)
+	var totalBooked, totalOpen int64
+	for _, rm := range rooms {
+		hours := a.hours
+		if rm.Policy != nil {
+			if oh, ok, _ := rm.Policy.hours(); ok {
+				hours = oh
+			}
+		}
+		roomLoc := rm.location()
+		open := hours.windows(from, to, roomLoc)
+		busy := mergeSpans(booked[rm.ID])
+		bookedOpen := intersectSpans(open, busy)
+
+		ru := RoomUtilization{
+			RoomID:   rm.ID,
+			RoomNo:   rm.RoomNo,
+			TimeZone: roomLoc.String(),
+			Periods:  make([]UtilizationPeriod, 0, len(periods)),
+			Heatmap:  newHeatmap(),
+		}
+		for _, p := range periods {
+			b, o := spanSeconds(bookedOpen, p), spanSeconds(open, p)
+			ru.Periods = append(ru.Periods, UtilizationPeriod{
+				Start:          formatIn(p.StartSec, loc),
+				End:            formatIn(p.EndSec, loc),
+				BookedHours:    hoursOf(b),
+				AvailableHours: hoursOf(o),
+				Utilization:    ratio(b, o),
+			})
+		}
+		b, o := spanSeconds(bookedOpen, span{from.Unix(), to.Unix()}), spanSeconds(open, span{from.Unix(), to.Unix()})
+		ru.BookedHours, ru.AvailableHours, ru.Utilization = hoursOf(b), hoursOf(o), ratio(b, o)
+		totalBooked += b
+		totalOpen += o
+
+		for _, s := range busy {
+			addToHeatmap(ru.Heatmap, s, roomLoc)
+			addToHeatmap(rep.Heatmap, s, roomLoc)
+		}
+		roundHeatmap(ru.Heatmap)
+		if rr := roomRates[rm.ID]; rr != nil {
+			ru.Rates = rr.finish()
+		}
+		rep.Rooms = append(rep.Rooms, ru)
+	}
+	roundHeatmap(rep.Heatmap)
+	rep.BookedHours, rep.AvailableHours, rep.Utilization = hoursOf(totalBooked), hoursOf(totalOpen), ratio(totalBooked, totalOpen)
+
+	for _, g := range guestRates {
+		g.BookingRates = g.BookingRates.finish()
+		rep.Guests = append(rep.Guests, *g)
+	}
+	sort.Slice(rep.Guests, func(i, j int) bool {
+		if rep.Guests[i].Bookings != rep.Guests[j].Bookings {
+			return rep.Guests[i].Bookings > rep.Guests[j].Bookings
+		}
+		return rep.Guests[i].GuestID < rep.Guests[j].GuestID
+	})
+	return rep, nil
+}
+
+func (br *BookingRates) add(status, reason string, n int) {
+	br.Bookings += n
+	switch {
+	case status == "CANCELLED" && reason == "EXPIRED":
+		br.ExpiredHolds += n
+	case status == "CANCELLED":
+		br.Cancelled += n
+	case status == "DONE":
+		br.Ended += n
+		if reason == "NO_SHOW" {
+			br.NoShows += n
+		}
+	}
+}
+
+func (br BookingRates) finish() BookingRates {
+	br.CancellationRate = ratio(int64(br.Cancelled), int64(br.Bookings))
+	br.ExpiredHoldRate = ratio(int64(br.ExpiredHolds), int64(br.Bookings))
+	br.NoShowRate = ratio(int64(br.NoShows), int64(br.Ended))
+	return br
+}
+
+// reportPeriods cuts [from,to) at local midnights (day) or Monday midnights
+// (week) in loc; the first and last period may be partial.
+func reportPeriods(from, to time.Time, granularity string, loc *time.Location) []span {
+	f := from.In(loc)
+	start := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc)
+	step := 1
+	if granularity == "week" {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		step = 7
+	}
+	var out []span
+	for p := start; p.Before(to); p = p.AddDate(0, 0, step) {
+		next := p.AddDate(0, 0, step)
+		out = append(out, span{StartSec: max(p.Unix(), from.Unix()), EndSec: min(next.Unix(), to.Unix())})
+	}
+	return out
+}
+
+// mergeSpans sorts spans and joins overlapping or touching ones.
+func mergeSpans(in []span) []span {
+	sort.Slice(in, func(i, j int) bool { return in[i].StartSec < in[j].StartSec })
+	var out []span
+	for _, s := range in {
+		if n := len(out); n > 0 && s.StartSec <= out[n-1].EndSec {
+			out[n-1].EndSec = max(out[n-1].EndSec, s.EndSec)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// spanSeconds is the length of spans inside w.
+func spanSeconds(spans []span, w span) int64 {
+	var n int64
+	for _, s := range spans {
+		if e, b := min(s.EndSec, w.EndSec), max(s.StartSec, w.StartSec); e > b {
+			n += e - b
+		}
+	}
+	return n
+}
+
+func newHeatmap() []HeatmapRow {
+	out := make([]HeatmapRow, len(heatmapDays))
+	for i, d := range heatmapDays {
+		out[i].Weekday = weekdayCode(d)
+	}
+	return out
+}
+
+// addToHeatmap spreads s over the local weekday/hour cells it covers.
+func addToHeatmap(hm []HeatmapRow, s span, loc *time.Location) {
+	for t := s.StartSec; t < s.EndSec; {
+		lt := time.Unix(t, 0).In(loc)
+		next := time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour()+1, 0, 0, 0, loc).Unix()
+		if next <= t { // DST fall-back repeats an hour
+			next = t + 3600 - int64(lt.Minute()*60+lt.Second())
+		}
+		end := min(next, s.EndSec)
+		row := (int(lt.Weekday()) + 6) % 7
+		hm[row].Hours[lt.Hour()] += float64(end-t) / 3600
+		t = end
+	}
+}
+
+func roundHeatmap(hm []HeatmapRow) {
+	for i := range hm {
+		for h := range hm[i].Hours {
+			hm[i].Hours[h] = round(hm[i].Hours[h], 2)
+		}
+	}
+}
+
+func hoursOf(sec int64) float64 { return round(float64(sec)/3600, 2) }
+
+func ratio(n, d int64) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return round(float64(n)/float64(d), 4)
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// writeUtilizationCSV writes one table of the report; a CSV file cannot
+// hold the nested JSON shape.
+func writeUtilizationCSV(w http.ResponseWriter, rep UtilizationReport, table string) {
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	rates := func(br BookingRates) []string {
+		return []string{strconv.Itoa(br.Bookings), strconv.Itoa(br.Cancelled), strconv.Itoa(br.ExpiredHolds), strconv.Itoa(br.Ended), strconv.Itoa(br.NoShows),
+			num(br.CancellationRate), num(br.ExpiredHoldRate), num(br.NoShowRate)}
+	}
+	rateHeader := []string{"bookings", "cancelled", "expired_holds", "ended", "no_shows", "cancellation_rate", "expired_hold_rate", "no_show_rate"}
+
+	var records [][]string
+	switch table {
+	case "rooms":
+		records = append(records, append([]string{"room_id", "room_no", "time_zone", "booked_hours", "available_hours", "utilization"}, rateHeader...))
+		for _, ru := range rep.Rooms {
+			records = append(records, append([]string{ru.RoomID, ru.RoomNo, ru.TimeZone, num(ru.BookedHours), num(ru.AvailableHours), num(ru.Utilization)}, rates(ru.Rates)...))
+		}
+	case "periods":
+		records = append(records, []string{"room_id", "room_no", "start", "end", "booked_hours", "available_hours", "utilization"})
+		for _, ru := range rep.Rooms {
+			for _, p := range ru.Periods {
+				records = append(records, []string{ru.RoomID, ru.RoomNo, p.Start, p.End, num(p.BookedHours), num(p.AvailableHours), num(p.Utilization)})
+			}
+		}
+	case "heatmap":
+		records = append(records, []string{"room_id", "room_no", "weekday", "hour", "booked_hours"})
+		add := func(id, no string, hm []HeatmapRow) {
+			for _, row := range hm {
+				for h, v := range row.Hours {
+					records = append(records, []string{id, no, row.Weekday, strconv.Itoa(h), num(v)})
+				}
+			}
+		}
+		add("", "ALL", rep.Heatmap)
+		for _, ru := range rep.Rooms {
+			add(ru.RoomID, ru.RoomNo, ru.Heatmap)
+		}
+	case "guests":
+		records = append(records, append([]string{"guest_id", "name"}, rateHeader...))
+		for _, g := range rep.Guests {
+			records = append(records, append([]string{g.GuestID, g.Name}, rates(g.BookingRates)...))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="utilization-%s.csv"`, table))
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(records)
+}
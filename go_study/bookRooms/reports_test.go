@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestUtilizationRatesFollowRoomFilter(t *testing.T) {
+	app := newTestApp(t)
+	for _, s := range []string{
+		`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r1', '101', 2, '2030-01-01T00:00:00Z')`,
+		`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r2', '102', 2, '2030-01-01T00:00:00Z')`,
+		`INSERT INTO guests(id, name, created_at) VALUES('g1', 'Ann', '2030-01-01T00:00:00Z')`,
+	} {
+		if _, err := app.db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, end := slot(9, 10)
+	for _, b := range []struct{ id, room, status, reason string }{
+		{"b1", "r1", "CONFIRMED", ""},
+		{"b2", "r1", "CANCELLED", ""},
+		{"b3", "r2", "CANCELLED", "EXPIRED"},
+	} {
+		if _, err := app.db.Exec(`INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, status_reason, created_at) VALUES(?,?,'g1',?,?,?,NULLIF(?, ''),'2030-01-01T00:00:00Z')`,
+			b.id, b.room, start.Unix(), end.Unix(), b.status, b.reason); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	app.utilizationReport(w, httptest.NewRequest(http.MethodGet, "/reports/utilization?from=2030-01-07T00:00:00Z&to=2030-01-08T00:00:00Z&room_id=r1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var rep UtilizationReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Guests) != 1 {
+		t.Fatalf("guests: %+v", rep.Guests)
+	}
+	if g := rep.Guests[0]; g.Bookings != 2 || g.Cancelled != 1 || g.ExpiredHolds != 0 {
+		t.Errorf("guest rates include other rooms: %+v", g)
+	}
+
+	w = httptest.NewRecorder()
+	app.utilizationReport(w, httptest.NewRequest(http.MethodGet, "/reports/utilization?from=2030-01-07T00:00:00Z&to=2030-01-08T00:00:00Z", nil))
+	rep = UtilizationReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if g := rep.Guests[0]; g.Bookings != 3 || g.ExpiredHolds != 1 || g.ExpiredHoldRate <= 0 {
+		t.Errorf("all rooms: %+v", g)
+	}
+}
+
+func checkIn(app *App, id string) *httptest.ResponseRecorder {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	r := httptest.NewRequest(http.MethodPost, "/bookings/"+id+"/check-in", nil)
+	w := httptest.NewRecorder()
+	app.checkInBooking(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+	return w
+}
+
+func TestNoShowsByGuestAndRoom(t *testing.T) {
+	app := newTestApp(t)
+	now := time.Now().Truncate(time.Second)
+	for _, s := range []string{
+		`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r1', '101', 2, '2030-01-01T00:00:00Z')`,
+		`INSERT INTO rooms(id, room_no, capacity, created_at) VALUES('r2', '102', 2, '2030-01-01T00:00:00Z')`,
+		`INSERT INTO guests(id, name, created_at) VALUES('g1', 'Ann', '2030-01-01T00:00:00Z')`,
+		`INSERT INTO guests(id, name, created_at) VALUES('g2', 'Bob', '2030-01-01T00:00:00Z')`,
+	} {
+		if _, err := app.db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, b := range []struct {
+		id, room, guest, status string
+		startMin                int
+	}{
+		{"b1", "r1", "g1", "CONFIRMED", -10}, // checked in
+		{"b2", "r2", "g2", "CONFIRMED", 10},  // check-in window open, never used
+		{"b3", "r1", "g2", "CONFIRMED", 120}, // too early to check in
+		{"b4", "r2", "g1", "PENDING", -10},
+	} {
+		start := now.Add(time.Duration(b.startMin) * time.Minute)
+		if _, err := app.db.Exec(`INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, created_at) VALUES(?,?,?,?,?,?,'2030-01-01T00:00:00Z')`,
+			b.id, b.room, b.guest, start.Unix(), start.Add(time.Hour).Unix(), b.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := checkIn(app, "b1")
+	var b Booking
+	if err := json.Unmarshal(w.Body.Bytes(), &b); w.Code != http.StatusOK || err != nil || b.CheckedInAt == "" {
+		t.Fatalf("check-in: %d %s", w.Code, w.Body)
+	}
+	for _, id := range []string{"b1", "b3", "b4"} {
+		if w := checkIn(app, id); w.Code != http.StatusConflict {
+			t.Errorf("check-in %s: %d %s", id, w.Code, w.Body)
+		}
+	}
+	if w := checkIn(app, "missing"); w.Code != http.StatusNotFound {
+		t.Errorf("check-in missing: %d", w.Code)
+	}
+
+	if err := app.lifecycleTick(context.Background(), now.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"b1": "", "b2": "NO_SHOW", "b3": "NO_SHOW"} {
+		got, err := app.store.GetBooking(context.Background(), id)
+		if err != nil || got.Status != "DONE" || got.StatusReason != want {
+			t.Errorf("%s: %+v %v", id, got, err)
+		}
+	}
+
+	q := url.Values{"from": {now.Add(-time.Hour).Format(time.RFC3339)}, "to": {now.Add(5 * time.Hour).Format(time.RFC3339)}}
+	w = httptest.NewRecorder()
+	app.utilizationReport(w, httptest.NewRequest(http.MethodGet, "/reports/utilization?"+q.Encode(), nil))
+	var rep UtilizationReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("report: %d %s", w.Code, w.Body)
+	}
+	rooms := map[string]BookingRates{}
+	for _, ru := range rep.Rooms {
+		rooms[ru.RoomID] = ru.Rates
+	}
+	if r := rooms["r1"]; r.Ended != 2 || r.NoShows != 1 || r.NoShowRate != 0.5 {
+		t.Errorf("r1: %+v", r)
+	}
+	if r := rooms["r2"]; r.Bookings != 2 || r.Ended != 1 || r.NoShows != 1 || r.NoShowRate != 1 {
+		t.Errorf("r2: %+v", r)
+	}
+	guests := map[string]BookingRates{}
+	for _, g := range rep.Guests {
+		guests[g.GuestID] = g.BookingRates
+	}
+	if g := guests["g1"]; g.Ended != 1 || g.NoShows != 0 || g.NoShowRate != 0 {
+		t.Errorf("g1: %+v", g)
+	}
+	if g := guests["g2"]; g.Ended != 2 || g.NoShows != 2 || g.NoShowRate != 1 {
+		t.Errorf("g2: %+v", g)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// RRULE (RFC 5545 subset)
+// ------------------------------------------------------------
+//
+// Supported parts: FREQ=DAILY|WEEKLY|MONTHLY, INTERVAL, COUNT, UNTIL,
+// BYDAY (plain weekdays, no ordinals) and BYMONTHDAY (MONTHLY only,
+// negative values count from the end of the month). Week starts on Monday.
+
+const maxOccurrences = 500
+
+type rrule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time // zero when not set
+	ByDay      []time.Weekday
+	ByMonthDay []int
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+func weekdayCode(d time.Weekday) string {
+	for k, v := range weekdayCodes {
+		if v == d {
+			return k
+		}
+	}
+	return ""
+}
+
+func parseRRule(s string) (*rrule, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, fmt.Errorf("rrule is empty")
+	}
+	rr := &rrule{Interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("rrule: malformed part %q", part)
+		}
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			rr.Freq = strings.ToUpper(v)
+			if rr.Freq != "DAILY" && rr.Freq != "WEEKLY" && rr.Freq != "MONTHLY" {
+				return nil, fmt.Errorf("rrule: FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("rrule: INTERVAL must be a positive integer")
+			}
+			rr.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("rrule: COUNT must be a positive integer")
+			}
+			rr.Count = n
+		case "UNTIL":
+			t, err := parseRRuleTime(v)
+			if err != nil {
+				return nil, err
+			}
+			rr.Until = t
+		case "BYDAY":
+			for _, d := range strings.Split(v, ",") {
+				wd, ok := weekdayCodes[strings.ToUpper(strings.TrimSpace(d))]
+				if !ok {
+					return nil, fmt.Errorf("rrule: unsupported BYDAY value %q", d)
+				}
+				if !containsWeekday(rr.ByDay, wd) { // MO,MO is one Monday
+					rr.ByDay = append(rr.ByDay, wd)
+				}
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(v, ",") {
+				n, err := strconv.Atoi(strings.TrimSpace(d))
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("rrule: invalid BYMONTHDAY value %q", d)
+				}
+				if !containsInt(rr.ByMonthDay, n) {
+					rr.ByMonthDay = append(rr.ByMonthDay, n)
+				}
+			}
+		case "WKST":
+			if strings.ToUpper(v) != "MO" {
+				return nil, fmt.Errorf("rrule: only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("rrule: unsupported part %q", k)
+		}
+	}
+	if rr.Freq == "" {
+		return nil, fmt.Errorf("rrule: FREQ is required")
+	}
+	if rr.Count > 0 && !rr.Until.IsZero() {
+		return nil, fmt.Errorf("rrule: COUNT and UNTIL are mutually exclusive")
+	}
+	if rr.Count == 0 && rr.Until.IsZero() {
+		return nil, fmt.Errorf("rrule: COUNT or UNTIL is required")
+	}
+	if len(rr.ByMonthDay) > 0 && rr.Freq != "MONTHLY" {
+		return nil, fmt.Errorf("rrule: BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	if len(rr.ByDay) > 0 && rr.Freq == "MONTHLY" {
+		return nil, fmt.Errorf("rrule: BYDAY is not supported with FREQ=MONTHLY")
+	}
+	return rr, nil
+}
+
+// UNTIL accepts the RFC 5545 forms (20250131T235959Z, 20250131) and RFC3339.
+func parseRRuleTime(v string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("20060102", v); err == nil {
+		// a date-only UNTIL includes the whole day
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	if t, err := parseRFC3339(v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("rrule: invalid UNTIL %q", v)
+}
+
+func (rr *rrule) String() string {
+	parts := []string{"FREQ=" + rr.Freq}
+	if rr.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rr.Interval))
+	}
+	if rr.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rr.Count))
+	}
+	if !rr.Until.IsZero() {
+		parts = append(parts, "UNTIL="+rr.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(rr.ByDay) > 0 {
+		days := make([]string, len(rr.ByDay))
+		for i, d := range rr.ByDay {
+			days[i] = weekdayCode(d)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(rr.ByMonthDay) > 0 {
+		days := make([]string, len(rr.ByMonthDay))
+		for i, d := range rr.ByMonthDay {
+			days[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// expand returns the occurrence start times of the rule. Wall-clock times are
+// computed in dtstart's location, so the series keeps its local time of day.
+// DTSTART is always the first occurrence, as in RFC 5545.
+func (rr *rrule) expand(dtstart time.Time) ([]time.Time, error) {
+	out := []time.Time{dtstart}
+	done := func(t time.Time) bool {
+		if rr.Count > 0 && len(out) >= rr.Count {
+			return true
+		}
+		return !rr.Until.IsZero() && t.After(rr.Until)
+	}
+	add := func(t time.Time) error {
+		if !t.After(dtstart) {
+			return nil
+		}
+		if len(out) >= maxOccurrences {
+			return fmt.Errorf("rrule expands to more than %d occurrences", maxOccurrences)
+		}
+		out = append(out, t)
+		return nil
+	}
+	if done(dtstart) {
+		return out, nil
+	}
+
+	y, m, d := dtstart.Date()
+	hh, mm, ss := dtstart.Clock()
+	loc := dtstart.Location()
+	at := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, hh, mm, ss, 0, loc) }
+
+	// iterate period by period (day / week / month) until the rule is exhausted
+	for period := 0; ; period++ {
+		var candidates []time.Time
+		switch rr.Freq {
+		case "DAILY":
+			t := at(y, m, d+period*rr.Interval)
+			if len(rr.ByDay) == 0 || containsWeekday(rr.ByDay, t.Weekday()) {
+				candidates = append(candidates, t)
+			}
+		case "WEEKLY":
+			if len(rr.ByDay) == 0 {
+				candidates = append(candidates, at(y, m, d+7*period*rr.Interval))
+				break
+			}
+			// Monday of dtstart's week, then jump whole weeks
+			offset := (int(dtstart.Weekday()) + 6) % 7
+			monday := d - offset + 7*period*rr.Interval
+			for _, wd := range rr.ByDay {
+				candidates = append(candidates, at(y, m, monday+(int(wd)+6)%7))
+			}
+		case "MONTHLY":
+			first := time.Date(y, m+time.Month(period*rr.Interval), 1, 0, 0, 0, 0, loc)
+			days := rr.ByMonthDay
+			if len(days) == 0 {
+				days = []int{d}
+			}
+			last := daysIn(first.Year(), first.Month())
+			for _, md := range days {
+				day := md
+				if md < 0 {
+					day = last + md + 1
+				}
+				if day < 1 || day > last {
+					continue // e.g. the 31st in a 30-day month is skipped
+				}
+				candidates = append(candidates, at(first.Year(), first.Month(), day))
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for i, t := range candidates {
+			if i > 0 && t.Equal(candidates[i-1]) {
+				continue // BYMONTHDAY=-1,31 in a 31-day month
+			}
+			if done(t) {
+				return out, nil
+			}
+			if err := add(t); err != nil {
+				return nil, err
+			}
+		}
+		if period > 100*maxOccurrences {
+			return out, nil
+		}
+	}
+}
+
+func containsWeekday(list []time.Weekday, d time.Weekday) bool {
+	for _, x := range list {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, x := range list {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+func daysIn(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
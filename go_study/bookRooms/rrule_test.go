@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRuleDuplicateValues(t *testing.T) {
+	dtstart := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC) // a Monday
+	for _, tc := range []struct {
+		rule string
+		want []string
+	}{
+		{"FREQ=WEEKLY;BYDAY=MO,MO,WE;COUNT=4", []string{"2030-01-07", "2030-01-09", "2030-01-14", "2030-01-16"}},
+		{"FREQ=DAILY;BYDAY=MO,MO;COUNT=2", []string{"2030-01-07", "2030-01-14"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1,31,31;COUNT=3", []string{"2030-01-07", "2030-01-31", "2030-02-28"}},
+	} {
+		rr, err := parseRRule(tc.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.rule, err)
+		}
+		got, err := rr.expand(dtstart)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.rule, err)
+		}
+		var dates []string
+		for _, o := range got {
+			dates = append(dates, o.Format("2006-01-02"))
+		}
+		if len(dates) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.rule, dates, tc.want)
+			continue
+		}
+		for i := range dates {
+			if dates[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.rule, dates, tc.want)
+				break
+			}
+		}
+	}
+	if rr, _ := parseRRule("FREQ=WEEKLY;BYDAY=MO,MO;COUNT=2"); rr.String() != "FREQ=WEEKLY;COUNT=2;BYDAY=MO" {
+		t.Errorf("String() = %s", rr.String())
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ------------------------------------------------------------
+// Recurring bookings (series)
+// ------------------------------------------------------------
+
+type Series struct {
+	ID          string    `json:"id"`
+	RoomID      string    `json:"room_id"`
+	GuestID     string    `json:"guest_id"`
+	RRule       string    `json:"rrule"`
+	StartsAt    string    `json:"starts_at"` // first occurrence, RFC3339 in the room's zone
+	EndsAt      string    `json:"ends_at"`
+	TimeZone    string    `json:"time_zone"` // zone the rule is expanded in
+	CreatedAt   string    `json:"created_at"`
+	Occurrences []Booking `json:"occurrences"`
+}
+
+// occurrenceConflict is one entry of the 409 conflict report.
+type occurrenceConflict struct {
+	Date       string   `json:"date"` // YYYY-MM-DD of the occurrence start, room-local
+	StartsAt   string   `json:"starts_at"`
+	EndsAt     string   `json:"ends_at"`
+	BookingIDs []string `json:"conflicting_booking_ids"`
+}
+
+type span struct {
+	StartSec int64
+	EndSec   int64
+}
+
+type createSeriesReq struct {
+	RoomID   string  `json:"room_id"`
+	GuestID  string  `json:"guest_id"`
+	StartsAt string  `json:"starts_at"` // first occurrence
+	EndsAt   string  `json:"ends_at"`
+	RRule    string  `json:"rrule"` // e.g. FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10
+	Status   *string `json:"status"`
+}
+
+func (a *App) createSeries(w http.ResponseWriter, r *http.Request) {
+	var req createSeriesReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, "invalid JSON body")
+		return
+	}
+	if req.RoomID == "" || req.GuestID == "" || req.StartsAt == "" || req.EndsAt == "" || req.RRule == "" {
+		badRequest(w, "room_id, guest_id, starts_at, ends_at, rrule are required")
+		return
+	}
+	loc, err := a.requestLocation(r, req.RoomID)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	startT, err := parseTimeIn(req.StartsAt, loc)
+	if err != nil {
+		badRequest(w, timeFieldErr("starts_at", err))
+		return
+	}
+	endT, err := parseTimeIn(req.EndsAt, loc)
+	if err != nil {
+		badRequest(w, timeFieldErr("ends_at", err))
+		return
+	}
+	if !endT.After(startT) {
+		badRequest(w, "ends_at must be after starts_at")
+		return
+	}
+	rule, err := parseRRule(req.RRule)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	status := "PENDING"
+	if req.Status != nil {
+		status = strings.ToUpper(strings.TrimSpace(*req.Status))
+		if status != "PENDING" && status != "CONFIRMED" {
+			badRequest(w, "status of a new series must be PENDING or CONFIRMED")
+			return
+		}
+	}
+
+	s, err := a.insertSeries(r.Context(), newBooking{RoomID: req.RoomID, GuestID: req.GuestID, Start: startT, End: endT, Status: status}, rule)
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// insertSeries expands rule from the first occurrence nb and stores the
+// series with all occurrences, or none of them if any occurrence conflicts.
+// The rule is expanded in the room's zone, so occurrences keep their local
+// time of day across DST changes.
+func (a *App) insertSeries(ctx context.Context, nb newBooking, rule *rrule) (*Series, error) {
+	loc, err := roomLocation(ctx, a.db, nb.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	starts, err := rule.expand(nb.Start.In(loc))
+	if err != nil {
+		return nil, clientErr(err.Error(), http.StatusBadRequest)
+	}
+	duration := int64(nb.End.Sub(nb.Start) / time.Second)
+	occs := occurrenceSpans(starts, duration)
+	if err := checkSelfOverlap(occs); err != nil {
+		return nil, clientErr(err.Error(), http.StatusBadRequest)
+	}
+
+	seriesID := uuid.New().String()
+	now := time.Now().UTC().Format(time.RFC3339)
+	err = withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		var x string
+		if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, nb.RoomID).Scan(&x); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return clientErr("room not found", http.StatusBadRequest)
+			}
+			return err
+		}
+		if err := guestExistsConn(ctx, conn, nb.GuestID); err != nil {
+			return err
+		}
+		if err := checkOccurrencePoliciesConn(ctx, conn, nb.RoomID, occs); err != nil {
+			return err
+		}
+		if nb.Status == "PENDING" || nb.Status == "CONFIRMED" {
+			if err := checkOccurrencesConn(ctx, conn, nb.RoomID, occs, overlapExclude{}); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.ExecContext(ctx, `INSERT INTO booking_series(id, room_id, guest_id, rrule, starts_at, duration_sec, created_at) VALUES(?,?,?,?,?,?,?)`,
+			seriesID, nb.RoomID, nb.GuestID, rule.String(), occs[0].StartSec, duration, now); err != nil {
+			return err
+		}
+		for _, o := range occs {
+			if _, err := conn.ExecContext(ctx, `INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, created_at, series_id, hold_expires_at, start_offset, end_offset) VALUES(?,?,?,?,?,?,?,?,?,?,?)`,
+				uuid.New().String(), nb.RoomID, nb.GuestID, o.StartSec, o.EndSec, nb.Status, now, seriesID, a.holdFor(nb.Status),
+				offsetAt(o.StartSec, loc), offsetAt(o.EndSec, loc)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s, err := a.loadSeries(ctx, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range s.Occurrences {
+		a.emit(ctx, "booking.created", b)
+	}
+	return s, nil
+}
+
+func (a *App) getSeries(w http.ResponseWriter, r *http.Request) {
+	s, err := a.loadSeries(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound(w)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *App) deleteSeries(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ctx := r.Context()
+	var deleted []bookingRow
+	var promoted []string
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		var err error
+		deleted, err = queryBookingRows(ctx, conn, `SELECT `+bookingColumns+` FROM bookings WHERE series_id = ?`, id)
+		if err != nil {
+			return err
+		}
+		// occurrences go with it (ON DELETE CASCADE)
+		var roomID string
+		err = conn.QueryRowContext(ctx, `DELETE FROM booking_series WHERE id = ? RETURNING room_id`, id).Scan(&roomID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		promoted, err = a.promoteWaitlistConn(ctx, conn, roomID, time.Now())
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	a.emitDeleted(ctx, deleted)
+	a.notifyPromoted(ctx, promoted)
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (a *App) loadSeries(ctx context.Context, id string) (*Series, error) {
+	var s Series
+	var startSec, durSec int64
+	err := a.db.QueryRowContext(ctx, `SELECT s.id, s.room_id, s.guest_id, s.rrule, s.starts_at, s.duration_sec, s.created_at, r.time_zone
+		FROM booking_series s JOIN rooms r ON r.id = s.room_id WHERE s.id = ?`, id).
+		Scan(&s.ID, &s.RoomID, &s.GuestID, &s.RRule, &startSec, &durSec, &s.CreatedAt, &s.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	s.StartsAt = formatIn(startSec, loc)
+	s.EndsAt = formatIn(startSec+durSec, loc)
+
+	rows, err := a.db.QueryContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE series_id = ? ORDER BY starts_at`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	s.Occurrences = []Booking{}
+	for rows.Next() {
+		br, err := scanBookingRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		s.Occurrences = append(s.Occurrences, toBookingDTO(br))
+	}
+	return &s, rows.Err()
+}
+
+func occurrenceSpans(starts []time.Time, durationSec int64) []span {
+	out := make([]span, len(starts))
+	for i, t := range starts {
+		out[i] = span{StartSec: t.Unix(), EndSec: t.Unix() + durationSec}
+	}
+	return out
+}
+
+// occurrences are sorted by start; a booking longer than the recurrence
+// interval would collide with its own next occurrence.
+func checkSelfOverlap(occs []span) error {
+	for i := 1; i < len(occs); i++ {
+		if occs[i].StartSec < occs[i-1].EndSec {
+			return fmt.Errorf("occurrences overlap each other (booking is longer than the recurrence interval)")
+		}
+	}
+	return nil
+}
+
+// checkOccurrencesConn runs the overlap check for every occurrence and
+// returns a 409 clientError listing all conflicting dates.
+func checkOccurrencesConn(ctx context.Context, conn *sql.Conn, roomID string, occs []span, ex overlapExclude) error {
+	loc, err := roomLocation(ctx, conn, roomID)
+	if err != nil {
+		return err
+	}
+	var conflicts []occurrenceConflict
+	for _, o := range occs {
+		ids, err := conflictingBookingsConn(ctx, conn, roomID, o.StartSec, o.EndSec, ex)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		conflicts = append(conflicts, occurrenceConflict{
+			Date:       time.Unix(o.StartSec, 0).In(loc).Format("2006-01-02"),
+			StartsAt:   formatIn(o.StartSec, loc),
+			EndsAt:     formatIn(o.EndSec, loc),
+			BookingIDs: ids,
+		})
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return &clientError{
+		msg:     fmt.Sprintf("%d of %d occurrences overlap existing bookings", len(conflicts), len(occs)),
+		code:    http.StatusConflict,
+		details: map[string]any{"conflicts": conflicts},
+	}
+}
+
+// checkOccurrencePoliciesConn checks every occurrence against the room policy
+// and reports the first one that breaks it.
+func checkOccurrencePoliciesConn(ctx context.Context, conn *sql.Conn, roomID string, occs []span) error {
+	p, err := roomPolicy(ctx, conn, roomID)
+	if err != nil {
+		return err
+	}
+	loc, err := roomLocation(ctx, conn, roomID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, o := range occs {
+		err := p.check(time.Unix(o.StartSec, 0), time.Unix(o.EndSec, 0), now, loc)
+		if ce, ok := err.(*clientError); ok {
+			ce.details["date"] = time.Unix(o.StartSec, 0).In(loc).Format("2006-01-02")
+			ce.msg = "occurrence on " + ce.details["date"].(string) + ": " + ce.msg
+			return ce
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------
+// "This and following" edits
+// ------------------------------------------------------------
+
+const (
+	scopeThis      = "this"
+	scopeFollowing = "following"
+)
+
+// ?scope=this (default) | following
+func parseEditScope(r *http.Request) (string, error) {
+	switch v := strings.ToLower(r.URL.Query().Get("scope")); v {
+	case "", scopeThis:
+		return scopeThis, nil
+	case scopeFollowing:
+		return scopeFollowing, nil
+	default:
+		return "", fmt.Errorf("scope must be %q or %q", scopeThis, scopeFollowing)
+	}
+}
+
+// bookingChange is the target state of an edited occurrence.
+type bookingChange struct {
+	RoomID   string
+	GuestID  string
+	StartSec int64
+	EndSec   int64
+	Status   string
+}
+
+// updateFollowing applies an edit of occurrence cur to it and every later
+// occurrence of its series: the start shift and the new duration are applied
+// to each of them. The shift is applied to the wall clock of the room's zone,
+// so moving 09:00 to 10:00 gives 10:00 on both sides of a DST change. The
+// series is split at cur so earlier occurrences keep the original rule.
+func (a *App) updateFollowing(w http.ResponseWriter, r *http.Request, cur bookingRow, ch bookingChange) {
+	ctx := r.Context()
+	shift := ch.StartSec - cur.StartSec
+	duration := ch.EndSec - ch.StartSec
+
+	var changed, promoted []string
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		loc, err := roomLocation(ctx, conn, ch.RoomID)
+		if err != nil {
+			return err
+		}
+		wallShift := wallClock(ch.StartSec, loc).Sub(wallClock(cur.StartSec, loc))
+		if ch.RoomID != cur.RoomID {
+			var x string
+			if err := conn.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, ch.RoomID).Scan(&x); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return clientErr("room not found", http.StatusBadRequest)
+				}
+				return err
+			}
+		}
+		following, err := seriesOccurrencesConn(ctx, conn, cur.SeriesID, cur.StartSec)
+		if err != nil {
+			return err
+		}
+		occs := make([]span, len(following))
+		for i, b := range following {
+			st := shiftWallClock(b.StartSec, wallShift, loc)
+			occs[i] = span{StartSec: st, EndSec: st + duration}
+		}
+		if err := checkSelfOverlap(occs); err != nil {
+			return clientErr(err.Error(), http.StatusBadRequest)
+		}
+		if ch.GuestID != cur.GuestID {
+			if err := guestExistsConn(ctx, conn, ch.GuestID); err != nil {
+				return err
+			}
+		}
+		if ch.RoomID != cur.RoomID || shift != 0 || duration != cur.EndSec-cur.StartSec {
+			if err := checkOccurrencePoliciesConn(ctx, conn, ch.RoomID, occs); err != nil {
+				return err
+			}
+		}
+		if ch.Status == "PENDING" || ch.Status == "CONFIRMED" {
+			ex := overlapExclude{SeriesID: cur.SeriesID, SeriesFrom: cur.StartSec}
+			if err := checkOccurrencesConn(ctx, conn, ch.RoomID, occs, ex); err != nil {
+				return err
+			}
+		}
+
+		targetSeries, err := splitSeriesConn(ctx, conn, cur.SeriesID, cur.StartSec, len(following), ch, duration)
+		if err != nil {
+			return err
+		}
+		for i, b := range following {
+			if _, err := conn.ExecContext(ctx, `UPDATE bookings SET room_id=?, guest_id=?, starts_at=?, ends_at=?, start_offset=?, end_offset=?, status=?, series_id=?, `+holdUpdateSQL+` WHERE id=?`,
+				ch.RoomID, ch.GuestID, occs[i].StartSec, occs[i].EndSec, offsetAt(occs[i].StartSec, loc), offsetAt(occs[i].EndSec, loc),
+				ch.Status, targetSeries, ch.Status, a.holdFor("PENDING"), b.ID); err != nil {
+				return err
+			}
+			changed = append(changed, b.ID)
+		}
+		promoted, err = a.promoteWaitlistConn(ctx, conn, cur.RoomID, time.Now())
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	a.emitBookings(ctx, false, changed)
+	a.notifyPromoted(ctx, promoted)
+	a.getBooking(w, r)
+}
+
+// deleteFollowing removes occurrence id and every later occurrence of its
+// series, and ends the series rule before it.
+func (a *App) deleteFollowing(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	var deleted []bookingRow
+	var promoted []string
+	err := withImmediateTx(ctx, a.db, func(conn *sql.Conn) error {
+		cur, err := scanBookingRow(conn.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if cur.SeriesID == "" {
+			if _, err := conn.ExecContext(ctx, `DELETE FROM bookings WHERE id = ?`, id); err != nil {
+				return err
+			}
+			deleted = []bookingRow{cur}
+			promoted, err = a.promoteWaitlistConn(ctx, conn, cur.RoomID, time.Now())
+			return err
+		}
+		deleted, err = queryBookingRows(ctx, conn, `DELETE FROM bookings WHERE series_id = ? AND starts_at >= ? RETURNING `+bookingColumns, cur.SeriesID, cur.StartSec)
+		if err != nil {
+			return err
+		}
+		if err := truncateSeriesConn(ctx, conn, cur.SeriesID, cur.StartSec); err != nil {
+			return err
+		}
+		promoted, err = a.promoteWaitlistConn(ctx, conn, cur.RoomID, time.Now())
+		return err
+	})
+	if err != nil {
+		if ce, ok := err.(*clientError); ok {
+			writeClientError(w, ce)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	a.emitDeleted(ctx, deleted)
+	a.notifyPromoted(ctx, promoted)
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func seriesOccurrencesConn(ctx context.Context, conn *sql.Conn, seriesID string, fromSec int64) ([]bookingRow, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE series_id = ? AND starts_at >= ? ORDER BY starts_at`, seriesID, fromSec)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []bookingRow
+	for rows.Next() {
+		br, err := scanBookingRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, br)
+	}
+	return out, rows.Err()
+}
+
+// splitSeriesConn makes the occurrences from fromSec on belong to a series
+// reflecting ch and returns its id. When nothing precedes fromSec the series
+// itself is updated; otherwise the old series is truncated and a new one,
+// with the remaining COUNT (or the same UNTIL), is created.
+func splitSeriesConn(ctx context.Context, conn *sql.Conn, seriesID string, fromSec int64, remaining int, ch bookingChange, duration int64) (string, error) {
+	var ruleStr string
+	if err := conn.QueryRowContext(ctx, `SELECT rrule FROM booking_series WHERE id = ?`, seriesID).Scan(&ruleStr); err != nil {
+		return "", err
+	}
+	rule, err := parseRRule(ruleStr)
+	if err != nil {
+		return "", err
+	}
+	if rule.Count > 0 {
+		rule.Count = remaining
+	}
+
+	var earlier int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM bookings WHERE series_id = ? AND starts_at < ?`, seriesID, fromSec).Scan(&earlier); err != nil {
+		return "", err
+	}
+	if earlier == 0 {
+		_, err := conn.ExecContext(ctx, `UPDATE booking_series SET room_id=?, guest_id=?, rrule=?, starts_at=?, duration_sec=? WHERE id=?`,
+			ch.RoomID, ch.GuestID, rule.String(), ch.StartSec, duration, seriesID)
+		return seriesID, err
+	}
+
+	if err := truncateSeriesConn(ctx, conn, seriesID, fromSec); err != nil {
+		return "", err
+	}
+	newID := uuid.New().String()
+	_, err = conn.ExecContext(ctx, `INSERT INTO booking_series(id, room_id, guest_id, rrule, starts_at, duration_sec, created_at) VALUES(?,?,?,?,?,?,?)`,
+		newID, ch.RoomID, ch.GuestID, rule.String(), ch.StartSec, duration, time.Now().UTC().Format(time.RFC3339))
+	return newID, err
+}
+
+// truncateSeriesConn ends the series rule just before beforeSec, or removes
+// the series when no occurrence is left.
+func truncateSeriesConn(ctx context.Context, conn *sql.Conn, seriesID string, beforeSec int64) error {
+	var left int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM bookings WHERE series_id = ? AND starts_at < ?`, seriesID, beforeSec).Scan(&left); err != nil {
+		return err
+	}
+	if left == 0 {
+		_, err := conn.ExecContext(ctx, `DELETE FROM booking_series WHERE id = ?`, seriesID)
+		return err
+	}
+	var ruleStr string
+	if err := conn.QueryRowContext(ctx, `SELECT rrule FROM booking_series WHERE id = ?`, seriesID).Scan(&ruleStr); err != nil {
+		return err
+	}
+	rule, err := parseRRule(ruleStr)
+	if err != nil {
+		return err
+	}
+	rule.Count = 0
+	rule.Until = time.Unix(beforeSec-1, 0).UTC()
+	_, err = conn.ExecContext(ctx, `UPDATE booking_series SET rrule = ? WHERE id = ?`, rule.String(), seriesID)
+	return err
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ------------------------------------------------------------
+// Booking store
+// ------------------------------------------------------------
+//
+// BookingStore is the single-booking CRUD the HTTP handlers need. Every
+// implementation must refuse overlapping active (PENDING / CONFIRMED)
+// bookings of a room atomically, not just check-then-insert. Errors meant
+// for the client are *clientError:
+//
+//	404 not found                  unknown booking id
+//	400 room not found / guest ... unknown room_id / guest_id
+//	400 ends_at must be after ...  empty or inverted interval
+//	409 booking time overlaps ...  another active booking holds the slot
+//
+// The SQLite store serialises writers with BEGIN IMMEDIATE; the Postgres store
+// (pgstore.go) leaves it to an EXCLUDE constraint on a tstzrange.
+// store_conformance_test.go checks both against the same cases.
+type BookingStore interface {
+	CreateBooking(ctx context.Context, nb newBooking) (Booking, error)
+	GetBooking(ctx context.Context, id string) (Booking, error)
+	ListBookings(ctx context.Context, f listBookingsFilters) ([]Booking, error)
+	UpdateBooking(ctx context.Context, id string, p bookingPatch) (Booking, error)
+	DeleteBooking(ctx context.Context, id string) error
+}
+
+// bookingPatch is a partial update; nil fields are left unchanged.
+type bookingPatch struct {
+	RoomID  *string
+	GuestID *string
+	Start   *time.Time
+	End     *time.Time
+	Status  *string
+}
+
+// apply returns br with the patch applied, keeping the offsets of new times.
+func (br bookingRow) apply(p bookingPatch) (bookingRow, error) {
+	if p.RoomID != nil {
+		br.RoomID = *p.RoomID
+	}
+	if p.GuestID != nil {
+		br.GuestID = *p.GuestID
+	}
+	if p.Start != nil {
+		br.StartSec, br.StartOff = p.Start.Unix(), offsetOf(*p.Start)
+	}
+	if p.End != nil {
+		br.EndSec, br.EndOff = p.End.Unix(), offsetOf(*p.End)
+	}
+	if p.Status != nil {
+		br.Status = *p.Status
+	}
+	if br.EndSec <= br.StartSec {
+		return br, clientErr("ends_at must be after starts_at", http.StatusBadRequest)
+	}
+	return br, nil
+}
+
+// isActive reports whether a booking with this status holds its slot.
+func isActive(status string) bool {
+	return status == "PENDING" || status == "CONFIRMED"
+}
+
+// ------------------------------------------------------------
+// SQLite store
+// ------------------------------------------------------------
+
+// sqliteStore also applies the SQLite-only features around a booking: room
+// policies and buffers, PENDING holds and waitlist promotion.
+type sqliteStore struct {
+	db   *sql.DB
+	hold time.Duration // how long a PENDING booking holds its slot
+
+	// onPromote is told about bookings created from the waitlist, after the
+	// transaction that created them has committed.
+	onPromote func(ctx context.Context, ids []string)
+}
+
+func newSQLiteStore(db *sql.DB, hold time.Duration) *sqliteStore {
+	return &sqliteStore{db: db, hold: hold}
+}
+
+// CreateBooking inserts a single booking inside a BEGIN IMMEDIATE transaction
+// with the overlap check. Shared by POST /bookings and calendar import.
+func (s *sqliteStore) CreateBooking(ctx context.Context, nb newBooking) (Booking, error) {
+	if !nb.End.After(nb.Start) {
+		return Booking{}, clientErr("ends_at must be after starts_at", http.StatusBadRequest)
+	}
+	id := uuid.New().String()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	err := withImmediateTx(ctx, s.db, func(conn *sql.Conn) error {
+		if err := roomExistsConn(ctx, conn, nb.RoomID); err != nil {
+			return err
+		}
+		if err := guestExistsConn(ctx, conn, nb.GuestID); err != nil {
+			return err
+		}
+		if err := checkRoomPolicyConn(ctx, conn, nb.RoomID, nb.Start, nb.End); err != nil {
+			return err
+		}
+		// Overlap check for active statuses
+		if isActive(nb.Status) {
+			ok, err := hasOverlapConn(ctx, conn, nb.RoomID, nb.Start.Unix(), nb.End.Unix(), "")
+			if err != nil {
+				return err
+			}
+			if ok {
+				return clientErr("booking time overlaps existing booking (or its buffer)", http.StatusConflict)
+			}
+		}
+		_, err := conn.ExecContext(ctx, `INSERT INTO bookings(id, room_id, guest_id, starts_at, ends_at, status, created_at, hold_expires_at, start_offset, end_offset) VALUES(?,?,?,?,?,?,?,?,?,?)`,
+			id, nb.RoomID, nb.GuestID, nb.Start.Unix(), nb.End.Unix(), nb.Status, now, s.holdFor(nb.Status), offsetOf(nb.Start), offsetOf(nb.End))
+		return err
+	})
+	if err != nil {
+		return Booking{}, err
+	}
+	return s.GetBooking(ctx, id)
+}
+
+func (s *sqliteStore) GetBooking(ctx context.Context, id string) (Booking, error) {
+	br, err := scanBookingRow(s.db.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Booking{}, clientErr("not found", http.StatusNotFound)
+	}
+	if err != nil {
+		return Booking{}, err
+	}
+	return toBookingDTO(br), nil
+}
+
+func (s *sqliteStore) ListBookings(ctx context.Context, f listBookingsFilters) ([]Booking, error) {
+	where := []string{"1=1"}
+	args := []any{}
+	if f.RoomID != "" {
+		where = append(where, "room_id = ?")
+		args = append(args, f.RoomID)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.From != nil {
+		where = append(where, "ends_at > ?")
+		args = append(args, f.From.Unix())
+	}
+	if f.To != nil {
+		where = append(where, "starts_at < ?")
+		args = append(args, f.To.Unix())
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE `+strings.Join(where, " AND ")+` ORDER BY starts_at LIMIT ? OFFSET ?`, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Booking{}
+	for rows.Next() {
+		br, err := scanBookingRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, toBookingDTO(br))
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) UpdateBooking(ctx context.Context, id string, p bookingPatch) (Booking, error) {
+	var promoted []string
+	err := withImmediateTx(ctx, s.db, func(conn *sql.Conn) error {
+		cur, err := scanBookingRow(conn.QueryRowContext(ctx, `SELECT `+bookingColumns+` FROM bookings WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		next, err := cur.apply(p)
+		if err != nil {
+			return err
+		}
+		// Ensure room exists if changed
+		if next.RoomID != cur.RoomID {
+			if err := roomExistsConn(ctx, conn, next.RoomID); err != nil {
+				return err
+			}
+		}
+		if next.GuestID != cur.GuestID {
+			if err := guestExistsConn(ctx, conn, next.GuestID); err != nil {
+				return err
+			}
+		}
+		// Room policy applies to the new slot; a status-only change is not re-checked
+		if next.RoomID != cur.RoomID || next.StartSec != cur.StartSec || next.EndSec != cur.EndSec {
+			if err := checkRoomPolicyConn(ctx, conn, next.RoomID, time.Unix(next.StartSec, 0), time.Unix(next.EndSec, 0)); err != nil {
+				return err
+			}
+		}
+		// Overlap check when status is active
+		if isActive(next.Status) {
+			ok, err := hasOverlapConn(ctx, conn, next.RoomID, next.StartSec, next.EndSec, id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return clientErr("booking time overlaps existing booking (or its buffer)", http.StatusConflict)
+			}
+		}
+		_, err = conn.ExecContext(ctx, `UPDATE bookings SET room_id=?, guest_id=?, starts_at=?, ends_at=?, start_offset=?, end_offset=?, status=?, `+holdUpdateSQL+` WHERE id=?`,
+			next.RoomID, next.GuestID, next.StartSec, next.EndSec, next.StartOff, next.EndOff, next.Status, next.Status, s.holdFor("PENDING"), id)
+		if err != nil {
+			return err
+		}
+		// the old slot may have been freed: let the waitlist take it
+		promoted, err = s.promoteWaitlistConn(ctx, conn, cur.RoomID, time.Now())
+		return err
+	})
+	if err != nil {
+		return Booking{}, err
+	}
+	s.notifyPromoted(ctx, promoted)
+	return s.GetBooking(ctx, id)
+}
+
+func (s *sqliteStore) DeleteBooking(ctx context.Context, id string) error {
+	var promoted []string
+	err := withImmediateTx(ctx, s.db, func(conn *sql.Conn) error {
+		var roomID string
+		err := conn.QueryRowContext(ctx, `DELETE FROM bookings WHERE id = ? RETURNING room_id`, id).Scan(&roomID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return clientErr("not found", http.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		promoted, err = s.promoteWaitlistConn(ctx, conn, roomID, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyPromoted(ctx, promoted)
+	return nil
+}
+
+func (s *sqliteStore) notifyPromoted(ctx context.Context, ids []string) {
+	if len(ids) > 0 && s.onPromote != nil {
+		s.onPromote(ctx, ids)
+	}
+}
+
+// roomExistsConn is the "room exists" check done before every insert.
+func roomExistsConn(ctx context.Context, q dbtx, roomID string) error {
+	var x string
+	err := q.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = ?`, roomID).Scan(&x)
+	if errors.Is(err, sql.ErrNoRows) {
+		return clientErr("room not found", http.StatusBadRequest)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // IANA zones even on hosts without /usr/share/zoneinfo
+)
+
+// ------------------------------------------------------------
+// Time zones
+// ------------------------------------------------------------
+//
+// Instants are still stored as unix seconds, but each room has an IANA zone
+// and each booking keeps the UTC offset its times were given in. Business
+// hours and recurrence rules are evaluated in the room's zone, so "every
+// Monday 09:00" stays at 09:00 across DST changes.
+
+// localLayouts are wall-clock forms accepted together with a zone.
+var localLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// loadZone validates an IANA zone name such as "Europe/Berlin".
+func loadZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("time zone must be an IANA name like Europe/Berlin")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// tzParam returns the zone from ?tz=, or nil when the parameter is absent.
+func tzParam(r *http.Request) (*time.Location, error) {
+	v := r.URL.Query().Get("tz")
+	if v == "" {
+		return nil, nil
+	}
+	loc, err := loadZone(v)
+	if err != nil {
+		return nil, clientErr("tz: "+err.Error(), http.StatusBadRequest)
+	}
+	return loc, nil
+}
+
+// roomLocation returns the zone of a room; unknown rooms get UTC so the
+// caller's own "room not found" check stays in charge.
+func roomLocation(ctx context.Context, q dbtx, roomID string) (*time.Location, error) {
+	var name string
+	err := q.QueryRowContext(ctx, `SELECT time_zone FROM rooms WHERE id = ?`, roomID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// location is the room's zone (UTC if the stored name is unusable).
+func (rm Room) location() *time.Location {
+	if loc, err := time.LoadLocation(rm.TimeZone); err == nil && rm.TimeZone != "" {
+		return loc
+	}
+	return time.UTC
+}
+
+// requestLocation is the zone used to read wall-clock times of a request:
+// ?tz= when given, otherwise the room's zone.
+func (a *App) requestLocation(r *http.Request, roomID string) (*time.Location, error) {
+	loc, err := tzParam(r)
+	if err != nil || loc != nil {
+		return loc, err
+	}
+	if roomID == "" {
+		return nil, nil
+	}
+	return roomLocation(r.Context(), a.db, roomID)
+}
+
+// parseTimeIn accepts RFC3339 (the offset wins) or, when loc is set, a local
+// wall-clock time in loc. Wall-clock times skipped by a DST jump are rejected.
+func parseTimeIn(s string, loc *time.Location) (time.Time, error) {
+	if t, err := parseRFC3339(s); err == nil {
+		return t, nil
+	}
+	if loc == nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	for _, l := range localLayouts {
+		wall, err := time.Parse(l, s)
+		if err != nil {
+			continue
+		}
+		t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc)
+		if t.Hour() != wall.Hour() || t.Minute() != wall.Minute() {
+			return time.Time{}, fmt.Errorf("%s does not exist in %s (DST gap)", s, loc)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// timeFieldErr is the 400 message for an unparsable time field.
+func timeFieldErr(field string, err error) string {
+	if strings.Contains(err.Error(), "DST gap") {
+		return field + ": " + err.Error()
+	}
+	return field + " must be RFC3339, or local time like 2025-03-10T09:00 with tz / the room's zone"
+}
+
+func offsetOf(t time.Time) int {
+	_, off := t.Zone()
+	return off
+}
+
+// offsetAt is the UTC offset of loc at the given instant.
+func offsetAt(sec int64, loc *time.Location) int {
+	return offsetOf(time.Unix(sec, 0).In(loc))
+}
+
+// formatAt renders an instant with a fixed UTC offset (0 renders as Z).
+func formatAt(sec int64, offset int) string {
+	if offset == 0 {
+		return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+	}
+	return time.Unix(sec, 0).In(time.FixedZone("", offset)).Format(time.RFC3339)
+}
+
+// wallClock is the local date and time of an instant in loc, as a naive UTC
+// value; differences between wall clocks ignore DST jumps.
+func wallClock(sec int64, loc *time.Location) time.Time {
+	t := time.Unix(sec, 0).In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// shiftWallClock moves an instant by d on the wall clock of loc.
+func shiftWallClock(sec int64, d time.Duration, loc *time.Location) int64 {
+	w := wallClock(sec, loc).Add(d)
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc).Unix()
+}
+
+// formatIn renders an instant in loc.
+func formatIn(sec int64, loc *time.Location) string {
+	return formatAt(sec, offsetAt(sec, loc))
+}
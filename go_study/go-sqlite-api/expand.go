@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ===== ?expand=items,payments,customer,products =====
+//
+// 订单查询时一次性带出关联数据，避免前端再分别调用 /orders/{id}/items 和 /payments?order_id=。
+// 每种关联只查一次（WHERE ... IN (...)），再按 id 挂回各个订单，不会出现 N+1 查询。
+
+type orderExpand struct {
+	Items    bool
+	Payments bool
+	Customer bool
+	Products bool // 明细里带上商品信息（隐含 items）
+}
+
+func (e orderExpand) any() bool {
+	return e.Items || e.Payments || e.Customer || e.Products
+}
+
+func parseOrderExpand(v string) (orderExpand, error) {
+	var e orderExpand
+	for _, part := range strings.Split(v, ",") {
+		switch strings.TrimSpace(part) {
+		case "":
+		case "items":
+			e.Items = true
+		case "payments":
+			e.Payments = true
+		case "customer":
+			e.Customer = true
+		case "products":
+			e.Items = true
+			e.Products = true
+		default:
+			return e, fmt.Errorf("unknown expand %q (allowed: items,payments,customer,products)", part)
+		}
+	}
+	return e, nil
+}
+
+// 展开后的订单：未展开的字段为 nil，不出现在 JSON 里；展开但为空时返回 []
+type OrderDetail struct {
+	Order
+	Customer *Customer         `json:"customer,omitempty"`
+	Items    []OrderItemDetail `json:"items,omitzero"`
+	Payments []Payment         `json:"payments,omitzero"`
+}
+
+type OrderItemDetail struct {
+	OrderItem
+	Product *Product `json:"product,omitempty"`
+}
+
+// 生成 "?,?,?" 以及对应参数
+func inClause(ids []int64) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
+
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	out := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (s *Server) expandOrders(ctx context.Context, orders []OrderDetail, exp orderExpand) error {
+	if len(orders) == 0 || !exp.any() {
+		return nil
+	}
+	orderIDs := make([]int64, len(orders))
+	customerIDs := make([]int64, len(orders))
+	byID := make(map[int64]*OrderDetail, len(orders))
+	for i := range orders {
+		o := &orders[i]
+		orderIDs[i] = o.ID
+		customerIDs[i] = o.CustomerID
+		byID[o.ID] = o
+		if exp.Items {
+			o.Items = []OrderItemDetail{}
+		}
+		if exp.Payments {
+			o.Payments = []Payment{}
+		}
+	}
+
+	if exp.Items {
+		if err := s.expandItems(ctx, byID, orderIDs, exp.Products); err != nil {
+			return err
+		}
+	}
+	if exp.Payments {
+		if err := s.expandPayments(ctx, byID, orderIDs); err != nil {
+			return err
+		}
+	}
+	if exp.Customer {
+		customers, err := s.customersByID(ctx, uniqueIDs(customerIDs))
+		if err != nil {
+			return err
+		}
+		for i := range orders {
+			if c, ok := customers[orders[i].CustomerID]; ok {
+				orders[i].Customer = &c
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) expandItems(ctx context.Context, byID map[int64]*OrderDetail, orderIDs []int64, withProducts bool) error {
+	in, args := inClause(orderIDs)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT id, order_id, product_id, quantity, unit_price
+FROM order_items WHERE order_id IN (%s) ORDER BY id`, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var productIDs []int64
+	for rows.Next() {
+		var it OrderItem
+		if err := rows.Scan(&it.ID, &it.OrderID, &it.ProductID, &it.Quantity, &it.UnitPrice); err != nil {
+			return err
+		}
+		o := byID[it.OrderID]
+		o.Items = append(o.Items, OrderItemDetail{OrderItem: it})
+		productIDs = append(productIDs, it.ProductID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !withProducts || len(productIDs) == 0 {
+		return nil
+	}
+
+	products, err := s.productsByID(ctx, uniqueIDs(productIDs))
+	if err != nil {
+		return err
+	}
+	for _, o := range byID {
+		for i := range o.Items {
+			if p, ok := products[o.Items[i].ProductID]; ok {
+				o.Items[i].Product = &p
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) expandPayments(ctx context.Context, byID map[int64]*OrderDetail, orderIDs []int64) error {
+	in, args := inClause(orderIDs)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT id, order_id, amount, paid_at, method
+FROM payments WHERE order_id IN (%s) ORDER BY id`, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Payment
+		var paid *string
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &paid, &p.Method); err != nil {
+			return err
+		}
+		if paid != nil {
+			t, _ := time.Parse(time.RFC3339, *paid)
+			p.PaidAt = &t
+		}
+		o := byID[p.OrderID]
+		o.Payments = append(o.Payments, p)
+	}
+	return rows.Err()
+}
+
+func (s *Server) customersByID(ctx context.Context, ids []int64) (map[int64]Customer, error) {
+	in, args := inClause(ids)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, city, created_at FROM customers WHERE id IN (%s)`, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]Customer, len(ids))
+	for rows.Next() {
+		var c Customer
+		var created string
+		if err := rows.Scan(&c.ID, &c.Name, &c.City, &created); err != nil {
+			return nil, err
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, created)
+		out[c.ID] = c
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) productsByID(ctx context.Context, ids []int64) (map[int64]Product, error) {
+	in, args := inClause(ids)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT id, name, category FROM products WHERE id IN (%s)`, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]Product, len(ids))
+	for rows.Next() {
+		var p Product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Category); err != nil {
+			return nil, err
+		}
+		out[p.ID] = p
+	}
+	return out, rows.Err()
+}
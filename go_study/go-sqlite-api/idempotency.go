@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Idempotency-Key =====
+//
+// 客户端重试 POST /api/orders、POST /api/payments 时带上同一个 Idempotency-Key，
+// 服务端在窗口期内直接回放第一次的响应，避免重复下单 / 重复扣款。
+// - 同一个 key + 相同请求体：回放已保存的响应（带 Idempotent-Replayed: true）
+// - 同一个 key + 不同请求体：422
+// - 第一次请求还没处理完又来了重试：409
+// - 5xx 响应不保存，客户端可以用同一个 key 重试
+
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	idempotencyMaxKeyLen = 255
+	idempotencyMaxBody   = 1 << 20 // 1MB，订单/付款请求体足够
+)
+
+// 保存窗口，可用环境变量 IDEMPOTENCY_TTL 覆盖（如 IDEMPOTENCY_TTL=1h）
+func idempotencyTTLFromEnv() time.Duration {
+	ttl := 24 * time.Hour
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ttl = d
+		} else {
+			log.Printf("invalid IDEMPOTENCY_TTL %q, using %s", v, ttl)
+		}
+	}
+	return ttl
+}
+
+// 记录处理结果：既写给客户端，又留一份用于保存
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotency 中间件：没有 Idempotency-Key 头的请求原样放行
+func (s *Server) idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(idempotencyHeader))
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKeyLen {
+			http.Error(w, "Idempotency-Key too long", 400)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBody))
+		if err != nil {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		scope := r.Method + " " + r.URL.Path
+		reqHash := hashRequest(r, body)
+
+		now := time.Now().UTC()
+		// 顺手清理过期的 key（单连接 SQLite，语句之间天然串行）
+		if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.Format(time.RFC3339)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// 抢占 key：插入一条 status_code=0 的“处理中”记录
+		res, err := s.db.Exec(`
+INSERT INTO idempotency_keys(scope, idem_key, request_hash, status_code, created_at, expires_at)
+VALUES(?,?,?,0,?,?)
+ON CONFLICT(scope, idem_key) DO NOTHING`,
+			scope, key, reqHash, now.Format(time.RFC3339), now.Add(s.idemTTL).Format(time.RFC3339))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			s.replayIdempotent(w, scope, key, reqHash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		// handler panic 时也要释放 key，否则重试会一直 409 到过期；释放后继续向上抛
+		defer func() {
+			if p := recover(); p != nil {
+				s.releaseIdempotencyKey(scope, key)
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= 500 {
+			// 失败不占用 key，允许客户端重试
+			s.releaseIdempotencyKey(scope, key)
+			return
+		}
+		if _, err := s.db.Exec(`
+UPDATE idempotency_keys SET status_code=?, content_type=?, response_body=?
+WHERE scope=? AND idem_key=?`,
+			rec.status, rec.Header().Get("Content-Type"), rec.body.String(), scope, key); err != nil {
+			log.Printf("idempotency: save response for key %q: %v", key, err)
+		}
+	})
+}
+
+func (s *Server) releaseIdempotencyKey(scope, key string) {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE scope=? AND idem_key=?`, scope, key); err != nil {
+		log.Printf("idempotency: release key %q: %v", key, err)
+	}
+}
+
+func (s *Server) replayIdempotent(w http.ResponseWriter, scope, key, reqHash string) {
+	var (
+		storedHash  string
+		status      int
+		contentType sql.NullString
+		body        sql.NullString
+	)
+	err := s.db.QueryRow(`
+SELECT request_hash, status_code, content_type, response_body
+FROM idempotency_keys WHERE scope=? AND idem_key=?`, scope, key).
+		Scan(&storedHash, &status, &contentType, &body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if storedHash != reqHash {
+		http.Error(w, "Idempotency-Key already used with a different request body", http.StatusUnprocessableEntity)
+		return
+	}
+	if status == 0 {
+		http.Error(w, "a request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+	if contentType.Valid && contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body.String))
+}
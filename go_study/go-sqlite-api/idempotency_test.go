@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newIdempotencyServer(t *testing.T) *Server {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := createSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{db: db, idemTTL: time.Hour}
+}
+
+func postWithKey(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/orders", strings.NewReader(body))
+	r.Header.Set(idempotencyHeader, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyReplayAndConflicts(t *testing.T) {
+	s := newIdempotencyServer(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := s.idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if strings.Contains(r.Header.Get(idempotencyHeader), "slow") {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":%d}`, n)
+	}))
+
+	first := postWithKey(h, "k1", `{"a":1}`)
+	if first.Code != http.StatusCreated || first.Body.String() != `{"id":1}` {
+		t.Fatalf("first: %d %s", first.Code, first.Body)
+	}
+
+	// 相同 key + 相同请求体：回放，不再执行 handler
+	replay := postWithKey(h, "k1", `{"a":1}`)
+	if replay.Code != http.StatusCreated || replay.Body.String() != `{"id":1}` ||
+		replay.Header().Get("Idempotent-Replayed") != "true" || replay.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("replay: %d %s %v", replay.Code, replay.Body, replay.Header())
+	}
+
+	// 相同 key + 不同请求体：422
+	if w := postWithKey(h, "k1", `{"a":2}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("body mismatch: %d %s", w.Code, w.Body)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("handler ran %d times", calls.Load())
+	}
+
+	// 第一次还没处理完：409
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postWithKey(h, "slow", `{}`) }()
+	for calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := postWithKey(h, "slow", `{}`); w.Code != http.StatusConflict {
+		t.Fatalf("in flight: %d %s", w.Code, w.Body)
+	}
+	close(release)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("slow request: %d %s", w.Code, w.Body)
+	}
+	if w := postWithKey(h, "slow", `{}`); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("after slow request: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestIdempotencyReleasesKeyOnFailure(t *testing.T) {
+	s := newIdempotencyServer(t)
+	var mode atomic.Value
+	h := s.idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch mode.Load() {
+		case "panic":
+			panic("boom")
+		case "500":
+			http.Error(w, "db down", http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "ok")
+		}
+	}))
+
+	// panic 继续向上抛，但 key 已释放
+	mode.Store("panic")
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recovered %v", p)
+			}
+		}()
+		postWithKey(h, "k", `{}`)
+	}()
+
+	mode.Store("500")
+	if w := postWithKey(h, "k", `{}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("retry after panic: %d %s", w.Code, w.Body)
+	}
+
+	mode.Store("ok")
+	if w := postWithKey(h, "k", `{}`); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after 500: %d %v", w.Code, w.Header())
+	}
+}
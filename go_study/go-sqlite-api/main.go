@@ -150,6 +150,20 @@ CREATE TABLE IF NOT EXISTS payments (
 CREATE INDEX IF NOT EXISTS idx_orders_customer ON orders(customer_id);
 CREATE INDEX IF NOT EXISTS idx_order_items_order ON order_items(order_id);
 CREATE INDEX IF NOT EXISTS idx_payments_order ON payments(order_id);
+
+-- 幂等键：保存请求摘要与首次响应，status_code=0 表示仍在处理中
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  scope          TEXT NOT NULL,
+  idem_key       TEXT NOT NULL,
+  request_hash   TEXT NOT NULL,
+  status_code    INTEGER NOT NULL DEFAULT 0,
+  content_type   TEXT,
+  response_body  TEXT,
+  created_at     TEXT NOT NULL,
+  expires_at     TEXT NOT NULL,
+  PRIMARY KEY (scope, idem_key)
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_expires ON idempotency_keys(expires_at);
 `
 	_, err := db.Exec(schema)
 	return err
@@ -265,7 +279,8 @@ func buildOrderBy(r *http.Request, allowed map[string]bool, defaultOrder string)
 // ===== Handlers =====
 
 type Server struct {
-	db *sql.DB
+	db      *sql.DB
+	idemTTL time.Duration // Idempotency-Key 保存窗口
 }
 
 // ===== Static: serve admin.html at "/" =====
@@ -422,21 +437,29 @@ const openapiJSON = `{
           { "name": "size", "in": "query", "schema": { "type": "integer" } },
           { "name": "sort", "in": "query", "schema": { "type": "string" } },
           { "name": "status", "in": "query", "schema": { "type": "string" } },
-          { "name": "customer_id", "in": "query", "schema": { "type": "integer" } }
+          { "name": "customer_id", "in": "query", "schema": { "type": "integer" } },
+          { "$ref": "#/components/parameters/OrderExpand" }
         ],
         "responses": { "200": { "description": "OK", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/PageOrders" } } } } }
       },
       "post": {
         "summary": "Create order (atomic, with items and optional payment)",
+        "parameters": [{ "$ref": "#/components/parameters/IdempotencyKey" }],
         "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CreateOrderRequest" } } } },
         "responses": {
-          "201": { "description": "Created", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CreateOrderResponse" } } } }
+          "201": { "description": "Created", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CreateOrderResponse" } } } },
+          "409": { "description": "A request with the same Idempotency-Key is still in progress" },
+          "422": { "description": "Idempotency-Key reused with a different request body" }
         }
       }
     },
     "/api/orders/{id}": {
       "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "integer", "format": "int64" } }],
-      "get": { "summary": "Get order (with total)", "responses": { "200": { "description": "OK", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Order" } } } }, "404": { "description": "Not Found" } } },
+      "get": {
+        "summary": "Get order (with total)",
+        "parameters": [{ "$ref": "#/components/parameters/OrderExpand" }],
+        "responses": { "200": { "description": "OK", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Order" } } } }, "404": { "description": "Not Found" } }
+      },
       "put": {
         "summary": "Update order status",
         "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/UpdateOrderStatus" } } } },
@@ -465,8 +488,13 @@ const openapiJSON = `{
       },
       "post": {
         "summary": "Create payment",
+        "parameters": [{ "$ref": "#/components/parameters/IdempotencyKey" }],
         "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CreatePayment" } } } },
-        "responses": { "201": { "description": "Created", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Payment" } } } } }
+        "responses": {
+          "201": { "description": "Created", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Payment" } } } },
+          "409": { "description": "A request with the same Idempotency-Key is still in progress" },
+          "422": { "description": "Idempotency-Key reused with a different request body" }
+        }
       }
     },
     "/api/payments/{id}": {
@@ -487,6 +515,22 @@ const openapiJSON = `{
     }
   },
   "components": {
+    "parameters": {
+      "IdempotencyKey": {
+        "name": "Idempotency-Key",
+        "in": "header",
+        "required": false,
+        "schema": { "type": "string", "maxLength": 255 },
+        "description": "Retries with the same key replay the first response (header Idempotent-Replayed: true) within IDEMPOTENCY_TTL (default 24h)"
+      },
+      "OrderExpand": {
+        "name": "expand",
+        "in": "query",
+        "required": false,
+        "schema": { "type": "string", "example": "items,payments,customer,products" },
+        "description": "Comma-separated relations to embed: items, payments, customer, products (products implies items)"
+      }
+    },
     "schemas": {
       "Health": {
         "type": "object",
@@ -560,10 +604,19 @@ const openapiJSON = `{
           "customer_id": { "type": "integer", "format": "int64" },
           "order_date": { "type": "string", "format": "date-time" },
           "status": { "type": "string", "example": "NEW/PAID/CANCEL" },
-          "total": { "type": "number" }
+          "total": { "type": "number" },
+          "customer": { "$ref": "#/components/schemas/Customer" },
+          "items": { "type": "array", "items": { "$ref": "#/components/schemas/OrderItemDetail" }, "description": "only with expand=items|products" },
+          "payments": { "type": "array", "items": { "$ref": "#/components/schemas/Payment" }, "description": "only with expand=payments" }
         },
         "required": ["id","customer_id","order_date","status"]
       },
+      "OrderItemDetail": {
+        "allOf": [
+          { "$ref": "#/components/schemas/OrderItem" },
+          { "type": "object", "properties": { "product": { "$ref": "#/components/schemas/Product" } } }
+        ]
+      },
       "OrderItem": {
         "type": "object",
         "properties": {
@@ -681,15 +734,15 @@ func (s *Server) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	db := mustInitDB()
-	s := &Server{db: db}
+	s := &Server{db: db, idemTTL: idempotencyTTLFromEnv()}
 
 	r := chi.NewRouter()
 	// CORS（前端可直接调用）
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Link", "Idempotent-Replayed"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
@@ -725,7 +778,7 @@ func main() {
 
 		// orders
 		api.Get("/orders", s.listOrders)
-		api.Post("/orders", s.createOrder)
+		api.With(s.idempotency).Post("/orders", s.createOrder)
 		api.Route("/orders/{id}", func(r chi.Router) {
 			r.Get("/", s.getOrder)
 			r.Put("/", s.updateOrder) // 仅更新 status
@@ -735,7 +788,7 @@ func main() {
 
 		// payments
 		api.Get("/payments", s.listPayments)
-		api.Post("/payments", s.createPayment)
+		api.With(s.idempotency).Post("/payments", s.createPayment)
 		api.Route("/payments/{id}", func(r chi.Router) {
 			r.Get("/", s.getPayment)
 			r.Delete("/", s.deletePayment)
@@ -979,6 +1032,11 @@ func (s *Server) deleteProduct(w http.ResponseWriter, r *http.Request) {
 // ========== Orders ==========
 
 func (s *Server) listOrders(w http.ResponseWriter, r *http.Request) {
+	exp, err := parseOrderExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	page, size := parsePageSize(r)
 	orderBy := buildOrderBy(r, map[string]bool{"id": true, "order_date": true}, "order_date DESC")
 	offset := (page - 1) * size
@@ -1013,10 +1071,7 @@ LIMIT ? OFFSET ?`, where, orderBy)
 	}
 	defer rows.Close()
 
-	type Row struct {
-		Order
-	}
-	var out []Row
+	var out []OrderDetail
 	for rows.Next() {
 		var o Order
 		var dateStr string
@@ -1025,7 +1080,14 @@ LIMIT ? OFFSET ?`, where, orderBy)
 			return
 		}
 		o.OrderDate, _ = time.Parse(time.RFC3339, dateStr)
-		out = append(out, Row{Order: o})
+		out = append(out, OrderDetail{Order: o})
+	}
+	rows.Close() // 单连接 SQLite：先释放连接再查关联数据
+
+	// 可选：?expand=items,payments,customer,products
+	if err := s.expandOrders(r.Context(), out, exp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
 	respondJSON(w, 200, map[string]any{"page": page, "size": size, "items": out})
 }
@@ -1106,10 +1168,15 @@ func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	exp, err := parseOrderExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	id, _ := parseID(chi.URLParam(r, "id"))
 	var o Order
 	var dateStr string
-	err := s.db.QueryRow(`
+	err = s.db.QueryRow(`
 SELECT o.id, o.customer_id, o.order_date, o.status,
        IFNULL(SUM(oi.quantity * oi.unit_price), 0) AS total
 FROM orders o
@@ -1126,7 +1193,12 @@ GROUP BY o.id
 		return
 	}
 	o.OrderDate, _ = time.Parse(time.RFC3339, dateStr)
-	respondJSON(w, 200, o)
+	out := []OrderDetail{{Order: o}}
+	if err := s.expandOrders(r.Context(), out, exp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	respondJSON(w, 200, out[0])
 }
 
 func (s *Server) updateOrder(w http.ResponseWriter, r *http.Request) {
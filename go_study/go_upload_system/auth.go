@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   用户、配额、私有文件
+=========================== */
+
+// 认证：请求头 Authorization: Bearer {token}；token 只在创建/重置时显示一次，库里存 sha256。
+// 用户通过子命令管理：./app users add|list|quota|token
+// 写操作（发帖、删帖、tus 上传）需要登录；公开帖子及其文件匿名可读。
+// 私有帖子的文件不能直接按 id 访问，需要 HMAC 签名的限时地址：/files/{id}?exp=&sig=
+
+const (
+	defaultQuotaBytes = 1 << 30 // 新用户默认 1GB
+	shareDefaultTTL   = time.Hour
+	shareMaxTTL       = 7 * 24 * time.Hour
+	urlKeyFile        = "./data/url.key"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+type User struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Admin      bool   `json:"admin"`
+	QuotaBytes int64  `json:"quotaBytes"`
+}
+
+type ctxKey int
+
+const userCtxKey ctxKey = 0
+
+// userFrom 取当前请求的用户；匿名返回 nil
+func userFrom(ctx context.Context) *User {
+	u, _ := ctx.Value(userCtxKey).(*User)
+	return u
+}
+
+// withUser 解析 Bearer token 放进 context。没带 token 按匿名处理，带了但无效直接 401。
+func (a *App) withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		if h == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok {
+			writeUnauthorized(w, "invalid Authorization header")
+			return
+		}
+		u, err := a.userByToken(r.Context(), strings.TrimSpace(token))
+		if err == sql.ErrNoRows {
+			writeUnauthorized(w, "invalid token")
+			return
+		}
+		if err != nil {
+			writeJSONErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userCtxKey, u)))
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="uploadsys"`)
+	writeJSONErr(w, http.StatusUnauthorized, msg)
+}
+
+// requireUser 用于写操作；返回 nil 时已写 401
+func requireUser(w http.ResponseWriter, r *http.Request) *User {
+	u := userFrom(r.Context())
+	if u == nil {
+		writeUnauthorized(w, "login required")
+	}
+	return u
+}
+
+func hashToken(token string) string {
+	s := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(s[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Name, &u.Admin, &u.QuotaBytes); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func userByID(ctx context.Context, q queryer, id int64) (*User, error) {
+	return scanUser(q.QueryRowContext(ctx, `SELECT id,name,is_admin,quota_bytes FROM users WHERE id=?`, id))
+}
+
+func (a *App) userByToken(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, sql.ErrNoRows
+	}
+	return scanUser(a.DB.QueryRowContext(ctx,
+		`SELECT id,name,is_admin,quota_bytes FROM users WHERE token_sha256=?`, hashToken(token)))
+}
+
+/* ---------- 配额：按用户引用的去重文件计算 ---------- */
+
+// 用户“持有”的文件：自己帖子里的附件 + 自己已完成但还没挂到帖子上的 tus 上传。
+// 同一个文件被自己多次引用只算一次；别人也引用了同内容的文件，各自都要计入（否则可以蹭别人的配额）。
+const userFilesSQL = `
+	SELECT pf.file_id FROM post_files pf JOIN posts p ON p.id = pf.post_id WHERE p.owner_id = ?
+	UNION
+	SELECT file_id FROM uploads WHERE owner_id = ? AND file_id IS NOT NULL`
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// usage 返回用户持有的文件数和总字节数（size_bytes 之和）
+func usage(ctx context.Context, q queryer, userID int64) (files, bytes int64, err error) {
+	err = q.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(size_bytes),0) FROM files WHERE id IN (`+userFilesSQL+`)`,
+		userID, userID,
+	).Scan(&files, &bytes)
+	return files, bytes, err
+}
+
+// checkQuota 在文件落盘前调用：用户已经持有同内容文件时不重复计费
+func checkQuota(ctx context.Context, q queryer, u *User, sum string, size int64) error {
+	if u == nil {
+		return nil
+	}
+	var held bool
+	if err := q.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM files WHERE sha256=? AND id IN (`+userFilesSQL+`))`,
+		sum, u.ID, u.ID,
+	).Scan(&held); err != nil {
+		return err
+	}
+	if held {
+		return nil
+	}
+	_, used, err := usage(ctx, q, u.ID)
+	if err != nil {
+		return err
+	}
+	if used+size > u.QuotaBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, file is %d bytes", errQuotaExceeded, used, u.QuotaBytes, size)
+	}
+	return nil
+}
+
+// GET /api/me
+func (a *App) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+	files, used, err := usage(r.Context(), a.DB, u.ID)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"user":      u,
+		"usedBytes": used,
+		"fileCount": files,
+	})
+}
+
+/* ---------- 访问控制 ---------- */
+
+// canReadPost：公开帖子所有人可读；私有帖子只有作者和管理员
+func canReadPost(u *User, ownerID sql.NullInt64, visibility string) bool {
+	if visibility != "private" {
+		return true
+	}
+	return canModifyPost(u, ownerID)
+}
+
+// canModifyPost：作者或管理员；迁移前的帖子没有作者，只有管理员能删
+func canModifyPost(u *User, ownerID sql.NullInt64) bool {
+	if u == nil {
+		return false
+	}
+	return u.Admin || (ownerID.Valid && ownerID.Int64 == u.ID)
+}
+
+// fileAccess 判断文件是否公开（被至少一个公开帖子引用），以及当前用户能否直接读取。
+// 非公开文件：上传者、持有者（帖子作者 / tus 上传者）和管理员可读。
+func (a *App) fileAccess(ctx context.Context, u *User, fileID int64, ownerID sql.NullInt64) (public, ok bool, err error) {
+	err = a.DB.QueryRowContext(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM post_files pf JOIN posts p ON p.id = pf.post_id
+			WHERE pf.file_id = ? AND p.visibility = 'public'
+		)`, fileID).Scan(&public)
+	if err != nil || public {
+		return public, public, err
+	}
+	if u == nil {
+		return false, false, nil
+	}
+	if u.Admin || (ownerID.Valid && ownerID.Int64 == u.ID) {
+		return false, true, nil
+	}
+	err = a.DB.QueryRowContext(ctx, `SELECT ? IN (`+userFilesSQL+`)`, fileID, u.ID, u.ID).Scan(&ok)
+	return false, ok, err
+}
+
+/* ---------- 签名地址 ---------- */
+
+var urlKey []byte // HMAC 密钥：FILE_URL_SECRET，未设置时用 data/url.key（首次启动随机生成）
+
+func loadURLKey() ([]byte, error) {
+	if s := os.Getenv("FILE_URL_SECRET"); s != "" {
+		return []byte(s), nil
+	}
+	b, err := os.ReadFile(urlKeyFile)
+	if err == nil && len(b) >= 32 {
+		return b, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	b = make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(urlKeyFile), 0o755); err != nil {
+		return nil, err
+	}
+	return b, os.WriteFile(urlKeyFile, b, 0o600)
+}
+
+func fileSig(fileID, exp int64) string {
+	m := hmac.New(sha256.New, urlKey)
+	fmt.Fprintf(m, "files/%d\n%d", fileID, exp)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// signedFileURL 生成 /files/{id}?exp=&sig=；签名只覆盖 id 和过期时间，
+// 所以 download、variant 等参数可以随意追加
+func signedFileURL(fileID int64, exp time.Time) string {
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	q.Set("sig", fileSig(fileID, exp.Unix()))
+	return fmt.Sprintf("/files/%d?%s", fileID, q.Encode())
+}
+
+// verifyFileSig 校验签名；有效时返回剩余有效期
+func verifyFileSig(fileID int64, q url.Values) (time.Duration, bool) {
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || q.Get("sig") == "" {
+		return 0, false
+	}
+	left := time.Until(time.Unix(exp, 0))
+	if left <= 0 {
+		return 0, false
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(fileSig(fileID, exp))) {
+		return 0, false
+	}
+	return left, true
+}
+
+// POST /api/files/{id}/share?ttl=24h：给能读这个文件的用户生成临时分享地址
+func (a *App) handleFileShare(w http.ResponseWriter, r *http.Request) {
+	idStr, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/share")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if !ok || err != nil || id <= 0 {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	u := requireUser(w, r)
+	if u == nil {
+		return
+	}
+
+	ttl := shareDefaultTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 || ttl > shareMaxTTL {
+			writeJSONErr(w, http.StatusBadRequest, "ttl must be a duration between 1s and "+shareMaxTTL.String())
+			return
+		}
+	}
+
+	ctx := r.Context()
+	var ownerID sql.NullInt64
+	var scanStatus string
+	err = a.DB.QueryRowContext(ctx, `SELECT owner_id, scan_status FROM files WHERE id=?`, id).Scan(&ownerID, &scanStatus)
+	if err == sql.ErrNoRows {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, ok, err := a.fileAccess(ctx, u, id, ownerID); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !ok {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	if scanStatus != scanClean {
+		writeJSONErr(w, http.StatusConflict, "file has not passed the content scan ("+scanStatus+")")
+		return
+	}
+
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":       signedFileURL(id, exp),
+		"expiresAt": exp.UTC(),
+	})
+}
+
+/* ---------- 用户管理子命令 ---------- */
+
+// runUsersCommand:
+//
+//	./app users add -name alice [-quota 2GB] [-admin]   创建用户并打印 token
+//	./app users list                                    列出用户及用量
+//	./app users quota -name alice -quota 5GB            修改配额
+//	./app users token -name alice                       重置 token
+func (a *App) runUsersCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: users add|list|quota|token [flags]")
+	}
+	fs := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "user name")
+	quota := fs.String("quota", "", "storage quota, e.g. 500MB, 2GB or plain bytes")
+	admin := fs.Bool("admin", false, "grant admin rights (add only)")
+	_ = fs.Parse(args[1:])
+
+	var quotaBytes int64 = defaultQuotaBytes
+	if *quota != "" {
+		n, err := parseByteSize(*quota)
+		if err != nil {
+			return err
+		}
+		quotaBytes = n
+	}
+	if args[0] != "list" && strings.TrimSpace(*name) == "" {
+		return errors.New("-name required")
+	}
+
+	switch args[0] {
+	case "add":
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		if _, err := a.DB.ExecContext(ctx, `
+			INSERT INTO users(name, token_sha256, quota_bytes, is_admin, created_at) VALUES(?,?,?,?,?)
+		`, *name, hashToken(token), quotaBytes, *admin, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+		fmt.Printf("created user %s (quota %d bytes)\ntoken: %s\n", *name, quotaBytes, token)
+	case "quota":
+		if *quota == "" {
+			return errors.New("-quota required")
+		}
+		return a.updateUser(ctx, *name, `quota_bytes=?`, quotaBytes)
+	case "token":
+		token, err := newToken()
+		if err != nil {
+			return err
+		}
+		if err := a.updateUser(ctx, *name, `token_sha256=?`, hashToken(token)); err != nil {
+			return err
+		}
+		fmt.Printf("token: %s\n", token)
+	case "list":
+		rows, err := a.DB.QueryContext(ctx, `SELECT id,name,is_admin,quota_bytes FROM users ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		var users []*User
+		for rows.Next() {
+			u, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			users = append(users, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, u := range users {
+			files, used, err := usage(ctx, a.DB, u.ID)
+			if err != nil {
+				return err
+			}
+			role := ""
+			if u.Admin {
+				role = " admin"
+			}
+			fmt.Printf("%d\t%s%s\t%d files\t%d / %d bytes\n", u.ID, u.Name, role, files, used, u.QuotaBytes)
+		}
+	default:
+		return fmt.Errorf("unknown users command %q (want add, list, quota or token)", args[0])
+	}
+	return nil
+}
+
+func (a *App) updateUser(ctx context.Context, name, set string, v any) error {
+	res, err := a.DB.ExecContext(ctx, `UPDATE users SET `+set+` WHERE name=?`, v, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %q not found", name)
+	}
+	return nil
+}
+
+// parseByteSize 解析 1048576 / 500KB / 20MB / 2GB（按 1024 进位，B 可省略）
+func parseByteSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "IB"), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(t, "K"):
+		shift = 10
+	case strings.HasSuffix(t, "M"):
+		shift = 20
+	case strings.HasSuffix(t, "G"):
+		shift = 30
+	case strings.HasSuffix(t, "T"):
+		shift = 40
+	}
+	if shift > 0 {
+		t = t[:len(t)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
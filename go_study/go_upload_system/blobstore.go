@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   Blob 存储：本地磁盘 / S3 兼容
+=========================== */
+
+// BlobStore 保存文件内容。key 即 files.rel_path（形如 uploads/2025/12/23/{sha}.ext），
+// 数据库只存 key，换后端不用改表。
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error // key 不存在不算错误
+	// Range 读取 [offset, offset+length)；length < 0 表示读到末尾
+	Range(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// BlobPresigner 由支持预签名下载的后端实现（S3）
+type BlobPresigner interface {
+	PresignGet(key string, ttl time.Duration, contentType, disposition string) (string, error)
+}
+
+// BlobLister 由能枚举对象的后端实现（fsck 找孤儿文件用）。只列出正式文件：
+// 本地后端跳过 uploads/tmp、uploads/derived 和以 . 开头的临时文件。
+type BlobLister interface {
+	List(ctx context.Context, prefix string, fn func(key string, info BlobInfo) error) error
+}
+
+type BlobInfo struct {
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+const presignTTL = 15 * time.Minute // BLOB_REDIRECT=1 时下载地址的有效期
+
+// checkBlobKey 只接受 uploads/ 下的相对路径，防止 ../ 穿越或写到桶的其他前缀
+func checkBlobKey(key string) error {
+	clean := path.Clean(key)
+	if clean != key || !strings.HasPrefix(clean, "uploads/") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// openBlobStore 按名字创建后端：local 或 s3（配置见 s3ConfigFromEnv）
+func openBlobStore(kind string) (BlobStore, error) {
+	switch kind {
+	case "", "local":
+		return localBlobStore{}, nil
+	case "s3":
+		return newS3BlobStore(s3ConfigFromEnv())
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q (want local or s3)", kind)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+/* ---------- 本地磁盘 ---------- */
+
+// localBlobStore 把 key 映射到 dataDir 下的文件，路径限制沿用 safeAbsPathFromRel
+type localBlobStore struct{}
+
+func (s localBlobStore) abs(key string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	abs, ok := safeAbsPathFromRel(key)
+	if !ok {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return abs, nil
+}
+
+func (s localBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	abs, err := s.abs(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		return err
+	}
+	// 先写同目录临时文件再 rename，读者不会看到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(abs), ".put-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("short write: %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), abs)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	abs, err := s.abs(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s localBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	abs, err := s.abs(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	st, err := os.Stat(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s localBlobStore) Delete(ctx context.Context, key string) error {
+	abs, err := s.abs(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(abs); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s localBlobStore) Range(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	abs, err := s.abs(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		length = max(0, st.Size()-offset)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (s localBlobStore) List(ctx context.Context, prefix string, fn func(key string, info BlobInfo) error) error {
+	root := filepath.Join(dataDir, filepath.FromSlash(prefix))
+	skip := map[string]bool{
+		filepath.Join(uploadRootDir, "tmp"):     true,
+		filepath.Join(uploadRootDir, "derived"): true,
+	}
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			if skip[p] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return err
+		}
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), BlobInfo{Size: st.Size(), ModTime: st.ModTime()})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+/* ---------- 给 http.ServeContent 用的 ReadSeeker ---------- */
+
+// blobReadSeeker 按需发 Range 请求：ServeContent 先 Seek 到目标位置再读，
+// 所以 S3 上的 Range/多段请求不会把整个对象拉下来。
+// ServeContent 不告诉我们要读多少，所以按块请求：第一块 256KB，之后每块翻倍到 16MB，
+// 播放器拖动进度条时的小 Range 只多读一点，顺序播放大文件时请求数也不多。
+type blobReadSeeker struct {
+	ctx   context.Context
+	store BlobStore
+	key   string
+	size  int64
+	off   int64
+	rc    io.ReadCloser
+	end   int64 // rc 读到 end 为止
+	chunk int64 // 下一次请求的长度
+}
+
+const (
+	blobChunkMin = 256 << 10
+	blobChunkMax = 16 << 20
+)
+
+func newBlobReadSeeker(ctx context.Context, store BlobStore, key string, size int64) *blobReadSeeker {
+	return &blobReadSeeker{ctx: ctx, store: store, key: key, size: size, chunk: blobChunkMin}
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if b.rc != nil && b.off >= b.end {
+		b.Close()
+	}
+	if b.rc == nil {
+		n := min(b.chunk, b.size-b.off)
+		rc, err := b.store.Range(b.ctx, b.key, b.off, n)
+		if err != nil {
+			return 0, err
+		}
+		b.rc, b.end = rc, b.off+n
+		b.chunk = min(b.chunk*2, blobChunkMax)
+	}
+	if rest := b.end - b.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := b.rc.Read(p)
+	b.off += int64(n)
+	if err == io.EOF {
+		err = nil
+		if b.off < b.end {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = b.off + offset
+	case io.SeekEnd:
+		abs = b.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != b.off {
+		b.Close()
+		b.off = abs
+		b.chunk = blobChunkMin
+	}
+	return abs, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.rc == nil {
+		return nil
+	}
+	err := b.rc.Close()
+	b.rc = nil
+	return err
+}
+
+/* ---------- 后端迁移 ---------- */
+
+// runMigrateBlobs: ./app migrate-blobs -from local -to s3 [-delete-source] [-dry-run]
+// 按 files 表逐个复制，边拷边算 sha256，和库里的值不一致的不算迁移成功。
+// 目标端已存在且大小一致的跳过，可重复执行。
+func (a *App) runMigrateBlobs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate-blobs", flag.ExitOnError)
+	from := fs.String("from", "local", "source backend: local|s3")
+	to := fs.String("to", "s3", "destination backend: local|s3")
+	deleteSource := fs.Bool("delete-source", false, "delete each blob from the source after it is copied and verified")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	_ = fs.Parse(args)
+	if *from == *to {
+		return errors.New("-from and -to must differ")
+	}
+	src, err := openBlobStore(*from)
+	if err != nil {
+		return err
+	}
+	dst, err := openBlobStore(*to)
+	if err != nil {
+		return err
+	}
+
+	rows, err := a.DB.QueryContext(ctx, `SELECT rel_path,mime,size_bytes,sha256 FROM files ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type item struct {
+		key, mime, sum string
+		size           int64
+	}
+	var items []item
+	for rows.Next() {
+		var it item
+		if err := rows.Scan(&it.key, &it.mime, &it.size, &it.sum); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var copied, skipped, failed int
+	for _, it := range items {
+		if st, err := dst.Stat(ctx, it.key); err == nil && st.Size == it.size {
+			skipped++
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("would copy %s (%d bytes)\n", it.key, it.size)
+			copied++
+			continue
+		}
+		if err := copyBlob(ctx, src, dst, it.key, it.mime, it.size, it.sum); err != nil {
+			fmt.Printf("FAIL %s: %v\n", it.key, err)
+			failed++
+			continue
+		}
+		if *deleteSource {
+			if err := src.Delete(ctx, it.key); err != nil {
+				fmt.Printf("copied %s but could not delete source: %v\n", it.key, err)
+			}
+		}
+		copied++
+	}
+	fmt.Printf("migrate-blobs %s -> %s: %d copied, %d already present, %d failed\n", *from, *to, copied, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d blobs failed to migrate", failed)
+	}
+	return nil
+}
+
+func copyBlob(ctx context.Context, src, dst BlobStore, key, mimeType string, size int64, sum string) error {
+	rc, err := src.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if err := dst.Put(ctx, key, io.TeeReader(rc, h), size, mimeType); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		_ = dst.Delete(ctx, key)
+		return fmt.Errorf("sha256 mismatch: db=%s source=%s", sum, got)
+	}
+	return nil
+}
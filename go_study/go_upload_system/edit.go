@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   编辑帖子 / 附件管理
+=========================== */
+
+//   PATCH  /api/posts/{id}                  {"title":..., "body":..., "visibility":...}，字段可选
+//   POST   /api/posts/{id}/files            multipart：files[] 和/或 uploadIds，追加到末尾
+//   PUT    /api/posts/{id}/files/order      {"fileIds":[3,1,2]}，必须正好是当前全部附件
+//   DELETE /api/posts/{id}/files/{fileId}   移除附件；文件没有其他引用时删除（同 handleDeletePost）
+// 都只允许作者或管理员，成功后返回最新的帖子详情。
+
+const maxJSONBodyBytes = 1 << 20
+
+// postForUpdate 在事务里确认帖子存在且当前用户能修改；返回非 0 状态码表示失败。
+// 看不到的私有帖子按不存在处理，看得到但不是作者的返回 403。
+func postForUpdate(ctx context.Context, tx *sql.Tx, u *User, id int64) (sql.NullInt64, int, string) {
+	var owner sql.NullInt64
+	var visibility string
+	err := tx.QueryRowContext(ctx, `SELECT owner_id, visibility FROM posts WHERE id=?`, id).Scan(&owner, &visibility)
+	if err == sql.ErrNoRows || (err == nil && !canReadPost(u, owner, visibility)) {
+		return owner, http.StatusNotFound, "not found"
+	}
+	if err != nil {
+		return owner, http.StatusInternalServerError, err.Error()
+	}
+	if !canModifyPost(u, owner) {
+		return owner, http.StatusForbidden, "only the author can modify this post"
+	}
+	return owner, 0, ""
+}
+
+func touchPost(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE posts SET updated_at=? WHERE id=?`, time.Now().UTC().Format(time.RFC3339), id)
+	return err
+}
+
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// PATCH /api/posts/{id}
+func (a *App) handleUpdatePost(w http.ResponseWriter, r *http.Request, id int64) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req struct {
+		Title      *string `json:"title"`
+		Body       *string `json:"body"`
+		Visibility *string `json:"visibility"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Title == nil && req.Body == nil && req.Visibility == nil {
+		writeJSONErr(w, http.StatusBadRequest, "nothing to update (title, body or visibility)")
+		return
+	}
+
+	var sets []string
+	var args []any
+	for _, f := range []struct {
+		col string
+		v   *string
+	}{{"title", req.Title}, {"body", req.Body}} {
+		if f.v == nil {
+			continue
+		}
+		v := strings.TrimSpace(*f.v)
+		if v == "" {
+			writeJSONErr(w, http.StatusBadRequest, f.col+" must not be empty")
+			return
+		}
+		sets = append(sets, f.col+"=?")
+		args = append(args, v)
+	}
+	if req.Visibility != nil {
+		if *req.Visibility != "public" && *req.Visibility != "private" {
+			writeJSONErr(w, http.StatusBadRequest, "visibility must be public or private")
+			return
+		}
+		sets = append(sets, "visibility=?")
+		args = append(args, *req.Visibility)
+	}
+	sets = append(sets, "updated_at=?")
+	args = append(args, time.Now().UTC().Format(time.RFC3339), id)
+
+	ctx := r.Context()
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if _, code, msg := postForUpdate(ctx, tx, user, id); code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+	// 全文索引由 posts_fts_au 触发器同步
+	if _, err := tx.ExecContext(ctx, `UPDATE posts SET `+strings.Join(sets, ",")+` WHERE id=?`, args...); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.handleGetPost(w, r, id)
+}
+
+// POST /api/posts/{id}/files
+func (a *App) handleAttachFiles(w http.ResponseWriter, r *http.Request, id int64) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+	if err := r.ParseMultipartForm(maxRequestBytes); err != nil {
+		writeJSONErr(w, http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		return
+	}
+	files := r.MultipartForm.File["files"]
+	uploadIDs := formList(r, "uploadIds")
+	if len(files) == 0 && len(uploadIDs) == 0 {
+		writeJSONErr(w, http.StatusBadRequest, "files or uploadIds required")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	owner, code, msg := postForUpdate(ctx, tx, user, id)
+	if code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+	// 配额记在帖子作者名下（管理员替别人加附件也一样）
+	var quotaUser *User
+	if owner.Valid {
+		if quotaUser, err = userByID(ctx, tx, owner.Int64); err != nil {
+			writeJSONErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	var ord int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(ord),0) FROM post_files WHERE post_id=?`, id).Scan(&ord); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	for _, fh := range files {
+		fm, err := a.saveOneFile(ctx, tx, fh, quotaUser, now)
+		if err != nil {
+			writeJSONErr(w, fileErrStatus(err), "file upload failed: "+err.Error())
+			return
+		}
+		// 已经是这个帖子的附件（同内容文件）时忽略
+		res, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO post_files(post_id, file_id, ord) VALUES(?,?,?)`,
+			id, fm.ID, ord+1,
+		)
+		if err != nil {
+			writeJSONErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			ord++
+		}
+	}
+	if _, err := a.attachUploads(ctx, tx, user, id, uploadIDs, ord); err != nil {
+		writeJSONErr(w, fileErrStatus(err), "file upload failed: "+err.Error())
+		return
+	}
+	if err := touchPost(ctx, tx, id); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.kickScanner()
+	a.handleGetPost(w, r, id)
+}
+
+// DELETE /api/posts/{id}/files/{fileId}
+func (a *App) handleDetachFile(w http.ResponseWriter, r *http.Request, id, fileID int64) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	ctx := r.Context()
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if _, code, msg := postForUpdate(ctx, tx, user, id); code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM post_files WHERE post_id=? AND file_id=?`, id, fileID)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONErr(w, http.StatusNotFound, "file is not attached to this post")
+		return
+	}
+	deleteAfterCommit, err := releaseFiles(ctx, tx, []int64{fileID})
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := touchPost(ctx, tx, id); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.deleteBlobs(ctx, deleteAfterCommit)
+	a.handleGetPost(w, r, id)
+}
+
+// PUT /api/posts/{id}/files/order
+func (a *App) handleReorderFiles(w http.ResponseWriter, r *http.Request, id int64) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var req struct {
+		FileIDs []int64 `json:"fileIds"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if _, code, msg := postForUpdate(ctx, tx, user, id); code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+
+	// 新顺序必须正好覆盖当前全部附件，不能多、不能少、不能重复
+	rows, err := tx.QueryContext(ctx, `SELECT file_id FROM post_files WHERE post_id=?`, id)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	current := map[int64]bool{}
+	for rows.Next() {
+		var fid int64
+		if err := rows.Scan(&fid); err != nil {
+			rows.Close()
+			writeJSONErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		current[fid] = true
+	}
+	rows.Close()
+	seen := map[int64]bool{}
+	for _, fid := range req.FileIDs {
+		if !current[fid] || seen[fid] {
+			writeJSONErr(w, http.StatusBadRequest, fmt.Sprintf("fileIds must list each attachment exactly once (bad id %d)", fid))
+			return
+		}
+		seen[fid] = true
+	}
+	if len(seen) != len(current) {
+		writeJSONErr(w, http.StatusBadRequest, fmt.Sprintf("fileIds must list all %d attachments", len(current)))
+		return
+	}
+
+	for i, fid := range req.FileIDs {
+		if _, err := tx.ExecContext(ctx, `UPDATE post_files SET ord=? WHERE post_id=? AND file_id=?`, i+1, id, fid); err != nil {
+			writeJSONErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := touchPost(ctx, tx, id); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.handleGetPost(w, r, id)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   fsck：数据库与存储的一致性检查
+=========================== */
+
+// 检查项：
+//   - 孤儿文件：存储里有、files 表里没有的对象
+//   - 内容丢失：files 表里有、存储里没有的对象
+//   - 内容不符：大小或 sha256 与 files 表不一致
+//   - 临时文件：uploads/tmp/upload-* / scan-*、没有 uploads 记录的 tus 分片、写了一半的 .put-* / .derive-*
+//   - 无主衍生图：uploads/derived 下 sha256 已不在 files 表里的缓存
+//
+// 上传时先写存储再提交事务，所以孤儿和临时文件只处理修改时间早于 grace 的，避免误删正在进行的上传。
+
+const (
+	fsckGrace         = time.Hour
+	fsckDefaultPeriod = 24 * time.Hour
+)
+
+type fsckOptions struct {
+	Verify       bool // 读取全部内容校验 sha256（慢）
+	CleanOrphans bool // 删除孤儿文件、过期临时文件、无主衍生图
+	DropMissing  bool // 删除内容丢失的 files 行（post_files 级联删除）
+	Grace        time.Duration
+}
+
+type fsckFileRef struct {
+	ID      int64  `json:"id"`
+	RelPath string `json:"relPath"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type fsckReport struct {
+	StartedAt     time.Time     `json:"startedAt"`
+	FinishedAt    time.Time     `json:"finishedAt"`
+	FilesChecked  int           `json:"filesChecked"`
+	BlobsListed   int           `json:"blobsListed"`
+	OrphanBlobs   []string      `json:"orphanBlobs"`
+	MissingBlobs  []fsckFileRef `json:"missingBlobs"`
+	Mismatched    []fsckFileRef `json:"mismatched"`
+	StaleTemp     []string      `json:"staleTemp"`
+	OrphanDerived []string      `json:"orphanDerived"`
+	Repaired      int           `json:"repaired"`
+	Errors        []string      `json:"errors"`
+}
+
+// Problems 是发现的问题总数（修复前）
+func (r *fsckReport) Problems() int {
+	return len(r.OrphanBlobs) + len(r.MissingBlobs) + len(r.Mismatched) + len(r.StaleTemp) + len(r.OrphanDerived)
+}
+
+func (r *fsckReport) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (a *App) fsck(ctx context.Context, opt fsckOptions) (*fsckReport, error) {
+	rep := &fsckReport{
+		StartedAt:     time.Now().UTC(),
+		OrphanBlobs:   []string{},
+		MissingBlobs:  []fsckFileRef{},
+		Mismatched:    []fsckFileRef{},
+		StaleTemp:     []string{},
+		OrphanDerived: []string{},
+		Errors:        []string{},
+	}
+	cutoff := time.Now().Add(-opt.Grace)
+
+	// 1. files 表快照
+	rows, err := a.DB.QueryContext(ctx, `SELECT id,rel_path,size_bytes,sha256 FROM files ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		id        int64
+		key, sum  string
+		sizeBytes int64
+	}
+	var files []row
+	known := map[string]bool{}
+	sums := map[string]bool{}
+	for rows.Next() {
+		var f row
+		if err := rows.Scan(&f.id, &f.key, &f.sizeBytes, &f.sum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, f)
+		known[f.key] = true
+		sums[f.sum] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rep.FilesChecked = len(files)
+
+	// 2. 每行对应的内容是否存在、是否一致
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		st, err := a.Blobs.Stat(ctx, f.key)
+		if errors.Is(err, ErrBlobNotFound) {
+			rep.MissingBlobs = append(rep.MissingBlobs, fsckFileRef{ID: f.id, RelPath: f.key})
+			if opt.DropMissing {
+				if err := a.fsckDropMissing(ctx, f.id, f.key); err != nil {
+					rep.errorf("drop file %d: %v", f.id, err)
+				} else {
+					rep.Repaired++
+				}
+			}
+			continue
+		}
+		if err != nil {
+			rep.errorf("stat %s: %v", f.key, err)
+			continue
+		}
+		if st.Size != f.sizeBytes {
+			rep.Mismatched = append(rep.Mismatched, fsckFileRef{ID: f.id, RelPath: f.key,
+				Detail: fmt.Sprintf("size %d, expected %d", st.Size, f.sizeBytes)})
+			continue
+		}
+		if opt.Verify {
+			got, err := a.blobSHA256(ctx, f.key)
+			if err != nil {
+				rep.errorf("read %s: %v", f.key, err)
+				continue
+			}
+			if got != f.sum {
+				rep.Mismatched = append(rep.Mismatched, fsckFileRef{ID: f.id, RelPath: f.key,
+					Detail: "sha256 " + got + ", expected " + f.sum})
+			}
+		}
+	}
+
+	// 3. 存储里多出来的对象
+	if lister, ok := a.Blobs.(BlobLister); ok {
+		err := lister.List(ctx, "uploads/", func(key string, info BlobInfo) error {
+			rep.BlobsListed++
+			if known[key] || info.ModTime.After(cutoff) {
+				return nil
+			}
+			rep.OrphanBlobs = append(rep.OrphanBlobs, key)
+			if opt.CleanOrphans {
+				// 删除前再确认一次：期间可能刚好有上传提交了这个 key
+				var n int
+				if err := a.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE rel_path=?`, key).Scan(&n); err != nil || n > 0 {
+					return err
+				}
+				if err := a.Blobs.Delete(ctx, key); err != nil {
+					rep.errorf("delete orphan %s: %v", key, err)
+				} else {
+					rep.Repaired++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			rep.errorf("list blobs: %v", err)
+		}
+	} else {
+		rep.errorf("blob backend cannot list objects; orphan check skipped")
+	}
+
+	// 4. 本地临时文件与衍生图缓存（与后端无关，总在本地磁盘）
+	a.fsckLocalTemp(ctx, rep, opt, cutoff)
+	fsckDerived(rep, opt, sums)
+
+	rep.FinishedAt = time.Now().UTC()
+	return rep, nil
+}
+
+func (a *App) blobSHA256(ctx context.Context, key string) (string, error) {
+	rc, err := a.Blobs.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fsckDropMissing 删除内容已丢失的文件记录；删除前再确认一次内容确实不在
+func (a *App) fsckDropMissing(ctx context.Context, id int64, key string) error {
+	if _, err := a.Blobs.Stat(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+		return errors.New("blob reappeared, skipped")
+	}
+	_, err := a.DB.ExecContext(ctx, `DELETE FROM files WHERE id=? AND rel_path=?`, id, key)
+	return err
+}
+
+func (a *App) fsckLocalTemp(ctx context.Context, rep *fsckReport, opt fsckOptions, cutoff time.Time) {
+	liveTus := map[string]bool{}
+	rows, err := a.DB.QueryContext(ctx, `SELECT id FROM uploads`)
+	if err != nil {
+		rep.errorf("list uploads: %v", err)
+		return
+	}
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			liveTus[id] = true
+		}
+	}
+	rows.Close()
+
+	err = filepath.WalkDir(uploadRootDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		inTmp := filepath.Dir(p) == filepath.Join(uploadRootDir, "tmp")
+		stale := false
+		switch {
+		case inTmp && (strings.HasPrefix(name, "upload-") || strings.HasPrefix(name, "scan-")):
+			stale = true
+		case inTmp && strings.HasPrefix(name, "tus-") && strings.HasSuffix(name, ".part"):
+			stale = !liveTus[strings.TrimSuffix(strings.TrimPrefix(name, "tus-"), ".part")]
+		case strings.HasPrefix(name, ".put-"), strings.HasPrefix(name, ".derive-"):
+			stale = true
+		}
+		if !stale {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		rep.StaleTemp = append(rep.StaleTemp, filepath.ToSlash(p))
+		if opt.CleanOrphans {
+			if err := os.Remove(p); err != nil {
+				rep.errorf("remove %s: %v", p, err)
+			} else {
+				rep.Repaired++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		rep.errorf("walk %s: %v", uploadRootDir, err)
+	}
+}
+
+// fsckDerived 衍生图文件名以原图 sha256 开头；原图已不在库里的缓存可以删
+func fsckDerived(rep *fsckReport, opt fsckOptions, sums map[string]bool) {
+	root := filepath.Join(uploadRootDir, "derived")
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || strings.HasPrefix(name, ".") || len(name) < 64 || sums[name[:64]] {
+			return nil
+		}
+		rep.OrphanDerived = append(rep.OrphanDerived, filepath.ToSlash(p))
+		if opt.CleanOrphans {
+			if err := os.Remove(p); err != nil {
+				rep.errorf("remove %s: %v", p, err)
+			} else {
+				rep.Repaired++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		rep.errorf("walk %s: %v", root, err)
+	}
+}
+
+/* ---------- 命令行与定时任务 ---------- */
+
+// runFsckCommand: ./app fsck [-repair] [-drop-missing] [-no-verify] [-json] [-grace 1h]
+// 有未修复的问题时返回错误（退出码 1），方便放进 cron / CI。
+func (a *App) runFsckCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "delete orphan blobs, stale temp files and orphan derivatives")
+	dropMissing := fs.Bool("drop-missing", false, "also delete files rows whose content is missing (detaches them from posts)")
+	noVerify := fs.Bool("no-verify", false, "skip reading every blob to check sha256")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	grace := fs.Duration("grace", fsckGrace, "ignore orphans and temp files newer than this")
+	_ = fs.Parse(args)
+
+	rep, err := a.fsck(ctx, fsckOptions{
+		Verify:       !*noVerify,
+		CleanOrphans: *repair,
+		DropMissing:  *dropMissing,
+		Grace:        *grace,
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	} else {
+		printFsckReport(rep)
+	}
+
+	unresolved := len(rep.Mismatched) + len(rep.Errors)
+	if !*repair {
+		unresolved += len(rep.OrphanBlobs) + len(rep.StaleTemp) + len(rep.OrphanDerived)
+	}
+	if !*dropMissing {
+		unresolved += len(rep.MissingBlobs)
+	}
+	if unresolved > 0 {
+		return fmt.Errorf("fsck: %d problem(s) left", unresolved)
+	}
+	return nil
+}
+
+func printFsckReport(rep *fsckReport) {
+	fmt.Printf("fsck: %d files, %d blobs listed\n", rep.FilesChecked, rep.BlobsListed)
+	section := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Printf("%s (%d):\n", title, len(items))
+		for _, it := range items {
+			fmt.Println("  " + it)
+		}
+	}
+	refs := func(list []fsckFileRef) []string {
+		out := make([]string, 0, len(list))
+		for _, r := range list {
+			s := fmt.Sprintf("#%d %s", r.ID, r.RelPath)
+			if r.Detail != "" {
+				s += ": " + r.Detail
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	section("missing content", refs(rep.MissingBlobs))
+	section("content mismatch (not repaired automatically)", refs(rep.Mismatched))
+	section("orphan blobs", rep.OrphanBlobs)
+	section("stale temp files", rep.StaleTemp)
+	section("orphan derivatives", rep.OrphanDerived)
+	section("errors", rep.Errors)
+	fmt.Printf("problems: %d, repaired: %d\n", rep.Problems(), rep.Repaired)
+}
+
+// runFsckLoop 定期执行 fsck：只做安全的清理（孤儿、临时文件、衍生图），
+// 内容丢失或不一致只记日志，留给人工用 ./app fsck 处理。FSCK_INTERVAL=0 关闭。
+func (a *App) runFsckLoop(ctx context.Context, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rep, err := a.fsck(ctx, fsckOptions{Verify: true, CleanOrphans: true, Grace: fsckGrace})
+		if err != nil {
+			fmt.Println("fsck:", err)
+			continue
+		}
+		if rep.Problems() > 0 || len(rep.Errors) > 0 {
+			fmt.Printf("fsck: %d missing, %d mismatched, %d orphan blobs, %d temp, %d derivatives, repaired %d, errors %d\n",
+				len(rep.MissingBlobs), len(rep.Mismatched), len(rep.OrphanBlobs), len(rep.StaleTemp),
+				len(rep.OrphanDerived), rep.Repaired, len(rep.Errors))
+		}
+	}
+}
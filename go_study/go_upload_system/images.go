@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+/* ===========================
+   图片：去元数据、尺寸、衍生图
+=========================== */
+
+const (
+	maxImagePixels = 40_000_000 // 解码前按 DecodeConfig 拦截超大图（防解压炸弹）
+	maxVariantSide = 2048       // ?w=&h= 的上限
+	jpegQuality    = 85
+)
+
+// 预置衍生图：上传时生成，也可 /files/{id}?variant=thumb|medium 访问
+var imageVariants = map[string]variantSpec{
+	"thumb":  {W: 256, H: 256, Fit: "contain"},
+	"medium": {W: 1024, H: 1024, Fit: "contain"},
+}
+
+// variantSpec 描述一张衍生图。Fit：contain 等比缩放到框内（默认）；
+// cover 等比缩放后居中裁剪填满；fill 拉伸到 W×H。W 或 H 为 0 表示按另一边等比缩放。不放大原图。
+type variantSpec struct {
+	W, H int
+	Fit  string
+}
+
+func (s variantSpec) key() string {
+	return fmt.Sprintf("%dx%d-%s", s.W, s.H, s.Fit)
+}
+
+// parseVariant 解析 ?variant= 或 ?w=&h=&fit=；ok=false 表示请求的是原图
+func parseVariant(q map[string][]string) (spec variantSpec, ok bool, err error) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	if name := get("variant"); name != "" {
+		spec, ok := imageVariants[name]
+		if !ok {
+			return spec, false, fmt.Errorf("unknown variant %q", name)
+		}
+		return spec, true, nil
+	}
+	ws, hs := get("w"), get("h")
+	if ws == "" && hs == "" {
+		return spec, false, nil
+	}
+	side := func(s string) (int, error) {
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxVariantSide {
+			return 0, fmt.Errorf("w/h must be 1..%d", maxVariantSide)
+		}
+		return n, nil
+	}
+	if spec.W, err = side(ws); err != nil {
+		return spec, false, err
+	}
+	if spec.H, err = side(hs); err != nil {
+		return spec, false, err
+	}
+	spec.Fit = get("fit")
+	switch spec.Fit {
+	case "":
+		spec.Fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return spec, false, errors.New("fit must be contain, cover or fill")
+	}
+	if spec.Fit != "contain" && (spec.W == 0 || spec.H == 0) {
+		return spec, false, errors.New("fit=" + spec.Fit + " needs both w and h")
+	}
+	return spec, true, nil
+}
+
+/* ---------- 元数据清理 ---------- */
+
+// sanitizeImage 去掉 EXIF/GPS 等元数据，返回新内容和（校正方向后的）宽高。
+// JPEG：无方向信息时逐段剔除 APP1/APP13/COM，不重新编码；带方向（Orientation≠1）时
+// 按方向旋转后重新编码，避免去掉 EXIF 后图片“躺倒”。PNG：剔除 eXIf 和文本块。GIF 原样保留。
+func sanitizeImage(data []byte, mimeType string) (out []byte, width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid image data: %v", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, 0, 0, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	switch mimeType {
+	case "image/jpeg":
+		if o := jpegOrientation(data); o > 1 && o <= 8 {
+			img, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("invalid image data: %v", err)
+			}
+			img = applyOrientation(img, o)
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+				return nil, 0, 0, err
+			}
+			b := img.Bounds()
+			return buf.Bytes(), b.Dx(), b.Dy(), nil
+		}
+		out, err = stripJPEGMetadata(data)
+	case "image/png":
+		out, err = stripPNGMetadata(data)
+	default:
+		out = data
+	}
+	return out, cfg.Width, cfg.Height, err
+}
+
+// stripJPEGMetadata 删除 APP1（EXIF/XMP）、APP13（IPTC）和 COM 段，其余字节不变
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a jpeg")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, errors.New("corrupt jpeg segment")
+		}
+		marker := data[i+1]
+		if marker == 0xDA { // SOS：之后是压缩数据，原样拷贝
+			return append(out, data[i:]...), nil
+		}
+		if marker == 0xFF { // 填充字节
+			i++
+			continue
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + segLen
+		if segLen < 2 || end > len(data) {
+			return nil, errors.New("corrupt jpeg segment")
+		}
+		switch marker {
+		case 0xE1, 0xED, 0xFE: // APP1 / APP13 / COM
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return nil, errors.New("jpeg without image data")
+}
+
+// jpegOrientation 读取 EXIF Orientation（0x0112），没有则返回 1
+func jpegOrientation(data []byte) int {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA {
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + segLen
+		if segLen < 2 || end > len(data) {
+			break
+		}
+		seg := data[i+4 : end]
+		if marker == 0xE1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(seg[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+func tiffOrientation(t []byte) int {
+	var bo binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(bo.Uint32(t[4:8]))
+	if ifd+2 > len(t) {
+		return 1
+	}
+	n := int(bo.Uint16(t[ifd : ifd+2]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(t) {
+			return 1
+		}
+		if bo.Uint16(t[e:e+2]) == 0x0112 {
+			return int(bo.Uint16(t[e+8 : e+10]))
+		}
+	}
+	return 1
+}
+
+// applyOrientation 把 EXIF 方向 2..8 变换成正向图像
+func applyOrientation(src image.Image, o int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// stripPNGMetadata 删除 eXIf、tEXt、zTXt、iTXt、tIME 块
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if len(data) < len(sig) || string(data[:len(sig)]) != sig {
+		return nil, errors.New("not a png")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:len(sig)]...)
+	i := len(sig)
+	for i+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, errors.New("corrupt png chunk")
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+/* ---------- 衍生图 ---------- */
+
+// derivedRelPath 衍生图缓存路径，按 sha256 + 规格命名，内容相同的文件共用
+func derivedRelPath(sum string, spec variantSpec, mimeType string) string {
+	ext := ".jpg"
+	if mimeType != "image/jpeg" {
+		ext = ".png" // png / gif（取第一帧）统一输出 png
+	}
+	return filepath.ToSlash(filepath.Join("uploads", "derived", sum[:2], sum+"-"+spec.key()+ext))
+}
+
+// ensureDerivative 返回衍生图的绝对路径，缓存里没有就用 open 读原图生成。
+// 衍生图只是缓存，始终放在本地磁盘，原图可以在任意 BlobStore 里。
+func ensureDerivative(open func() (io.ReadCloser, error), sum, mimeType string, spec variantSpec) (string, error) {
+	abs, ok := safeAbsPathFromRel(derivedRelPath(sum, spec, mimeType))
+	if !ok {
+		return "", errors.New("invalid derivative path")
+	}
+	if _, err := os.Stat(abs); err == nil {
+		return abs, nil
+	}
+
+	f, err := open()
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	out := resizeImage(img, spec)
+
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		return "", err
+	}
+	// 先写临时文件再 rename，并发生成同一张图也不会读到半截文件
+	tmp, err := os.CreateTemp(filepath.Dir(abs), ".derive-*")
+	if err != nil {
+		return "", err
+	}
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(tmp, out, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(tmp, out)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), abs); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return abs, nil
+}
+
+// generateVariants 上传时预生成 thumb / medium；失败不影响上传本身
+func generateVariants(open func() (io.ReadCloser, error), sum, mimeType string) {
+	for name, spec := range imageVariants {
+		if _, err := ensureDerivative(open, sum, mimeType, spec); err != nil {
+			fmt.Printf("variant %s for %s: %v\n", name, sum, err)
+		}
+	}
+}
+
+func resizeImage(src image.Image, spec variantSpec) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	srcRect := b
+	var dw, dh int
+
+	switch spec.Fit {
+	case "fill":
+		dw, dh = spec.W, spec.H
+	case "cover":
+		scale := max(float64(spec.W)/float64(sw), float64(spec.H)/float64(sh))
+		if scale > 1 {
+			scale = 1
+		}
+		dw, dh = min(spec.W, sw), min(spec.H, sh)
+		// 源图上与目标宽高比一致的居中区域
+		cw, ch := int(float64(dw)/scale+0.5), int(float64(dh)/scale+0.5)
+		cw, ch = min(cw, sw), min(ch, sh)
+		x0, y0 := b.Min.X+(sw-cw)/2, b.Min.Y+(sh-ch)/2
+		srcRect = image.Rect(x0, y0, x0+cw, y0+ch)
+	default: // contain
+		scale := 1.0
+		if spec.W > 0 {
+			scale = min(scale, float64(spec.W)/float64(sw))
+		}
+		if spec.H > 0 {
+			scale = min(scale, float64(spec.H)/float64(sh))
+		}
+		dw, dh = max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	if _, isGIF := src.(*image.Paletted); isGIF {
+		// 透明 GIF 先铺白底，避免缩放后边缘发黑
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Over, nil)
+	return dst
+}
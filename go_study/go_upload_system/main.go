@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
@@ -8,15 +9,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
-	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -36,15 +36,22 @@ const (
 )
 
 type App struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Blobs BlobStore // 文件内容；BLOB_BACKEND=local（默认）| s3
+
+	Scanners []Scanner     // 上传后的内容扫描（scan.go）
+	scanKick chan struct{} // 新文件入库后唤醒扫描
 }
 
 type Post struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"createdAt"`
-	Files     []File    `json:"files,omitempty"`
+	ID         int64      `json:"id"`
+	Title      string     `json:"title"`
+	Body       string     `json:"body"`
+	OwnerID    int64      `json:"ownerId,omitempty"` // 迁移前的帖子没有作者
+	Visibility string     `json:"visibility"`        // "public" | "private"
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  *time.Time `json:"updatedAt,omitempty"` // PATCH 编辑或增删附件后才有
+	Files      []File     `json:"files,omitempty"`
 }
 
 type File struct {
@@ -55,7 +62,36 @@ type File struct {
 	SizeBytes int64     `json:"sizeBytes"`
 	SHA256    string    `json:"sha256"`
 	RelPath   string    `json:"relPath"`
+	Width     int       `json:"width,omitempty"`  // 仅图片（已按 EXIF 方向校正）
+	Height    int       `json:"height,omitempty"` // 仅图片
 	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url,omitempty"` // 访问地址；私有帖子里是限时签名地址；未通过扫描时为空
+
+	ScanStatus string `json:"scanStatus"`           // quarantined | clean | infected | held
+	ScanDetail string `json:"scanDetail,omitempty"` // 拦截原因，或最近一次扫描出错的原因
+}
+
+// fileColumns 与 scanFile 的字段顺序一致；prefix 用于 JOIN 时的表别名，如 "f."
+func fileColumns(prefix string) string {
+	cols := []string{"id", "orig_name", "kind", "mime", "size_bytes", "sha256", "rel_path", "width", "height", "created_at", "scan_status", "scan_detail"}
+	for i := range cols {
+		cols[i] = prefix + cols[i]
+	}
+	return strings.Join(cols, ",")
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFile(row rowScanner) (File, error) {
+	var f File
+	var ca string
+	if err := row.Scan(&f.ID, &f.OrigName, &f.Kind, &f.MIME, &f.SizeBytes, &f.SHA256, &f.RelPath, &f.Width, &f.Height, &ca, &f.ScanStatus, &f.ScanDetail); err != nil {
+		return File{}, err
+	}
+	f.CreatedAt, _ = time.Parse(time.RFC3339, ca)
+	return f, nil
 }
 
 func main() {
@@ -68,19 +104,87 @@ func main() {
 	}
 	db.SetMaxOpenConns(1)
 
-	app := &App{DB: db}
+	if policy, err = loadUploadPolicy(envOr("UPLOAD_POLICY_FILE", "./data/policy.json")); err != nil {
+		panic(err)
+	}
+
+	blobs, err := openBlobStore(envOr("BLOB_BACKEND", "local"))
+	if err != nil {
+		panic(err)
+	}
+
+	if urlKey, err = loadURLKey(); err != nil {
+		panic(err)
+	}
+
+	scanners, err := loadScanners()
+	if err != nil {
+		panic(err)
+	}
+
+	app := &App{DB: db, Blobs: blobs, Scanners: scanners}
 	if err := app.migrate(context.Background()); err != nil {
 		panic(err)
 	}
 
+	// 子命令：./app migrate-blobs -from local -to s3 / ./app fsck -repair / ./app users add -name alice
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "migrate-blobs":
+			err = app.runMigrateBlobs(context.Background(), os.Args[2:])
+		case "fsck":
+			err = app.runFsckCommand(context.Background(), os.Args[2:])
+		case "users":
+			err = app.runUsersCommand(context.Background(), os.Args[2:])
+		case "reindex":
+			err = app.reindex(context.Background())
+		case "scan":
+			err = app.runScanCommand(context.Background(), os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q (want migrate-blobs, fsck, users, reindex or scan)", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fsckEvery, err := time.ParseDuration(envOr("FSCK_INTERVAL", fsckDefaultPeriod.String()))
+	if err != nil {
+		panic(fmt.Errorf("FSCK_INTERVAL: %v", err))
+	}
+
+	go app.runTusSweeper(context.Background())
+	go app.runFsckLoop(context.Background(), fsckEvery)
+
+	// clamd 连不上不影响启动：文件留在隔离状态，恢复后自动补扫
+	for _, s := range scanners {
+		if c, ok := s.(*clamdScanner); ok {
+			if err := c.Ping(context.Background()); err != nil {
+				fmt.Printf("clamd %s: %v (uploads stay quarantined until it is reachable)\n", c.addr, err)
+			}
+		}
+	}
+	app.scanKick = make(chan struct{}, 1)
+	go app.runScanner(context.Background())
+
 	mux := http.NewServeMux()
 
 	// API
-	mux.HandleFunc("/api/posts", app.handlePosts)     // GET list, POST create
-	mux.HandleFunc("/api/posts/", app.handlePostByID) // GET one, DELETE
+	mux.HandleFunc("/api/posts", app.handlePosts)      // GET list, POST create
+	mux.HandleFunc("/api/posts/", app.handlePostByID)  // GET one, PATCH, DELETE, 附件管理
+	mux.HandleFunc("/api/me", app.handleMe)            // 当前用户 + 配额用量
+	mux.HandleFunc("/api/files/", app.handleFileShare) // POST /api/files/{id}/share
+	mux.HandleFunc("/api/search", app.handleSearch)    // GET ?q=&type=all|post|file
+
+	// tus 1.0 resumable uploads
+	mux.HandleFunc("/api/uploads", app.handleTusUploads) // OPTIONS, POST create
+	mux.HandleFunc(tusBasePath, app.handleTusUpload)     // HEAD, PATCH, DELETE
 
 	// Serve file binary by file id
-	mux.HandleFunc("/files/", app.handleServeFile) // GET /files/{fileId}?download=1
+	mux.HandleFunc("/files/", app.handleServeFile) // GET /files/{fileId}?download=1[&exp=&sig=]
 
 	// Serve the test html (same dir as main.go)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -95,7 +199,7 @@ func main() {
 
 	srv := &http.Server{
 		Addr:              ":8080",
-		Handler:           withCORS(withBasicMiddleware(mux)),
+		Handler:           withCORS(withBasicMiddleware(app.withUser(mux))),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -118,11 +222,13 @@ func withBasicMiddleware(next http.Handler) http.Handler {
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, X-HTTP-Method-Override")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Upload-Metadata, Upload-File-Id")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
-		if r.Method == http.MethodOptions {
+		// 只拦截浏览器预检；tus 的 OPTIONS 能力发现交给后面的 handler
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -150,6 +256,25 @@ func (a *App) migrate(ctx context.Context) error {
 			created_at TEXT NOT NULL
 		);`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS idx_files_sha256 ON files(sha256);`,
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			token_sha256 TEXT NOT NULL UNIQUE,
+			quota_bytes INTEGER NOT NULL,
+			is_admin INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL
+		);`,
+		// tus 断点续传：分片在 uploadRootDir/tmp，收齐后 file_id 指向入库的文件
+		`CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			length INTEGER NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL,
+			metadata TEXT NOT NULL DEFAULT '',
+			file_id INTEGER REFERENCES files(id) ON DELETE SET NULL,
+			created_at TEXT NOT NULL,
+			expires_at TEXT NOT NULL
+		);`,
 		`CREATE TABLE IF NOT EXISTS post_files (
 			post_id INTEGER NOT NULL,
 			file_id INTEGER NOT NULL,
@@ -164,7 +289,71 @@ func (a *App) migrate(ctx context.Context) error {
 			return err
 		}
 	}
-	return nil
+	// 旧库补列：图片宽高（文本为 0）
+	for _, col := range []string{"width", "height"} {
+		if err := a.addColumnIfMissing(ctx, "files", col, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	// 作者 / 上传者；旧数据为 NULL，帖子默认公开
+	for _, t := range []string{"posts", "files", "uploads"} {
+		if err := a.addColumnIfMissing(ctx, t, "owner_id", "INTEGER REFERENCES users(id)"); err != nil {
+			return err
+		}
+	}
+	if err := a.addColumnIfMissing(ctx, "posts", "visibility", "TEXT NOT NULL DEFAULT 'public'"); err != nil {
+		return err
+	}
+	if err := a.addColumnIfMissing(ctx, "posts", "updated_at", "TEXT"); err != nil {
+		return err
+	}
+	// 内容扫描（scan.go）；已有文件视为 clean，需要时用 ./app scan -all 重扫
+	for _, c := range [][2]string{
+		{"scan_status", "TEXT NOT NULL DEFAULT 'clean'"},
+		{"scan_detail", "TEXT NOT NULL DEFAULT ''"},
+		{"scanned_at", "TEXT"},
+	} {
+		if err := a.addColumnIfMissing(ctx, "files", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	for _, s := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_posts_owner ON posts(owner_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_uploads_owner ON uploads(owner_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_post_files_file ON post_files(file_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_files_scan_status ON files(scan_status);`,
+	} {
+		if _, err := a.DB.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	// 全文索引（search.go）
+	return a.migrateSearch(ctx)
+}
+
+func (a *App) addColumnIfMissing(ctx context.Context, table, column, decl string) error {
+	rows, err := a.DB.QueryContext(ctx, `PRAGMA table_info(`+table+`)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = a.DB.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+decl)
+	return err
 }
 
 /* ===========================
@@ -182,21 +371,55 @@ func (a *App) handlePosts(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// /api/posts/{id}
+// /api/posts/{id}/files            POST 追加附件
+// /api/posts/{id}/files/order      PUT 调整顺序
+// /api/posts/{id}/files/{fileId}   DELETE 移除附件
 func (a *App) handlePostByID(w http.ResponseWriter, r *http.Request) {
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/posts/")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/posts/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil || id <= 0 {
 		writeJSONErr(w, http.StatusBadRequest, "invalid id")
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		a.handleGetPost(w, r, id)
-	case http.MethodDelete:
-		a.handleDeletePost(w, r, id)
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			a.handleGetPost(w, r, id)
+		case http.MethodPatch:
+			a.handleUpdatePost(w, r, id)
+		case http.MethodDelete:
+			a.handleDeletePost(w, r, id)
+		default:
+			writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 2 && parts[1] == "files":
+		if r.Method != http.MethodPost {
+			writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.handleAttachFiles(w, r, id)
+	case len(parts) == 3 && parts[1] == "files" && parts[2] == "order":
+		if r.Method != http.MethodPut {
+			writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.handleReorderFiles(w, r, id)
+	case len(parts) == 3 && parts[1] == "files":
+		fileID, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || fileID <= 0 {
+			writeJSONErr(w, http.StatusBadRequest, "invalid file id")
+			return
+		}
+		if r.Method != http.MethodDelete {
+			writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.handleDetachFile(w, r, id, fileID)
 	default:
-		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		writeJSONErr(w, http.StatusNotFound, "not found")
 	}
 }
 
@@ -205,6 +428,10 @@ func (a *App) handlePostByID(w http.ResponseWriter, r *http.Request) {
 =========================== */
 
 func (a *App) handleCreatePost(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
 
 	// Parse multipart
@@ -219,8 +446,17 @@ func (a *App) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 		writeJSONErr(w, http.StatusBadRequest, "title/body required")
 		return
 	}
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = "public"
+	}
+	if visibility != "public" && visibility != "private" {
+		writeJSONErr(w, http.StatusBadRequest, "visibility must be public or private")
+		return
+	}
 
 	files := r.MultipartForm.File["files"] // 多文件：图片+文本
+	uploadIDs := formList(r, "uploadIds")  // 已通过 tus 传完的文件
 	now := time.Now().UTC()
 
 	ctx := r.Context()
@@ -233,8 +469,8 @@ func (a *App) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 
 	// insert post
 	res, err := tx.ExecContext(ctx,
-		`INSERT INTO posts(title, body, created_at) VALUES(?,?,?)`,
-		title, body, now.Format(time.RFC3339),
+		`INSERT INTO posts(title, body, owner_id, visibility, created_at) VALUES(?,?,?,?,?)`,
+		title, body, user.ID, visibility, now.Format(time.RFC3339),
 	)
 	if err != nil {
 		writeJSONErr(w, http.StatusInternalServerError, err.Error())
@@ -246,9 +482,9 @@ func (a *App) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 	ord := 0
 	for _, fh := range files {
 		ord++
-		fm, err := a.saveOneFile(ctx, tx, fh, now)
+		fm, err := a.saveOneFile(ctx, tx, fh, user, now)
 		if err != nil {
-			writeJSONErr(w, http.StatusBadRequest, "file upload failed: "+err.Error())
+			writeJSONErr(w, fileErrStatus(err), "file upload failed: "+err.Error())
 			return
 		}
 		if _, err := tx.ExecContext(ctx,
@@ -261,20 +497,56 @@ func (a *App) handleCreatePost(w http.ResponseWriter, r *http.Request) {
 		saved = append(saved, fm)
 	}
 
+	attached, err := a.attachUploads(ctx, tx, user, postID, uploadIDs, ord)
+	if err != nil {
+		writeJSONErr(w, fileErrStatus(err), "file upload failed: "+err.Error())
+		return
+	}
+	saved = append(saved, attached...)
+
 	if err := tx.Commit(); err != nil {
 		writeJSONErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	a.kickScanner()
 
+	setFileURLs(saved, visibility)
 	writeJSON(w, http.StatusCreated, Post{
-		ID:        postID,
-		Title:     title,
-		Body:      body,
-		CreatedAt: now,
-		Files:     saved,
+		ID:         postID,
+		Title:      title,
+		Body:       body,
+		OwnerID:    user.ID,
+		Visibility: visibility,
+		CreatedAt:  now,
+		Files:      saved,
 	})
 }
 
+// fileErrStatus：超配额 413，其余（类型、大小、内容校验）400
+func fileErrStatus(err error) int {
+	if errors.Is(err, errQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// setFileURLs 填文件访问地址：公开帖子直接用 /files/{id}，私有帖子给 1 小时有效的签名地址。
+// 都带上 v={sha256 前 16 位}，内容寻址，浏览器可以长期缓存。还没通过扫描的文件不给地址
+func setFileURLs(files []File, visibility string) {
+	exp := time.Now().Add(shareDefaultTTL).Truncate(time.Second)
+	for i := range files {
+		if files[i].ScanStatus != scanClean {
+			continue
+		}
+		v := "v=" + files[i].SHA256[:16]
+		if visibility == "private" {
+			files[i].URL = signedFileURL(files[i].ID, exp) + "&" + v
+		} else {
+			files[i].URL = fmt.Sprintf("/files/%d?%s", files[i].ID, v)
+		}
+	}
+}
+
 func (a *App) handleListPosts(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	page := parseIntDefault(q.Get("page"), 1)
@@ -287,10 +559,19 @@ func (a *App) handleListPosts(w http.ResponseWriter, r *http.Request) {
 	}
 	offset := (page - 1) * pageSize
 
+	// 匿名只看公开帖子；登录用户另外能看到自己的私有帖子，管理员看全部
+	var uid int64 = -1
+	admin := false
+	if u := userFrom(r.Context()); u != nil {
+		uid, admin = u.ID, u.Admin
+	}
+
 	ctx := r.Context()
-	rows, err := a.DB.QueryContext(ctx,
-		`SELECT id,title,body,created_at FROM posts ORDER BY id DESC LIMIT ? OFFSET ?`,
-		pageSize, offset,
+	rows, err := a.DB.QueryContext(ctx, `
+		SELECT id,title,body,owner_id,visibility,created_at,updated_at FROM posts
+		WHERE visibility = 'public' OR owner_id = ? OR ?
+		ORDER BY id DESC LIMIT ? OFFSET ?`,
+		uid, admin, pageSize, offset,
 	)
 	if err != nil {
 		writeJSONErr(w, http.StatusInternalServerError, err.Error())
@@ -300,13 +581,11 @@ func (a *App) handleListPosts(w http.ResponseWriter, r *http.Request) {
 
 	var items []Post
 	for rows.Next() {
-		var p Post
-		var ca string
-		if err := rows.Scan(&p.ID, &p.Title, &p.Body, &ca); err != nil {
+		p, _, err := scanPost(rows)
+		if err != nil {
 			writeJSONErr(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		p.CreatedAt, _ = time.Parse(time.RFC3339, ca)
 		items = append(items, p)
 	}
 
@@ -320,11 +599,10 @@ func (a *App) handleListPosts(w http.ResponseWriter, r *http.Request) {
 func (a *App) handleGetPost(w http.ResponseWriter, r *http.Request, id int64) {
 	ctx := r.Context()
 
-	var p Post
-	var ca string
-	err := a.DB.QueryRowContext(ctx, `SELECT id,title,body,created_at FROM posts WHERE id=?`, id).
-		Scan(&p.ID, &p.Title, &p.Body, &ca)
-	if err == sql.ErrNoRows {
+	p, owner, err := scanPost(a.DB.QueryRowContext(ctx,
+		`SELECT id,title,body,owner_id,visibility,created_at,updated_at FROM posts WHERE id=?`, id))
+	// 无权查看的私有帖子按不存在处理，不暴露 id 是否有效
+	if err == sql.ErrNoRows || (err == nil && !canReadPost(userFrom(ctx), owner, p.Visibility)) {
 		writeJSONErr(w, http.StatusNotFound, "not found")
 		return
 	}
@@ -332,10 +610,9 @@ func (a *App) handleGetPost(w http.ResponseWriter, r *http.Request, id int64) {
 		writeJSONErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	p.CreatedAt, _ = time.Parse(time.RFC3339, ca)
 
 	rows, err := a.DB.QueryContext(ctx, `
-		SELECT f.id,f.orig_name,f.kind,f.mime,f.size_bytes,f.sha256,f.rel_path,f.created_at
+		SELECT `+fileColumns("f.")+`
 		FROM files f
 		JOIN post_files pf ON pf.file_id = f.id
 		WHERE pf.post_id = ?
@@ -348,20 +625,40 @@ func (a *App) handleGetPost(w http.ResponseWriter, r *http.Request, id int64) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var f File
-		var fca string
-		if err := rows.Scan(&f.ID, &f.OrigName, &f.Kind, &f.MIME, &f.SizeBytes, &f.SHA256, &f.RelPath, &fca); err != nil {
+		f, err := scanFile(rows)
+		if err != nil {
 			writeJSONErr(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		f.CreatedAt, _ = time.Parse(time.RFC3339, fca)
 		p.Files = append(p.Files, f)
 	}
+	setFileURLs(p.Files, p.Visibility)
 
 	writeJSON(w, http.StatusOK, p)
 }
 
+// scanPost 对应 SELECT id,title,body,owner_id,visibility,created_at,updated_at
+func scanPost(row rowScanner) (Post, sql.NullInt64, error) {
+	var p Post
+	var owner sql.NullInt64
+	var ca string
+	var ua sql.NullString
+	if err := row.Scan(&p.ID, &p.Title, &p.Body, &owner, &p.Visibility, &ca, &ua); err != nil {
+		return Post{}, owner, err
+	}
+	p.OwnerID = owner.Int64
+	p.CreatedAt, _ = time.Parse(time.RFC3339, ca)
+	if t, err := time.Parse(time.RFC3339, ua.String); err == nil {
+		p.UpdatedAt = &t
+	}
+	return p, owner, nil
+}
+
 func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request, id int64) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
 	ctx := r.Context()
 	tx, err := a.DB.BeginTx(ctx, nil)
 	if err != nil {
@@ -370,30 +667,26 @@ func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request, id int64)
 	}
 	defer tx.Rollback()
 
+	if _, code, msg := postForUpdate(ctx, tx, user, id); code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+
 	// 先拿到与 post 关联的文件
-	rows, err := tx.QueryContext(ctx, `
-		SELECT f.id, f.rel_path
-		FROM files f
-		JOIN post_files pf ON pf.file_id = f.id
-		WHERE pf.post_id = ?
-	`, id)
+	rows, err := tx.QueryContext(ctx, `SELECT file_id FROM post_files WHERE post_id = ?`, id)
 	if err != nil {
 		writeJSONErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	type ref struct {
-		FileID  int64
-		RelPath string
-	}
-	var refs []ref
+	var fileIDs []int64
 	for rows.Next() {
-		var rref ref
-		if err := rows.Scan(&rref.FileID, &rref.RelPath); err != nil {
+		var fid int64
+		if err := rows.Scan(&fid); err != nil {
 			rows.Close()
 			writeJSONErr(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		refs = append(refs, rref)
+		fileIDs = append(fileIDs, fid)
 	}
 	rows.Close()
 
@@ -410,20 +703,10 @@ func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request, id int64)
 	}
 
 	// 对每个文件：如果不再被任何 post 引用，则删除 files 表记录（并在 commit 后删磁盘文件）
-	var deleteAfterCommit []string
-	for _, rf := range refs {
-		var cnt int64
-		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM post_files WHERE file_id=?`, rf.FileID).Scan(&cnt); err != nil {
-			writeJSONErr(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		if cnt == 0 {
-			if _, err := tx.ExecContext(ctx, `DELETE FROM files WHERE id=?`, rf.FileID); err != nil {
-				writeJSONErr(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			deleteAfterCommit = append(deleteAfterCommit, rf.RelPath)
-		}
+	deleteAfterCommit, err := releaseFiles(ctx, tx, fileIDs)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -431,15 +714,44 @@ func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request, id int64)
 		return
 	}
 
-	// commit 后删除磁盘文件（不会影响 DB 一致性）
-	for _, rel := range deleteAfterCommit {
-		abs, ok := safeAbsPathFromRel(rel)
-		if ok {
-			_ = os.Remove(abs)
+	// commit 后删除文件内容（不会影响 DB 一致性）
+	a.deleteBlobs(ctx, deleteAfterCommit)
+
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": id})
+}
+
+// releaseFiles 在解除引用（删帖、移除附件、删除 tus 上传）之后调用：
+// 不再被任何帖子或上传引用的文件删除 files 记录，返回要在 commit 之后删除的对象 key
+func releaseFiles(ctx context.Context, tx *sql.Tx, fileIDs []int64) ([]string, error) {
+	var keys []string
+	for _, fid := range fileIDs {
+		var cnt int64
+		if err := tx.QueryRowContext(ctx, `
+			SELECT (SELECT COUNT(*) FROM post_files WHERE file_id=?) + (SELECT COUNT(*) FROM uploads WHERE file_id=?)
+		`, fid, fid).Scan(&cnt); err != nil {
+			return nil, err
+		}
+		if cnt > 0 {
+			continue
+		}
+		var rel string
+		err := tx.QueryRowContext(ctx, `DELETE FROM files WHERE id=? RETURNING rel_path`, fid).Scan(&rel)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		keys = append(keys, rel)
 	}
+	return keys, nil
+}
 
-	writeJSON(w, http.StatusOK, map[string]any{"deleted": id})
+// deleteBlobs 删除 releaseFiles 返回的对象；请求取消也要删完
+func (a *App) deleteBlobs(ctx context.Context, keys []string) {
+	for _, rel := range keys {
+		_ = a.Blobs.Delete(context.WithoutCancel(ctx), rel)
+	}
 }
 
 /* ===========================
@@ -447,7 +759,7 @@ func (a *App) handleDeletePost(w http.ResponseWriter, r *http.Request, id int64)
 =========================== */
 
 func (a *App) handleServeFile(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
@@ -459,10 +771,19 @@ func (a *App) handleServeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	spec, wantVariant, err := parseVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	ctx := r.Context()
-	var relPath, mimeType, origName, kind string
-	err = a.DB.QueryRowContext(ctx, `SELECT rel_path,mime,orig_name,kind FROM files WHERE id=?`, id).
-		Scan(&relPath, &mimeType, &origName, &kind)
+	var relPath, mimeType, origName, kind, sum, createdAt string
+	var size int64
+	var owner sql.NullInt64
+	var scanStatus string
+	err = a.DB.QueryRowContext(ctx, `SELECT rel_path,mime,orig_name,kind,sha256,size_bytes,owner_id,created_at,scan_status FROM files WHERE id=?`, id).
+		Scan(&relPath, &mimeType, &origName, &kind, &sum, &size, &owner, &createdAt, &scanStatus)
 	if err == sql.ErrNoRows {
 		http.NotFound(w, r)
 		return
@@ -472,49 +793,158 @@ func (a *App) handleServeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	abs, ok := safeAbsPathFromRel(relPath)
-	if !ok {
-		http.Error(w, "invalid path", http.StatusForbidden)
-		return
+	// 文件行一经写入内容就不再变（sha256 即内容），带 ?v={sha256 前缀} 的地址可以永久缓存；
+	// v 对不上说明地址过期或被篡改，按不存在处理
+	versioned := false
+	if v := r.URL.Query().Get("v"); v != "" {
+		if len(v) < 8 || !strings.HasPrefix(sum, strings.ToLower(v)) {
+			http.NotFound(w, r)
+			return
+		}
+		versioned = true
 	}
 
-	f, err := os.Open(abs)
+	// 访问控制：公开文件直接给；否则要签名地址，或者登录用户本人有权限。无权限一律 404
+	public, allowed, err := a.fileAccess(ctx, userFrom(ctx), id, owner)
 	if err != nil {
-		http.NotFound(w, r)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 公开文件：版本化地址 immutable；裸 /files/{id} 每次用 ETag 回源确认（304），
+	// 这样改成私有或删除后不会被缓存继续返回
+	cacheControl := "public, no-cache"
+	if versioned {
+		cacheControl = "public, max-age=31536000, immutable"
+	}
+	if !public {
+		if left, ok := verifyFileSig(id, r.URL.Query()); ok {
+			// 浏览器缓存不超过签名剩余有效期
+			cacheControl = fmt.Sprintf("private, max-age=%d", int(min(left, 24*time.Hour).Seconds()))
+			if versioned {
+				cacheControl += ", immutable"
+			}
+		} else if allowed {
+			cacheControl = "private, no-cache"
+			w.Header().Add("Vary", "Authorization")
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// 隔离中 / 被扫描拦截的文件不提供内容（包括衍生图和预签名跳转）；放在权限检查之后，不向无权限的人透露状态
+	if code, msg := fileScanGate(scanStatus); code != 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		if code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "5")
+		}
+		http.Error(w, msg, code)
+		return
+	}
+
+	if checkBlobKey(relPath) != nil {
+		http.Error(w, "invalid path", http.StatusForbidden)
 		return
 	}
-	defer f.Close()
 
 	download := r.URL.Query().Get("download") == "1"
+	var disposition string
+	if download || !inlineKinds[kind] {
+		// 文本 / Office / 压缩包默认下载；UI 预览文本会用 download=0 来 inline fetch
+		if r.URL.Query().Get("download") == "0" {
+			// inline
+		} else {
+			disposition = fmt.Sprintf(`attachment; filename="%s"`, escapeQuoted(safeFilename(origName)))
+		}
+	}
+
+	// 条件请求 / Range：ETag 用内容的 sha256（强校验），Last-Modified 用入库时间。
+	// http.ServeContent 据此处理 If-None-Match / If-Modified-Since（304）、If-Range、If-Match，
+	// 以及单段和多段 Range（206 / multipart/byteranges），音视频拖动进度条靠这个
+	etag := `"` + sum + `"`
+	modTime, _ := time.Parse(time.RFC3339, createdAt)
 
 	// content-type
 	ct := cleanMime(mimeType)
 	if strings.HasPrefix(ct, "text/") && !strings.Contains(ct, "charset") {
 		ct = ct + "; charset=utf-8"
 	}
-	w.Header().Set("Content-Type", ct)
 
-	// disposition
-	if download || kind == "text" {
-		// 文本默认下载；UI 预览会用 download=0 来 inline fetch
-		if r.URL.Query().Get("download") == "0" {
-			// inline
+	// 原图 + 支持预签名的后端 + BLOB_REDIRECT=1：302 到限时地址，由存储直接出流量
+	if p, ok := a.Blobs.(BlobPresigner); ok && !wantVariant && os.Getenv("BLOB_REDIRECT") == "1" {
+		u, err := p.PresignGet(relPath, presignTTL, ct, disposition)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	// 衍生图：?variant=thumb|medium 或 ?w=&h=&fit=，按 sha256 缓存在 uploads/derived
+	if wantVariant {
+		if kind != "image" {
+			http.Error(w, "variants are only available for images", http.StatusBadRequest)
+			return
+		}
+		open := func() (io.ReadCloser, error) { return a.Blobs.Get(ctx, relPath) }
+		dabs, err := ensureDerivative(open, sum, mimeType, spec)
+		if err != nil {
+			if errors.Is(err, ErrBlobNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(dabs)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		if mimeType == "image/jpeg" {
+			w.Header().Set("Content-Type", "image/jpeg")
 		} else {
-			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, escapeQuoted(safeFilename(origName))))
+			w.Header().Set("Content-Type", "image/png")
 		}
+		// 衍生图由原图和参数唯一确定，ETag 带上参数
+		w.Header().Set("ETag", `"`+sum+"-"+spec.key()+`"`)
+		w.Header().Set("Cache-Control", cacheControl)
+		http.ServeContent(w, r, filepath.Base(dabs), modTime, f)
+		return
 	}
 
-	// cache
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	http.ServeContent(w, r, filepath.Base(abs), time.Now(), f)
+	// 原图不存在时直接 404，避免先写了 200 头再失败
+	if _, err := a.Blobs.Stat(ctx, relPath); err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content := newBlobReadSeeker(ctx, a.Blobs, relPath, size)
+	defer content.Close()
+
+	w.Header().Set("Content-Type", ct)
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+
+	// cache：私有文件不进共享缓存
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r, path.Base(relPath), modTime, content)
 }
 
 /* ===========================
    Save file logic (image + text)
 =========================== */
 
-func (a *App) saveOneFile(ctx context.Context, tx *sql.Tx, fh *multipart.FileHeader, now time.Time) (File, error) {
-	if fh.Size > maxFileBytes {
+func (a *App) saveOneFile(ctx context.Context, tx *sql.Tx, fh *multipart.FileHeader, owner *User, now time.Time) (File, error) {
+	if fh.Size > policy.largest() {
 		return File{}, fmt.Errorf("file too large: %d bytes", fh.Size)
 	}
 
@@ -523,17 +953,23 @@ func (a *App) saveOneFile(ctx context.Context, tx *sql.Tx, fh *multipart.FileHea
 		return File{}, err
 	}
 	defer src.Close()
+	return a.saveFileFrom(ctx, tx, src, fh.Filename, owner, now)
+}
 
+// saveFileFrom 是 saveOneFile 的通用部分：嗅探类型、写临时文件、算 sha256、去重、落盘、写元数据。
+// multipart 上传和 tus 断点续传完成后的文件都走这里。owner 为 nil 时不检查配额。
+func (a *App) saveFileFrom(ctx context.Context, tx *sql.Tx, src io.Reader, filename string, owner *User, now time.Time) (File, error) {
 	// sniff head
 	head := make([]byte, 512)
 	n, _ := io.ReadFull(src, head)
 	head = head[:n]
 
-	detected := cleanMime(http.DetectContentType(head))
-	kind, finalMime, ok := classifyFile(detected, fh.Filename)
-	if !ok {
-		return File{}, fmt.Errorf("unsupported file type: detected=%s name=%s", detected, safeFilename(fh.Filename))
+	ft, err := classifyFile(head, filename)
+	if err != nil {
+		return File{}, err
 	}
+	kind, finalMime := ft.Kind, ft.MIME
+	limit := policy.maxBytesFor(kind)
 
 	// temp file
 	tmpDir := filepath.Join(uploadRootDir, "tmp")
@@ -558,91 +994,121 @@ func (a *App) saveOneFile(ctx context.Context, tx *sql.Tx, fh *multipart.FileHea
 		return File{}, err
 	}
 
-	written, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(src, maxFileBytes+1))
+	written, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(src, limit+1))
 	if err != nil {
 		return File{}, err
 	}
 	size := int64(len(head)) + written
-	if size > maxFileBytes {
-		return File{}, fmt.Errorf("file too large after read: %d bytes", size)
+	if size > limit {
+		return File{}, fmt.Errorf("file too large: %s files are limited to %d bytes", kind, limit)
 	}
 	sum := hex.EncodeToString(h.Sum(nil))
 
-	// validate image data
+	// validate image data + strip EXIF/GPS
+	// 清理后的内容才是实际落盘的字节，sha256 / size 按它重算，去重才对得上
+	var width, height int
 	if kind == "image" {
-		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		raw, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			return File{}, err
+		}
+		clean, w, h, err := sanitizeImage(raw, finalMime)
+		if err != nil {
 			return File{}, err
 		}
-		if _, _, err := image.DecodeConfig(tmp); err != nil {
-			return File{}, fmt.Errorf("invalid image data: %v", err)
+		width, height = w, h
+		if !bytes.Equal(clean, raw) {
+			if err := tmp.Truncate(0); err != nil {
+				return File{}, err
+			}
+			if _, err := tmp.WriteAt(clean, 0); err != nil {
+				return File{}, err
+			}
+			s := sha256.Sum256(clean)
+			sum = hex.EncodeToString(s[:])
+			size = int64(len(clean))
 		}
 	}
 
+	// zip / Office：条目数、压缩比检查
+	if ft.Zip != "" {
+		if err := checkZip(tmp, size, ft); err != nil {
+			return File{}, err
+		}
+	}
+
+	// 配额：用户已持有同内容文件时不重复计算
+	if err := checkQuota(ctx, tx, owner, sum, size); err != nil {
+		return File{}, err
+	}
+
 	// dedup by sha256
-	var existing File
-	var ca string
-	err = tx.QueryRowContext(ctx, `
-		SELECT id,orig_name,kind,mime,size_bytes,sha256,rel_path,created_at
-		FROM files WHERE sha256=?
-	`, sum).Scan(&existing.ID, &existing.OrigName, &existing.Kind, &existing.MIME, &existing.SizeBytes, &existing.SHA256, &existing.RelPath, &ca)
+	existing, err := scanFile(tx.QueryRowContext(ctx, `SELECT `+fileColumns("")+` FROM files WHERE sha256=?`, sum))
 	if err == nil {
-		existing.CreatedAt, _ = time.Parse(time.RFC3339, ca)
+		if existing.ScanStatus == scanInfected {
+			return File{}, fmt.Errorf("file blocked by content scan: %s", existing.ScanDetail)
+		}
 		return existing, nil
 	}
 	if err != nil && err != sql.ErrNoRows {
 		return File{}, err
 	}
 
-	// final path
-	ext := guessExt(finalMime, fh.Filename)
-	relDir := filepath.Join("uploads", now.Format("2006"), now.Format("01"), now.Format("02"))
-	finalDir := filepath.Join(dataDir, relDir)
-	if err := os.MkdirAll(finalDir, 0o755); err != nil {
-		return File{}, err
-	}
+	// final key
+	ext := ft.Exts[0]
+	finalRel := path.Join("uploads", now.Format("2006"), now.Format("01"), now.Format("02"), sum+ext)
 
-	finalName := sum + ext
-	finalAbs := filepath.Join(finalDir, finalName)
-	finalRel := filepath.ToSlash(filepath.Join(relDir, finalName))
-
-	// copy tmp -> final
+	// copy tmp -> blob store
 	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
 		return File{}, err
 	}
-	out, err := os.Create(finalAbs)
-	if err != nil {
-		return File{}, err
-	}
-	if _, err := io.Copy(out, tmp); err != nil {
-		out.Close()
-		_ = os.Remove(finalAbs)
-		return File{}, err
-	}
-	if err := out.Close(); err != nil {
-		_ = os.Remove(finalAbs)
+	if err := a.Blobs.Put(ctx, finalRel, tmp, size, finalMime); err != nil {
 		return File{}, err
 	}
 
 	// insert meta
+	var ownerID sql.NullInt64
+	if owner != nil {
+		ownerID = sql.NullInt64{Int64: owner.ID, Valid: true}
+	}
+	// 新文件先隔离，commit 后由 kickScanner 唤醒扫描（scan.go）
 	res, err := tx.ExecContext(ctx, `
-		INSERT INTO files(orig_name,kind,mime,size_bytes,sha256,rel_path,created_at)
-		VALUES(?,?,?,?,?,?,?)
-	`, safeFilename(fh.Filename), kind, finalMime, size, sum, finalRel, now.Format(time.RFC3339))
+		INSERT INTO files(orig_name,kind,mime,size_bytes,sha256,rel_path,width,height,owner_id,created_at,scan_status)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?)
+	`, safeFilename(filename), kind, finalMime, size, sum, finalRel, width, height, ownerID, now.Format(time.RFC3339), scanQuarantined)
 	if err != nil {
-		_ = os.Remove(finalAbs)
+		_ = a.Blobs.Delete(context.WithoutCancel(ctx), finalRel)
 		return File{}, err
 	}
 	fileID, _ := res.LastInsertId()
 
+	// 文本文件进全文索引，和 files 行在同一个事务里
+	if kind == "text" {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return File{}, err
+		}
+		if err := indexTextFile(ctx, tx, fileID, safeFilename(filename), tmp); err != nil {
+			return File{}, err
+		}
+	}
+
+	if kind == "image" {
+		generateVariants(func() (io.ReadCloser, error) { return os.Open(tmp.Name()) }, sum, finalMime)
+	}
+
 	return File{
 		ID:        fileID,
-		OrigName:  safeFilename(fh.Filename),
+		OrigName:  safeFilename(filename),
 		Kind:      kind,
 		MIME:      finalMime,
 		SizeBytes: size,
 		SHA256:    sum,
 		RelPath:   finalRel,
+		Width:     width,
+		Height:    height,
 		CreatedAt: now,
+
+		ScanStatus: scanQuarantined,
 	}, nil
 }
 
@@ -658,62 +1124,6 @@ func cleanMime(m string) string {
 	return strings.ToLower(m)
 }
 
-func classifyFile(detectedMime string, filename string) (kind string, finalMime string, ok bool) {
-	ext := strings.ToLower(filepath.Ext(filename))
-
-	// Images
-	switch detectedMime {
-	case "image/jpeg", "image/png", "image/gif":
-		return "image", detectedMime, true
-	}
-
-	// Text: http.DetectContentType 对文本经常是 text/plain 或 application/octet-stream
-	if strings.HasPrefix(detectedMime, "text/") {
-		return "text", detectedMime, true
-	}
-
-	// 对于被 sniff 成 octet-stream 的文本文件，用扩展名兜底
-	if detectedMime == "application/octet-stream" {
-		switch ext {
-		case ".txt":
-			return "text", "text/plain", true
-		case ".md":
-			return "text", "text/markdown", true
-		case ".csv":
-			return "text", "text/csv", true
-		case ".json":
-			return "text", "application/json", true
-		case ".xml":
-			return "text", "application/xml", true
-		case ".yaml", ".yml":
-			return "text", "text/yaml", true
-		}
-	}
-
-	// 额外允许：json/xml 即使 sniff 不是 text/*
-	if detectedMime == "application/json" || detectedMime == "application/xml" {
-		return "text", detectedMime, true
-	}
-
-	return "", "", false
-}
-
-func guessExt(mimeType, origName string) string {
-	exts, _ := mime.ExtensionsByType(mimeType)
-	if len(exts) > 0 {
-		// 某些平台可能返回 .jpe 之类，保持第一个即可
-		return exts[0]
-	}
-	ext := strings.ToLower(filepath.Ext(origName))
-	// 兜底：仅允许较安全的扩展
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".gif", ".txt", ".md", ".csv", ".json", ".xml", ".yaml", ".yml":
-		return ext
-	default:
-		return ""
-	}
-}
-
 /* ===========================
    Path safety + misc
 =========================== */
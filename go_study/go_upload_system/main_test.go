@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestApp 在临时目录里建库；工作目录也切过去，localBlobStore 写在 ./data 下
+func newTestApp(t *testing.T, store BlobStore) *App {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	db, err := sql.Open("sqlite", "app.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	app := &App{DB: db, Blobs: store}
+	if err := app.migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+/* ---------- /files/{id}：条件请求、Range、HEAD ---------- */
+
+// serveFixture 是一个公开帖子里的文件；内容比 blobChunkMin 大，Range 会跨过 blobReadSeeker 的分块边界
+type serveFixture struct {
+	app     *App
+	url     string
+	etag    string
+	modTime time.Time
+	content []byte
+}
+
+func newServeFixture(t *testing.T, store BlobStore) serveFixture {
+	t.Helper()
+	app := newTestApp(t, store)
+	db, ctx := app.DB, context.Background()
+
+	content := make([]byte, blobChunkMin+100<<10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	const key = "uploads/2025/01/02/serve.bin"
+	if err := store.Put(ctx, key, bytes.NewReader(content), int64(len(content)), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	sum := fmt.Sprintf("%064x", len(content))
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	res, err := db.Exec(`INSERT INTO files(orig_name,kind,mime,size_bytes,sha256,rel_path,created_at,scan_status) VALUES('serve.bin','other','application/octet-stream',?,?,?,?,'clean')`,
+		len(content), sum, key, modTime.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileID, _ := res.LastInsertId()
+	if _, err := db.Exec(`INSERT INTO posts(id,title,body,created_at,visibility) VALUES(1,'p','',?,'public')`, modTime.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO post_files(post_id,file_id) VALUES(1,?)`, fileID); err != nil {
+		t.Fatal(err)
+	}
+	return serveFixture{app: app, url: "/files/" + strconv.FormatInt(fileID, 10), etag: `"` + sum + `"`, modTime: modTime, content: content}
+}
+
+func (f serveFixture) do(method string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, f.url, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	f.app.handleServeFile(w, r)
+	return w
+}
+
+func TestServeFile(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) (BlobStore, func() []string)
+	}{
+		{"local", func(t *testing.T) (BlobStore, func() []string) { return localBlobStore{}, nil }},
+		{"s3", func(t *testing.T) (BlobStore, func() []string) {
+			fake, s := newFakeS3(t)
+			return s, fake.requests
+		}},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			store, requests := b.open(t)
+			f := newServeFixture(t, store)
+			size := len(f.content)
+
+			t.Run("full", func(t *testing.T) {
+				w := f.do(http.MethodGet, nil)
+				if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), f.content) {
+					t.Fatalf("status %d, %d bytes", w.Code, w.Body.Len())
+				}
+				if w.Header().Get("ETag") != f.etag || w.Header().Get("Accept-Ranges") != "bytes" {
+					t.Errorf("headers %v", w.Header())
+				}
+			})
+
+			t.Run("if-none-match", func(t *testing.T) {
+				w := f.do(http.MethodGet, map[string]string{"If-None-Match": f.etag})
+				if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+					t.Fatalf("status %d, %d bytes", w.Code, w.Body.Len())
+				}
+				if w := f.do(http.MethodGet, map[string]string{"If-None-Match": `"other"`}); w.Code != http.StatusOK {
+					t.Errorf("stale etag: status %d", w.Code)
+				}
+			})
+
+			t.Run("if-modified-since", func(t *testing.T) {
+				w := f.do(http.MethodGet, map[string]string{"If-Modified-Since": f.modTime.Format(http.TimeFormat)})
+				if w.Code != http.StatusNotModified {
+					t.Fatalf("status %d", w.Code)
+				}
+				older := f.modTime.Add(-time.Hour).Format(http.TimeFormat)
+				if w := f.do(http.MethodGet, map[string]string{"If-Modified-Since": older}); w.Code != http.StatusOK {
+					t.Errorf("older date: status %d", w.Code)
+				}
+			})
+
+			t.Run("single range", func(t *testing.T) {
+				// 跨过第一块的末尾
+				lo, hi := blobChunkMin-10, blobChunkMin+9
+				w := f.do(http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", lo, hi)})
+				if w.Code != http.StatusPartialContent {
+					t.Fatalf("status %d", w.Code)
+				}
+				if want := fmt.Sprintf("bytes %d-%d/%d", lo, hi, size); w.Header().Get("Content-Range") != want {
+					t.Errorf("Content-Range %q, want %q", w.Header().Get("Content-Range"), want)
+				}
+				if !bytes.Equal(w.Body.Bytes(), f.content[lo:hi+1]) {
+					t.Errorf("body differs (%d bytes)", w.Body.Len())
+				}
+			})
+
+			t.Run("multi range", func(t *testing.T) {
+				w := f.do(http.MethodGet, map[string]string{"Range": "bytes=0-9,300000-300009,-5"})
+				if w.Code != http.StatusPartialContent {
+					t.Fatalf("status %d", w.Code)
+				}
+				mt, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+				if err != nil || mt != "multipart/byteranges" {
+					t.Fatalf("Content-Type %q", w.Header().Get("Content-Type"))
+				}
+				want := [][2]int{{0, 10}, {300000, 300010}, {size - 5, size}}
+				mr := multipart.NewReader(w.Body, params["boundary"])
+				for i, span := range want {
+					part, err := mr.NextPart()
+					if err != nil {
+						t.Fatalf("part %d: %v", i, err)
+					}
+					if cr := fmt.Sprintf("bytes %d-%d/%d", span[0], span[1]-1, size); part.Header.Get("Content-Range") != cr {
+						t.Errorf("part %d: Content-Range %q, want %q", i, part.Header.Get("Content-Range"), cr)
+					}
+					data, _ := io.ReadAll(part)
+					if !bytes.Equal(data, f.content[span[0]:span[1]]) {
+						t.Errorf("part %d: body differs", i)
+					}
+				}
+				if _, err := mr.NextPart(); err != io.EOF {
+					t.Errorf("extra part: %v", err)
+				}
+			})
+
+			t.Run("if-range", func(t *testing.T) {
+				w := f.do(http.MethodGet, map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`})
+				if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), f.content) {
+					t.Fatalf("mismatch: status %d, %d bytes", w.Code, w.Body.Len())
+				}
+				w = f.do(http.MethodGet, map[string]string{"Range": "bytes=0-9", "If-Range": f.etag})
+				if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), f.content[:10]) {
+					t.Fatalf("match: status %d, %d bytes", w.Code, w.Body.Len())
+				}
+			})
+
+			t.Run("head", func(t *testing.T) {
+				w := f.do(http.MethodHead, nil)
+				if w.Code != http.StatusOK || w.Body.Len() != 0 {
+					t.Fatalf("status %d, %d bytes", w.Code, w.Body.Len())
+				}
+				if w.Header().Get("Content-Length") != strconv.Itoa(size) || w.Header().Get("ETag") != f.etag {
+					t.Errorf("headers %v", w.Header())
+				}
+			})
+
+			// S3 上每次读都应该是 Range 请求，不能把整个对象拉下来
+			if requests != nil {
+				for _, r := range requests() {
+					if strings.HasPrefix(r, "GET ") && !strings.Contains(r, "bytes=") {
+						t.Errorf("GET without Range: %q", r)
+					}
+				}
+			}
+		})
+	}
+}
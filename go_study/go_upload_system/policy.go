@@ -0,0 +1,372 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+/* ===========================
+   类型策略：允许的类型 / 扩展名、按类别的大小上限、魔数校验、zip 炸弹防护
+=========================== */
+
+// fileType 是一种内置支持的文件类型。Exts 第一个是落盘时用的扩展名。
+// Magic 校验文件头（前 512 字节）；声明了扩展名的文件内容必须与之匹配。
+type fileType struct {
+	MIME  string
+	Kind  string // image | text | pdf | office | audio | video | archive
+	Exts  []string
+	Magic func(head []byte) bool
+	Zip   string // 基于 zip 的格式：需要做 zip 检查；OOXML 另外要求包含该目录
+}
+
+var fileTypes = []fileType{
+	{MIME: "image/jpeg", Kind: "image", Exts: []string{".jpg", ".jpeg", ".jfif"}, Magic: prefix("\xFF\xD8\xFF")},
+	{MIME: "image/png", Kind: "image", Exts: []string{".png"}, Magic: prefix("\x89PNG\r\n\x1a\n")},
+	{MIME: "image/gif", Kind: "image", Exts: []string{".gif"}, Magic: anyPrefix("GIF87a", "GIF89a")},
+
+	{MIME: "text/plain", Kind: "text", Exts: []string{".txt", ".log"}, Magic: looksLikeText},
+	{MIME: "text/markdown", Kind: "text", Exts: []string{".md"}, Magic: looksLikeText},
+	{MIME: "text/csv", Kind: "text", Exts: []string{".csv"}, Magic: looksLikeText},
+	{MIME: "application/json", Kind: "text", Exts: []string{".json"}, Magic: looksLikeText},
+	{MIME: "application/xml", Kind: "text", Exts: []string{".xml"}, Magic: looksLikeText},
+	{MIME: "text/yaml", Kind: "text", Exts: []string{".yaml", ".yml"}, Magic: looksLikeText},
+
+	{MIME: "application/pdf", Kind: "pdf", Exts: []string{".pdf"}, Magic: prefix("%PDF-")},
+
+	{MIME: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Kind: "office", Exts: []string{".docx"}, Magic: isZip, Zip: "word/"},
+	{MIME: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Kind: "office", Exts: []string{".xlsx"}, Magic: isZip, Zip: "xl/"},
+	{MIME: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Kind: "office", Exts: []string{".pptx"}, Magic: isZip, Zip: "ppt/"},
+	// 老格式都是 OLE 复合文档，文件头区分不了 doc/xls/ppt，只校验是 OLE
+	{MIME: "application/msword", Kind: "office", Exts: []string{".doc"}, Magic: prefix("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	{MIME: "application/vnd.ms-excel", Kind: "office", Exts: []string{".xls"}, Magic: prefix("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	{MIME: "application/vnd.ms-powerpoint", Kind: "office", Exts: []string{".ppt"}, Magic: prefix("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+
+	{MIME: "audio/mpeg", Kind: "audio", Exts: []string{".mp3"}, Magic: isMP3},
+	{MIME: "audio/wav", Kind: "audio", Exts: []string{".wav"}, Magic: riff("WAVE")},
+	{MIME: "audio/ogg", Kind: "audio", Exts: []string{".ogg", ".oga"}, Magic: prefix("OggS")},
+	{MIME: "audio/flac", Kind: "audio", Exts: []string{".flac"}, Magic: prefix("fLaC")},
+	{MIME: "audio/mp4", Kind: "audio", Exts: []string{".m4a"}, Magic: ftyp("M4A ", "M4B ", "mp42", "isom")},
+
+	{MIME: "video/mp4", Kind: "video", Exts: []string{".mp4", ".m4v"}, Magic: ftyp("isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "dash")},
+	{MIME: "video/quicktime", Kind: "video", Exts: []string{".mov"}, Magic: ftyp("qt  ")},
+	{MIME: "video/webm", Kind: "video", Exts: []string{".webm"}, Magic: prefix("\x1A\x45\xDF\xA3")},
+
+	{MIME: "application/zip", Kind: "archive", Exts: []string{".zip"}, Magic: isZip, Zip: "-"},
+}
+
+// uploadPolicy 可由 UPLOAD_POLICY_FILE 指向的 JSON 覆盖，未写的字段用默认值
+type uploadPolicy struct {
+	// 允许的 MIME 或扩展名（如 "application/pdf"、".docx"、"image/*"）；空 = 全部内置类型
+	Allow []string `json:"allow"`
+	// 按类别的单文件上限（字节），未列出的类别用 defaultMaxBytes
+	MaxBytes map[string]int64 `json:"maxBytes"`
+
+	ZipMaxEntries           int     `json:"zipMaxEntries"`
+	ZipMaxRatio             float64 `json:"zipMaxRatio"` // 解压后总大小 / 压缩包大小
+	ZipMaxUncompressedBytes int64   `json:"zipMaxUncompressedBytes"`
+}
+
+var defaultMaxBytes = map[string]int64{
+	"image":   maxFileBytes, // 图片要整张读进内存去元数据，保持 15MB
+	"text":    maxFileBytes,
+	"pdf":     50 << 20,
+	"office":  50 << 20,
+	"audio":   100 << 20,
+	"video":   500 << 20,
+	"archive": 100 << 20,
+}
+
+var policy = defaultUploadPolicy()
+
+func defaultUploadPolicy() uploadPolicy {
+	p := uploadPolicy{
+		MaxBytes:                map[string]int64{},
+		ZipMaxEntries:           10000,
+		ZipMaxRatio:             100,
+		ZipMaxUncompressedBytes: 1 << 30,
+	}
+	for k, v := range defaultMaxBytes {
+		p.MaxBytes[k] = v
+	}
+	return p
+}
+
+// loadUploadPolicy 读取 JSON 配置；文件不存在时用默认策略
+func loadUploadPolicy(path string) (uploadPolicy, error) {
+	p := defaultUploadPolicy()
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	var cfg uploadPolicy
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+	p.Allow = cfg.Allow
+	for k, v := range cfg.MaxBytes {
+		if _, ok := defaultMaxBytes[k]; !ok {
+			return p, fmt.Errorf("%s: unknown kind %q in maxBytes", path, k)
+		}
+		p.MaxBytes[k] = v
+	}
+	if cfg.ZipMaxEntries > 0 {
+		p.ZipMaxEntries = cfg.ZipMaxEntries
+	}
+	if cfg.ZipMaxRatio > 0 {
+		p.ZipMaxRatio = cfg.ZipMaxRatio
+	}
+	if cfg.ZipMaxUncompressedBytes > 0 {
+		p.ZipMaxUncompressedBytes = cfg.ZipMaxUncompressedBytes
+	}
+	return p, nil
+}
+
+func (p uploadPolicy) allows(t fileType) bool {
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, a := range p.Allow {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == t.MIME:
+			return true
+		case strings.HasSuffix(a, "/*") && strings.HasPrefix(t.MIME, strings.TrimSuffix(a, "*")):
+			return true
+		case strings.HasPrefix(a, "."):
+			for _, e := range t.Exts {
+				if e == a {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// maxBytesFor 返回类别上限
+func (p uploadPolicy) maxBytesFor(kind string) int64 {
+	if n, ok := p.MaxBytes[kind]; ok && n > 0 {
+		return n
+	}
+	return defaultMaxBytes[kind]
+}
+
+// largest 是所有允许类别里最大的上限（tus 的 Tus-Max-Size、扩展名未知时的预检）
+func (p uploadPolicy) largest() int64 {
+	var n int64
+	for _, t := range fileTypes {
+		if p.allows(t) {
+			n = max(n, p.maxBytesFor(t.Kind))
+		}
+	}
+	return n
+}
+
+// typeByExt 按扩展名找内置类型
+func typeByExt(filename string) (fileType, bool) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return fileType{}, false
+	}
+	for _, t := range fileTypes {
+		for _, e := range t.Exts {
+			if e == ext {
+				return t, true
+			}
+		}
+	}
+	return fileType{}, false
+}
+
+// classifyFile 决定文件类型：
+//   - 扩展名是已知类型：文件头必须匹配，否则拒绝（防止 .pdf 里装的是别的东西）
+//   - 没有扩展名或扩展名未知：按文件头识别，二进制格式优先，最后才当文本
+//
+// 类型不在策略允许范围内同样拒绝。
+func classifyFile(head []byte, filename string) (fileType, error) {
+	if t, ok := typeByExt(filename); ok {
+		if !t.Magic(head) {
+			return fileType{}, fmt.Errorf("content does not match extension %s", strings.ToLower(filepath.Ext(filename)))
+		}
+		if !policy.allows(t) {
+			return fileType{}, fmt.Errorf("file type not allowed: %s", t.MIME)
+		}
+		return t, nil
+	}
+
+	var found *fileType
+	for i := range fileTypes {
+		t := &fileTypes[i]
+		if t.Kind == "text" || t.Zip != "" && t.Zip != "-" {
+			continue // 文本放最后；OOXML 必须靠扩展名声明，否则按普通 zip
+		}
+		if t.Magic(head) {
+			found = t
+			break
+		}
+	}
+	if found == nil && looksLikeText(head) {
+		found = &fileTypes[textPlainIndex()]
+	}
+	if found == nil {
+		detected := cleanMime(http.DetectContentType(head))
+		return fileType{}, fmt.Errorf("unsupported file type: detected=%s name=%s", detected, safeFilename(filename))
+	}
+	if !policy.allows(*found) {
+		return fileType{}, fmt.Errorf("file type not allowed: %s", found.MIME)
+	}
+	return *found, nil
+}
+
+func textPlainIndex() int {
+	for i, t := range fileTypes {
+		if t.MIME == "text/plain" {
+			return i
+		}
+	}
+	panic("text/plain missing from fileTypes")
+}
+
+/* ---------- 魔数 ---------- */
+
+func prefix(p string) func([]byte) bool {
+	return func(h []byte) bool { return bytes.HasPrefix(h, []byte(p)) }
+}
+
+func anyPrefix(ps ...string) func([]byte) bool {
+	return func(h []byte) bool {
+		for _, p := range ps {
+			if bytes.HasPrefix(h, []byte(p)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func riff(form string) func([]byte) bool {
+	return func(h []byte) bool {
+		return len(h) >= 12 && string(h[:4]) == "RIFF" && string(h[8:12]) == form
+	}
+}
+
+// ftyp 匹配 ISO BMFF（mp4/mov/m4a）：box 类型 ftyp + 主品牌或兼容品牌
+func ftyp(brands ...string) func([]byte) bool {
+	return func(h []byte) bool {
+		if len(h) < 12 || string(h[4:8]) != "ftyp" {
+			return false
+		}
+		boxLen := int(h[0])<<24 | int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		end := min(len(h), max(boxLen, 12))
+		for i := 8; i+4 <= end; i += 4 {
+			if i == 12 {
+				continue // minor version
+			}
+			for _, b := range brands {
+				if string(h[i:i+4]) == b {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func isZip(h []byte) bool {
+	return bytes.HasPrefix(h, []byte("PK\x03\x04")) || bytes.HasPrefix(h, []byte("PK\x05\x06"))
+}
+
+// isMP3：ID3 标签或 MPEG 音频帧同步字
+func isMP3(h []byte) bool {
+	if bytes.HasPrefix(h, []byte("ID3")) {
+		return true
+	}
+	return len(h) >= 2 && h[0] == 0xFF && h[1]&0xE0 == 0xE0 && h[1]&0x06 != 0
+}
+
+// looksLikeText：没有 NUL、是合法 UTF-8（末尾被截断的半个字符不算错）
+func looksLikeText(h []byte) bool {
+	if bytes.IndexByte(h, 0) >= 0 {
+		return false
+	}
+	for i := 0; i < utf8.UTFMax && len(h) > 0 && !utf8.Valid(h); i++ {
+		h = h[:len(h)-1]
+	}
+	return utf8.Valid(h)
+}
+
+/* ---------- zip 检查 ---------- */
+
+// checkZip 防 zip 炸弹：条目数、解压总量、压缩比。先看目录里声明的大小，
+// 再实际解压一遍计数（声明的大小可以伪造），超过上限立即停止。
+// OOXML（docx/xlsx/pptx）另外要求有 [Content_Types].xml 和对应目录。
+func checkZip(r io.ReaderAt, size int64, t fileType) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", t.Exts[0], err)
+	}
+	if len(zr.File) > policy.ZipMaxEntries {
+		return fmt.Errorf("archive has too many entries: %d > %d", len(zr.File), policy.ZipMaxEntries)
+	}
+	limit := policy.ZipMaxUncompressedBytes
+	if byRatio := int64(policy.ZipMaxRatio * float64(max(size, 1))); byRatio < limit {
+		limit = byRatio
+	}
+
+	var declared uint64
+	hasTypes, hasDir := false, t.Zip == "-"
+	for _, f := range zr.File {
+		declared += f.UncompressedSize64
+		if f.Name == "[Content_Types].xml" {
+			hasTypes = true
+		}
+		if t.Zip != "-" && strings.HasPrefix(f.Name, t.Zip) {
+			hasDir = true
+		}
+	}
+	if declared > uint64(limit) {
+		return fmt.Errorf("archive expands too much: %d bytes from %d (limit %d)", declared, size, limit)
+	}
+	if t.Zip != "-" && (!hasTypes || !hasDir) {
+		return fmt.Errorf("content does not match extension %s", t.Exts[0])
+	}
+
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("invalid archive entry %q: %v", f.Name, err)
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(rc, limit-total+1))
+		rc.Close()
+		total += n
+		if total > limit {
+			return fmt.Errorf("archive expands too much: more than %d bytes from %d", limit, size)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive entry %q: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// inlineKinds 可以在浏览器里直接打开的类别；其余（文本、Office、压缩包）默认作为附件下载
+var inlineKinds = map[string]bool{"image": true, "pdf": true, "audio": true, "video": true}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===========================
+   上传后内容扫描：隔离 → 扫描 → 放行 / 拦截
+=========================== */
+
+// 文件入库时 scan_status = quarantined，/files/{id} 不提供内容；后台按顺序跑完所有扫描器：
+//   - 都没命中：clean，正常访问
+//   - 任一命中：infected，记录扫描器和原因，内容保留在存储里但永远不再提供（同内容重传会命中去重，仍是 infected）
+//   - 扫描器出错（如 clamd 连不上）：保持 quarantined，scanRetryEvery 后重试
+//   - 扫描器拒绝扫描（文件超过 clamd 的大小上限）：held，没扫过就不算 clean，也不自动重试；
+//     运维确认后用 ./app scan -release {id} 放行
+//
+// 扫描器：
+//   - svg：文本文件里的 SVG / XHTML（.xml 按 application/xml 打开时浏览器会执行其中的脚本）
+//   - polyglot：同时是另一种格式的文件，如 JPEG + zip、图片里的 HTML / PHP、图片结尾后的附加数据
+//   - clamd：设置 CLAMD_ADDR 后启用，走 clamd 的 INSTREAM 协议；任何实现了该协议的服务（包括本地假服务）都可以
+//
+// 迁移前的文件默认 clean；./app scan -all 可以用当前扫描器重扫全部文件（已拦截的除非加 -infected）。
+
+const (
+	scanQuarantined = "quarantined"
+	scanClean       = "clean"
+	scanInfected    = "infected"
+	scanHeld        = "held"
+
+	scanRetryEvery = time.Minute
+	scanBatch      = 20
+
+	clamdChunkBytes = 64 << 10
+	clamdTimeout    = 2 * time.Minute
+)
+
+// Scanner 检查一个文件的内容。返回非空字符串表示命中（病毒签名或原因），
+// 返回 error 表示没能完成扫描，文件保持隔离，稍后重试；
+// 返回包装了 errNotScanned 的 error 表示这个文件它不会扫（重试也没用），文件转为 held。
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, f File, content io.ReaderAt) (string, error)
+}
+
+var errNotScanned = errors.New("not scanned")
+
+// loadScanners：SCANNERS 为内置扫描器列表（默认 "svg,polyglot"，"none" 关闭），
+// CLAMD_ADDR（host:port 或 unix:/path/clamd.sock）另外加上 clamd
+func loadScanners() ([]Scanner, error) {
+	var out []Scanner
+	for _, name := range strings.Split(envOr("SCANNERS", "svg,polyglot"), ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "svg":
+			out = append(out, svgScanner{})
+		case "polyglot":
+			out = append(out, polyglotScanner{})
+		default:
+			return nil, fmt.Errorf("SCANNERS: unknown scanner %q (want svg, polyglot or none)", name)
+		}
+	}
+	if addr := envOr("CLAMD_ADDR", ""); addr != "" {
+		c := newClamdScanner(addr)
+		if s := envOr("CLAMD_MAX_BYTES", ""); s != "" {
+			n, err := parseByteSize(s)
+			if err != nil {
+				return nil, fmt.Errorf("CLAMD_MAX_BYTES: %v", err)
+			}
+			c.maxBytes = n
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// kickScanner 在新文件提交后唤醒后台扫描，不阻塞；子命令里 scanKick 为 nil，什么都不做
+func (a *App) kickScanner() {
+	select {
+	case a.scanKick <- struct{}{}:
+	default:
+	}
+}
+
+// runScanner 扫描所有隔离中的文件；有新文件时被 kickScanner 唤醒，否则定期重试失败的
+func (a *App) runScanner(ctx context.Context) {
+	t := time.NewTicker(scanRetryEvery)
+	defer t.Stop()
+	for {
+		if n, err := a.scanPending(ctx); err != nil {
+			fmt.Println("scan:", err)
+		} else if n > 0 {
+			fmt.Printf("scan: %d file(s) still quarantined after errors\n", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.scanKick:
+		case <-t.C:
+		}
+	}
+}
+
+// scanPending 按 id 顺序扫一遍隔离中的文件，返回因出错仍在隔离的数量
+func (a *App) scanPending(ctx context.Context) (int, error) {
+	var after int64
+	failed := 0
+	for {
+		files, err := a.filesByScanStatus(ctx, scanQuarantined, after)
+		if err != nil {
+			return failed, err
+		}
+		if len(files) == 0 {
+			return failed, nil
+		}
+		for _, f := range files {
+			after = f.ID
+			if _, err := a.scanAndRecord(ctx, f); err != nil {
+				if ctx.Err() != nil {
+					return failed, ctx.Err()
+				}
+				fmt.Printf("scan: file %d: %v\n", f.ID, err)
+				failed++
+			}
+		}
+	}
+}
+
+// filesByScanStatus 分批取文件；status 为空表示全部
+func (a *App) filesByScanStatus(ctx context.Context, status string, after int64) ([]File, error) {
+	rows, err := a.DB.QueryContext(ctx,
+		`SELECT `+fileColumns("")+` FROM files WHERE id > ? AND (? = '' OR scan_status = ?) ORDER BY id LIMIT ?`,
+		after, status, status, scanBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+// scanAndRecord 扫描一个文件并写回结果。出错时只记录原因，状态不变。
+func (a *App) scanAndRecord(ctx context.Context, f File) (string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	status, detail, err := a.scanBlob(ctx, f)
+	if err != nil {
+		_, _ = a.DB.ExecContext(ctx, `UPDATE files SET scan_detail=? WHERE id=?`, "scan error: "+err.Error(), f.ID)
+		return "", err
+	}
+	if _, err := a.DB.ExecContext(ctx,
+		`UPDATE files SET scan_status=?, scan_detail=?, scanned_at=? WHERE id=?`,
+		status, detail, now, f.ID); err != nil {
+		return "", err
+	}
+	switch status {
+	case scanInfected:
+		fmt.Printf("scan: file %d (%s) blocked: %s\n", f.ID, f.OrigName, detail)
+	case scanHeld:
+		fmt.Printf("scan: file %d (%s) held: %s; release with ./app scan -release %d\n", f.ID, f.OrigName, detail, f.ID)
+	}
+	return status, nil
+}
+
+// scanBlob 把内容取到本地临时文件（S3 上的对象也只下载一次），依次交给每个扫描器
+func (a *App) scanBlob(ctx context.Context, f File) (status, detail string, err error) {
+	rc, err := a.Blobs.Get(ctx, f.RelPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer rc.Close()
+
+	tmpDir := filepath.Join(uploadRootDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return "", "", err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "scan-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	n, err := io.Copy(tmp, rc)
+	if err != nil {
+		return "", "", err
+	}
+	f.SizeBytes = n
+	return runScanners(ctx, a.Scanners, f, tmp)
+}
+
+// runScanners 依次跑扫描器；有扫描器没扫时仍跑完其余的，命中优先于 held
+func runScanners(ctx context.Context, scanners []Scanner, f File, content io.ReaderAt) (status, detail string, err error) {
+	var skipped []string
+	for _, s := range scanners {
+		hit, err := s.Scan(ctx, f, content)
+		if errors.Is(err, errNotScanned) {
+			skipped = append(skipped, s.Name()+": "+err.Error())
+			continue
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %v", s.Name(), err)
+		}
+		if hit != "" {
+			return scanInfected, s.Name() + ": " + hit, nil
+		}
+	}
+	if len(skipped) > 0 {
+		return scanHeld, strings.Join(skipped, "; "), nil
+	}
+	return scanClean, "", nil
+}
+
+/* ---------- clamd ---------- */
+
+// clamdScanner 是 clamd 的最小客户端：一次连接一条命令，用 z 前缀（命令和回复都以 NUL 结尾）。
+// INSTREAM 把内容切成「4 字节大端长度 + 数据」的块发送，长度 0 表示结束，回复形如
+//
+//	stream: OK
+//	stream: Eicar-Test-Signature FOUND
+//	INSTREAM size limit exceeded. ERROR
+//
+// 超过大小上限的文件（本地 maxBytes 或 clamd 回复 size limit exceeded）返回 errNotScanned，文件转为 held。
+type clamdScanner struct {
+	network, addr string
+	timeout       time.Duration
+	maxBytes      int64 // 大于此大小的文件不发给 clamd（应与 clamd 的 StreamMaxLength 一致）；0 = 不限
+}
+
+func newClamdScanner(addr string) *clamdScanner {
+	c := &clamdScanner{network: "tcp", addr: strings.TrimPrefix(addr, "tcp:"), timeout: clamdTimeout}
+	if p, ok := strings.CutPrefix(addr, "unix:"); ok {
+		c.network, c.addr = "unix", p
+	} else if strings.HasPrefix(addr, "/") {
+		c.network = "unix"
+	}
+	return c
+}
+
+func (c *clamdScanner) Name() string { return "clamd" }
+
+func (c *clamdScanner) Scan(ctx context.Context, f File, content io.ReaderAt) (string, error) {
+	if c.maxBytes > 0 && f.SizeBytes > c.maxBytes {
+		return "", fmt.Errorf("%w: too large (%d > %d bytes)", errNotScanned, f.SizeBytes, c.maxBytes)
+	}
+	reply, err := c.command(ctx, "INSTREAM", io.NewSectionReader(content, 0, f.SizeBytes))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return "", fmt.Errorf("%w: too large for clamd StreamMaxLength (%d bytes)", errNotScanned, f.SizeBytes)
+	default:
+		return "", errors.New(reply)
+	}
+}
+
+// Ping 用于启动时确认 clamd 可用
+func (c *clamdScanner) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func (c *clamdScanner) command(ctx context.Context, cmd string, body io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, "z"+cmd+"\x00"); err != nil {
+		return "", err
+	}
+	if body != nil {
+		buf := make([]byte, 4+clamdChunkBytes)
+		for {
+			n, rerr := io.ReadFull(body, buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf, uint32(n))
+				if _, err := conn.Write(buf[:4+n]); err != nil {
+					// 超过 StreamMaxLength 时 clamd 先回复再断开，有回复就用回复
+					if reply, rerr := readClamdReply(conn); rerr == nil {
+						return reply, nil
+					}
+					return "", err
+				}
+			}
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				break
+			}
+			if rerr != nil {
+				return "", rerr
+			}
+		}
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return "", err
+		}
+	}
+	return readClamdReply(conn)
+}
+
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", fmt.Errorf("read reply: %v", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+/* ---------- SVG / XHTML 脚本 ---------- */
+
+const (
+	svgNS   = "http://www.w3.org/2000/svg"
+	xhtmlNS = "http://www.w3.org/1999/xhtml"
+)
+
+// 在 SVG / XHTML 里能执行脚本或嵌入其它文档的元素
+var svgActiveElements = map[string]bool{
+	"script": true, "handler": true, "foreignobject": true,
+	"iframe": true, "embed": true, "object": true,
+}
+
+// svgScanner 只看文本类文件（SVG 没有单独的类型，上传后按 .xml / 纯文本保存）：
+// 文档里有 SVG 或 XHTML 命名空间的元素、或根元素是 svg / html 时，
+// 拒绝脚本类元素、on* 事件属性和 javascript: 之类的链接
+type svgScanner struct{}
+
+func (svgScanner) Name() string { return "svg" }
+
+func (svgScanner) Scan(ctx context.Context, f File, content io.ReaderAt) (string, error) {
+	if f.Kind != "text" {
+		return "", nil
+	}
+	data, err := io.ReadAll(io.NewSectionReader(content, 0, f.SizeBytes))
+	if err != nil {
+		return "", err
+	}
+	lower := bytes.ToLower(data)
+	if !bytes.Contains(lower, []byte("<svg")) && !bytes.Contains(lower, []byte(xhtmlNS)) {
+		return "", nil
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	active, depth := false, 0
+	var finding string
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			break // 解析不下去浏览器也不会当 SVG 渲染；已经看到的照常判断
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			local := strings.ToLower(t.Name.Local)
+			if depth == 1 && (local == "svg" || local == "html") {
+				active = true
+			}
+			for _, at := range t.Attr {
+				if at.Name.Local == "xmlns" && (at.Value == svgNS || at.Value == xhtmlNS) {
+					active = true
+				}
+			}
+			if finding != "" {
+				continue
+			}
+			if svgActiveElements[local] {
+				finding = fmt.Sprintf("<%s> element", t.Name.Local)
+				continue
+			}
+			for _, at := range t.Attr {
+				name := strings.ToLower(at.Name.Local)
+				if strings.HasPrefix(name, "on") && at.Name.Space != "xmlns" {
+					finding = fmt.Sprintf("event handler %s on <%s>", at.Name.Local, t.Name.Local)
+					break
+				}
+				if isScriptURL(at.Value) {
+					finding = fmt.Sprintf("script URL in %s on <%s>", at.Name.Local, t.Name.Local)
+					break
+				}
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			if finding == "" && bytes.Contains(bytes.ToUpper(t), []byte("<!ENTITY")) {
+				finding = "entity declaration"
+			}
+		}
+	}
+	if active && finding != "" {
+		return "active content in SVG/XHTML: " + finding, nil
+	}
+	return "", nil
+}
+
+// isScriptURL：去掉空白和控制字符后以 javascript: / vbscript: / data:text/html 开头
+func isScriptURL(v string) bool {
+	v = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, v))
+	for _, p := range []string{"javascript:", "vbscript:", "data:text/html", "data:image/svg"} {
+		if strings.HasPrefix(v, p) {
+			return true
+		}
+	}
+	return false
+}
+
+/* ---------- 多格式文件（polyglot） ---------- */
+
+const (
+	polyglotHeadBytes = 1024       // PDF 阅读器和浏览器嗅探都只看开头这么多
+	polyglotTailBytes = 65535 + 22 // zip 的目录结尾记录（含最长注释）一定在这个范围里
+)
+
+// 图片里出现这些就不是正常图片；图片不大（≤15MB），整份内容都查
+var polyglotMarkupMarkers = [][]byte{
+	[]byte("<script"), []byte("<?php"), []byte("<html"), []byte("<!doctype html"),
+	[]byte("<iframe"), []byte("<svg"), []byte("<body"),
+}
+
+// polyglotScanner 找「同时是另一种格式」的文件：这类文件能绕过只看文件头的类型检查，
+// 被其它程序（zip 解压、PDF 阅读器、浏览器嗅探、PHP）按另一种格式解释
+type polyglotScanner struct{}
+
+func (polyglotScanner) Name() string { return "polyglot" }
+
+func (polyglotScanner) Scan(ctx context.Context, f File, content io.ReaderAt) (string, error) {
+	if f.Kind == "text" {
+		return "", nil // 文本按 text/plain 或下载提供，内容里写什么都可以
+	}
+	head, err := readSection(content, 0, min(f.SizeBytes, polyglotHeadBytes))
+	if err != nil {
+		return "", err
+	}
+	tailOff := max(f.SizeBytes-polyglotTailBytes, 0)
+	tail, err := readSection(content, tailOff, f.SizeBytes-tailOff)
+	if err != nil {
+		return "", err
+	}
+
+	// zip 从结尾读目录，附加在任何文件后面都能解压
+	if f.Kind != "archive" && f.Kind != "office" && hasZipEOCD(tail) {
+		return fmt.Sprintf("%s with an appended zip archive", f.MIME), nil
+	}
+	// PDF 头可以在前 1KB 的任何位置
+	if f.Kind != "pdf" && bytes.Contains(head, []byte("%PDF-")) {
+		return fmt.Sprintf("%s with an embedded PDF header", f.MIME), nil
+	}
+
+	switch f.Kind {
+	case "image":
+		data, err := readSection(content, 0, f.SizeBytes)
+		if err != nil {
+			return "", err
+		}
+		lower := asciiLower(data)
+		for _, m := range polyglotMarkupMarkers {
+			if bytes.Contains(lower, m) {
+				return fmt.Sprintf("%s containing %q", f.MIME, m), nil
+			}
+		}
+		if n := trailingAfterImage(data, f.MIME); n > 0 {
+			return fmt.Sprintf("%d bytes after the end of the %s data", n, f.MIME), nil
+		}
+	case "audio", "video":
+		lower := asciiLower(head)
+		for _, m := range polyglotMarkupMarkers {
+			if bytes.Contains(lower, m) {
+				return fmt.Sprintf("%s containing %q", f.MIME, m), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func readSection(r io.ReaderAt, off, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// hasZipEOCD：有一条目录结尾记录，且它的注释长度正好延伸到文件末尾（随机数据几乎不可能满足）
+func hasZipEOCD(tail []byte) bool {
+	for i := bytes.LastIndex(tail, []byte("PK\x05\x06")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("PK\x05\x06")) {
+		if i+22 <= len(tail) && i+22+int(binary.LittleEndian.Uint16(tail[i+20:i+22])) == len(tail) {
+			return true
+		}
+	}
+	return false
+}
+
+// trailingAfterImage 返回图片数据结束之后的非填充字节数。按格式结构走到结束位置，
+// 不找最后一个结束标记（附加的数据里自己也可以带一个）。GIF 没有可靠的结构长度，不检查
+func trailingAfterImage(data []byte, mimeType string) int {
+	end := -1
+	switch mimeType {
+	case "image/jpeg":
+		end = jpegEnd(data)
+	case "image/png":
+		end = pngEnd(data)
+	}
+	if end < 0 || end >= len(data) {
+		return 0
+	}
+	// 有的设备会在结尾补 0
+	if len(bytes.Trim(data[end:], "\x00")) == 0 {
+		return 0
+	}
+	return len(data) - end
+}
+
+// pngEnd：逐个 chunk（长度 + 类型 + 数据 + CRC）走到 IEND 之后
+func pngEnd(data []byte) int {
+	i := 8
+	for i+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i : i+4]))
+		next := i + 12 + n
+		if next > len(data) {
+			return -1
+		}
+		if string(data[i+4:i+8]) == "IEND" {
+			return next
+		}
+		i = next
+	}
+	return -1
+}
+
+// jpegEnd：跳过各个段；压缩数据里 FF 后面只会跟 00（转义）、RSTn 或填充 FF，
+// 遇到别的标记（渐进式 JPEG 的 DHT / SOS 等）按段长度跳过，直到 EOI
+func jpegEnd(data []byte) int {
+	i := 2
+	for i+1 < len(data) {
+		if data[i] != 0xFF {
+			i++ // 压缩数据
+			continue
+		}
+		m := data[i+1]
+		switch {
+		case m == 0xD9:
+			return i + 2
+		case m == 0x00, m == 0xFF, 0xD0 <= m && m <= 0xD7:
+			i++
+		default:
+			if i+4 > len(data) {
+				return -1
+			}
+			i += 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		}
+	}
+	return -1
+}
+
+// asciiLower 只转换 ASCII 字母，二进制内容长度不变
+func asciiLower(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+/* ---------- 子命令 ---------- */
+
+// runScanCommand:
+//
+//	./app scan                  扫描所有隔离中的文件
+//	./app scan -all             用当前扫描器重扫全部文件（扫描期间状态不变，结果出来再更新）；
+//	                            已拦截的文件跳过，加 -infected 才重扫（误报时用，避免少配了扫描器就把它们放行）
+//	./app scan -file a.svg ...  只扫描本地文件并打印结果，不读写数据库（可用来验证 clamd 配置）
+//	./app scan -release 12 ...  放行 held 的文件（太大没扫过的，由运维确认后放行）
+func (a *App) runScanCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	all := fs.Bool("all", false, "rescan every file, not only quarantined ones")
+	infected := fs.Bool("infected", false, "with -all, also rescan blocked files (they are released if no scanner flags them now)")
+	local := fs.Bool("file", false, "scan the local files given as arguments without touching the database")
+	release := fs.Bool("release", false, "mark the held files with the given ids as clean without scanning them")
+	_ = fs.Parse(args)
+
+	if *release {
+		return a.releaseHeld(ctx, fs.Args())
+	}
+
+	if len(a.Scanners) == 0 {
+		fmt.Println("scan: no scanners configured; pending files will be marked clean")
+	}
+	for _, s := range a.Scanners {
+		if c, ok := s.(*clamdScanner); ok {
+			if err := c.Ping(ctx); err != nil {
+				return fmt.Errorf("clamd %s: %v", c.addr, err)
+			}
+		}
+	}
+
+	if *local {
+		hits := 0
+		for _, name := range fs.Args() {
+			status, detail, err := scanLocalFile(ctx, a.Scanners, name)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if status == scanInfected {
+				hits++
+			}
+			fmt.Printf("%s: %s %s\n", name, status, detail)
+		}
+		if hits > 0 {
+			return fmt.Errorf("scan: %d file(s) infected", hits)
+		}
+		return nil
+	}
+
+	if !*all {
+		failed, err := a.scanPending(ctx)
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("scan: %d file(s) still quarantined", failed)
+		}
+		return nil
+	}
+
+	var after int64
+	counts := map[string]int{}
+	for {
+		files, err := a.filesByScanStatus(ctx, "", after)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, f := range files {
+			after = f.ID
+			if f.ScanStatus == scanInfected && !*infected {
+				counts["skipped"]++
+				continue
+			}
+			status, err := a.scanAndRecord(ctx, f)
+			if err != nil {
+				fmt.Printf("file %d: %v\n", f.ID, err)
+				status = "error"
+			}
+			counts[status]++
+		}
+	}
+	fmt.Printf("scan: %d clean, %d infected, %d held, %d errors, %d blocked files skipped\n",
+		counts[scanClean], counts[scanInfected], counts[scanHeld], counts["error"], counts["skipped"])
+	if counts["error"] > 0 {
+		return errors.New("scan: some files could not be scanned")
+	}
+	return nil
+}
+
+// releaseHeld 把 held 的文件标为 clean；只动 held 的，隔离中和已拦截的不受影响
+func (a *App) releaseHeld(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("scan -release: give the ids of the held files")
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, s := range ids {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("scan -release: invalid id %q", s)
+		}
+		res, err := a.DB.ExecContext(ctx,
+			`UPDATE files SET scan_status=?, scan_detail='released by operator: '||scan_detail, scanned_at=? WHERE id=? AND scan_status=?`,
+			scanClean, now, id, scanHeld)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("scan -release: file %d is not held", id)
+		}
+		fmt.Printf("file %d released\n", id)
+	}
+	return nil
+}
+
+// scanLocalFile 按上传时的规则识别类型，再跑扫描器
+func scanLocalFile(ctx context.Context, scanners []Scanner, name string) (status, detail string, err error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer fh.Close()
+	st, err := fh.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	head, err := readSection(fh, 0, min(st.Size(), 512))
+	if err != nil {
+		return "", "", err
+	}
+	ft, err := classifyFile(head, name)
+	if err != nil {
+		return "", "", err
+	}
+	f := File{OrigName: filepath.Base(name), Kind: ft.Kind, MIME: ft.MIME, SizeBytes: st.Size()}
+	return runScanners(ctx, scanners, f, fh)
+}
+
+// fileScanGate 给 handleServeFile 用：隔离中或被拦截的文件不提供内容
+func fileScanGate(status string) (code int, msg string) {
+	switch status {
+	case scanClean:
+		return 0, ""
+	case scanInfected:
+		return http.StatusForbidden, "file blocked by content scan"
+	case scanHeld:
+		return http.StatusForbidden, "file was not scanned (too large) and is held for review"
+	default:
+		return http.StatusServiceUnavailable, "file is being scanned"
+	}
+}
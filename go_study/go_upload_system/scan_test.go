@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* ---------- 假 clamd：只实现 zPING 和 zINSTREAM ---------- */
+
+const fakeEicar = "EICAR-TEST"
+
+type fakeClamd struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	streamMax int // 超过后回复 size limit exceeded；0 = 不限
+	conns     int
+	maxChunk  int // 收到的最大 INSTREAM 块
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClamd{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	return c
+}
+
+func (c *fakeClamd) scanner() *clamdScanner {
+	return newClamdScanner(c.ln.Addr().String())
+}
+
+func (c *fakeClamd) connections() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns
+}
+
+func (c *fakeClamd) setStreamMax(n int) {
+	c.mu.Lock()
+	c.streamMax = n
+	c.mu.Unlock()
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c.mu.Lock()
+	c.conns++
+	streamMax := c.streamMax
+	c.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	reply := func(s string) { _, _ = io.WriteString(conn, s+"\x00") }
+	switch cmd {
+	case "zPING\x00":
+		reply("PONG")
+	case "zINSTREAM\x00":
+		var data []byte
+		for {
+			var n uint32
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				return
+			}
+			if n == 0 {
+				break
+			}
+			c.mu.Lock()
+			c.maxChunk = max(c.maxChunk, int(n))
+			c.mu.Unlock()
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+			if streamMax > 0 && len(data) > streamMax {
+				// clamd 回复后就不再读；这里把剩下的读完再关，免得客户端还在写时被 RST 冲掉回复
+				reply("INSTREAM size limit exceeded. ERROR")
+				_, _ = io.Copy(io.Discard, r)
+				return
+			}
+		}
+		if bytes.Contains(data, []byte(fakeEicar)) {
+			reply("stream: Eicar-Test-Signature FOUND")
+		} else {
+			reply("stream: OK")
+		}
+	default:
+		reply("UNKNOWN COMMAND")
+	}
+}
+
+/* ---------- 测试 ---------- */
+
+func clamdScan(s *clamdScanner, content string) (string, error) {
+	f := File{OrigName: "a.bin", SizeBytes: int64(len(content))}
+	return s.Scan(context.Background(), f, strings.NewReader(content))
+}
+
+func TestClamdScanner(t *testing.T) {
+	fake := newFakeClamd(t)
+	s := fake.scanner()
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	// 跨多个 INSTREAM 块
+	clean := strings.Repeat("x", 2*clamdChunkBytes+10)
+	if hit, err := clamdScan(s, clean); hit != "" || err != nil {
+		t.Errorf("clean: %q, %v", hit, err)
+	}
+	fake.mu.Lock()
+	if fake.maxChunk > clamdChunkBytes {
+		t.Errorf("chunk of %d bytes", fake.maxChunk)
+	}
+	fake.mu.Unlock()
+	if hit, err := clamdScan(s, clean+fakeEicar); hit != "Eicar-Test-Signature" || err != nil {
+		t.Errorf("infected: %q, %v", hit, err)
+	}
+	if hit, err := clamdScan(s, ""); hit != "" || err != nil {
+		t.Errorf("empty: %q, %v", hit, err)
+	}
+
+	// clamd 的 StreamMaxLength：不能当成 OK，也不是可重试的错误
+	fake.setStreamMax(clamdChunkBytes)
+	if hit, err := clamdScan(s, clean+fakeEicar); hit != "" || !errors.Is(err, errNotScanned) {
+		t.Errorf("over clamd limit: %q, %v", hit, err)
+	}
+
+	// 本地上限：直接 held，不连 clamd
+	before := fake.connections()
+	s.maxBytes = 100
+	if hit, err := clamdScan(s, clean); hit != "" || !errors.Is(err, errNotScanned) {
+		t.Errorf("over local limit: %q, %v", hit, err)
+	}
+	if fake.connections() != before {
+		t.Error("oversized file was sent to clamd")
+	}
+
+	s = newClamdScanner("127.0.0.1:1")
+	if _, err := clamdScan(s, "x"); err == nil || errors.Is(err, errNotScanned) {
+		t.Errorf("unreachable clamd: %v", err)
+	}
+}
+
+func TestOversizedFileIsHeldUntilReleased(t *testing.T) {
+	fake := newFakeClamd(t)
+	app := newTestApp(t, localBlobStore{})
+	clamd := fake.scanner()
+	clamd.maxBytes = 8
+	app.Scanners = []Scanner{clamd}
+	ctx := context.Background()
+
+	add := func(name, content string) int64 {
+		t.Helper()
+		key := "uploads/" + name
+		if err := app.Blobs.Put(ctx, key, strings.NewReader(content), int64(len(content)), ""); err != nil {
+			t.Fatal(err)
+		}
+		res, err := app.DB.Exec(`INSERT INTO files(orig_name,kind,mime,size_bytes,sha256,rel_path,created_at,scan_status) VALUES(?,'other','application/octet-stream',?,?,?,?,?)`,
+			name, len(content), name, key, time.Now().UTC().Format(time.RFC3339), scanQuarantined)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	status := func(id int64) string {
+		t.Helper()
+		var s string
+		if err := app.DB.QueryRow(`SELECT scan_status FROM files WHERE id=?`, id).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	small := add("small.bin", "hello")
+	big := add("big.bin", "0123456789")
+	if failed, err := app.scanPending(ctx); failed != 0 || err != nil {
+		t.Fatalf("scanPending: %d, %v", failed, err)
+	}
+	if status(small) != scanClean || status(big) != scanHeld {
+		t.Fatalf("small %s, big %s", status(small), status(big))
+	}
+	if code, _ := fileScanGate(scanHeld); code != http.StatusForbidden {
+		t.Errorf("held file served with gate %d", code)
+	}
+
+	// held 不会被当成待扫文件反复重试
+	before := fake.connections()
+	if _, err := app.scanPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fake.connections() != before || status(big) != scanHeld {
+		t.Errorf("held file rescanned: %s", status(big))
+	}
+
+	if err := app.releaseHeld(ctx, []string{strconv.FormatInt(small, 10)}); err == nil {
+		t.Error("released a file that was not held")
+	}
+	if err := app.releaseHeld(ctx, []string{strconv.FormatInt(big, 10)}); err != nil || status(big) != scanClean {
+		t.Fatalf("release: %v, %s", err, status(big))
+	}
+}
+
+func TestRunScannersPrefersHitOverHeld(t *testing.T) {
+	fake := newFakeClamd(t)
+	clamd := fake.scanner()
+	clamd.maxBytes = 1
+	content := "<svg xmlns=\"http://www.w3.org/2000/svg\"><script>alert(1)</script></svg>"
+	f := File{OrigName: "a.svg", Kind: "text", MIME: "image/svg+xml", SizeBytes: int64(len(content))}
+	status, detail, err := runScanners(context.Background(), []Scanner{clamd, svgScanner{}}, f, strings.NewReader(content))
+	if err != nil || status != scanInfected || !strings.HasPrefix(detail, "svg: ") {
+		t.Fatalf("%s %q %v", status, detail, err)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+/* ===========================
+   全文搜索：SQLite FTS5
+=========================== */
+
+// posts_fts 是 posts 的外部内容表（content='posts'），由触发器随增删改同步，本身不重复存正文；
+// files_fts 存文本文件（kind=text）的文件名和内容，rowid = files.id，入库时写入，删除由触发器处理。
+// 分词用 trigram：中文不需要分词也能按子串命中；少于 3 个字的词 FTS 匹配不了，退回 LIKE 过滤。
+
+const (
+	searchMaxTextBytes = 1 << 20 // 每个文本文件最多索引前 1MB
+	searchMaxTerms     = 8
+
+	// snippet/highlight 先用私有区字符做标记，转义 HTML 后再换成 <mark>
+	markOpen  = "\ue000"
+	markClose = "\ue001"
+)
+
+var searchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+		title, body, content='posts', content_rowid='id', tokenize='trigram'
+	);`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(name, content, tokenize='trigram');`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_ai AFTER INSERT ON posts BEGIN
+		INSERT INTO posts_fts(rowid, title, body) VALUES (new.id, new.title, new.body);
+	END;`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_ad AFTER DELETE ON posts BEGIN
+		INSERT INTO posts_fts(posts_fts, rowid, title, body) VALUES ('delete', old.id, old.title, old.body);
+	END;`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_au AFTER UPDATE OF title, body ON posts BEGIN
+		INSERT INTO posts_fts(posts_fts, rowid, title, body) VALUES ('delete', old.id, old.title, old.body);
+		INSERT INTO posts_fts(rowid, title, body) VALUES (new.id, new.title, new.body);
+	END;`,
+	`CREATE TRIGGER IF NOT EXISTS files_fts_ad AFTER DELETE ON files BEGIN
+		DELETE FROM files_fts WHERE rowid = old.id;
+	END;`,
+}
+
+// migrateSearch 建索引表和触发器；表是第一次创建时（旧库升级）把已有数据补进去
+func (a *App) migrateSearch(ctx context.Context) error {
+	var existed bool
+	if err := a.DB.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name='files_fts')`,
+	).Scan(&existed); err != nil {
+		return err
+	}
+	for _, s := range searchSchema {
+		if _, err := a.DB.ExecContext(ctx, s); err != nil {
+			return fmt.Errorf("search index (SQLite needs FTS5 with the trigram tokenizer): %w", err)
+		}
+	}
+	if existed {
+		return nil
+	}
+	return a.reindex(ctx)
+}
+
+// reindex 重建全部索引：帖子直接 rebuild，文本文件从 BlobStore 重新读取。./app reindex 也走这里
+func (a *App) reindex(ctx context.Context) error {
+	if _, err := a.DB.ExecContext(ctx, `INSERT INTO posts_fts(posts_fts) VALUES('rebuild')`); err != nil {
+		return err
+	}
+	rows, err := a.DB.QueryContext(ctx, `SELECT id, orig_name, rel_path FROM files WHERE kind='text' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type item struct {
+		id        int64
+		name, key string
+	}
+	var items []item
+	for rows.Next() {
+		var it item
+		if err := rows.Scan(&it.id, &it.name, &it.key); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := a.DB.ExecContext(ctx, `DELETE FROM files_fts`); err != nil {
+		return err
+	}
+	for _, it := range items {
+		rc, err := a.Blobs.Get(ctx, it.key)
+		if err != nil {
+			// 内容丢失的交给 fsck，这里只跳过
+			fmt.Printf("reindex: skip file %d (%s): %v\n", it.id, it.key, err)
+			continue
+		}
+		err = indexTextFile(ctx, a.DB, it.id, it.name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// indexTextFile 把文本文件写进 files_fts；非 UTF-8 的字节替换掉，超过 1MB 的只索引开头
+func indexTextFile(ctx context.Context, db execer, fileID int64, name string, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, searchMaxTextBytes))
+	if err != nil {
+		return err
+	}
+	text := strings.ToValidUTF8(string(b), "\uFFFD")
+	_, err = db.ExecContext(ctx, `INSERT OR REPLACE INTO files_fts(rowid, name, content) VALUES(?,?,?)`, fileID, name, text)
+	return err
+}
+
+/* ---------- 查询 ---------- */
+
+type SearchHit struct {
+	Type    string  `json:"type"` // "post" | "file"
+	PostID  int64   `json:"postId"`
+	FileID  int64   `json:"fileId,omitempty"`
+	Title   string  `json:"title"`   // 帖子标题或文件名；HTML 已转义，命中处为 <mark>
+	Snippet string  `json:"snippet"` // 命中上下文，格式同上
+	Score   float64 `json:"score"`   // bm25 取反，越大越相关；只有短词的查询为 0
+}
+
+// searchQuery 把用户输入拆成词：>= 3 个字的拼成 FTS5 短语查询（AND），更短的走 LIKE
+type searchQuery struct {
+	terms []string
+	match string
+	short []string
+}
+
+func parseSearchQuery(q string) searchQuery {
+	var sq searchQuery
+	for _, t := range strings.Fields(q) {
+		if len(sq.terms) == searchMaxTerms {
+			break
+		}
+		sq.terms = append(sq.terms, t)
+		if utf8.RuneCountInString(t) >= 3 {
+			// 双引号包起来按短语处理，用户输入里的 " 要写成 ""
+			if sq.match != "" {
+				sq.match += " "
+			}
+			sq.match += `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+		} else {
+			sq.short = append(sq.short, t)
+		}
+	}
+	return sq
+}
+
+func likePattern(t string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(t) + "%"
+}
+
+// GET /api/search?q=&type=all|post|file&page=&pageSize=
+func (a *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	sq := parseSearchQuery(q.Get("q"))
+	if len(sq.terms) == 0 {
+		writeJSONErr(w, http.StatusBadRequest, "q required")
+		return
+	}
+	typ := q.Get("type")
+	if typ == "" {
+		typ = "all"
+	}
+	if typ != "all" && typ != "post" && typ != "file" {
+		writeJSONErr(w, http.StatusBadRequest, "type must be all, post or file")
+		return
+	}
+	page := parseIntDefault(q.Get("page"), 1)
+	pageSize := parseIntDefault(q.Get("pageSize"), 10)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+
+	var uid int64 = -1
+	admin := false
+	if u := userFrom(r.Context()); u != nil {
+		uid, admin = u.ID, u.Admin
+	}
+
+	hits, err := a.search(r.Context(), sq, typ, uid, admin, pageSize, (page-1)*pageSize)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"q":        q.Get("q"),
+		"page":     page,
+		"pageSize": pageSize,
+		"items":    hits,
+	})
+}
+
+// search 在帖子和文本文件里查，合并后按相关度排序。可见性与列表一致：
+// 公开帖子 + 自己的帖子（管理员全部）；文件命中时挂到一个可见的引用帖子上，没有可见帖子的不返回。
+func (a *App) search(ctx context.Context, sq searchQuery, typ string, uid int64, admin bool, limit, offset int) ([]SearchHit, error) {
+	visible := `(p.visibility = 'public' OR p.owner_id = ? OR ?)`
+	var parts []string
+	var args []any
+
+	if typ != "file" {
+		sel := `SELECT 'post', p.id, 0, `
+		where := ` WHERE ` + visible
+		wargs := []any{uid, admin}
+		if sq.match != "" {
+			sel += `highlight(posts_fts, 0, ?, ?), snippet(posts_fts, 1, ?, ?, '…', 48), -bm25(posts_fts, 5.0, 1.0)`
+			args = append(args, markOpen, markClose, markOpen, markClose)
+			where += ` AND posts_fts MATCH ?`
+			wargs = append(wargs, sq.match)
+		} else {
+			sel += `p.title, p.body, 0.0`
+		}
+		for _, t := range sq.short {
+			where += ` AND (p.title LIKE ? ESCAPE '\' OR p.body LIKE ? ESCAPE '\')`
+			wargs = append(wargs, likePattern(t), likePattern(t))
+		}
+		parts = append(parts, sel+` AS score FROM posts_fts JOIN posts p ON p.id = posts_fts.rowid`+where)
+		args = append(args, wargs...)
+	}
+
+	if typ != "post" {
+		sel := `SELECT 'file', (
+				SELECT MAX(p.id) FROM post_files pf JOIN posts p ON p.id = pf.post_id
+				WHERE pf.file_id = files_fts.rowid AND ` + visible + `
+			) AS pid, files_fts.rowid, `
+		args = append(args, uid, admin)
+		// 隔离中 / 被拦截的文件内容不出现在结果里
+		where := ` WHERE files_fts.rowid IN (SELECT id FROM files WHERE scan_status = 'clean')`
+		var wargs []any
+		if sq.match != "" {
+			sel += `highlight(files_fts, 0, ?, ?), snippet(files_fts, 1, ?, ?, '…', 48), -bm25(files_fts, 5.0, 1.0)`
+			args = append(args, markOpen, markClose, markOpen, markClose)
+			where += ` AND files_fts MATCH ?`
+			wargs = append(wargs, sq.match)
+		} else {
+			sel += `files_fts.name, files_fts.content, 0.0`
+		}
+		for _, t := range sq.short {
+			where += ` AND (files_fts.name LIKE ? ESCAPE '\' OR files_fts.content LIKE ? ESCAPE '\')`
+			wargs = append(wargs, likePattern(t), likePattern(t))
+		}
+		// 子查询只取能看到的帖子；外层再把没有可见帖子的文件去掉
+		parts = append(parts, `SELECT * FROM (`+sel+` AS score FROM files_fts`+where+`) WHERE pid IS NOT NULL`)
+		args = append(args, wargs...)
+	}
+
+	query := strings.Join(parts, ` UNION ALL `) + ` ORDER BY score DESC, 2 DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+	rows, err := a.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var h SearchHit
+		if err := rows.Scan(&h.Type, &h.PostID, &h.FileID, &h.Title, &h.Snippet, &h.Score); err != nil {
+			return nil, err
+		}
+		if sq.match == "" {
+			// 没有 FTS 匹配时 SQLite 给不出 snippet，这里查到的是整段标题/正文
+			h.Title = markTerms(h.Title, sq.terms)
+			h.Snippet = snippetAround(h.Snippet, sq.terms, 48)
+		} else if len(sq.short) > 0 {
+			// 短词不在 FTS 查询里，补上标记
+			h.Title = markTerms(h.Title, sq.short)
+			h.Snippet = markTerms(h.Snippet, sq.short)
+		}
+		h.Title = renderMarks(h.Title)
+		h.Snippet = renderMarks(h.Snippet)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// markTerms 给 text 里所有词（不区分大小写）加标记
+func markTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	type span struct{ from, to int }
+	var spans []span
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		for i := 0; t != ""; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			spans = append(spans, span{i + j, i + j + len(t)})
+			i += j + len(t)
+		}
+	}
+	if len(spans) == 0 || len(lower) != len(text) {
+		// ToLower 改变了字节长度（少数字符）时偏移对不上，不标记
+		return text
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].from < spans[j].from })
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		if s.from < last {
+			continue
+		}
+		b.WriteString(text[last:s.from])
+		b.WriteString(markOpen + text[s.from:s.to] + markClose)
+		last = s.to
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// snippetAround 截取第一个命中词前后约 width 个字符并加标记
+func snippetAround(text string, terms []string, width int) string {
+	lower := strings.ToLower(text)
+	at := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, strings.ToLower(t)); i >= 0 && (at < 0 || i < at) {
+			at = i
+		}
+	}
+	runes := []rune(text)
+	start := 0
+	if at > 0 && len(lower) == len(text) {
+		start = max(0, utf8.RuneCountInString(text[:at])-width/2)
+	}
+	end := min(len(runes), start+width)
+	out := string(runes[start:end])
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(runes) {
+		out += "…"
+	}
+	return markTerms(out, terms)
+}
+
+// renderMarks 转义 HTML 后把标记换成 <mark>
+func renderMarks(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, markOpen, "<mark>")
+	return strings.ReplaceAll(s, markClose, "</mark>")
+}
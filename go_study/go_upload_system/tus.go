@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ===========================
+   tus 1.0 断点续传
+=========================== */
+
+// 协议：https://tus.io/protocols/resumable-upload
+//   OPTIONS /api/uploads         能力发现（Tus-Version / Tus-Extension / Tus-Max-Size）
+//   POST    /api/uploads         creation：Upload-Length + Upload-Metadata(filename, filetype)
+//   HEAD    /api/uploads/{id}    查询已收到的 Upload-Offset
+//   PATCH   /api/uploads/{id}    追加分片（Content-Type: application/offset+octet-stream）
+//   DELETE  /api/uploads/{id}    termination
+// 分片数据存在 uploadRootDir/tmp/tus-{id}.part；收齐后走 saveFileFrom（嗅探/哈希/去重），
+// 得到的 file id 通过 Upload-File-Id 响应头返回，创建帖子时用 uploadIds 引用。
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusBasePath   = "/api/uploads/"
+	tusExpiry     = 24 * time.Hour // 未完成/未使用的上传保留时长
+	tusSweepEvery = 10 * time.Minute
+)
+
+type tusUpload struct {
+	ID        string
+	Length    int64
+	Offset    int64
+	Filename  string
+	Metadata  string // 原样保存的 Upload-Metadata
+	FileID    sql.NullInt64
+	OwnerID   sql.NullInt64
+	ExpiresAt time.Time
+}
+
+// 同一个上传的 PATCH 串行执行
+var tusLocks sync.Map // id -> *sync.Mutex
+
+func tusLock(id string) func() {
+	m, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func tusPartPath(id string) string {
+	return filepath.Join(uploadRootDir, "tmp", "tus-"+id+".part")
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseTusMetadata 解析 "filename d29ybGQ=,filetype aW1hZ2UvcG5n"
+func parseTusMetadata(h string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(h) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(h, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not base64", key)
+		}
+		meta[key] = string(dec)
+	}
+	return meta, nil
+}
+
+// tusMethod 支持 X-HTTP-Method-Override（部分环境不允许 PATCH/DELETE）
+func tusMethod(r *http.Request) string {
+	if m := r.Header.Get("X-HTTP-Method-Override"); m != "" && r.Method == http.MethodPost {
+		return strings.ToUpper(m)
+	}
+	return r.Method
+}
+
+// tusPrecheck 设置公共响应头并校验 Tus-Resumable；返回 false 时已写响应
+func tusPrecheck(w http.ResponseWriter, r *http.Request, method string) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if method == http.MethodOptions {
+		return true
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONErr(w, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+		return false
+	}
+	return true
+}
+
+func writeTusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(policy.largest(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /api/uploads
+func (a *App) handleTusUploads(w http.ResponseWriter, r *http.Request) {
+	method := tusMethod(r)
+	if !tusPrecheck(w, r, method) {
+		return
+	}
+	switch method {
+	case http.MethodOptions:
+		writeTusOptions(w)
+	case http.MethodPost:
+		a.handleTusCreate(w, r)
+	default:
+		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// /api/uploads/{id}
+func (a *App) handleTusUpload(w http.ResponseWriter, r *http.Request) {
+	method := tusMethod(r)
+	if !tusPrecheck(w, r, method) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	if method == http.MethodOptions {
+		writeTusOptions(w)
+		return
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	// 只有上传者本人能续传/查询/取消
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	var owner sql.NullInt64
+	err := a.DB.QueryRowContext(r.Context(), `SELECT owner_id FROM uploads WHERE id=?`, id).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err == sql.ErrNoRows || !owner.Valid || owner.Int64 != user.ID {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		a.handleTusHead(w, r, id)
+	case http.MethodGet:
+		a.handleTusStatus(w, r, id)
+	case http.MethodPatch:
+		a.handleTusPatch(w, r, id)
+	case http.MethodDelete:
+		a.handleTusDelete(w, r, id)
+	default:
+		writeJSONErr(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *App) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeJSONErr(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeJSONErr(w, http.StatusBadRequest, "Upload-Length required")
+		return
+	}
+	rawMeta := r.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(rawMeta)
+	if err != nil {
+		writeJSONErr(w, http.StatusBadRequest, "invalid Upload-Metadata: "+err.Error())
+		return
+	}
+	filename := safeFilename(meta["filename"])
+	// 扩展名已知时按该类别的上限提前拒绝；内容是否匹配在收齐后由 saveFileFrom 校验
+	maxLen := policy.largest()
+	if t, ok := typeByExt(filename); ok {
+		if !policy.allows(t) {
+			writeJSONErr(w, http.StatusUnsupportedMediaType, "file type not allowed: "+t.MIME)
+			return
+		}
+		maxLen = policy.maxBytesFor(t.Kind)
+	}
+	if length > maxLen {
+		writeJSONErr(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file too large: %d bytes (limit %d)", length, maxLen))
+		return
+	}
+	// 配额先按 Upload-Length 粗查，避免传完才发现超额；去重后的精确检查在入库时
+	_, used, err := usage(r.Context(), a.DB, user.ID)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if used+length > user.QuotaBytes {
+		writeJSONErr(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v: %d of %d bytes used", errQuotaExceeded, used, user.QuotaBytes))
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(uploadRootDir, "tmp"), 0o755); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f, err := os.OpenFile(tusPartPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f.Close()
+
+	now := time.Now().UTC()
+	up := tusUpload{
+		ID: id, Length: length, Filename: filename, Metadata: rawMeta,
+		OwnerID: sql.NullInt64{Int64: user.ID, Valid: true}, ExpiresAt: now.Add(tusExpiry),
+	}
+	if _, err := a.DB.ExecContext(r.Context(), `
+		INSERT INTO uploads(id, length, upload_offset, filename, metadata, owner_id, created_at, expires_at)
+		VALUES(?,?,0,?,?,?,?,?)
+	`, id, length, filename, rawMeta, user.ID, now.Format(time.RFC3339), up.ExpiresAt.Format(time.RFC3339)); err != nil {
+		_ = os.Remove(tusPartPath(id))
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", tusBasePath+id)
+	w.Header().Set("Upload-Expires", up.ExpiresAt.Format(http.TimeFormat))
+
+	// creation-with-upload：创建请求里直接带第一段数据；空文件立即完成
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" || length == 0 {
+		if r.ContentLength > length {
+			writeJSONErr(w, http.StatusRequestEntityTooLarge, "body exceeds Upload-Length")
+			return
+		}
+		code, msg := a.tusAppend(r, &up)
+		if code != 0 {
+			writeJSONErr(w, code, msg)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+		setUploadFileID(w, up)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *App) loadTusUpload(ctx context.Context, id string) (tusUpload, error) {
+	var up tusUpload
+	var exp string
+	err := a.DB.QueryRowContext(ctx, `
+		SELECT id, length, upload_offset, filename, metadata, file_id, owner_id, expires_at
+		FROM uploads WHERE id=?
+	`, id).Scan(&up.ID, &up.Length, &up.Offset, &up.Filename, &up.Metadata, &up.FileID, &up.OwnerID, &exp)
+	if err != nil {
+		return up, err
+	}
+	up.ExpiresAt, _ = time.Parse(time.RFC3339, exp)
+	if time.Now().After(up.ExpiresAt) {
+		return up, sql.ErrNoRows // 过期的上传等同于不存在，由清理任务删除
+	}
+	return up, nil
+}
+
+func setUploadFileID(w http.ResponseWriter, up tusUpload) {
+	if up.FileID.Valid {
+		w.Header().Set("Upload-File-Id", strconv.FormatInt(up.FileID.Int64, 10))
+	}
+}
+
+func (a *App) handleTusHead(w http.ResponseWriter, r *http.Request, id string) {
+	up, err := a.loadTusUpload(r.Context(), id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.Format(http.TimeFormat))
+	if up.Metadata != "" {
+		w.Header().Set("Upload-Metadata", up.Metadata)
+	}
+	setUploadFileID(w, up)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GET /api/uploads/{id}：非 tus 标准，方便前端查看状态和完成后的文件元信息
+func (a *App) handleTusStatus(w http.ResponseWriter, r *http.Request, id string) {
+	up, err := a.loadTusUpload(r.Context(), id)
+	if err == sql.ErrNoRows {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := map[string]any{
+		"id":        up.ID,
+		"filename":  up.Filename,
+		"length":    up.Length,
+		"offset":    up.Offset,
+		"expiresAt": up.ExpiresAt,
+	}
+	if up.FileID.Valid {
+		out["fileId"] = up.FileID.Int64
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *App) handleTusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJSONErr(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONErr(w, http.StatusBadRequest, "Upload-Offset required")
+		return
+	}
+
+	unlock := tusLock(id)
+	defer unlock()
+
+	up, err := a.loadTusUpload(r.Context(), id)
+	if err == sql.ErrNoRows {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if offset != up.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+		writeJSONErr(w, http.StatusConflict, fmt.Sprintf("offset mismatch: server has %d", up.Offset))
+		return
+	}
+	if r.ContentLength > up.Length-up.Offset {
+		writeJSONErr(w, http.StatusRequestEntityTooLarge, "body exceeds Upload-Length")
+		return
+	}
+
+	code, msg := a.tusAppend(r, &up)
+	if code != 0 {
+		writeJSONErr(w, code, msg)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Expires", up.ExpiresAt.Format(http.TimeFormat))
+	setUploadFileID(w, up)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusAppend 把请求体追加到分片文件并更新 offset；收齐后入库。
+// 返回非 0 的状态码表示失败。连接中途断开时已收到的部分照样保存，客户端 HEAD 后续传。
+func (a *App) tusAppend(r *http.Request, up *tusUpload) (int, string) {
+	// 客户端断开后 r.Context() 会被取消，但已写入的数据仍要记账
+	ctx := context.WithoutCancel(r.Context())
+
+	f, err := os.OpenFile(tusPartPath(up.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	// 上次崩溃可能留下超出 offset 的半截数据
+	if err := f.Truncate(up.Offset); err != nil {
+		f.Close()
+		return http.StatusInternalServerError, err.Error()
+	}
+	if _, err := f.Seek(up.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return http.StatusInternalServerError, err.Error()
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Length-up.Offset))
+	syncErr := f.Sync()
+	f.Close()
+	if syncErr != nil {
+		return http.StatusInternalServerError, syncErr.Error()
+	}
+
+	up.Offset += n
+	if _, err := a.DB.ExecContext(ctx, `UPDATE uploads SET upload_offset=? WHERE id=?`, up.Offset, up.ID); err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	if copyErr != nil {
+		return http.StatusBadRequest, "upload interrupted: " + copyErr.Error()
+	}
+	if up.Offset < up.Length {
+		return 0, ""
+	}
+
+	fileID, err := a.finishTusUpload(ctx, *up)
+	if err != nil {
+		// 内容不被接受（类型/大小/配额），上传作废
+		a.removeTusUpload(ctx, up.ID)
+		return fileErrStatus(err), "file upload failed: " + err.Error()
+	}
+	up.FileID = sql.NullInt64{Int64: fileID, Valid: true}
+	return 0, ""
+}
+
+func (a *App) finishTusUpload(ctx context.Context, up tusUpload) (int64, error) {
+	part, err := os.Open(tusPartPath(up.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer part.Close()
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var owner *User
+	if up.OwnerID.Valid {
+		if owner, err = userByID(ctx, tx, up.OwnerID.Int64); err != nil {
+			return 0, err
+		}
+	}
+	fm, err := a.saveFileFrom(ctx, tx, part, up.Filename, owner, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE uploads SET file_id=? WHERE id=?`, fm.ID, up.ID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	a.kickScanner()
+	part.Close()
+	_ = os.Remove(tusPartPath(up.ID))
+	return fm.ID, nil
+}
+
+func (a *App) handleTusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	unlock := tusLock(id)
+	defer unlock()
+
+	if _, err := a.loadTusUpload(r.Context(), id); err == sql.ErrNoRows {
+		writeJSONErr(w, http.StatusNotFound, "not found")
+		return
+	} else if err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := a.removeTusUpload(r.Context(), id); err != nil {
+		writeJSONErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeTusUpload 删除上传记录和分片文件。已入库的文件如果没有被任何帖子（或其它上传）引用，
+// 也一并删除，规则与 handleDeletePost 一致（releaseFiles）：commit 后再删磁盘文件。
+func (a *App) removeTusUpload(ctx context.Context, id string) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fileID sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT file_id FROM uploads WHERE id=?`, id).Scan(&fileID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM uploads WHERE id=?`, id); err != nil {
+		return err
+	}
+	var deleteAfterCommit []string
+	if fileID.Valid {
+		if deleteAfterCommit, err = releaseFiles(ctx, tx, []int64{fileID.Int64}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(tusPartPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	a.deleteBlobs(ctx, deleteAfterCommit)
+	tusLocks.Delete(id)
+	return nil
+}
+
+// runTusSweeper 定期清理过期的上传
+func (a *App) runTusSweeper(ctx context.Context) {
+	t := time.NewTicker(tusSweepEvery)
+	defer t.Stop()
+	for {
+		if err := a.sweepTusUploads(ctx, time.Now().UTC()); err != nil {
+			fmt.Println("tus sweep:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (a *App) sweepTusUploads(ctx context.Context, now time.Time) error {
+	rows, err := a.DB.QueryContext(ctx, `SELECT id FROM uploads WHERE expires_at < ?`, now.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		unlock := tusLock(id)
+		err := a.removeTusUpload(ctx, id)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachUploads 把已完成的 tus 上传挂到帖子上（POST /api/posts 的 uploadIds 字段）。
+// 只能引用自己的上传；上传时已按配额计入，这里不再检查。
+func (a *App) attachUploads(ctx context.Context, tx *sql.Tx, user *User, postID int64, uploadIDs []string, ord int) ([]File, error) {
+	var out []File
+	seen := map[int64]bool{}
+	for _, uid := range uploadIDs {
+		var fileID sql.NullInt64
+		var exp string
+		err := tx.QueryRowContext(ctx, `SELECT file_id, expires_at FROM uploads WHERE id=? AND owner_id=?`, uid, user.ID).Scan(&fileID, &exp)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("upload %s not found", uid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fileID.Valid {
+			return nil, fmt.Errorf("upload %s is not complete", uid)
+		}
+		if seen[fileID.Int64] {
+			continue
+		}
+		seen[fileID.Int64] = true
+
+		f, err := scanFile(tx.QueryRowContext(ctx, `SELECT `+fileColumns("")+` FROM files WHERE id=?`, fileID.Int64))
+		if err != nil {
+			return nil, err
+		}
+
+		ord++
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO post_files(post_id, file_id, ord) VALUES(?,?,?)`,
+			postID, f.ID, ord,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// formList 读取可重复或逗号分隔的表单字段
+func formList(r *http.Request, key string) []string {
+	var out []string
+	for _, v := range r.MultipartForm.Value[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
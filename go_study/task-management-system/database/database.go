@@ -1,7 +1,10 @@
 package database
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"log"
+	"os"
 	"task-management-system/models"
 	"time"
 
@@ -28,6 +31,12 @@ func InitDB(dbPath string) error {
 		&models.Project{},
 		&models.Task{},
 		&models.TaskProgress{},
+		&models.TaskDependency{},
+		&models.WorkflowColumn{},
+		&models.WorkflowTransition{},
+		&models.Comment{},
+		&models.Notification{},
+		&models.Attachment{},
 	)
 	if err != nil {
 		return err
@@ -35,6 +44,8 @@ func InitDB(dbPath string) error {
 
 	// 初始化测试数据
 	initSampleData()
+	ensurePasswords()
+	ensureWorkflows()
 
 	log.Println("数据库初始化成功")
 	return nil
@@ -58,6 +69,11 @@ func initSampleData() {
 		{Username: "王五", Email: "wang@example.com", Role: models.RoleTeamMember},
 		{Username: "赵六", Email: "zhao@example.com", Role: models.RoleTeamMember},
 	}
+	for i := range users {
+		if err := setInitialPassword(&users[i]); err != nil {
+			log.Printf("设置示例用户密码失败: %v", err)
+		}
+	}
 	DB.Create(&users)
 
 	// 创建项目
@@ -192,6 +208,82 @@ func initSampleData() {
 	log.Println("示例数据初始化完成")
 }
 
+// setInitialPassword 设置用户初始密码：优先用 DEFAULT_PASSWORD；未设置时为每个用户随机生成，
+// 只在日志里打印这一次
+func setInitialPassword(user *models.User) error {
+	password := os.Getenv("DEFAULT_PASSWORD")
+	generated := password == ""
+	if generated {
+		buf := make([]byte, 12)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	if generated {
+		log.Printf("用户 %s 的初始密码: %s（只显示这一次，请登录后修改）", user.Username, password)
+	}
+	return nil
+}
+
+// ensurePasswords 为升级前创建、尚无密码的用户设置初始密码
+func ensurePasswords() {
+	var users []models.User
+	DB.Where("password_hash IS NULL OR password_hash = ''").Find(&users)
+	if len(users) == 0 {
+		return
+	}
+
+	for i := range users {
+		if err := setInitialPassword(&users[i]); err != nil {
+			log.Printf("设置用户 %s 的初始密码失败: %v", users[i].Username, err)
+			continue
+		}
+		DB.Model(&users[i]).Select("PasswordHash", "PasswordChangedAt").Updates(&users[i])
+	}
+	log.Printf("已为 %d 个无密码用户设置初始密码，请尽快登录修改", len(users))
+}
+
+// CreateDefaultWorkflow 为项目创建默认看板列，并按状态把项目中尚未入列的任务放进对应列
+func CreateDefaultWorkflow(db *gorm.DB, projectID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i, def := range models.DefaultWorkflowColumns {
+			col := def
+			col.ProjectID = projectID
+			col.Position = i
+			if err := tx.Create(&col).Error; err != nil {
+				return err
+			}
+
+			var tasks []models.Task
+			tx.Where("project_id = ? AND column_id IS NULL AND status = ?", projectID, col.Category).
+				Order("created_at ASC").Find(&tasks)
+			for pos, t := range tasks {
+				if err := tx.Model(&t).Updates(map[string]interface{}{"column_id": col.ID, "position": pos}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ensureWorkflows 为升级前创建、还没有看板列的项目补建默认工作流
+func ensureWorkflows() {
+	var ids []uint
+	DB.Model(&models.Project{}).
+		Where("id NOT IN (?)", DB.Model(&models.WorkflowColumn{}).Select("project_id")).
+		Pluck("id", &ids)
+	for _, id := range ids {
+		if err := CreateDefaultWorkflow(DB, id); err != nil {
+			log.Printf("为项目 %d 创建默认工作流失败: %v", id, err)
+		}
+	}
+}
+
 // GetDB 获取数据库实例
 func GetDB() *gorm.DB {
 	return DB
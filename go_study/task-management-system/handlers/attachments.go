@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 任务附件 ==========
+
+// maxAttachmentSize 单个附件的大小上限
+const maxAttachmentSize = 20 << 20
+
+var uploadDir = "uploads"
+
+// InitAttachments 设置附件保存目录（为空时使用 ./uploads）并确保目录存在
+func InitAttachments(dir string) error {
+	if dir != "" {
+		uploadDir = dir
+	}
+	return os.MkdirAll(uploadDir, 0o755)
+}
+
+// attachmentPath 附件在磁盘上的路径
+func attachmentPath(a *models.Attachment) string {
+	return filepath.Join(uploadDir, a.StoredName)
+}
+
+// cleanFileName 去掉客户端文件名中的路径和控制字符，只用于展示和下载时的文件名
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > 200 {
+		name = string(r[:200])
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "attachment"
+	}
+	return name
+}
+
+// loadTaskAttachment 加载属于该任务的附件
+func loadTaskAttachment(c *gin.Context) (*models.Task, *models.Attachment, bool) {
+	var task models.Task
+	if err := database.DB.First(&task, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return nil, nil, false
+	}
+	var attachment models.Attachment
+	if err := database.DB.Where("task_id = ?", task.ID).First(&attachment, c.Param("attachmentId")).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "附件不存在",
+		})
+		return nil, nil, false
+	}
+	return &task, &attachment, true
+}
+
+// GetTaskAttachments 获取任务附件列表
+func GetTaskAttachments(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	var attachments []models.Attachment
+	if err := database.DB.Preload("Uploader").Where("task_id = ?", task.ID).Order("created_at ASC").Find(&attachments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "获取附件失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    attachments,
+	})
+}
+
+// UploadTaskAttachment 上传附件，表单字段为 file。文件以随机名保存，类型按内容识别
+func UploadTaskAttachment(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	// 给表单的其他部分留 1MB 余量
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, models.APIResponse{
+				Success: false,
+				Error:   fmt.Sprintf("附件不能超过 %dMB", maxAttachmentSize>>20),
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "请选择要上传的文件",
+		})
+		return
+	}
+	if header.Size > maxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, models.APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("附件不能超过 %dMB", maxAttachmentSize>>20),
+		})
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "读取上传文件失败",
+		})
+		return
+	}
+	defer src.Close()
+
+	user := middleware.CurrentUser(c)
+	attachment := models.Attachment{
+		TaskID:     task.ID,
+		UploaderID: user.ID,
+		FileName:   cleanFileName(header.Filename),
+		Size:       header.Size,
+	}
+	if attachment.StoredName, attachment.ContentType, err = saveAttachment(src); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "保存附件失败",
+		})
+		return
+	}
+
+	if err := database.DB.Create(&attachment).Error; err != nil {
+		os.Remove(attachmentPath(&attachment))
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "保存附件失败",
+		})
+		return
+	}
+
+	database.DB.Preload("Uploader").First(&attachment, attachment.ID)
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Message: "附件上传成功",
+		Data:    attachment,
+	})
+}
+
+// saveAttachment 把上传内容写到随机命名的文件，返回文件名和按内容识别的类型
+func saveAttachment(src io.Reader) (string, string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	name := hex.EncodeToString(buf)
+
+	dst, err := os.OpenFile(filepath.Join(uploadDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", "", err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+
+	if _, err = dst.Write(head[:n]); err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", "", err
+	}
+	return name, contentType, nil
+}
+
+// DownloadTaskAttachment 下载附件，始终以附件方式返回，避免浏览器直接渲染上传的内容
+func DownloadTaskAttachment(c *gin.Context) {
+	_, attachment, ok := loadTaskAttachment(c)
+	if !ok {
+		return
+	}
+
+	path := attachmentPath(attachment)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "附件文件不存在",
+		})
+		return
+	}
+
+	c.Header("Content-Type", attachment.ContentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.FileAttachment(path, attachment.FileName)
+}
+
+// DeleteTaskAttachment 删除附件，上传者和能管理任务的人可以删除
+func DeleteTaskAttachment(c *gin.Context) {
+	task, attachment, ok := loadTaskAttachment(c)
+	if !ok {
+		return
+	}
+
+	user := middleware.CurrentUser(c)
+	if attachment.UploaderID != user.ID && !canManageTask(user, task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能删除自己上传的附件",
+		})
+		return
+	}
+
+	if err := database.DB.Delete(attachment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "删除附件失败",
+		})
+		return
+	}
+	os.Remove(attachmentPath(attachment))
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "附件删除成功",
+	})
+}
+
+// deleteTaskAttachments 删除任务的全部附件及文件
+func deleteTaskAttachments(taskID uint) {
+	var attachments []models.Attachment
+	database.DB.Where("task_id = ?", taskID).Find(&attachments)
+	for i := range attachments {
+		os.Remove(attachmentPath(&attachments[i]))
+	}
+	database.DB.Where("task_id = ?", taskID).Delete(&models.Attachment{})
+}
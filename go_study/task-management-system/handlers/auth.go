@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"net/http"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 认证 ==========
+
+// dummyUser 用户名不存在时也做一次哈希比较，避免通过响应时间枚举用户名
+var dummyUser = func() models.User {
+	var u models.User
+	u.SetPassword("dummy-password")
+	return u
+}()
+
+// Login 用户登录
+func Login(c *gin.Context) {
+	var req models.LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		dummyUser.CheckPassword(req.Password)
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "用户名或密码错误",
+		})
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "用户名或密码错误",
+		})
+		return
+	}
+
+	token, expiresAt, err := middleware.GenerateToken(&user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "签发令牌失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "登录成功",
+		Data: models.LoginResponse{
+			Token:       token,
+			ExpiresAt:   expiresAt,
+			User:        user,
+			Permissions: models.RolePermissions[user.Role],
+		},
+	})
+}
+
+// GetCurrentUser 获取当前登录用户及其权限
+func GetCurrentUser(c *gin.Context) {
+	user := middleware.CurrentUser(c)
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: models.CurrentUserResponse{
+			User:        *user,
+			Permissions: models.RolePermissions[user.Role],
+		},
+	})
+}
+
+// ChangePassword 修改自己的密码，修改后旧令牌失效
+func ChangePassword(c *gin.Context) {
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	user := middleware.CurrentUser(c)
+	if !user.CheckPassword(req.OldPassword) {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "原密码错误",
+		})
+		return
+	}
+
+	if err := user.SetPassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "修改密码失败",
+		})
+		return
+	}
+	if err := database.DB.Model(user).Select("PasswordHash", "PasswordChangedAt").Updates(user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "修改密码失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "密码修改成功，请重新登录",
+	})
+}
+
+// ========== 数据范围校验 ==========
+// 路由上的 RequirePermission 只判断角色，这里再按资源归属限定范围
+
+// canManageProject 管理员可管理所有项目，项目经理只能管理自己负责的项目
+func canManageProject(user *models.User, project *models.Project) bool {
+	if user.Role == models.RoleAdmin {
+		return true
+	}
+	return user.Role.Can(models.PermManageProjects) &&
+		project.ManagerID != nil && *project.ManagerID == user.ID
+}
+
+// canManageTask 管理员可管理所有任务；创建人可管理自己创建的任务；
+// 项目经理还可管理自己负责项目下的任务和未归属项目的任务
+func canManageTask(user *models.User, task *models.Task) bool {
+	if user.Role == models.RoleAdmin {
+		return true
+	}
+	if !user.Role.Can(models.PermManageTasks) {
+		return false
+	}
+	if task.CreatorID != nil && *task.CreatorID == user.ID {
+		return true
+	}
+	if user.Role != models.RoleProjectManager {
+		return false
+	}
+	if task.ProjectID == nil {
+		return true
+	}
+	var project models.Project
+	if err := database.DB.First(&project, *task.ProjectID).Error; err != nil {
+		return false
+	}
+	return canManageProject(user, &project)
+}
+
+// canUpdateProgress 能管理任务的人和任务负责人可以更新进度
+func canUpdateProgress(user *models.User, task *models.Task) bool {
+	if !user.Role.Can(models.PermUpdateProgress) {
+		return false
+	}
+	if task.AssigneeID != nil && *task.AssigneeID == user.ID {
+		return true
+	}
+	return canManageTask(user, task)
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ========== 任务评论 ==========
+
+// mentionPattern 匹配 @ 后的连续字母、数字、下划线、点和连字符。
+// 中文用户名后面常直接接正文（如“@李四看一下”），所以含非 ASCII 字母的片段取其中最长的已存在用户名前缀，
+// 但不在两个 ASCII 字符之间截断；纯 ASCII 的片段要整段匹配（句末的点和连字符除外），
+// 否则 @administrators 会提醒到 admin
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.\-]+)`)
+
+const (
+	maxMentionRunes = 32 // 参与匹配的用户名最大长度
+	maxMentions     = 20 // 单条评论最多解析的 @ 数量
+)
+
+// resolveMentions 解析评论中 @ 到的用户，按出现顺序去重；
+// 紧跟在英文字母或数字后的 @（如邮箱地址）不算提及
+func resolveMentions(content string) []models.User {
+	var tokens [][]string // 每个片段按优先顺序排列的候选用户名
+	candidates := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		if m[0] > 0 && isASCIIAlnum(content[m[0]-1]) {
+			continue
+		}
+		token := content[m[2]:m[3]]
+		var names []string
+		if isASCII(token) {
+			names = append(names, token)
+			if trimmed := strings.TrimRight(token, ".-"); trimmed != token && trimmed != "" {
+				names = append(names, trimmed)
+			}
+		} else {
+			r := []rune(token)
+			if len(r) > maxMentionRunes {
+				r = r[:maxMentionRunes]
+			}
+			for i := len(r); i > 0; i-- {
+				if i < len(r) && r[i] < utf8.RuneSelf && r[i-1] < utf8.RuneSelf {
+					continue
+				}
+				names = append(names, string(r[:i]))
+			}
+		}
+		tokens = append(tokens, names)
+		for _, name := range names {
+			candidates[name] = true
+		}
+		if len(tokens) == maxMentions {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	var users []models.User
+	database.DB.Where("username IN ?", names).Find(&users)
+	byName := make(map[string]models.User, len(users))
+	for _, u := range users {
+		byName[u.Username] = u
+	}
+
+	var mentioned []models.User
+	seen := make(map[uint]bool)
+	for _, names := range tokens {
+		for _, name := range names {
+			if u, ok := byName[name]; ok {
+				if !seen[u.ID] {
+					seen[u.ID] = true
+					mentioned = append(mentioned, u)
+				}
+				break
+			}
+		}
+	}
+	return mentioned
+}
+
+func isASCIIAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyMentions 通知评论中新提及的用户，skip 中的用户已经通知过
+func notifyMentions(tx *gorm.DB, task *models.Task, comment *models.Comment, author *models.User, skip map[uint]bool) error {
+	msg := fmt.Sprintf("%s 在任务「%s」的评论中提到了你", author.Username, task.Title)
+	for _, u := range comment.Mentions {
+		if skip[u.ID] {
+			continue
+		}
+		if err := notify(tx, u.ID, models.NotifyMention, task, &comment.ID, author, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTaskComment 加载属于该任务的评论
+func loadTaskComment(c *gin.Context) (*models.Task, *models.Comment, bool) {
+	var task models.Task
+	if err := database.DB.First(&task, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return nil, nil, false
+	}
+	var comment models.Comment
+	if err := database.DB.Where("task_id = ?", task.ID).First(&comment, c.Param("commentId")).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "评论不存在",
+		})
+		return nil, nil, false
+	}
+	return &task, &comment, true
+}
+
+// GetTaskComments 获取任务评论，按回复关系组成树，同一层按时间先后排列
+func GetTaskComments(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	var comments []*models.Comment
+	if err := database.DB.Preload("Author").Preload("Mentions").Where("task_id = ?", task.ID).
+		Order("created_at ASC, id ASC").Find(&comments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "获取评论失败",
+		})
+		return
+	}
+
+	byID := make(map[uint]*models.Comment, len(comments))
+	for _, cm := range comments {
+		cm.Replies = []*models.Comment{}
+		byID[cm.ID] = cm
+	}
+	roots := []*models.Comment{}
+	for _, cm := range comments {
+		if cm.ParentID != nil {
+			if parent, ok := byID[*cm.ParentID]; ok {
+				parent.Replies = append(parent.Replies, cm)
+				continue
+			}
+		}
+		roots = append(roots, cm)
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    roots,
+	})
+}
+
+// CreateTaskComment 发表评论或回复，并通知被 @ 的用户
+func CreateTaskComment(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	var req models.CreateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	if req.ParentID != nil {
+		var parent models.Comment
+		if err := database.DB.Where("task_id = ?", task.ID).First(&parent, *req.ParentID).Error; err != nil || parent.Deleted {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "回复的评论不存在",
+			})
+			return
+		}
+	}
+
+	user := middleware.CurrentUser(c)
+	comment := models.Comment{
+		TaskID:   task.ID,
+		ParentID: req.ParentID,
+		AuthorID: user.ID,
+		Content:  req.Content,
+		Mentions: resolveMentions(req.Content),
+	}
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// 只写关联表，不回写被提及的用户
+		if err := tx.Omit("Mentions.*").Create(&comment).Error; err != nil {
+			return err
+		}
+		return notifyMentions(tx, &task, &comment, user, nil)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "发表评论失败",
+		})
+		return
+	}
+
+	database.DB.Preload("Author").Preload("Mentions").First(&comment, comment.ID)
+	comment.Replies = []*models.Comment{}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Message: "评论发表成功",
+		Data:    comment,
+	})
+}
+
+// UpdateTaskComment 编辑自己的评论，只通知新增提及的用户
+func UpdateTaskComment(c *gin.Context) {
+	task, comment, ok := loadTaskComment(c)
+	if !ok {
+		return
+	}
+
+	user := middleware.CurrentUser(c)
+	if comment.AuthorID != user.ID || comment.Deleted {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能编辑自己的评论",
+		})
+		return
+	}
+
+	var req models.UpdateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	var previous []models.User
+	database.DB.Model(comment).Association("Mentions").Find(&previous)
+	notified := make(map[uint]bool, len(previous))
+	for _, u := range previous {
+		notified[u.ID] = true
+	}
+
+	comment.Content = req.Content
+	comment.Mentions = resolveMentions(req.Content)
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(comment).Update("content", comment.Content).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(comment).Omit("Mentions.*").Association("Mentions").Replace(comment.Mentions); err != nil {
+			return err
+		}
+		return notifyMentions(tx, task, comment, user, notified)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "编辑评论失败",
+		})
+		return
+	}
+
+	database.DB.Preload("Author").Preload("Mentions").First(comment, comment.ID)
+	comment.Replies = []*models.Comment{}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "评论编辑成功",
+		Data:    comment,
+	})
+}
+
+// DeleteTaskComment 删除评论。作者和能管理任务的人可以删除；
+// 有回复的评论只清空内容保留占位，没有回复时连同已删除的空父评论一起移除
+func DeleteTaskComment(c *gin.Context) {
+	task, comment, ok := loadTaskComment(c)
+	if !ok {
+		return
+	}
+
+	user := middleware.CurrentUser(c)
+	if comment.AuthorID != user.ID && !canManageTask(user, task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能删除自己的评论",
+		})
+		return
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for cur := comment; cur != nil; {
+			var replies int64
+			tx.Model(&models.Comment{}).Where("parent_id = ?", cur.ID).Count(&replies)
+			if err := tx.Model(cur).Association("Mentions").Clear(); err != nil {
+				return err
+			}
+			if err := tx.Where("comment_id = ?", cur.ID).Delete(&models.Notification{}).Error; err != nil {
+				return err
+			}
+			if replies > 0 {
+				return tx.Model(cur).Updates(map[string]interface{}{"content": "", "deleted": true}).Error
+			}
+			if err := tx.Delete(cur).Error; err != nil {
+				return err
+			}
+
+			// 父评论已删除且没有其他回复时一并移除
+			if cur.ParentID == nil {
+				return nil
+			}
+			var parent models.Comment
+			if err := tx.First(&parent, *cur.ParentID).Error; err != nil || !parent.Deleted {
+				return nil
+			}
+			cur = &parent
+		}
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "删除评论失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "评论删除成功",
+	})
+}
+
+// deleteTaskComments 删除任务的全部评论及提及记录
+func deleteTaskComments(taskID uint) {
+	sub := database.DB.Model(&models.Comment{}).Select("id").Where("task_id = ?", taskID)
+	database.DB.Exec("DELETE FROM comment_mentions WHERE comment_id IN (?)", sub)
+	database.DB.Where("task_id = ?", taskID).Delete(&models.Comment{})
+}
@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ========== 子任务与依赖 ==========
+
+// taskGraph 任务关系图。每个任务拆成“开始”和“结束”两个节点：
+//   - 任务自身：开始 → 结束
+//   - 依赖 B 阻塞 T：B 结束 → T 开始
+//   - 子任务 C 属于 P：P 开始 → C 开始，C 结束 → P 结束
+//
+// 依赖和父子关系混在一起也可能成环（例如父任务被自己的子任务阻塞），
+// 所以环检测和排期都基于这张图。
+type taskGraph struct {
+	tasks    map[uint]*models.Task
+	parent   map[uint]uint
+	blockers map[uint][]uint
+}
+
+// loadTaskGraph 加载任务关系图，projectID 不为空时只包含该项目的任务和项目内的依赖
+func loadTaskGraph(db *gorm.DB, projectID *uint) (*taskGraph, error) {
+	var tasks []models.Task
+	query := db.Select("id", "title", "status", "progress", "parent_id", "estimate_hours", "due_date")
+	if projectID != nil {
+		query = query.Where("project_id = ?", *projectID)
+	}
+	if err := query.Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+
+	var deps []models.TaskDependency
+	if err := db.Find(&deps).Error; err != nil {
+		return nil, err
+	}
+
+	g := &taskGraph{
+		tasks:    make(map[uint]*models.Task, len(tasks)),
+		parent:   make(map[uint]uint),
+		blockers: make(map[uint][]uint),
+	}
+	for i := range tasks {
+		g.tasks[tasks[i].ID] = &tasks[i]
+	}
+	for _, t := range tasks {
+		if t.ParentID != nil && g.tasks[*t.ParentID] != nil {
+			g.parent[t.ID] = *t.ParentID
+		}
+	}
+	for _, d := range deps {
+		if g.tasks[d.TaskID] != nil && g.tasks[d.BlockerID] != nil {
+			g.blockers[d.TaskID] = append(g.blockers[d.TaskID], d.BlockerID)
+		}
+	}
+	return g, nil
+}
+
+func startNode(id uint) uint64 { return uint64(id) << 1 }
+func endNode(id uint) uint64   { return uint64(id)<<1 | 1 }
+
+// edges 生成节点之间的有向边
+func (g *taskGraph) edges() map[uint64][]uint64 {
+	out := make(map[uint64][]uint64, len(g.tasks)*2)
+	for id := range g.tasks {
+		out[startNode(id)] = append(out[startNode(id)], endNode(id))
+		if _, ok := out[endNode(id)]; !ok {
+			out[endNode(id)] = nil
+		}
+	}
+	for child, parent := range g.parent {
+		out[startNode(parent)] = append(out[startNode(parent)], startNode(child))
+		out[endNode(child)] = append(out[endNode(child)], endNode(parent))
+	}
+	for task, blockers := range g.blockers {
+		for _, b := range blockers {
+			out[endNode(b)] = append(out[endNode(b)], startNode(task))
+		}
+	}
+	return out
+}
+
+// topoOrder 返回节点的拓扑序，图中有环时 ok 为 false
+func (g *taskGraph) topoOrder() (order []uint64, out map[uint64][]uint64, ok bool) {
+	out = g.edges()
+	indeg := make(map[uint64]int, len(out))
+	for n, succ := range out {
+		if _, seen := indeg[n]; !seen {
+			indeg[n] = 0
+		}
+		for _, s := range succ {
+			indeg[s]++
+		}
+	}
+
+	queue := make([]uint64, 0, len(out))
+	for n, d := range indeg {
+		if d == 0 {
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		order = append(order, n)
+		for _, s := range out[n] {
+			indeg[s]--
+			if indeg[s] == 0 {
+				queue = append(queue, s)
+			}
+		}
+	}
+	return order, out, len(order) == len(indeg)
+}
+
+func (g *taskGraph) hasCycle() bool {
+	_, _, ok := g.topoOrder()
+	return !ok
+}
+
+// incompleteBlockers 返回尚未完成的前置任务，父任务的前置任务同样约束子任务
+func incompleteBlockers(task *models.Task) []models.Task {
+	ids := []uint{task.ID}
+	seen := map[uint]bool{task.ID: true}
+	for pid := task.ParentID; pid != nil && !seen[*pid]; {
+		seen[*pid] = true
+		ids = append(ids, *pid)
+		var parent models.Task
+		if err := database.DB.Select("id", "parent_id").First(&parent, *pid).Error; err != nil {
+			break
+		}
+		pid = parent.ParentID
+	}
+
+	var rows []models.Task
+	database.DB.Joins("JOIN task_dependencies ON task_dependencies.blocker_id = tasks.id").
+		Where("task_dependencies.task_id IN ? AND tasks.status != ?", ids, models.StatusCompleted).
+		Find(&rows)
+
+	// 同一个任务可能同时阻塞子任务和父任务
+	blockers := make([]models.Task, 0, len(rows))
+	added := make(map[uint]bool, len(rows))
+	for _, b := range rows {
+		if !added[b.ID] {
+			added[b.ID] = true
+			blockers = append(blockers, b)
+		}
+	}
+	return blockers
+}
+
+// checkCanStart 任务从待办进入进行中/已完成时，所有前置任务必须已完成
+func checkCanStart(c *gin.Context, task *models.Task, oldStatus models.TaskStatus) bool {
+	if oldStatus != models.StatusTodo || task.Status == models.StatusTodo {
+		return true
+	}
+	blockers := incompleteBlockers(task)
+	if len(blockers) == 0 {
+		return true
+	}
+	c.JSON(http.StatusConflict, models.APIResponse{
+		Success: false,
+		Error:   "前置任务未完成，不能开始: " + blockers[0].Title,
+		Data:    blockers,
+	})
+	return false
+}
+
+// countSubtasks 统计直接子任务数量
+func countSubtasks(taskID uint) int64 {
+	var n int64
+	database.DB.Model(&models.Task{}).Where("parent_id = ?", taskID).Count(&n)
+	return n
+}
+
+// validateParent 校验父任务存在，且设置后不会与已有父子/依赖关系成环
+func validateParent(c *gin.Context, taskID uint, parentID uint) bool {
+	var parent models.Task
+	if err := database.DB.First(&parent, parentID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "父任务不存在",
+		})
+		return false
+	}
+	if taskID == 0 {
+		return true // 新建任务没有任何关系，不会成环
+	}
+
+	g, err := loadTaskGraph(database.DB, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "加载任务关系失败",
+		})
+		return false
+	}
+	g.parent[taskID] = parentID
+	if g.hasCycle() {
+		c.JSON(http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   "设置父任务后会形成循环",
+		})
+		return false
+	}
+	return true
+}
+
+// rollUpProgress 在 tx 中从 parentID 开始逐级向上汇总子任务进度和状态。
+// 进度按子任务估时加权，未填写估时的子任务按 1 小时计。
+// 项目中的父任务随汇总状态移到对应分类的第一列，同样受流转规则和 WIP 上限约束，
+// 移不过去时返回 409，调用方回滚引起汇总的改动
+func rollUpProgress(tx *gorm.DB, parentID *uint, userID uint) error {
+	seen := make(map[uint]bool)
+	for id := parentID; id != nil && !seen[*id]; {
+		seen[*id] = true
+
+		var parent models.Task
+		if err := tx.First(&parent, *id).Error; err != nil {
+			return nil
+		}
+		var children []models.Task
+		tx.Where("parent_id = ?", parent.ID).Find(&children)
+		if len(children) > 0 {
+			var total, done float64
+			allDone, started := true, false
+			for _, ch := range children {
+				w := ch.Estimate
+				if w <= 0 {
+					w = 1
+				}
+				total += w
+				done += w * float64(ch.Progress) / 100
+				if ch.Status != models.StatusCompleted {
+					allDone = false
+				}
+				if ch.Status != models.StatusTodo || ch.Progress > 0 {
+					started = true
+				}
+			}
+
+			progress := int(math.Round(done / total * 100))
+			status := models.StatusTodo
+			switch {
+			case allDone:
+				progress, status = 100, models.StatusCompleted
+			case started:
+				status = models.StatusInProgress
+				if progress >= 100 {
+					progress = 99
+				}
+			}
+			var col *models.WorkflowColumn
+			if status != parent.Status && parent.ProjectID != nil {
+				col = columnForStatus(tx, *parent.ProjectID, status)
+			}
+			if col != nil {
+				if err := checkColumnEntry(tx, parent.ID, parent.ColumnID, col); err != nil {
+					we := err.(*workflowError)
+					we.msg = fmt.Sprintf("父任务「%s」无法随子任务移动: %s", parent.Title, we.msg)
+					return we
+				}
+				parent.Progress = progress
+				if err := placeInColumn(tx, &parent, col, nil, userID, "子任务汇总"); err != nil {
+					return err
+				}
+			} else if err := tx.Model(&parent).Updates(map[string]interface{}{"progress": progress, "status": status}).Error; err != nil {
+				return err
+			}
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
+
+// GetSubtasks 获取直接子任务
+func GetSubtasks(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	var subtasks []models.Task
+	if err := database.DB.Preload("Assignee").Where("parent_id = ?", task.ID).
+		Order("created_at ASC").Find(&subtasks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "获取子任务失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    subtasks,
+	})
+}
+
+// GetTaskDependencies 获取任务的前置任务和后续任务
+func GetTaskDependencies(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	deps := models.TaskDependencies{BlockedBy: []models.Task{}, Blocks: []models.Task{}}
+	database.DB.Preload("Assignee").
+		Joins("JOIN task_dependencies ON task_dependencies.blocker_id = tasks.id").
+		Where("task_dependencies.task_id = ?", task.ID).Find(&deps.BlockedBy)
+	database.DB.Preload("Assignee").
+		Joins("JOIN task_dependencies ON task_dependencies.task_id = tasks.id").
+		Where("task_dependencies.blocker_id = ?", task.ID).Find(&deps.Blocks)
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    deps,
+	})
+}
+
+// AddTaskDependency 添加前置任务（blocker 阻塞当前任务）
+func AddTaskDependency(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	if !canManageTask(middleware.CurrentUser(c), &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "无权管理该任务",
+		})
+		return
+	}
+
+	var req models.AddDependencyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	var blocker models.Task
+	if err := database.DB.First(&blocker, req.BlockerID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "前置任务不存在",
+		})
+		return
+	}
+
+	var exists int64
+	database.DB.Model(&models.TaskDependency{}).Where("task_id = ? AND blocker_id = ?", task.ID, blocker.ID).Count(&exists)
+	if exists > 0 {
+		c.JSON(http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   "依赖关系已存在",
+		})
+		return
+	}
+
+	g, err := loadTaskGraph(database.DB, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "加载任务关系失败",
+		})
+		return
+	}
+	g.blockers[task.ID] = append(g.blockers[task.ID], blocker.ID)
+	if g.hasCycle() {
+		c.JSON(http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   "添加该依赖会形成循环依赖",
+		})
+		return
+	}
+
+	dep := models.TaskDependency{TaskID: task.ID, BlockerID: blocker.ID}
+	if err := database.DB.Create(&dep).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "添加依赖失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Message: "依赖添加成功",
+		Data:    dep,
+	})
+}
+
+// RemoveTaskDependency 移除前置任务
+func RemoveTaskDependency(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	if !canManageTask(middleware.CurrentUser(c), &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "无权管理该任务",
+		})
+		return
+	}
+
+	blockerID, _ := strconv.ParseUint(c.Param("blockerId"), 10, 32)
+	result := database.DB.Where("task_id = ? AND blocker_id = ?", task.ID, blockerID).Delete(&models.TaskDependency{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "移除依赖失败",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "依赖关系不存在",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "依赖移除成功",
+	})
+}
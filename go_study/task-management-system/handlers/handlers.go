@@ -5,10 +5,12 @@ import (
 	"net/http"
 	"strconv"
 	"task-management-system/database"
+	"task-management-system/middleware"
 	"task-management-system/models"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // ========== 用户管理 ==========
@@ -33,6 +35,21 @@ func CreateUser(c *gin.Context) {
 	if user.Role == "" {
 		user.Role = models.RoleTeamMember
 	}
+	if !user.Role.Valid() {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的角色: " + string(user.Role),
+		})
+		return
+	}
+
+	if err := user.SetPassword(req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "设置密码失败",
+		})
+		return
+	}
 
 	if err := database.DB.Create(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -84,6 +101,73 @@ func GetUser(c *gin.Context) {
 	})
 }
 
+// UpdateUser 更新用户（修改邮箱、角色或重置密码）
+func UpdateUser(c *gin.Context) {
+	id := c.Param("id")
+	var user models.User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "用户不存在",
+		})
+		return
+	}
+
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	if req.Email != "" {
+		user.Email = req.Email
+	}
+	if req.Role != "" {
+		if !req.Role.Valid() {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "无效的角色: " + string(req.Role),
+			})
+			return
+		}
+		// 防止管理员把自己降级后系统里没有管理员
+		if current := middleware.CurrentUser(c); current.ID == user.ID && req.Role != models.RoleAdmin {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "不能修改自己的管理员角色",
+			})
+			return
+		}
+		user.Role = req.Role
+	}
+	if req.Password != "" {
+		if err := user.SetPassword(req.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Error:   "设置密码失败",
+			})
+			return
+		}
+	}
+
+	if err := database.DB.Save(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "更新用户失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "用户更新成功",
+		Data:    user,
+	})
+}
+
 // ========== 项目管理 ==========
 
 // CreateProject 创建项目
@@ -104,6 +188,11 @@ func CreateProject(c *gin.Context) {
 		Status:      models.ProjectPlanning,
 	}
 
+	// 未指定负责人时由创建人负责
+	if project.ManagerID == nil {
+		project.ManagerID = &middleware.CurrentUser(c).ID
+	}
+
 	if req.StartDate != "" {
 		if t, err := time.Parse("2006-01-02", req.StartDate); err == nil {
 			project.StartDate = &t
@@ -124,6 +213,14 @@ func CreateProject(c *gin.Context) {
 		return
 	}
 
+	if err := database.CreateDefaultWorkflow(database.DB, project.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "创建项目工作流失败: " + err.Error(),
+		})
+		return
+	}
+
 	// 重新加载项目以获取关联数据
 	database.DB.Preload("Manager").First(&project, project.ID)
 
@@ -188,6 +285,14 @@ func UpdateProject(c *gin.Context) {
 		return
 	}
 
+	if !canManageProject(middleware.CurrentUser(c), &project) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能管理自己负责的项目",
+		})
+		return
+	}
+
 	var req models.UpdateProjectRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
@@ -250,13 +355,24 @@ func DeleteProject(c *gin.Context) {
 		return
 	}
 
+	if !canManageProject(middleware.CurrentUser(c), &project) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能管理自己负责的项目",
+		})
+		return
+	}
+
 	// 检查是否有关联任务
 	var taskCount int64
 	database.DB.Model(&models.Task{}).Where("project_id = ?", id).Count(&taskCount)
 	if taskCount > 0 {
-		// 将任务的project_id设为null
-		database.DB.Model(&models.Task{}).Where("project_id = ?", id).Update("project_id", nil)
+		// 将任务的project_id设为null，同时移出看板
+		database.DB.Model(&models.Task{}).Where("project_id = ?", id).
+			Updates(map[string]interface{}{"project_id": nil, "column_id": nil, "position": 0})
 	}
+	database.DB.Where("project_id = ?", project.ID).Delete(&models.WorkflowTransition{})
+	database.DB.Where("project_id = ?", project.ID).Delete(&models.WorkflowColumn{})
 
 	if err := database.DB.Delete(&project).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -291,11 +407,25 @@ func CreateTask(c *gin.Context) {
 		Priority:    req.Priority,
 		ProjectID:   req.ProjectID,
 		AssigneeID:  req.AssigneeID,
-		CreatorID:   req.CreatorID,
+		CreatorID:   &middleware.CurrentUser(c).ID,
+		ParentID:    req.ParentID,
+		Estimate:    req.Estimate,
 		Status:      models.StatusTodo,
 		Progress:    0,
 	}
 
+	// 子任务默认归属父任务所在项目
+	if task.ParentID != nil {
+		if !validateParent(c, 0, *task.ParentID) {
+			return
+		}
+		if task.ProjectID == nil {
+			var parent models.Task
+			database.DB.First(&parent, *task.ParentID)
+			task.ProjectID = parent.ProjectID
+		}
+	}
+
 	if task.Priority == "" {
 		task.Priority = models.PriorityMedium
 	}
@@ -306,7 +436,19 @@ func CreateTask(c *gin.Context) {
 		}
 	}
 
-	if err := database.DB.Create(&task).Error; err != nil {
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := placeInProject(tx, &task); err != nil {
+			return err
+		}
+		if err := tx.Create(&task).Error; err != nil {
+			return err
+		}
+		return rollUpProgress(tx, task.ParentID, middleware.CurrentUser(c).ID)
+	}); err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Error:   "创建任务失败: " + err.Error(),
@@ -314,6 +456,8 @@ func CreateTask(c *gin.Context) {
 		return
 	}
 
+	notifyAssigned(&task, nil, middleware.CurrentUser(c))
+
 	// 重新加载以获取关联数据
 	database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, task.ID)
 
@@ -361,6 +505,9 @@ func GetTasks(c *gin.Context) {
 	if filter.AssigneeID != nil && *filter.AssigneeID > 0 {
 		query = query.Where("assignee_id = ?", *filter.AssigneeID)
 	}
+	if filter.ParentID != nil && *filter.ParentID > 0 {
+		query = query.Where("parent_id = ?", *filter.ParentID)
+	}
 	if filter.Search != "" {
 		search := "%" + filter.Search + "%"
 		query = query.Where("title LIKE ? OR description LIKE ?", search, search)
@@ -399,7 +546,7 @@ func GetTasks(c *gin.Context) {
 func GetTask(c *gin.Context) {
 	id := c.Param("id")
 	var task models.Task
-	if err := database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, id).Error; err != nil {
+	if err := database.DB.Preload("Project").Preload("Assignee").Preload("Creator").Preload("Subtasks").First(&task, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, models.APIResponse{
 			Success: false,
 			Error:   "任务不存在",
@@ -425,6 +572,14 @@ func UpdateTask(c *gin.Context) {
 		return
 	}
 
+	if !canManageTask(middleware.CurrentUser(c), &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "无权管理该任务",
+		})
+		return
+	}
+
 	var req models.UpdateTaskRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
@@ -434,6 +589,18 @@ func UpdateTask(c *gin.Context) {
 		return
 	}
 
+	// 有子任务的任务，进度和状态由子任务汇总
+	if (req.Status != "" || req.Progress != nil) && countSubtasks(task.ID) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "该任务有子任务，进度和状态由子任务汇总",
+		})
+		return
+	}
+
+	oldStatus, oldParentID, oldProjectID, oldColumnID := task.Status, task.ParentID, task.ProjectID, task.ColumnID
+	oldAssigneeID := task.AssigneeID
+
 	// 更新字段
 	if req.Title != "" {
 		task.Title = req.Title
@@ -441,13 +608,6 @@ func UpdateTask(c *gin.Context) {
 	if req.Description != "" {
 		task.Description = req.Description
 	}
-	if req.Status != "" {
-		task.Status = req.Status
-		// 自动更新进度
-		if req.Status == models.StatusCompleted {
-			task.Progress = 100
-		}
-	}
 	if req.Priority != "" {
 		task.Priority = req.Priority
 	}
@@ -457,6 +617,19 @@ func UpdateTask(c *gin.Context) {
 	if req.AssigneeID != nil {
 		task.AssigneeID = req.AssigneeID
 	}
+	if req.ParentID != nil {
+		if *req.ParentID == 0 {
+			task.ParentID = nil
+		} else {
+			if !validateParent(c, task.ID, *req.ParentID) {
+				return
+			}
+			task.ParentID = req.ParentID
+		}
+	}
+	if req.Estimate != nil {
+		task.Estimate = *req.Estimate
+	}
 	if req.DueDate != "" {
 		if t, err := time.Parse("2006-01-02", req.DueDate); err == nil {
 			task.DueDate = &t
@@ -464,16 +637,97 @@ func UpdateTask(c *gin.Context) {
 	}
 	if req.Progress != nil {
 		task.Progress = *req.Progress
-		// 自动更新状态
-		if *req.Progress >= 100 {
-			task.Status = models.StatusCompleted
-			task.Progress = 100
-		} else if *req.Progress > 0 {
-			task.Status = models.StatusInProgress
+	}
+
+	// 项目任务的状态由所在看板列决定：换项目时在事务中放进新项目对应的列，
+	// 修改状态相当于移动到该分类的第一列，进度不再推断状态
+	var moveTo *models.WorkflowColumn
+	projectChanged := (oldProjectID == nil) != (task.ProjectID == nil) ||
+		(oldProjectID != nil && task.ProjectID != nil && *oldProjectID != *task.ProjectID)
+	switch {
+	case task.ProjectID == nil:
+		if req.Status != "" {
+			task.Status = req.Status
+			// 自动更新进度
+			if req.Status == models.StatusCompleted {
+				task.Progress = 100
+			}
+		}
+		if req.Progress != nil {
+			// 自动更新状态
+			if *req.Progress >= 100 {
+				task.Status = models.StatusCompleted
+				task.Progress = 100
+			} else if *req.Progress > 0 {
+				task.Status = models.StatusInProgress
+			}
+		}
+	case projectChanged:
+		if req.Status != "" {
+			task.Status = req.Status
+		}
+	case req.Status != "" && req.Status != task.Status:
+		if moveTo = columnForStatus(database.DB, *task.ProjectID, req.Status); moveTo == nil {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "项目工作流中没有该状态的列: " + string(req.Status),
+			})
+			return
 		}
 	}
 
-	if err := database.DB.Save(&task).Error; err != nil {
+	if !checkCanStart(c, &task, oldStatus) {
+		return
+	}
+
+	userID := middleware.CurrentUser(c).ID
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if projectChanged {
+			// 放进新项目时可能落到别的分类的列，重新检查前置任务
+			if err := placeInProject(tx, &task); err != nil {
+				return err
+			}
+			if oldStatus == models.StatusTodo && task.Status != models.StatusTodo {
+				if blockers := incompleteBlockers(&task); len(blockers) > 0 {
+					return &workflowError{code: http.StatusConflict, msg: "前置任务未完成，不能开始: " + blockers[0].Title, data: blockers}
+				}
+			}
+		}
+		if err := tx.Save(&task).Error; err != nil {
+			return err
+		}
+		if projectChanged && (oldColumnID != nil || task.ColumnID != nil) {
+			if err := tx.Create(&models.TaskProgress{
+				TaskID:       task.ID,
+				OldStatus:    oldStatus,
+				NewStatus:    task.Status,
+				Comment:      "更换项目",
+				UpdatedBy:    &userID,
+				FromColumnID: oldColumnID,
+				ToColumnID:   task.ColumnID,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		if moveTo != nil {
+			if err := moveTask(tx, &task, moveTo, nil, userID, ""); err != nil {
+				return err
+			}
+		}
+
+		// 原父任务和新父任务都要重新汇总
+		if err := rollUpProgress(tx, oldParentID, userID); err != nil {
+			return err
+		}
+		if task.ParentID != nil && (oldParentID == nil || *oldParentID != *task.ParentID) {
+			return rollUpProgress(tx, task.ParentID, userID)
+		}
+		return nil
+	}); err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Error:   "更新任务失败",
@@ -481,6 +735,8 @@ func UpdateTask(c *gin.Context) {
 		return
 	}
 
+	notifyAssigned(&task, oldAssigneeID, middleware.CurrentUser(c))
+
 	database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, task.ID)
 
 	c.JSON(http.StatusOK, models.APIResponse{
@@ -502,10 +758,28 @@ func DeleteTask(c *gin.Context) {
 		return
 	}
 
-	// 删除相关进度记录
-	database.DB.Where("task_id = ?", id).Delete(&models.TaskProgress{})
+	if !canManageTask(middleware.CurrentUser(c), &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "无权管理该任务",
+		})
+		return
+	}
 
-	if err := database.DB.Delete(&task).Error; err != nil {
+	// 子任务变为独立任务；父任务重新汇总，移不动时整个删除回滚
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Task{}).Where("parent_id = ?", task.ID).Update("parent_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&task).Error; err != nil {
+			return err
+		}
+		return rollUpProgress(tx, task.ParentID, middleware.CurrentUser(c).ID)
+	}); err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Error:   "删除任务失败",
@@ -513,6 +787,13 @@ func DeleteTask(c *gin.Context) {
 		return
 	}
 
+	// 删除相关进度记录、依赖、评论、附件和通知
+	database.DB.Where("task_id = ?", id).Delete(&models.TaskProgress{})
+	deleteTaskComments(task.ID)
+	deleteTaskAttachments(task.ID)
+	database.DB.Where("task_id = ?", task.ID).Delete(&models.Notification{})
+	database.DB.Where("task_id = ? OR blocker_id = ?", task.ID, task.ID).Delete(&models.TaskDependency{})
+
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Message: "任务删除成功",
@@ -531,6 +812,14 @@ func AssignTask(c *gin.Context) {
 		return
 	}
 
+	if !canManageTask(middleware.CurrentUser(c), &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "无权管理该任务",
+		})
+		return
+	}
+
 	var req models.AssignTaskRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
@@ -550,6 +839,7 @@ func AssignTask(c *gin.Context) {
 		return
 	}
 
+	oldAssigneeID := task.AssigneeID
 	task.AssigneeID = &req.AssigneeID
 	if err := database.DB.Save(&task).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
@@ -558,6 +848,7 @@ func AssignTask(c *gin.Context) {
 		})
 		return
 	}
+	notifyAssigned(&task, oldAssigneeID, middleware.CurrentUser(c))
 
 	database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, task.ID)
 
@@ -580,6 +871,15 @@ func UpdateTaskProgress(c *gin.Context) {
 		return
 	}
 
+	user := middleware.CurrentUser(c)
+	if !canUpdateProgress(user, &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能更新分配给自己的任务进度",
+		})
+		return
+	}
+
 	var req models.UpdateProgressRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
@@ -589,41 +889,87 @@ func UpdateTaskProgress(c *gin.Context) {
 		return
 	}
 
-	oldStatus := task.Status
+	if countSubtasks(task.ID) > 0 {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "该任务有子任务，进度和状态由子任务汇总",
+		})
+		return
+	}
 
-	// 更新进度
-	if req.Progress >= 0 && req.Progress <= 100 {
-		task.Progress = req.Progress
-		// 自动更新状态
-		if req.Progress >= 100 {
-			task.Status = models.StatusCompleted
-			task.Progress = 100
-		} else if req.Progress > 0 {
-			task.Status = models.StatusInProgress
-		} else {
-			task.Status = models.StatusTodo
+	oldStatus := task.Status
+	var moveTo *models.WorkflowColumn
+
+	if task.ProjectID == nil {
+		// 更新进度
+		if req.Progress >= 0 && req.Progress <= 100 {
+			task.Progress = req.Progress
+			// 自动更新状态
+			if req.Progress >= 100 {
+				task.Status = models.StatusCompleted
+				task.Progress = 100
+			} else if req.Progress > 0 {
+				task.Status = models.StatusInProgress
+			} else {
+				task.Status = models.StatusTodo
+			}
 		}
-	}
 
-	// 如果直接指定状态
-	if req.Status != "" {
-		task.Status = req.Status
-		if req.Status == models.StatusCompleted {
-			task.Progress = 100
+		// 如果直接指定状态
+		if req.Status != "" {
+			task.Status = req.Status
+			if req.Status == models.StatusCompleted {
+				task.Progress = 100
+			}
+		}
+	} else {
+		// 项目任务的状态由看板列决定：只更新进度，指定状态时移动到该分类的第一列
+		if req.Progress >= 0 && req.Progress <= 100 {
+			task.Progress = req.Progress
+		}
+		if req.Status != "" && req.Status != task.Status {
+			if moveTo = columnForStatus(database.DB, *task.ProjectID, req.Status); moveTo == nil {
+				c.JSON(http.StatusBadRequest, models.APIResponse{
+					Success: false,
+					Error:   "项目工作流中没有该状态的列: " + string(req.Status),
+				})
+				return
+			}
 		}
 	}
 
-	// 记录进度变更
-	progressRecord := models.TaskProgress{
-		TaskID:    task.ID,
-		OldStatus: oldStatus,
-		NewStatus: task.Status,
-		Comment:   req.Comment,
-		UpdatedBy: req.UpdatedBy,
+	if !checkCanStart(c, &task, oldStatus) {
+		return
 	}
-	database.DB.Create(&progressRecord)
 
-	if err := database.DB.Save(&task).Error; err != nil {
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&task).Error; err != nil {
+			return err
+		}
+		// 移动看板列时由 moveTask 记录流转
+		if moveTo != nil {
+			if err := moveTask(tx, &task, moveTo, nil, user.ID, req.Comment); err != nil {
+				return err
+			}
+		} else {
+			// 记录进度变更
+			progressRecord := models.TaskProgress{
+				TaskID:    task.ID,
+				OldStatus: oldStatus,
+				NewStatus: task.Status,
+				Comment:   req.Comment,
+				UpdatedBy: &user.ID,
+			}
+			if err := tx.Create(&progressRecord).Error; err != nil {
+				return err
+			}
+		}
+		return rollUpProgress(tx, task.ParentID, user.ID)
+	}); err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Error:   "更新进度失败",
@@ -691,11 +1037,17 @@ func AddTaskToProject(c *gin.Context) {
 		Priority:    req.Priority,
 		ProjectID:   &projectIDUint,
 		AssigneeID:  req.AssigneeID,
-		CreatorID:   req.CreatorID,
+		CreatorID:   &middleware.CurrentUser(c).ID,
+		ParentID:    req.ParentID,
+		Estimate:    req.Estimate,
 		Status:      models.StatusTodo,
 		Progress:    0,
 	}
 
+	if task.ParentID != nil && !validateParent(c, 0, *task.ParentID) {
+		return
+	}
+
 	if task.Priority == "" {
 		task.Priority = models.PriorityMedium
 	}
@@ -706,7 +1058,19 @@ func AddTaskToProject(c *gin.Context) {
 		}
 	}
 
-	if err := database.DB.Create(&task).Error; err != nil {
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := placeInProject(tx, &task); err != nil {
+			return err
+		}
+		if err := tx.Create(&task).Error; err != nil {
+			return err
+		}
+		return rollUpProgress(tx, task.ParentID, middleware.CurrentUser(c).ID)
+	}); err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Error:   "创建任务失败",
@@ -714,6 +1078,8 @@ func AddTaskToProject(c *gin.Context) {
 		return
 	}
 
+	notifyAssigned(&task, nil, middleware.CurrentUser(c))
+
 	database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, task.ID)
 
 	c.JSON(http.StatusCreated, models.APIResponse{
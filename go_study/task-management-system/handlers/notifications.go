@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ========== 站内通知 ==========
+
+// notify 给用户发送一条通知，自己触发的操作不通知自己
+func notify(db *gorm.DB, userID uint, typ models.NotificationType, task *models.Task, commentID *uint, actor *models.User, msg string) error {
+	if userID == actor.ID {
+		return nil
+	}
+	return db.Create(&models.Notification{
+		UserID:    userID,
+		Type:      typ,
+		TaskID:    &task.ID,
+		CommentID: commentID,
+		ActorID:   &actor.ID,
+		Message:   msg,
+	}).Error
+}
+
+// notifyAssigned 负责人变化时通知新的负责人。通知失败不影响任务本身的操作
+func notifyAssigned(task *models.Task, oldAssigneeID *uint, actor *models.User) {
+	if task.AssigneeID == nil || *task.AssigneeID == 0 || (oldAssigneeID != nil && *oldAssigneeID == *task.AssigneeID) {
+		return
+	}
+	msg := fmt.Sprintf("%s 把任务「%s」分配给了你", actor.Username, task.Title)
+	if err := notify(database.DB, *task.AssigneeID, models.NotifyAssigned, task, nil, actor, msg); err != nil {
+		log.Printf("发送分配通知失败: %v", err)
+	}
+}
+
+// GetNotifications 获取当前用户的通知，按时间倒序
+func GetNotifications(c *gin.Context) {
+	var filter models.NotificationFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的查询参数",
+		})
+		return
+	}
+
+	if filter.Page <= 0 {
+		filter.Page = 1
+	}
+	if filter.PageSize <= 0 {
+		filter.PageSize = 20
+	}
+	if filter.PageSize > 100 {
+		filter.PageSize = 100
+	}
+
+	user := middleware.CurrentUser(c)
+	query := database.DB.Model(&models.Notification{}).Where("user_id = ?", user.ID)
+	if filter.Unread {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var total, unread int64
+	query.Count(&total)
+	database.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", user.ID).Count(&unread)
+
+	offset := (filter.Page - 1) * filter.PageSize
+	var notifications []models.Notification
+	if err := query.Preload("Actor").Preload("Task").Order("created_at DESC, id DESC").
+		Offset(offset).Limit(filter.PageSize).Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "获取通知失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: models.NotificationList{
+			PaginatedResponse: models.PaginatedResponse{
+				Data:       notifications,
+				Total:      total,
+				Page:       filter.Page,
+				PageSize:   filter.PageSize,
+				TotalPages: int(math.Ceil(float64(total) / float64(filter.PageSize))),
+			},
+			Unread: unread,
+		},
+	})
+}
+
+// MarkNotificationRead 标记单条通知为已读
+func MarkNotificationRead(c *gin.Context) {
+	id := c.Param("id")
+	user := middleware.CurrentUser(c)
+	var notification models.Notification
+	if err := database.DB.Where("user_id = ?", user.ID).First(&notification, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "通知不存在",
+		})
+		return
+	}
+
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		if err := database.DB.Model(&notification).Update("read_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Error:   "标记已读失败",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    notification,
+	})
+}
+
+// MarkAllNotificationsRead 标记当前用户的全部通知为已读
+func MarkAllNotificationsRead(c *gin.Context) {
+	user := middleware.CurrentUser(c)
+	result := database.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", user.ID).Update("read_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "标记已读失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("已将 %d 条通知标为已读", result.RowsAffected),
+	})
+}
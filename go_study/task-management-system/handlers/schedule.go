@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"task-management-system/database"
+	"task-management-system/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 项目排期 ==========
+
+const (
+	defaultEstimateHours = 8 // 未填写估时的任务按一个工作日计
+	workHoursPerDay      = 8 // 工时换算成日历时间时每天的工作小时数
+	slackEpsilon         = 1e-6
+)
+
+// GetProjectSchedule 计算项目剩余工作的关键路径和最早完成时间。
+// 以当前时间为起点，每个任务的剩余工时 = 估时 × (1 - 进度)，已完成任务为 0；
+// 有子任务的汇总任务本身不占工期，跨项目的依赖不参与计算。
+func GetProjectSchedule(c *gin.Context) {
+	id := c.Param("id")
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "项目不存在",
+		})
+		return
+	}
+
+	g, err := loadTaskGraph(database.DB, &project.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "加载任务关系失败",
+		})
+		return
+	}
+	order, out, ok := g.topoOrder()
+	if !ok {
+		c.JSON(http.StatusConflict, models.APIResponse{
+			Success: false,
+			Error:   "任务关系存在循环，无法排期",
+		})
+		return
+	}
+
+	// 每个任务的剩余工时
+	summary := make(map[uint]bool)
+	for _, p := range g.parent {
+		summary[p] = true
+	}
+	remaining := make(map[uint]float64, len(g.tasks))
+	estimated := make(map[uint]bool, len(g.tasks))
+	for tid, t := range g.tasks {
+		estimated[tid] = t.Estimate > 0
+		if summary[tid] || t.Status == models.StatusCompleted {
+			continue
+		}
+		est := t.Estimate
+		if est <= 0 {
+			est = defaultEstimateHours
+		}
+		remaining[tid] = est * float64(100-t.Progress) / 100
+	}
+	weight := func(from, to uint64) float64 {
+		if from&1 == 0 && to == from|1 {
+			return remaining[uint(from>>1)]
+		}
+		return 0
+	}
+
+	// 正推：最早时间
+	early := make(map[uint64]float64, len(order))
+	var finish float64
+	for _, n := range order {
+		for _, s := range out[n] {
+			if v := early[n] + weight(n, s); v > early[s] {
+				early[s] = v
+			}
+		}
+		if early[n] > finish {
+			finish = early[n]
+		}
+	}
+
+	// 逆推：最晚时间
+	late := make(map[uint64]float64, len(order))
+	for _, n := range order {
+		late[n] = finish
+	}
+	preds := make(map[uint64][]uint64, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		for _, s := range out[n] {
+			preds[s] = append(preds[s], n)
+			if v := late[s] - weight(n, s); v < late[n] {
+				late[n] = v
+			}
+		}
+	}
+
+	startAt := time.Now()
+	at := func(hours float64) time.Time {
+		return startAt.Add(time.Duration(hours / workHoursPerDay * 24 * float64(time.Hour)))
+	}
+
+	schedule := models.ProjectSchedule{
+		ProjectID:      project.ID,
+		StartAt:        startAt,
+		EarliestFinish: at(finish),
+		TotalHours:     finish,
+		CriticalPath:   criticalPath(order, preds, early, late, weight, summary),
+		Tasks:          make([]models.ScheduledTask, 0, len(g.tasks)),
+	}
+	if project.EndDate != nil {
+		schedule.Late = schedule.EarliestFinish.After(project.EndDate.AddDate(0, 0, 1))
+	}
+
+	for tid, t := range g.tasks {
+		es, ef := early[startNode(tid)], early[endNode(tid)]
+		ls, lf := late[startNode(tid)], late[endNode(tid)]
+		st := models.ScheduledTask{
+			TaskID:         tid,
+			Title:          t.Title,
+			Status:         t.Status,
+			ParentID:       t.ParentID,
+			Summary:        summary[tid],
+			Estimated:      estimated[tid],
+			RemainingHours: remaining[tid],
+			EarliestStart:  at(es),
+			EarliestFinish: at(ef),
+			LatestStart:    at(ls),
+			LatestFinish:   at(lf),
+			SlackHours:     lf - ef,
+			Critical:       lf-ef < slackEpsilon && t.Status != models.StatusCompleted,
+			DueDate:        t.DueDate,
+		}
+		if t.DueDate != nil && t.Status != models.StatusCompleted {
+			// 截止日期只精确到天，当天结束前完成都不算延期
+			st.Late = st.EarliestFinish.After(t.DueDate.AddDate(0, 0, 1))
+		}
+		schedule.Tasks = append(schedule.Tasks, st)
+	}
+	sort.Slice(schedule.Tasks, func(i, j int) bool {
+		a, b := schedule.Tasks[i], schedule.Tasks[j]
+		if !a.EarliestStart.Equal(b.EarliestStart) {
+			return a.EarliestStart.Before(b.EarliestStart)
+		}
+		return a.TaskID < b.TaskID
+	})
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    schedule,
+	})
+}
+
+// criticalPath 从最晚结束的节点沿零浮动的紧前节点回溯，返回路径上有剩余工时的任务
+func criticalPath(order []uint64, preds map[uint64][]uint64, early, late map[uint64]float64,
+	weight func(from, to uint64) float64, summary map[uint]bool) []uint {
+	path := []uint{}
+	var finish float64
+	var cur uint64
+	found := false
+	for _, n := range order {
+		if !found || early[n] > finish || (early[n] == finish && n < cur) {
+			finish, cur, found = early[n], n, true
+		}
+	}
+	if !found || finish == 0 {
+		return path
+	}
+
+	for {
+		ps := preds[cur]
+		sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+		next, ok := uint64(0), false
+		for _, p := range ps {
+			w := weight(p, cur)
+			if late[p]-early[p] < slackEpsilon && early[p]+w > early[cur]-slackEpsilon {
+				next, ok = p, true
+				if w > 0 {
+					break // 优先沿任务自身的工期回溯
+				}
+			}
+		}
+		if !ok {
+			break
+		}
+		if w := weight(next, cur); w > 0 && !summary[uint(cur>>1)] {
+			path = append(path, uint(cur>>1))
+		}
+		cur = next
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
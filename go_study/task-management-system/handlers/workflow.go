@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"task-management-system/database"
+	"task-management-system/middleware"
+	"task-management-system/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ========== 看板与工作流 ==========
+
+// workflowError 移动任务或修改工作流失败的原因及对应的 HTTP 状态码
+type workflowError struct {
+	code int
+	msg  string
+	data interface{}
+}
+
+func (e *workflowError) Error() string { return e.msg }
+
+func respondWorkflowError(c *gin.Context, err error) {
+	if me, ok := err.(*workflowError); ok {
+		c.JSON(me.code, models.APIResponse{
+			Success: false,
+			Error:   me.msg,
+			Data:    me.data,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, models.APIResponse{
+		Success: false,
+		Error:   "移动任务失败",
+	})
+}
+
+// columnForStatus 返回项目中第一个属于该分类的列
+func columnForStatus(db *gorm.DB, projectID uint, status models.TaskStatus) *models.WorkflowColumn {
+	var col models.WorkflowColumn
+	if err := db.Where("project_id = ? AND category = ?", projectID, status).Order("position ASC").First(&col).Error; err != nil {
+		return nil
+	}
+	return &col
+}
+
+// nextPosition 返回列末尾的位置
+func nextPosition(db *gorm.DB, columnID uint) int {
+	var max sql.NullInt64
+	db.Model(&models.Task{}).Where("column_id = ?", columnID).Select("MAX(position)").Scan(&max)
+	if !max.Valid {
+		return 0
+	}
+	return int(max.Int64) + 1
+}
+
+// placeInProject 把任务放到所属项目中与其状态对应的列末尾，没有对应分类的列时放进第一列。
+// 用于新建任务和任务换项目：没有来源列，不涉及流转规则，但目标列达到 WIP 上限时返回 409
+func placeInProject(db *gorm.DB, task *models.Task) error {
+	task.ColumnID, task.Position = nil, 0
+	if task.ProjectID == nil {
+		return nil
+	}
+	col := columnForStatus(db, *task.ProjectID, task.Status)
+	if col == nil {
+		var first models.WorkflowColumn
+		if err := db.Where("project_id = ?", *task.ProjectID).Order("position ASC").First(&first).Error; err != nil {
+			return nil
+		}
+		col = &first
+		task.Status = col.Category
+	}
+	if err := checkColumnEntry(db, task.ID, nil, col); err != nil {
+		return err
+	}
+	task.ColumnID = &col.ID
+	task.Position = nextPosition(db, col.ID)
+	return nil
+}
+
+// checkColumnEntry 校验任务能否从 fromID 列（nil 表示原来不在该项目看板上）进入 to 列：
+// 项目定义了流转规则时必须有 from → to 的规则，to 列不能超过 WIP 上限
+func checkColumnEntry(tx *gorm.DB, taskID uint, fromID *uint, to *models.WorkflowColumn) error {
+	if fromID != nil {
+		var rules, allowed int64
+		tx.Model(&models.WorkflowTransition{}).Where("project_id = ?", to.ProjectID).Count(&rules)
+		if rules > 0 {
+			tx.Model(&models.WorkflowTransition{}).
+				Where("project_id = ? AND from_column_id = ? AND to_column_id = ?", to.ProjectID, *fromID, to.ID).
+				Count(&allowed)
+			if allowed == 0 {
+				var from models.WorkflowColumn
+				tx.First(&from, *fromID)
+				return &workflowError{code: http.StatusConflict, msg: fmt.Sprintf("不允许从「%s」移动到「%s」", from.Name, to.Name)}
+			}
+		}
+	}
+
+	if to.WIPLimit > 0 {
+		var n int64
+		tx.Model(&models.Task{}).Where("column_id = ? AND id != ?", to.ID, taskID).Count(&n)
+		if n >= int64(to.WIPLimit) {
+			return &workflowError{code: http.StatusConflict, msg: fmt.Sprintf("「%s」已达到 WIP 上限 %d", to.Name, to.WIPLimit)}
+		}
+	}
+	return nil
+}
+
+// moveTask 把任务移到目标列的 position 位置（nil 表示末尾）。
+// 跨列移动时校验流转规则、WIP 上限和前置任务，并记录到 TaskProgress
+func moveTask(tx *gorm.DB, task *models.Task, to *models.WorkflowColumn, position *int, userID uint, comment string) error {
+	if task.ProjectID == nil || *task.ProjectID != to.ProjectID {
+		return &workflowError{code: http.StatusBadRequest, msg: "目标列不属于任务所在项目"}
+	}
+
+	if task.ColumnID == nil || *task.ColumnID != to.ID {
+		if countSubtasks(task.ID) > 0 {
+			return &workflowError{code: http.StatusBadRequest, msg: "该任务有子任务，状态由子任务汇总，只能在列内调整顺序"}
+		}
+
+		if err := checkColumnEntry(tx, task.ID, task.ColumnID, to); err != nil {
+			return err
+		}
+
+		if task.Status == models.StatusTodo && to.Category != models.StatusTodo {
+			if blockers := incompleteBlockers(task); len(blockers) > 0 {
+				return &workflowError{code: http.StatusConflict, msg: "前置任务未完成，不能开始: " + blockers[0].Title, data: blockers}
+			}
+		}
+	}
+	return placeInColumn(tx, task, to, position, userID, comment)
+}
+
+// placeInColumn 把任务放到 to 列的 position 位置（nil 表示末尾），跨列时记录到 TaskProgress。
+// 不做校验，调用方负责
+func placeInColumn(tx *gorm.DB, task *models.Task, to *models.WorkflowColumn, position *int, userID uint, comment string) error {
+	fromID := task.ColumnID
+	crossing := fromID == nil || *fromID != to.ID
+
+	// 重新排列目标列，只改 position 不更新其他任务的 updated_at
+	var ids []uint
+	if err := tx.Model(&models.Task{}).Where("column_id = ? AND id != ?", to.ID, task.ID).
+		Order("position ASC, id ASC").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	pos := len(ids)
+	if position != nil && *position >= 0 && *position < pos {
+		pos = *position
+	}
+	for i, id := range ids {
+		want := i
+		if i >= pos {
+			want = i + 1
+		}
+		if err := tx.Model(&models.Task{}).Where("id = ?", id).UpdateColumn("position", want).Error; err != nil {
+			return err
+		}
+	}
+
+	oldStatus := task.Status
+	task.ColumnID = &to.ID
+	task.Position = pos
+	task.Status = to.Category
+	if to.Category == models.StatusCompleted {
+		task.Progress = 100
+	}
+	if err := tx.Model(task).Updates(map[string]interface{}{
+		"column_id": to.ID,
+		"position":  pos,
+		"status":    task.Status,
+		"progress":  task.Progress,
+	}).Error; err != nil {
+		return err
+	}
+
+	if !crossing {
+		return nil
+	}
+	return tx.Create(&models.TaskProgress{
+		TaskID:       task.ID,
+		OldStatus:    oldStatus,
+		NewStatus:    task.Status,
+		Comment:      comment,
+		UpdatedBy:    &userID,
+		FromColumnID: fromID,
+		ToColumnID:   &to.ID,
+	}).Error
+}
+
+// loadWorkflow 按看板顺序加载项目的列和流转规则
+func loadWorkflow(projectID uint) models.Workflow {
+	wf := models.Workflow{Columns: []models.WorkflowColumn{}, Transitions: []models.WorkflowTransition{}}
+	database.DB.Where("project_id = ?", projectID).Order("position ASC").Find(&wf.Columns)
+	database.DB.Where("project_id = ?", projectID).Order("id ASC").Find(&wf.Transitions)
+	return wf
+}
+
+// GetProjectWorkflow 获取项目工作流
+func GetProjectWorkflow(c *gin.Context) {
+	id := c.Param("id")
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "项目不存在",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    loadWorkflow(project.ID),
+	})
+}
+
+// UpdateProjectWorkflow 整体替换项目的看板列和流转规则。
+// 按 Key 匹配已有列，删除的列中不能还有任务；列的分类改变时，列中任务的状态随之改变
+func UpdateProjectWorkflow(c *gin.Context) {
+	id := c.Param("id")
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "项目不存在",
+		})
+		return
+	}
+
+	if !canManageProject(middleware.CurrentUser(c), &project) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能管理自己负责的项目",
+		})
+		return
+	}
+
+	var req models.UpdateWorkflowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	keys := make(map[string]bool, len(req.Columns))
+	for _, col := range req.Columns {
+		if keys[col.Key] {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "列的 key 重复: " + col.Key,
+			})
+			return
+		}
+		if !col.Category.Valid() {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "无效的列分类: " + string(col.Category),
+			})
+			return
+		}
+		keys[col.Key] = true
+	}
+	for _, t := range req.Transitions {
+		if !keys[t.From] || !keys[t.To] || t.From == t.To {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   fmt.Sprintf("无效的流转: %s → %s", t.From, t.To),
+			})
+			return
+		}
+	}
+
+	var touchedParents []*uint
+	userID := middleware.CurrentUser(c).ID
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var existing []models.WorkflowColumn
+		tx.Where("project_id = ?", project.ID).Find(&existing)
+		byKey := make(map[string]models.WorkflowColumn, len(existing))
+		for _, col := range existing {
+			byKey[col.Key] = col
+		}
+
+		// 先处理删除，避免删掉仍有任务的列
+		for _, col := range existing {
+			if keys[col.Key] {
+				continue
+			}
+			var n int64
+			tx.Model(&models.Task{}).Where("column_id = ?", col.ID).Count(&n)
+			if n > 0 {
+				return &workflowError{code: http.StatusConflict, msg: fmt.Sprintf("列「%s」中还有 %d 个任务，请先移走", col.Name, n)}
+			}
+			if err := tx.Delete(&col).Error; err != nil {
+				return err
+			}
+		}
+
+		ids := make(map[string]uint, len(req.Columns))
+		for i, in := range req.Columns {
+			col, ok := byKey[in.Key]
+			categoryChanged := ok && col.Category != in.Category
+			col.ProjectID = project.ID
+			col.Key = in.Key
+			col.Name = in.Name
+			col.Category = in.Category
+			col.Position = i
+			col.WIPLimit = in.WIPLimit
+			if err := tx.Save(&col).Error; err != nil {
+				return err
+			}
+			ids[in.Key] = col.ID
+
+			if categoryChanged {
+				var moved []models.Task
+				tx.Where("column_id = ?", col.ID).Find(&moved)
+				for _, t := range moved {
+					touchedParents = append(touchedParents, t.ParentID)
+				}
+				updates := map[string]interface{}{"status": col.Category}
+				if col.Category == models.StatusCompleted {
+					updates["progress"] = 100
+				}
+				if err := tx.Model(&models.Task{}).Where("column_id = ?", col.ID).Updates(updates).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Where("project_id = ?", project.ID).Delete(&models.WorkflowTransition{}).Error; err != nil {
+			return err
+		}
+		seen := make(map[[2]uint]bool, len(req.Transitions))
+		for _, t := range req.Transitions {
+			pair := [2]uint{ids[t.From], ids[t.To]}
+			if seen[pair] {
+				continue
+			}
+			seen[pair] = true
+			if err := tx.Create(&models.WorkflowTransition{
+				ProjectID:    project.ID,
+				FromColumnID: pair[0],
+				ToColumnID:   pair[1],
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		// 按新的列和规则汇总受影响的父任务
+		for _, pid := range touchedParents {
+			if err := rollUpProgress(tx, pid, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(*workflowError); ok {
+			respondWorkflowError(c, err)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "更新工作流失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "工作流更新成功",
+		Data:    loadWorkflow(project.ID),
+	})
+}
+
+// GetProjectBoard 获取项目看板，列内任务按 position 排序
+func GetProjectBoard(c *gin.Context) {
+	id := c.Param("id")
+	var project models.Project
+	if err := database.DB.First(&project, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "项目不存在",
+		})
+		return
+	}
+
+	wf := loadWorkflow(project.ID)
+	var tasks []models.Task
+	if err := database.DB.Preload("Assignee").Where("project_id = ? AND column_id IS NOT NULL", project.ID).
+		Order("position ASC, id ASC").Find(&tasks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "获取看板失败",
+		})
+		return
+	}
+	byColumn := make(map[uint][]models.Task, len(wf.Columns))
+	for _, t := range tasks {
+		byColumn[*t.ColumnID] = append(byColumn[*t.ColumnID], t)
+	}
+
+	board := models.Board{
+		ProjectID:   project.ID,
+		Columns:     make([]models.BoardColumn, 0, len(wf.Columns)),
+		Transitions: wf.Transitions,
+	}
+	for _, col := range wf.Columns {
+		ts := byColumn[col.ID]
+		if ts == nil {
+			ts = []models.Task{}
+		}
+		board.Columns = append(board.Columns, models.BoardColumn{
+			WorkflowColumn: col,
+			Tasks:          ts,
+			Count:          len(ts),
+			OverLimit:      col.WIPLimit > 0 && len(ts) > col.WIPLimit,
+		})
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    board,
+	})
+}
+
+// MoveTask 在看板上移动任务：跨列移动或调整列内顺序
+func MoveTask(c *gin.Context) {
+	id := c.Param("id")
+	var task models.Task
+	if err := database.DB.First(&task, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "任务不存在",
+		})
+		return
+	}
+
+	user := middleware.CurrentUser(c)
+	if !canUpdateProgress(user, &task) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "只能移动分配给自己的任务",
+		})
+		return
+	}
+
+	var req models.MoveTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "无效的请求参数: " + err.Error(),
+		})
+		return
+	}
+
+	var column models.WorkflowColumn
+	if err := database.DB.First(&column, req.ColumnID).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "看板列不存在",
+		})
+		return
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := moveTask(tx, &task, &column, req.Position, user.ID, req.Comment); err != nil {
+			return err
+		}
+		return rollUpProgress(tx, task.ParentID, user.ID)
+	}); err != nil {
+		respondWorkflowError(c, err)
+		return
+	}
+
+	database.DB.Preload("Project").Preload("Assignee").Preload("Creator").First(&task, task.ID)
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "任务移动成功",
+		Data:    task,
+	})
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 	"runtime"
 	"task-management-system/database"
 	"task-management-system/handlers"
 	"task-management-system/middleware"
+	"task-management-system/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -35,35 +37,78 @@ func main() {
 	r.StaticFile("/", "./static/index.html")
 	r.StaticFile("/favicon.ico", "./static/favicon.ico")
 
-	// API路由组
+	// 令牌签名密钥
+	middleware.InitAuth(os.Getenv("JWT_SECRET"))
+
+	// 附件保存目录
+	if err := handlers.InitAttachments(os.Getenv("UPLOAD_DIR")); err != nil {
+		log.Fatalf("创建附件目录失败: %v", err)
+	}
+
+	// 认证（无需登录）
+	r.POST("/api/auth/login", handlers.Login)
+
+	// API路由组，所有接口都需要登录；访客只能调用 GET 接口
 	api := r.Group("/api")
+	api.Use(middleware.Auth())
 	{
+		// 当前用户
+		api.GET("/auth/me", handlers.GetCurrentUser)
+		api.PUT("/auth/password", handlers.ChangePassword)
+
 		// 仪表盘
 		api.GET("/dashboard", handlers.GetDashboardStats)
 
 		// 用户管理
-		api.POST("/users", handlers.CreateUser)
+		api.POST("/users", middleware.RequirePermission(models.PermManageUsers), handlers.CreateUser)
 		api.GET("/users", handlers.GetUsers)
 		api.GET("/users/:id", handlers.GetUser)
+		api.PUT("/users/:id", middleware.RequirePermission(models.PermManageUsers), handlers.UpdateUser)
 
 		// 项目管理
-		api.POST("/projects", handlers.CreateProject)
+		api.POST("/projects", middleware.RequirePermission(models.PermCreateProject), handlers.CreateProject)
 		api.GET("/projects", handlers.GetProjects)
 		api.GET("/projects/:id", handlers.GetProject)
-		api.PUT("/projects/:id", handlers.UpdateProject)
-		api.DELETE("/projects/:id", handlers.DeleteProject)
+		api.PUT("/projects/:id", middleware.RequirePermission(models.PermManageProjects), handlers.UpdateProject)
+		api.DELETE("/projects/:id", middleware.RequirePermission(models.PermManageProjects), handlers.DeleteProject)
 		api.GET("/projects/:id/tasks", handlers.GetProjectTasks)
-		api.POST("/projects/:id/tasks", handlers.AddTaskToProject)
+		api.POST("/projects/:id/tasks", middleware.RequirePermission(models.PermCreateTask), handlers.AddTaskToProject)
+		api.GET("/projects/:id/schedule", handlers.GetProjectSchedule)
+		api.GET("/projects/:id/workflow", handlers.GetProjectWorkflow)
+		api.PUT("/projects/:id/workflow", middleware.RequirePermission(models.PermManageProjects), handlers.UpdateProjectWorkflow)
+		api.GET("/projects/:id/board", handlers.GetProjectBoard)
 
 		// 任务管理
-		api.POST("/tasks", handlers.CreateTask)
+		api.POST("/tasks", middleware.RequirePermission(models.PermCreateTask), handlers.CreateTask)
 		api.GET("/tasks", handlers.GetTasks)
 		api.GET("/tasks/:id", handlers.GetTask)
-		api.PUT("/tasks/:id", handlers.UpdateTask)
-		api.DELETE("/tasks/:id", handlers.DeleteTask)
-		api.PUT("/tasks/:id/assign", handlers.AssignTask)
-		api.PUT("/tasks/:id/progress", handlers.UpdateTaskProgress)
+		api.PUT("/tasks/:id", middleware.RequirePermission(models.PermManageTasks), handlers.UpdateTask)
+		api.DELETE("/tasks/:id", middleware.RequirePermission(models.PermManageTasks), handlers.DeleteTask)
+		api.PUT("/tasks/:id/assign", middleware.RequirePermission(models.PermManageTasks), handlers.AssignTask)
+		api.PUT("/tasks/:id/progress", middleware.RequirePermission(models.PermUpdateProgress), handlers.UpdateTaskProgress)
 		api.GET("/tasks/:id/progress", handlers.GetTaskProgress)
+		api.PUT("/tasks/:id/move", middleware.RequirePermission(models.PermUpdateProgress), handlers.MoveTask)
+
+		// 子任务与依赖
+		api.GET("/tasks/:id/subtasks", handlers.GetSubtasks)
+		api.GET("/tasks/:id/dependencies", handlers.GetTaskDependencies)
+		api.POST("/tasks/:id/dependencies", middleware.RequirePermission(models.PermManageTasks), handlers.AddTaskDependency)
+		api.DELETE("/tasks/:id/dependencies/:blockerId", middleware.RequirePermission(models.PermManageTasks), handlers.RemoveTaskDependency)
+
+		// 评论与附件
+		api.GET("/tasks/:id/comments", handlers.GetTaskComments)
+		api.POST("/tasks/:id/comments", middleware.RequirePermission(models.PermComment), handlers.CreateTaskComment)
+		api.PUT("/tasks/:id/comments/:commentId", middleware.RequirePermission(models.PermComment), handlers.UpdateTaskComment)
+		api.DELETE("/tasks/:id/comments/:commentId", middleware.RequirePermission(models.PermComment), handlers.DeleteTaskComment)
+		api.GET("/tasks/:id/attachments", handlers.GetTaskAttachments)
+		api.POST("/tasks/:id/attachments", middleware.RequirePermission(models.PermComment), handlers.UploadTaskAttachment)
+		api.GET("/tasks/:id/attachments/:attachmentId", handlers.DownloadTaskAttachment)
+		api.DELETE("/tasks/:id/attachments/:attachmentId", middleware.RequirePermission(models.PermComment), handlers.DeleteTaskAttachment)
+
+		// 通知
+		api.GET("/notifications", handlers.GetNotifications)
+		api.PUT("/notifications/read-all", handlers.MarkAllNotificationsRead)
+		api.PUT("/notifications/:id/read", handlers.MarkNotificationRead)
 	}
 
 	// 健康检查
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"task-management-system/database"
+	"task-management-system/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenTTL 令牌有效期
+const TokenTTL = 24 * time.Hour
+
+const currentUserKey = "currentUser"
+
+var (
+	jwtSecret []byte
+	// jwtHeader 固定的 HS256 头部，签发和校验都只接受这一种算法
+	jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	errInvalidToken = errors.New("无效的令牌")
+	errTokenExpired = errors.New("令牌已过期")
+)
+
+// Claims 令牌载荷
+type Claims struct {
+	UserID    uint            `json:"sub"`
+	Role      models.UserRole `json:"role"`
+	IssuedAt  int64           `json:"iat"`
+	ExpiresAt int64           `json:"exp"`
+}
+
+// InitAuth 设置令牌签名密钥，未配置时随机生成（服务重启后需重新登录）
+func InitAuth(secret string) {
+	if secret != "" {
+		jwtSecret = []byte(secret)
+		return
+	}
+	jwtSecret = make([]byte, 32)
+	if _, err := rand.Read(jwtSecret); err != nil {
+		log.Fatalf("生成签名密钥失败: %v", err)
+	}
+	log.Println("未设置 JWT_SECRET，已随机生成签名密钥，服务重启后需重新登录")
+}
+
+// GenerateToken 为用户签发令牌
+func GenerateToken(user *models.User) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(TokenTTL)
+	payload, err := json.Marshal(Claims{
+		UserID:    user.ID,
+		Role:      user.Role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + sign(signingInput), expiresAt, nil
+}
+
+// ParseToken 校验签名和有效期并返回载荷
+func ParseToken(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(parts[0]+"."+parts[1]))) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.UserID == 0 {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	return &claims, nil
+}
+
+func sign(input string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Auth 认证中间件，校验 Bearer 令牌并加载当前用户
+func Auth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == "" || token == header {
+			abortUnauthorized(c, "未登录")
+			return
+		}
+
+		claims, err := ParseToken(token)
+		if err != nil {
+			abortUnauthorized(c, err.Error())
+			return
+		}
+
+		// 每次请求都从数据库加载用户，角色变更和删除即时生效
+		var user models.User
+		if err := database.DB.First(&user, claims.UserID).Error; err != nil {
+			abortUnauthorized(c, "用户不存在")
+			return
+		}
+		if user.PasswordChangedAt != nil && claims.IssuedAt < user.PasswordChangedAt.Unix() {
+			abortUnauthorized(c, "密码已修改，请重新登录")
+			return
+		}
+
+		c.Set(currentUserKey, &user)
+		c.Next()
+	}
+}
+
+// RequirePermission 权限中间件，当前用户角色不具备该权限时返回 403
+func RequirePermission(p models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := CurrentUser(c)
+		if user == nil || !user.Role.Can(p) {
+			c.AbortWithStatusJSON(http.StatusForbidden, models.APIResponse{
+				Success: false,
+				Error:   "权限不足",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser 获取当前登录用户，未经过 Auth 中间件时返回 nil
+func CurrentUser(c *gin.Context) *models.User {
+	if v, ok := c.Get(currentUserKey); ok {
+		if user, ok := v.(*models.User); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+func abortUnauthorized(c *gin.Context, msg string) {
+	c.Header("WWW-Authenticate", `Bearer realm="taskflow"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, models.APIResponse{
+		Success: false,
+		Error:   msg,
+	})
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TaskStatus 任务状态
@@ -13,6 +15,11 @@ const (
 	StatusCompleted  TaskStatus = "completed"
 )
 
+// Valid 判断是否为已定义的任务状态
+func (s TaskStatus) Valid() bool {
+	return s == StatusTodo || s == StatusInProgress || s == StatusCompleted
+}
+
 // Priority 优先级
 type Priority string
 
@@ -32,6 +39,51 @@ const (
 	RoleGuest          UserRole = "guest"
 )
 
+// Permission 操作权限
+type Permission string
+
+const (
+	PermManageUsers    Permission = "user:manage"    // 创建用户、修改角色、重置密码
+	PermCreateProject  Permission = "project:create" // 创建项目
+	PermManageProjects Permission = "project:manage" // 编辑/删除项目（项目经理仅限自己负责的项目）
+	PermCreateTask     Permission = "task:create"    // 创建任务
+	PermManageTasks    Permission = "task:manage"    // 编辑/删除/分配任务（按项目或创建人限定范围）
+	PermUpdateProgress Permission = "task:progress"  // 更新任务进度（团队成员仅限分配给自己的任务）
+	PermComment        Permission = "task:comment"   // 评论任务、上传附件
+)
+
+// RolePermissions 角色权限矩阵，访客不具备任何写权限
+var RolePermissions = map[UserRole][]Permission{
+	RoleAdmin: {
+		PermManageUsers, PermCreateProject, PermManageProjects,
+		PermCreateTask, PermManageTasks, PermUpdateProgress, PermComment,
+	},
+	RoleProjectManager: {
+		PermCreateProject, PermManageProjects,
+		PermCreateTask, PermManageTasks, PermUpdateProgress, PermComment,
+	},
+	RoleTeamMember: {
+		PermCreateTask, PermManageTasks, PermUpdateProgress, PermComment,
+	},
+	RoleGuest: {},
+}
+
+// Can 判断角色是否拥有指定权限
+func (r UserRole) Can(p Permission) bool {
+	for _, perm := range RolePermissions[r] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid 判断是否为已定义的角色
+func (r UserRole) Valid() bool {
+	_, ok := RolePermissions[r]
+	return ok
+}
+
 // ProjectStatus 项目状态
 type ProjectStatus string
 
@@ -49,6 +101,29 @@ type User struct {
 	Role      UserRole  `json:"role" gorm:"default:'team_member'"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	PasswordHash      string     `json:"-"`
+	PasswordChangedAt *time.Time `json:"-"` // 早于此时间签发的令牌失效
+}
+
+// SetPassword 设置密码哈希，并使此前签发的令牌失效
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u.PasswordHash = string(hash)
+	u.PasswordChangedAt = &now
+	return nil
+}
+
+// CheckPassword 校验密码
+func (u *User) CheckPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
 }
 
 // Project 项目模型
@@ -79,12 +154,25 @@ type Task struct {
 	Assignee    *User      `json:"assignee,omitempty" gorm:"foreignKey:AssigneeID"`
 	CreatorID   *uint      `json:"creator_id"`
 	Creator     *User      `json:"creator,omitempty" gorm:"foreignKey:CreatorID"`
+	ParentID    *uint      `json:"parent_id" gorm:"index"`
+	Subtasks    []Task     `json:"subtasks,omitempty" gorm:"foreignKey:ParentID"`
+	ColumnID    *uint      `json:"column_id" gorm:"index"`    // 所在看板列，Status 随列的分类变化
+	Position    int        `json:"position" gorm:"default:0"` // 列内排序，从 0 开始
 	DueDate     *time.Time `json:"due_date"`
-	Progress    int        `json:"progress" gorm:"default:0"` // 0-100
+	Estimate    float64    `json:"estimate_hours" gorm:"column:estimate_hours;default:0"` // 预估工时（小时）
+	Progress    int        `json:"progress" gorm:"default:0"`                             // 0-100，有子任务时由子任务汇总
 	CreatedAt   time.Time  `json:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
+// TaskDependency 任务依赖：Blocker 完成前 Task 不能开始
+type TaskDependency struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TaskID    uint      `json:"task_id" gorm:"not null;uniqueIndex:idx_task_blocker"`
+	BlockerID uint      `json:"blocker_id" gorm:"not null;uniqueIndex:idx_task_blocker;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 // TaskProgress 任务进度记录
 type TaskProgress struct {
 	ID        uint       `json:"id" gorm:"primaryKey"`
@@ -96,6 +184,89 @@ type TaskProgress struct {
 	UpdatedBy *uint      `json:"updated_by"`
 	User      *User      `json:"user,omitempty" gorm:"foreignKey:UpdatedBy"`
 	CreatedAt time.Time  `json:"created_at"`
+
+	FromColumnID *uint `json:"from_column_id"` // 看板移动记录的起止列
+	ToColumnID   *uint `json:"to_column_id"`
+}
+
+// WorkflowColumn 项目看板列。Category 把自定义列归入待办/进行中/已完成，
+// 统计、依赖校验和子任务汇总都按分类工作
+type WorkflowColumn struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	ProjectID uint       `json:"project_id" gorm:"not null;uniqueIndex:idx_project_column_key"`
+	Key       string     `json:"key" gorm:"not null;uniqueIndex:idx_project_column_key"`
+	Name      string     `json:"name" gorm:"not null"`
+	Category  TaskStatus `json:"category" gorm:"not null"`
+	Position  int        `json:"position"`
+	WIPLimit  int        `json:"wip_limit" gorm:"default:0"` // 0 表示不限制
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// WorkflowTransition 允许的列间流转。项目没有定义任何流转时可以在列之间自由移动
+type WorkflowTransition struct {
+	ID           uint `json:"id" gorm:"primaryKey"`
+	ProjectID    uint `json:"project_id" gorm:"not null;index"`
+	FromColumnID uint `json:"from_column_id" gorm:"not null"`
+	ToColumnID   uint `json:"to_column_id" gorm:"not null"`
+}
+
+// Comment 任务评论，ParentID 指向被回复的评论
+type Comment struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	TaskID    uint       `json:"task_id" gorm:"not null;index"`
+	ParentID  *uint      `json:"parent_id" gorm:"index"`
+	AuthorID  uint       `json:"author_id" gorm:"not null"`
+	Author    *User      `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
+	Content   string     `json:"content"`
+	Deleted   bool       `json:"deleted" gorm:"default:false"` // 有回复的评论删除后保留占位，回复不丢失
+	Mentions  []User     `json:"mentions" gorm:"many2many:comment_mentions"`
+	Replies   []*Comment `json:"replies" gorm:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// NotificationType 通知类型
+type NotificationType string
+
+const (
+	NotifyMention  NotificationType = "mention"  // 在评论中被 @
+	NotifyAssigned NotificationType = "assigned" // 被分配任务
+)
+
+// Notification 站内通知，每个用户一个收件箱
+type Notification struct {
+	ID        uint             `json:"id" gorm:"primaryKey"`
+	UserID    uint             `json:"user_id" gorm:"not null;index"`
+	Type      NotificationType `json:"type" gorm:"not null"`
+	TaskID    *uint            `json:"task_id" gorm:"index"`
+	Task      *Task            `json:"task,omitempty" gorm:"foreignKey:TaskID"`
+	CommentID *uint            `json:"comment_id"`
+	ActorID   *uint            `json:"actor_id"`
+	Actor     *User            `json:"actor,omitempty" gorm:"foreignKey:ActorID"`
+	Message   string           `json:"message"`
+	ReadAt    *time.Time       `json:"read_at"` // nil 表示未读
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// Attachment 任务附件，文件保存在上传目录中，StoredName 为随机文件名
+type Attachment struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TaskID      uint      `json:"task_id" gorm:"not null;index"`
+	UploaderID  uint      `json:"uploader_id" gorm:"not null"`
+	Uploader    *User     `json:"uploader,omitempty" gorm:"foreignKey:UploaderID"`
+	FileName    string    `json:"file_name" gorm:"not null"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	StoredName  string    `json:"-" gorm:"not null"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DefaultWorkflowColumns 新项目的默认看板列
+var DefaultWorkflowColumns = []WorkflowColumn{
+	{Key: "todo", Name: "待办", Category: StatusTodo},
+	{Key: "in_progress", Name: "进行中", Category: StatusInProgress},
+	{Key: "completed", Name: "已完成", Category: StatusCompleted},
 }
 
 // ========== 请求/响应结构体 ==========
@@ -104,9 +275,43 @@ type TaskProgress struct {
 type CreateUserRequest struct {
 	Username string   `json:"username" binding:"required"`
 	Email    string   `json:"email" binding:"required,email"`
+	Password string   `json:"password" binding:"required,min=6"`
 	Role     UserRole `json:"role"`
 }
 
+// UpdateUserRequest 管理员更新用户请求
+type UpdateUserRequest struct {
+	Email    string   `json:"email" binding:"omitempty,email"`
+	Role     UserRole `json:"role"`
+	Password string   `json:"password" binding:"omitempty,min=6"`
+}
+
+// LoginRequest 登录请求
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// LoginResponse 登录响应
+type LoginResponse struct {
+	Token       string       `json:"token"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+	User        User         `json:"user"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// CurrentUserResponse 当前用户信息
+type CurrentUserResponse struct {
+	User        User         `json:"user"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// ChangePasswordRequest 修改密码请求
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
 // CreateProjectRequest 创建项目请求
 type CreateProjectRequest struct {
 	Name        string `json:"name" binding:"required"`
@@ -133,7 +338,8 @@ type CreateTaskRequest struct {
 	Priority    Priority `json:"priority"`
 	ProjectID   *uint    `json:"project_id"`
 	AssigneeID  *uint    `json:"assignee_id"`
-	CreatorID   *uint    `json:"creator_id"`
+	ParentID    *uint    `json:"parent_id"`
+	Estimate    float64  `json:"estimate_hours" binding:"gte=0"`
 	DueDate     string   `json:"due_date"`
 }
 
@@ -145,10 +351,23 @@ type UpdateTaskRequest struct {
 	Priority    Priority   `json:"priority"`
 	ProjectID   *uint      `json:"project_id"`
 	AssigneeID  *uint      `json:"assignee_id"`
+	ParentID    *uint      `json:"parent_id"` // 传 0 表示取消父任务
+	Estimate    *float64   `json:"estimate_hours" binding:"omitempty,gte=0"`
 	DueDate     string     `json:"due_date"`
 	Progress    *int       `json:"progress"`
 }
 
+// AddDependencyRequest 添加依赖请求
+type AddDependencyRequest struct {
+	BlockerID uint `json:"blocker_id" binding:"required"`
+}
+
+// TaskDependencies 任务的依赖关系
+type TaskDependencies struct {
+	BlockedBy []Task `json:"blocked_by"` // 阻塞当前任务的任务
+	Blocks    []Task `json:"blocks"`     // 被当前任务阻塞的任务
+}
+
 // AssignTaskRequest 分配任务请求
 type AssignTaskRequest struct {
 	AssigneeID uint `json:"assignee_id" binding:"required"`
@@ -156,10 +375,81 @@ type AssignTaskRequest struct {
 
 // UpdateProgressRequest 更新进度请求
 type UpdateProgressRequest struct {
-	Status    TaskStatus `json:"status"`
-	Progress  int        `json:"progress"`
-	Comment   string     `json:"comment"`
-	UpdatedBy *uint      `json:"updated_by"`
+	Status   TaskStatus `json:"status"`
+	Progress int        `json:"progress"`
+	Comment  string     `json:"comment"`
+}
+
+// WorkflowColumnInput 工作流列定义，按 Key 匹配已有列
+type WorkflowColumnInput struct {
+	Key      string     `json:"key" binding:"required"`
+	Name     string     `json:"name" binding:"required"`
+	Category TaskStatus `json:"category" binding:"required"`
+	WIPLimit int        `json:"wip_limit" binding:"gte=0"`
+}
+
+// WorkflowTransitionInput 流转定义，使用列的 Key
+type WorkflowTransitionInput struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+}
+
+// UpdateWorkflowRequest 更新项目工作流请求，列的顺序即看板顺序
+type UpdateWorkflowRequest struct {
+	Columns     []WorkflowColumnInput     `json:"columns" binding:"required,min=1,dive"`
+	Transitions []WorkflowTransitionInput `json:"transitions" binding:"dive"`
+}
+
+// Workflow 项目工作流
+type Workflow struct {
+	Columns     []WorkflowColumn     `json:"columns"`
+	Transitions []WorkflowTransition `json:"transitions"`
+}
+
+// MoveTaskRequest 移动任务请求
+type MoveTaskRequest struct {
+	ColumnID uint   `json:"column_id" binding:"required"`
+	Position *int   `json:"position"` // 目标列中的位置，从 0 开始；不传则放到末尾
+	Comment  string `json:"comment"`
+}
+
+// CreateCommentRequest 发表评论请求
+type CreateCommentRequest struct {
+	Content  string `json:"content" binding:"required,max=5000"`
+	ParentID *uint  `json:"parent_id"` // 回复的评论
+}
+
+// UpdateCommentRequest 编辑评论请求
+type UpdateCommentRequest struct {
+	Content string `json:"content" binding:"required,max=5000"`
+}
+
+// NotificationFilter 通知过滤器
+type NotificationFilter struct {
+	Unread   bool `form:"unread"`
+	Page     int  `form:"page"`
+	PageSize int  `form:"page_size"`
+}
+
+// NotificationList 通知列表及未读数
+type NotificationList struct {
+	PaginatedResponse
+	Unread int64 `json:"unread"`
+}
+
+// BoardColumn 看板列及其中的任务
+type BoardColumn struct {
+	WorkflowColumn
+	Tasks     []Task `json:"tasks"`
+	Count     int    `json:"count"`
+	OverLimit bool   `json:"over_limit"` // 调整 WIP 上限后已有任务可能超出
+}
+
+// Board 项目看板
+type Board struct {
+	ProjectID   uint                 `json:"project_id"`
+	Columns     []BoardColumn        `json:"columns"`
+	Transitions []WorkflowTransition `json:"transitions"`
 }
 
 // TaskFilter 任务过滤器
@@ -168,6 +458,7 @@ type TaskFilter struct {
 	Priority   Priority   `form:"priority"`
 	ProjectID  *uint      `form:"project_id"`
 	AssigneeID *uint      `form:"assignee_id"`
+	ParentID   *uint      `form:"parent_id"`
 	Search     string     `form:"search"`
 	Page       int        `form:"page"`
 	PageSize   int        `form:"page_size"`
@@ -190,6 +481,36 @@ type APIResponse struct {
 	Error   string      `json:"error,omitempty"`
 }
 
+// ScheduledTask 排期中的单个任务，时间均为最早/最晚可能时间
+type ScheduledTask struct {
+	TaskID         uint       `json:"task_id"`
+	Title          string     `json:"title"`
+	Status         TaskStatus `json:"status"`
+	ParentID       *uint      `json:"parent_id"`
+	Summary        bool       `json:"summary"`   // 有子任务，工期由子任务决定
+	Estimated      bool       `json:"estimated"` // false 表示未填写估时，按默认工时计算
+	RemainingHours float64    `json:"remaining_hours"`
+	EarliestStart  time.Time  `json:"earliest_start"`
+	EarliestFinish time.Time  `json:"earliest_finish"`
+	LatestStart    time.Time  `json:"latest_start"`
+	LatestFinish   time.Time  `json:"latest_finish"`
+	SlackHours     float64    `json:"slack_hours"`
+	Critical       bool       `json:"critical"`
+	DueDate        *time.Time `json:"due_date"`
+	Late           bool       `json:"late"` // 最早完成时间晚于截止日期
+}
+
+// ProjectSchedule 项目排期与关键路径
+type ProjectSchedule struct {
+	ProjectID      uint            `json:"project_id"`
+	StartAt        time.Time       `json:"start_at"`
+	EarliestFinish time.Time       `json:"earliest_finish"`
+	TotalHours     float64         `json:"total_hours"` // 关键路径上的剩余工时
+	CriticalPath   []uint          `json:"critical_path"`
+	Late           bool            `json:"late"` // 最早完成时间晚于项目结束日期
+	Tasks          []ScheduledTask `json:"tasks"`
+}
+
 // DashboardStats 仪表盘统计
 type DashboardStats struct {
 	TotalTasks       int64 `json:"total_tasks"`
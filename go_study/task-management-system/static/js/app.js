@@ -1,7 +1,43 @@
 const API_BASE = '/api';
 let currentPage = 'dashboard', tasks = [], projects = [], users = [], currentTaskPage = 1, totalTaskPages = 1, currentView = 'list';
+let authToken = localStorage.getItem('token'), currentUser = null, permissions = [];
+let notifyTimer = null, discussionTaskId = null, replyToComment = null, commentIndex = {};
 
-document.addEventListener('DOMContentLoaded', () => { initNavigation(); initEventListeners(); loadDashboard(); loadProjects(); loadUsers(); });
+document.addEventListener('DOMContentLoaded', () => { initNavigation(); initEventListeners(); loadCurrentUser(); });
+
+// 所有接口请求都带上登录令牌，令牌失效时弹出登录框
+async function apiFetch(url, opts) {
+    opts = opts || {}; opts.headers = Object.assign({}, opts.headers, authToken ? { 'Authorization': 'Bearer ' + authToken } : {});
+    const r = await fetch(url, opts);
+    if (r.status === 401 && !url.endsWith('/auth/login')) { authToken = null; localStorage.removeItem('token'); showLogin(); }
+    return r;
+}
+
+async function loadCurrentUser() {
+    if (!authToken) { showLogin(); return; }
+    try { const r = await apiFetch(API_BASE + '/auth/me'), result = await r.json(); if (result.success) onLoggedIn(result.data.user, result.data.permissions); } catch (e) { console.error(e); }
+}
+
+function onLoggedIn(user, perms) {
+    currentUser = user; permissions = perms || [];
+    document.getElementById('current-user-name').textContent = user.username; document.getElementById('current-user-role').textContent = getRoleText(user.role);
+    document.querySelectorAll('[data-perm]').forEach(el => el.classList.toggle('hidden', !can(el.dataset.perm)));
+    document.getElementById('login-modal').classList.add('hidden');
+    switchPage(currentPage); loadProjects(); loadUsers();
+    // 每分钟刷新一次未读通知数
+    loadNotifications(); if (!notifyTimer) notifyTimer = setInterval(() => { if (authToken) loadNotifications(); }, 60000);
+}
+
+function can(p) { return permissions.includes(p); }
+function showLogin() { document.getElementById('login-form').reset(); document.getElementById('login-modal').classList.remove('hidden'); }
+
+async function login(e) {
+    e.preventDefault();
+    const data = { username: document.getElementById('login-username').value, password: document.getElementById('login-password').value };
+    try { const r = await apiFetch(API_BASE + '/auth/login', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json(); if (result.success) { authToken = result.data.token; localStorage.setItem('token', authToken); onLoggedIn(result.data.user, result.data.permissions); showToast('欢迎回来，' + result.data.user.username, 'success'); } else showToast(result.error || '登录失败', 'error'); } catch (err) { console.error(err); showToast('登录失败', 'error'); }
+}
+
+function logout() { authToken = null; currentUser = null; permissions = []; localStorage.removeItem('token'); document.getElementById('notify-panel').classList.add('hidden'); showLogin(); }
 
 function initNavigation() { document.querySelectorAll('.nav-item').forEach(item => item.addEventListener('click', () => switchPage(item.dataset.page))); }
 
@@ -20,14 +56,15 @@ function initEventListeners() {
     document.getElementById('menuToggle').addEventListener('click', () => document.getElementById('sidebar').classList.toggle('open'));
     document.getElementById('quickAddTask').addEventListener('click', () => openTaskModal());
     document.getElementById('globalSearch').addEventListener('input', debounce(() => { if (currentPage === 'tasks') loadTasks(); }, 300));
-    ['filter-status', 'filter-priority', 'filter-project', 'filter-assignee'].forEach(id => { const el = document.getElementById(id); if (el) el.addEventListener('change', () => loadTasks()); });
+    ['filter-status', 'filter-priority', 'filter-project', 'filter-assignee'].forEach(id => { const el = document.getElementById(id); if (el) el.addEventListener('change', () => currentView === 'kanban' ? renderKanbanBoard() : loadTasks()); });
     document.querySelectorAll('.view-toggle button').forEach(btn => btn.addEventListener('click', () => switchView(btn.dataset.view)));
     const p = document.getElementById('task-progress'); if (p) p.addEventListener('input', e => document.getElementById('progress-value').textContent = e.target.value);
+    document.addEventListener('click', e => { if (!e.target.closest('.notify-wrapper')) document.getElementById('notify-panel').classList.add('hidden'); });
 }
 
 async function loadDashboard() {
     try {
-        const r = await fetch(API_BASE + '/dashboard'), result = await r.json();
+        const r = await apiFetch(API_BASE + '/dashboard'), result = await r.json();
         if (result.success) {
             const s = result.data;
             document.getElementById('stat-total').textContent = s.total_tasks;
@@ -58,7 +95,7 @@ async function loadTasks() {
         if (status) params.append('status', status); if (priority) params.append('priority', priority);
         if (projectId) params.append('project_id', projectId); if (assigneeId) params.append('assignee_id', assigneeId);
         if (search) params.append('search', search);
-        const r = await fetch(API_BASE + '/tasks?' + params), result = await r.json();
+        const r = await apiFetch(API_BASE + '/tasks?' + params), result = await r.json();
         if (result.success) { tasks = result.data.data || []; totalTaskPages = result.data.total_pages; if (currentView === 'list') { renderTaskTable(tasks); renderPagination(result.data); } else renderKanbanBoard(); }
     } catch (e) { console.error(e); showToast('加载任务失败', 'error'); }
 }
@@ -87,8 +124,12 @@ function switchView(v) {
 }
 
 async function renderKanbanBoard() {
+    // 选中项目时按项目工作流渲染看板，否则按三种状态汇总
+    const pid = document.getElementById('filter-project')?.value, board = document.getElementById('project-board');
+    document.getElementById('status-board').classList.toggle('hidden', !!pid); board.classList.toggle('hidden', !pid);
+    if (pid) return renderProjectBoard(pid);
     try {
-        const r = await fetch(API_BASE + '/tasks?page_size=100'), result = await r.json();
+        const r = await apiFetch(API_BASE + '/tasks?page_size=100'), result = await r.json();
         if (result.success) {
             const all = result.data.data || [], todo = all.filter(t => t.status === 'todo'), prog = all.filter(t => t.status === 'in_progress'), done = all.filter(t => t.status === 'completed');
             document.getElementById('kanban-todo-count').textContent = todo.length; document.getElementById('kanban-progress-count').textContent = prog.length; document.getElementById('kanban-completed-count').textContent = done.length;
@@ -97,22 +138,53 @@ async function renderKanbanBoard() {
     } catch (e) { console.error(e); }
 }
 
-function renderKanbanTasks(tasks) {
+async function renderProjectBoard(pid) {
+    const c = document.getElementById('project-board');
+    try {
+        const r = await apiFetch(API_BASE + '/projects/' + pid + '/board'), result = await r.json();
+        if (!result.success) { showToast(result.error || '加载看板失败', 'error'); return; }
+        const cols = result.data.columns || [];
+        c.style.gridTemplateColumns = 'repeat(' + cols.length + ', minmax(220px, 1fr))';
+        c.innerHTML = cols.map(col => '<div class="kanban-column' + (col.over_limit ? ' over-limit' : '') + '" data-column="' + col.id + '"><div class="kanban-header"><span class="status-dot ' + col.category.replace('_', '-') + '"></span><h4>' + escapeHtml(col.name) + '</h4><span class="count">' + col.count + (col.wip_limit ? ' / ' + col.wip_limit : '') + '</span></div><div class="kanban-tasks">' + renderKanbanTasks(col.tasks || [], true) + '</div></div>').join('');
+        c.querySelectorAll('.kanban-column').forEach(el => {
+            el.addEventListener('dragover', e => { e.preventDefault(); el.classList.add('drag-over'); });
+            el.addEventListener('dragleave', () => el.classList.remove('drag-over'));
+            el.addEventListener('drop', e => { e.preventDefault(); el.classList.remove('drag-over'); dropTask(e, el, pid); });
+        });
+    } catch (e) { console.error(e); showToast('加载看板失败', 'error'); }
+}
+
+async function dropTask(e, colEl, pid) {
+    const id = e.dataTransfer.getData('text/plain'); if (!id) return;
+    // 放在鼠标位置下方第一张卡片之前
+    const cards = [...colEl.querySelectorAll('.kanban-task')].filter(el => el.dataset.id !== id);
+    let position = cards.findIndex(el => { const b = el.getBoundingClientRect(); return e.clientY < b.top + b.height / 2; });
+    if (position < 0) position = cards.length;
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + id + '/move', { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ column_id: parseInt(colEl.dataset.column), position: position }) }), result = await r.json();
+        if (!result.success) showToast(result.error || '移动任务失败', 'error');
+    } catch (err) { console.error(err); showToast('移动任务失败', 'error'); }
+    renderProjectBoard(pid); loadDashboard();
+}
+
+function renderKanbanTasks(tasks, draggable) {
     if (!tasks.length) return '<div class="empty-state"><p>暂无任务</p></div>';
-    return tasks.map(t => '<div class="kanban-task" onclick="editTask(' + t.id + ')"><div class="kanban-task-title">' + escapeHtml(t.title) + '</div><div class="kanban-task-meta"><span class="priority-badge priority-' + t.priority + '">' + getPriorityText(t.priority) + '</span>' + (t.assignee ? '<span class="avatar-sm" style="width:24px;height:24px;font-size:0.6rem;">' + t.assignee.username.charAt(0) + '</span>' : '') + '</div></div>').join('');
+    return tasks.map(t => '<div class="kanban-task" data-id="' + t.id + '"' + (draggable ? ' draggable="true" ondragstart="event.dataTransfer.setData(\'text/plain\',\'' + t.id + '\')"' : '') + ' onclick="editTask(' + t.id + ')"><div class="kanban-task-title">' + escapeHtml(t.title) + '</div><div class="kanban-task-meta"><span class="priority-badge priority-' + t.priority + '">' + getPriorityText(t.priority) + '</span>' + (t.assignee ? '<span class="avatar-sm" style="width:24px;height:24px;font-size:0.6rem;">' + t.assignee.username.charAt(0) + '</span>' : '') + '</div></div>').join('');
 }
 
 function openTaskModal(id) {
     const m = document.getElementById('task-modal'), t = document.getElementById('task-modal-title'), sr = document.getElementById('task-status-row');
     document.getElementById('task-form').reset(); document.getElementById('task-id').value = ''; document.getElementById('progress-value').textContent = '0';
     populateProjectSelect('task-project'); populateUserSelect('task-assignee');
-    if (id) { t.textContent = '编辑任务'; sr.style.display = 'grid'; loadTaskDetails(id); } else { t.textContent = '新建任务'; sr.style.display = 'none'; }
+    // 父任务选项加载完再回填详情，否则 select 取不到值
+    if (id) { t.textContent = '编辑任务'; sr.style.display = 'grid'; populateParentSelect(id).then(() => loadTaskDetails(id)); } else { t.textContent = '新建任务'; sr.style.display = 'none'; populateParentSelect(); }
+    openDiscussion(id);
     m.classList.remove('hidden');
 }
 
 async function loadTaskDetails(id) {
     try {
-        const r = await fetch(API_BASE + '/tasks/' + id), result = await r.json();
+        const r = await apiFetch(API_BASE + '/tasks/' + id), result = await r.json();
         if (result.success) {
             const t = result.data;
             document.getElementById('task-id').value = t.id; document.getElementById('task-title').value = t.title;
@@ -121,6 +193,9 @@ async function loadTaskDetails(id) {
             document.getElementById('task-status').value = t.status; document.getElementById('task-progress').value = t.progress;
             document.getElementById('progress-value').textContent = t.progress;
             if (t.due_date) document.getElementById('task-due').value = t.due_date.split('T')[0];
+            document.getElementById('task-estimate').value = t.estimate_hours || ''; document.getElementById('task-parent').value = t.parent_id || '';
+            // 有子任务时进度和状态由子任务汇总，不允许手动修改
+            if (t.subtasks && t.subtasks.length) document.getElementById('task-status-row').style.display = 'none';
         }
     } catch (e) { console.error(e); showToast('加载任务详情失败', 'error'); }
 }
@@ -130,29 +205,149 @@ function closeTaskModal() { document.getElementById('task-modal').classList.add(
 async function saveTask(e) {
     e.preventDefault(); const id = document.getElementById('task-id').value, isEdit = !!id;
     const data = { title: document.getElementById('task-title').value, description: document.getElementById('task-description').value, priority: document.getElementById('task-priority').value, due_date: document.getElementById('task-due').value || null };
-    const pid = document.getElementById('task-project').value, aid = document.getElementById('task-assignee').value;
+    const pid = document.getElementById('task-project').value, aid = document.getElementById('task-assignee').value, parent = document.getElementById('task-parent').value;
     if (pid) data.project_id = parseInt(pid); if (aid) data.assignee_id = parseInt(aid);
-    if (isEdit) { data.status = document.getElementById('task-status').value; data.progress = parseInt(document.getElementById('task-progress').value); }
+    data.estimate_hours = parseFloat(document.getElementById('task-estimate').value) || 0;
+    if (parent) data.parent_id = parseInt(parent); else if (isEdit) data.parent_id = 0;
+    if (isEdit && document.getElementById('task-status-row').style.display !== 'none') { data.status = document.getElementById('task-status').value; data.progress = parseInt(document.getElementById('task-progress').value); }
     try {
-        const r = await fetch(isEdit ? API_BASE + '/tasks/' + id : API_BASE + '/tasks', { method: isEdit ? 'PUT' : 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json();
+        const r = await apiFetch(isEdit ? API_BASE + '/tasks/' + id : API_BASE + '/tasks', { method: isEdit ? 'PUT' : 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json();
         if (result.success) { showToast(isEdit ? '任务更新成功' : '任务创建成功', 'success'); closeTaskModal(); loadTasks(); loadDashboard(); } else showToast(result.error || '操作失败', 'error');
     } catch (err) { console.error(err); showToast('保存任务失败', 'error'); }
 }
 
 function editTask(id) { openTaskModal(id); }
 
+// ========== 评论与附件 ==========
+
+function openDiscussion(taskId) {
+    discussionTaskId = taskId || null; cancelReply(); document.getElementById('comment-input').value = '';
+    document.getElementById('task-discussion').classList.toggle('hidden', !taskId);
+    if (taskId) { loadComments(); loadAttachments(); }
+}
+
+async function loadComments() {
+    const c = document.getElementById('comment-list');
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/comments'), result = await r.json();
+        if (!result.success) return;
+        commentIndex = {}; const roots = result.data || [];
+        c.innerHTML = roots.length ? roots.map(renderComment).join('') : '<div class="empty-state"><p>暂无评论</p></div>';
+    } catch (e) { console.error(e); }
+}
+
+function renderComment(cm) {
+    commentIndex[cm.id] = cm;
+    const mine = currentUser && cm.author_id === currentUser.id, name = cm.author ? cm.author.username : '';
+    let body = escapeHtml(cm.content);
+    // 长用户名优先匹配，避免 @ab 被 @a 截断
+    const names = (cm.mentions || []).map(u => escapeHtml(u.username).replace(/[.*+?^${}()|[\]\\]/g, '\\$&')).sort((a, b) => b.length - a.length);
+    if (names.length) body = body.replace(new RegExp('@(' + names.join('|') + ')', 'g'), '<span class="mention">@$1</span>');
+    let actions = '';
+    if (!cm.deleted && can('task:comment')) actions += '<button onclick="replyComment(' + cm.id + ')">回复</button>';
+    if (!cm.deleted && mine) actions += '<button onclick="editComment(' + cm.id + ')">编辑</button>';
+    if (!cm.deleted && (mine || can('task:manage'))) actions += '<button onclick="confirmDeleteComment(' + cm.id + ')">删除</button>';
+    return '<div class="comment-item"><div class="comment-head"><strong>' + escapeHtml(name) + '</strong><span>' + formatDateTime(cm.created_at) + '</span></div>' +
+        (cm.deleted ? '<div class="comment-body deleted">该评论已删除</div>' : '<div class="comment-body">' + body + '</div>') +
+        '<div class="comment-actions">' + actions + '</div>' +
+        ((cm.replies || []).length ? '<div class="comment-replies">' + cm.replies.map(renderComment).join('') + '</div>' : '') + '</div>';
+}
+
+function replyComment(id) {
+    const cm = commentIndex[id]; replyToComment = id;
+    const h = document.getElementById('comment-reply-hint'); h.innerHTML = '回复 ' + escapeHtml(cm.author ? cm.author.username : '') + ' <a href="#" onclick="event.preventDefault();cancelReply()">取消</a>'; h.classList.remove('hidden');
+    document.getElementById('comment-input').focus();
+}
+
+function cancelReply() { replyToComment = null; document.getElementById('comment-reply-hint').classList.add('hidden'); }
+
+async function submitComment() {
+    const input = document.getElementById('comment-input'), content = input.value.trim(); if (!content) return;
+    const data = { content: content }; if (replyToComment) data.parent_id = replyToComment;
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/comments', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json();
+        if (result.success) { input.value = ''; cancelReply(); loadComments(); } else showToast(result.error || '发表评论失败', 'error');
+    } catch (e) { console.error(e); showToast('发表评论失败', 'error'); }
+}
+
+async function editComment(id) {
+    const content = prompt('编辑评论', commentIndex[id].content); if (content === null || !content.trim()) return;
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/comments/' + id, { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ content: content.trim() }) }), result = await r.json();
+        if (result.success) loadComments(); else showToast(result.error || '编辑评论失败', 'error');
+    } catch (e) { console.error(e); showToast('编辑评论失败', 'error'); }
+}
+
+function confirmDeleteComment(id) { document.getElementById('confirm-message').textContent = '确定要删除这条评论吗？'; document.getElementById('confirm-delete-btn').onclick = () => deleteComment(id); document.getElementById('confirm-modal').classList.remove('hidden'); }
+
+async function deleteComment(id) { try { const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/comments/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) { closeConfirmModal(); loadComments(); } else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除评论失败', 'error'); } }
+
+async function loadAttachments() {
+    const c = document.getElementById('attachment-list');
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/attachments'), result = await r.json();
+        if (!result.success) return;
+        const list = result.data || [];
+        c.innerHTML = list.length ? list.map(a => '<div class="attachment-item"><i class="bi bi-file-earmark"></i><a onclick="downloadAttachment(' + a.id + ')" data-id="' + a.id + '" data-name="' + escapeHtml(a.file_name) + '">' + escapeHtml(a.file_name) + '</a><span class="attachment-meta">' + formatSize(a.size) + ' · ' + escapeHtml(a.uploader ? a.uploader.username : '') + '</span>' + ((currentUser && a.uploader_id === currentUser.id) || can('task:manage') ? '<button class="btn btn-sm btn-secondary" onclick="deleteAttachment(' + a.id + ')"><i class="bi bi-trash"></i></button>' : '') + '</div>').join('') : '<div class="empty-state"><p>暂无附件</p></div>';
+    } catch (e) { console.error(e); }
+}
+
+async function uploadAttachment(input) {
+    const file = input.files[0]; input.value = ''; if (!file) return;
+    if (file.size > 20 * 1024 * 1024) { showToast('附件不能超过 20MB', 'error'); return; }
+    const fd = new FormData(); fd.append('file', file);
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/attachments', { method: 'POST', body: fd }), result = await r.json();
+        if (result.success) { showToast('附件上传成功', 'success'); loadAttachments(); } else showToast(result.error || '上传失败', 'error');
+    } catch (e) { console.error(e); showToast('上传附件失败', 'error'); }
+}
+
+// 下载需要带令牌，先取回内容再触发保存
+async function downloadAttachment(id) {
+    try {
+        const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/attachments/' + id);
+        if (!r.ok) { showToast('下载附件失败', 'error'); return; }
+        const url = URL.createObjectURL(await r.blob()), a = document.createElement('a');
+        a.href = url; a.download = document.querySelector('#attachment-list a[data-id="' + id + '"]').dataset.name; a.click(); URL.revokeObjectURL(url);
+    } catch (e) { console.error(e); showToast('下载附件失败', 'error'); }
+}
+
+async function deleteAttachment(id) { try { const r = await apiFetch(API_BASE + '/tasks/' + discussionTaskId + '/attachments/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) loadAttachments(); else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除附件失败', 'error'); } }
+
+// ========== 通知 ==========
+
+async function loadNotifications() {
+    try {
+        const r = await apiFetch(API_BASE + '/notifications?page_size=20'), result = await r.json();
+        if (!result.success) return;
+        const badge = document.getElementById('notify-count'), list = result.data.data || [];
+        badge.textContent = result.data.unread > 99 ? '99+' : result.data.unread; badge.classList.toggle('hidden', !result.data.unread);
+        document.getElementById('notify-list').innerHTML = list.length ? list.map(n => '<div class="notify-item' + (n.read_at ? '' : ' unread') + '" onclick="openNotification(' + n.id + ',' + (n.task_id || 0) + ',' + !n.read_at + ')"><div>' + escapeHtml(n.message) + '</div><div class="notify-time">' + formatDateTime(n.created_at) + '</div></div>').join('') : '<div class="empty-state"><p>暂无通知</p></div>';
+    } catch (e) { console.error(e); }
+}
+
+function toggleNotifications() { const p = document.getElementById('notify-panel'); p.classList.toggle('hidden'); if (!p.classList.contains('hidden')) loadNotifications(); }
+
+async function openNotification(id, taskId, unread) {
+    document.getElementById('notify-panel').classList.add('hidden');
+    if (unread) { try { await apiFetch(API_BASE + '/notifications/' + id + '/read', { method: 'PUT' }); } catch (e) { console.error(e); } loadNotifications(); }
+    if (taskId) editTask(taskId);
+}
+
+async function markAllNotificationsRead() { try { const r = await apiFetch(API_BASE + '/notifications/read-all', { method: 'PUT' }), result = await r.json(); if (result.success) loadNotifications(); } catch (e) { console.error(e); } }
+
 async function toggleTaskStatus(id, status) {
     const ns = status === 'completed' ? 'todo' : 'completed';
-    try { const r = await fetch(API_BASE + '/tasks/' + id + '/progress', { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ status: ns, progress: ns === 'completed' ? 100 : 0 }) }), result = await r.json(); if (result.success) { loadDashboard(); if (currentPage === 'tasks') loadTasks(); } } catch (e) { console.error(e); }
+    try { const r = await apiFetch(API_BASE + '/tasks/' + id + '/progress', { method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ status: ns, progress: ns === 'completed' ? 100 : 0 }) }), result = await r.json(); if (result.success) { loadDashboard(); if (currentPage === 'tasks') loadTasks(); } else showToast(result.error || '更新状态失败', 'error'); } catch (e) { console.error(e); }
 }
 
 function confirmDeleteTask(id) { document.getElementById('confirm-message').textContent = '确定要删除这个任务吗？此操作不可恢复。'; document.getElementById('confirm-delete-btn').onclick = () => deleteTask(id); document.getElementById('confirm-modal').classList.remove('hidden'); }
 
-async function deleteTask(id) { try { const r = await fetch(API_BASE + '/tasks/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) { showToast('任务删除成功', 'success'); closeConfirmModal(); loadTasks(); loadDashboard(); } else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除任务失败', 'error'); } }
+async function deleteTask(id) { try { const r = await apiFetch(API_BASE + '/tasks/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) { showToast('任务删除成功', 'success'); closeConfirmModal(); loadTasks(); loadDashboard(); } else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除任务失败', 'error'); } }
 
-async function loadProjects() { try { const r = await fetch(API_BASE + '/projects'), result = await r.json(); if (result.success) { projects = result.data || []; populateProjectFilter(); } } catch (e) { console.error(e); } }
+async function loadProjects() { try { const r = await apiFetch(API_BASE + '/projects'), result = await r.json(); if (result.success) { projects = result.data || []; populateProjectFilter(); } } catch (e) { console.error(e); } }
 
-async function loadProjectsList() { try { const r = await fetch(API_BASE + '/projects'), result = await r.json(); if (result.success) { projects = result.data || []; renderProjects(projects); } } catch (e) { console.error(e); } }
+async function loadProjectsList() { try { const r = await apiFetch(API_BASE + '/projects'), result = await r.json(); if (result.success) { projects = result.data || []; renderProjects(projects); } } catch (e) { console.error(e); } }
 
 function renderProjects(projects) {
     const c = document.getElementById('projects-grid');
@@ -169,7 +364,7 @@ function openProjectModal(id) {
     m.classList.remove('hidden');
 }
 
-async function loadProjectDetails(id) { try { const r = await fetch(API_BASE + '/projects/' + id), result = await r.json(); if (result.success) { const p = result.data; document.getElementById('project-id').value = p.id; document.getElementById('project-name').value = p.name; document.getElementById('project-description').value = p.description || ''; document.getElementById('project-manager').value = p.manager_id || ''; document.getElementById('project-status').value = p.status; if (p.start_date) document.getElementById('project-start').value = p.start_date.split('T')[0]; if (p.end_date) document.getElementById('project-end').value = p.end_date.split('T')[0]; } } catch (e) { console.error(e); } }
+async function loadProjectDetails(id) { try { const r = await apiFetch(API_BASE + '/projects/' + id), result = await r.json(); if (result.success) { const p = result.data; document.getElementById('project-id').value = p.id; document.getElementById('project-name').value = p.name; document.getElementById('project-description').value = p.description || ''; document.getElementById('project-manager').value = p.manager_id || ''; document.getElementById('project-status').value = p.status; if (p.start_date) document.getElementById('project-start').value = p.start_date.split('T')[0]; if (p.end_date) document.getElementById('project-end').value = p.end_date.split('T')[0]; } } catch (e) { console.error(e); } }
 
 function closeProjectModal() { document.getElementById('project-modal').classList.add('hidden'); }
 
@@ -177,15 +372,15 @@ async function saveProject(e) {
     e.preventDefault(); const id = document.getElementById('project-id').value, isEdit = !!id;
     const data = { name: document.getElementById('project-name').value, description: document.getElementById('project-description').value, start_date: document.getElementById('project-start').value || null, end_date: document.getElementById('project-end').value || null };
     const mid = document.getElementById('project-manager').value; if (mid) data.manager_id = parseInt(mid); if (isEdit) data.status = document.getElementById('project-status').value;
-    try { const r = await fetch(isEdit ? API_BASE + '/projects/' + id : API_BASE + '/projects', { method: isEdit ? 'PUT' : 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json(); if (result.success) { showToast(isEdit ? '项目更新成功' : '项目创建成功', 'success'); closeProjectModal(); loadProjectsList(); loadProjects(); } else showToast(result.error || '操作失败', 'error'); } catch (err) { console.error(err); showToast('保存项目失败', 'error'); }
+    try { const r = await apiFetch(isEdit ? API_BASE + '/projects/' + id : API_BASE + '/projects', { method: isEdit ? 'PUT' : 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json(); if (result.success) { showToast(isEdit ? '项目更新成功' : '项目创建成功', 'success'); closeProjectModal(); loadProjectsList(); loadProjects(); } else showToast(result.error || '操作失败', 'error'); } catch (err) { console.error(err); showToast('保存项目失败', 'error'); }
 }
 
 function editProject(id) { openProjectModal(id); }
 function confirmDeleteProject(id) { document.getElementById('confirm-message').textContent = '确定要删除这个项目吗？项目下的任务将变为无项目状态。'; document.getElementById('confirm-delete-btn').onclick = () => deleteProject(id); document.getElementById('confirm-modal').classList.remove('hidden'); }
-async function deleteProject(id) { try { const r = await fetch(API_BASE + '/projects/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) { showToast('项目删除成功', 'success'); closeConfirmModal(); loadProjectsList(); loadProjects(); } else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除项目失败', 'error'); } }
+async function deleteProject(id) { try { const r = await apiFetch(API_BASE + '/projects/' + id, { method: 'DELETE' }), result = await r.json(); if (result.success) { showToast('项目删除成功', 'success'); closeConfirmModal(); loadProjectsList(); loadProjects(); } else showToast(result.error || '删除失败', 'error'); } catch (e) { console.error(e); showToast('删除项目失败', 'error'); } }
 
-async function loadUsers() { try { const r = await fetch(API_BASE + '/users'), result = await r.json(); if (result.success) { users = result.data || []; populateUserFilter(); } } catch (e) { console.error(e); } }
-async function loadUsersList() { try { const r = await fetch(API_BASE + '/users'), result = await r.json(); if (result.success) { users = result.data || []; renderUsers(users); } } catch (e) { console.error(e); } }
+async function loadUsers() { try { const r = await apiFetch(API_BASE + '/users'), result = await r.json(); if (result.success) { users = result.data || []; populateUserFilter(); } } catch (e) { console.error(e); } }
+async function loadUsersList() { try { const r = await apiFetch(API_BASE + '/users'), result = await r.json(); if (result.success) { users = result.data || []; renderUsers(users); } } catch (e) { console.error(e); } }
 
 function renderUsers(users) {
     const c = document.getElementById('users-grid');
@@ -198,12 +393,16 @@ function closeUserModal() { document.getElementById('user-modal').classList.add(
 
 async function saveUser(e) {
     e.preventDefault();
-    const data = { username: document.getElementById('user-name').value, email: document.getElementById('user-email').value, role: document.getElementById('user-role').value };
-    try { const r = await fetch(API_BASE + '/users', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json(); if (result.success) { showToast('成员添加成功', 'success'); closeUserModal(); loadUsersList(); loadUsers(); } else showToast(result.error || '添加失败', 'error'); } catch (err) { console.error(err); showToast('添加成员失败', 'error'); }
+    const data = { username: document.getElementById('user-name').value, email: document.getElementById('user-email').value, password: document.getElementById('user-password').value, role: document.getElementById('user-role').value };
+    try { const r = await apiFetch(API_BASE + '/users', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(data) }), result = await r.json(); if (result.success) { showToast('成员添加成功', 'success'); closeUserModal(); loadUsersList(); loadUsers(); } else showToast(result.error || '添加失败', 'error'); } catch (err) { console.error(err); showToast('添加成员失败', 'error'); }
 }
 
 function populateProjectSelect(id) { const s = document.getElementById(id); if (!s) return; s.innerHTML = '<option value="">无项目</option>' + projects.map(p => '<option value="' + p.id + '">' + escapeHtml(p.name) + '</option>').join(''); }
 function populateProjectFilter() { const s = document.getElementById('filter-project'); if (!s) return; s.innerHTML = '<option value="">所有项目</option>' + projects.map(p => '<option value="' + p.id + '">' + escapeHtml(p.name) + '</option>').join(''); }
+async function populateParentSelect(taskId) {
+    const s = document.getElementById('task-parent'); s.innerHTML = '<option value="">无</option>';
+    try { const r = await apiFetch(API_BASE + '/tasks?page_size=100'), result = await r.json(); if (result.success) s.innerHTML += (result.data.data || []).filter(t => t.id !== taskId).map(t => '<option value="' + t.id + '">' + escapeHtml(t.title) + '</option>').join(''); } catch (e) { console.error(e); }
+}
 function populateUserSelect(id) { const s = document.getElementById(id); if (!s) return; s.innerHTML = '<option value="">未分配</option>' + users.map(u => '<option value="' + u.id + '">' + escapeHtml(u.username) + '</option>').join(''); }
 function populateUserFilter() { const s = document.getElementById('filter-assignee'); if (!s) return; s.innerHTML = '<option value="">所有成员</option>' + users.map(u => '<option value="' + u.id + '">' + escapeHtml(u.username) + '</option>').join(''); }
 function closeConfirmModal() { document.getElementById('confirm-modal').classList.add('hidden'); }
@@ -212,6 +411,8 @@ function getPriorityText(p) { return { high: '高', medium: '中', low: '低' }[
 function getStatusText(s) { return { todo: '待办', in_progress: '进行中', completed: '已完成' }[s] || s; }
 function getProjectStatusText(s) { return { planning: '计划中', in_progress: '进行中', completed: '已完成' }[s] || s; }
 function getRoleText(r) { return { admin: '管理员', project_manager: '项目经理', team_member: '团队成员', guest: '访客' }[r] || r; }
+function formatDateTime(d) { if (!d) return ''; return new Date(d).toLocaleString('zh-CN', { month: 'numeric', day: 'numeric', hour: '2-digit', minute: '2-digit' }); }
+function formatSize(n) { if (n < 1024) return n + ' B'; if (n < 1024 * 1024) return (n / 1024).toFixed(1) + ' KB'; return (n / 1024 / 1024).toFixed(1) + ' MB'; }
 function formatDate(d) { if (!d) return ''; const date = new Date(d); return (date.getMonth() + 1) + '/' + date.getDate(); }
 function isOverdue(d, s) { if (!d || s === 'completed') return false; return new Date(d) < new Date(new Date().toDateString()); }
 function escapeHtml(t) { if (!t) return ''; const d = document.createElement('div'); d.textContent = t; return d.innerHTML; }